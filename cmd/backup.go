@@ -2,11 +2,9 @@ package cmd
 
 import (
 	"fmt"
-	"io"
 	"os"
-	"path/filepath"
-	"time"
 
+	"github.com/iansinnott/browser-gopher/pkg/backup"
 	"github.com/iansinnott/browser-gopher/pkg/config"
 	"github.com/spf13/cobra"
 )
@@ -14,85 +12,108 @@ import (
 var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "Backup your data",
-	Long:  `This command will backup your database and search index.`,
+	Long: `Write a compressed snapshot of your database and config to the backup dir.
+It is safe to run while other commands, such as populate, are running.
+
+Older backups are then deleted according to the "backups" section of
+config.json. By default the last 3 backups are kept, plus the latest backup of
+each of the last 7 days and 4 weeks.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		backupPath := filepath.Join(config.Config.BackupDir, "backup_"+time.Now().Format("20060102150405"))
-		err := os.MkdirAll(backupPath, 0755)
+		if config.Config.Database.Backend == config.BackendPostgres {
+			fmt.Println("backup is for local sqlite databases. Use pg_dump to back up postgres.")
+			os.Exit(1)
+		}
+
+		b, err := backup.Create(cmd.Context(), config.Config)
 		if err != nil {
-			fmt.Println("could not create backup dir", err)
+			fmt.Println("could not create backup", err)
 			os.Exit(1)
 		}
 
-		// copy the config dir to the backup dir
-		err = copyDir(config.Config.AppDataPath, backupPath)
+		fmt.Println("Backed up to:", b.Path)
+
+		removed, err := backup.Rotate(config.Config.BackupDir, config.Config.Backups)
 		if err != nil {
-			fmt.Println("could not copy config dir to backup dir", err)
+			fmt.Println("could not remove old backups", err)
 			os.Exit(1)
 		}
 
-		fmt.Println("Backed up to:", backupPath)
+		for _, b := range removed {
+			fmt.Println("Removed old backup:", b.Name)
+		}
 	},
 }
 
-func copyDir(src, dst string) error {
-	// get properties of source dir
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
-	}
-
-	// create destination dir
-	err = os.MkdirAll(dst, srcInfo.Mode())
-	if err != nil {
-		return err
-	}
-
-	entries, err := os.ReadDir(src)
-	if err != nil {
-		return err
-	}
-
-	for _, entry := range entries {
-		srcPath := filepath.Join(src, entry.Name())
-		dstPath := filepath.Join(dst, entry.Name())
-
-		if entry.IsDir() {
-			err = copyDir(srcPath, dstPath)
-			if err != nil {
-				return err
-			}
-		} else {
-			err = copyFile(srcPath, dstPath)
-			if err != nil {
-				return err
-			}
+var backupListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List backups, newest first",
+	Run: func(cmd *cobra.Command, args []string) {
+		backups, err := backup.List(config.Config.BackupDir)
+		if err != nil {
+			fmt.Println("could not list backups", err)
+			os.Exit(1)
+		}
+
+		if len(backups) == 0 {
+			fmt.Println("No backups in", config.Config.BackupDir)
+			return
+		}
+
+		verify, err := cmd.Flags().GetBool("verify")
+		if err != nil {
+			fmt.Println("could not parse --verify:", err)
+			os.Exit(1)
 		}
-	}
 
-	return nil
+		for _, b := range backups {
+			status := ""
+			if verify {
+				status = "ok"
+				if err := backup.Verify(cmd.Context(), config.Config, &b); err != nil {
+					status = "failed: " + err.Error()
+				}
+			}
+
+			fmt.Printf("%-32s  %s  %8.1f MB  %s\n", b.Name, b.Time.Format("2006-01-02 15:04:05"), float64(b.Size)/1024/1024, status)
+		}
+	},
 }
 
-func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	dstFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer dstFile.Close()
-
-	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
-		return err
-	}
-
-	return nil
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore <name>",
+	Short: "Replace the database with the one from a backup",
+	Long: `Replace the database with the one from a backup, as shown by 'backup list'.
+The current database is renamed rather than deleted, so a restore can be undone
+by hand. config.json is not restored, extract it from the archive with tar if
+needed.
+
+Example:
+
+	browser-gopher backup restore backup_20221030120000
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if config.Config.Database.Backend == config.BackendPostgres {
+			fmt.Println("restore is for local sqlite databases. Use pg_restore to restore postgres.")
+			os.Exit(1)
+		}
+
+		previous, err := backup.Restore(cmd.Context(), config.Config, args[0])
+		if err != nil {
+			fmt.Println("could not restore backup", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Restored", args[0])
+		if previous != "" {
+			fmt.Println("The previous database was moved to:", previous)
+		}
+	},
 }
 
 func init() {
 	rootCmd.AddCommand(backupCmd)
+	backupCmd.AddCommand(backupListCmd)
+	backupCmd.AddCommand(backupRestoreCmd)
+	backupListCmd.Flags().Bool("verify", false, "Check the integrity of every backup")
 }
@@ -18,12 +18,12 @@ var dbMigrateCmd = &cobra.Command{
 	Short: "Migrate the database and do nothing else.",
 	Long:  `Migrate the database and do nothing else. This is useful in development.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		db, err := persistence.InitDb(cmd.Context(), config.Config)
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
-		defer db.Close()
+		defer store.Close()
 		fmt.Println("Database migrated successfully.")
 	},
 }
@@ -19,11 +19,12 @@ var dbInitCmd = &cobra.Command{
 	Short: "Initialize the database",
 	Run: func(cmd *cobra.Command, args []string) {
 		// init the db
-		_, err := persistence.InitDb(cmd.Context(), config.Config)
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
 		if err != nil {
 			fmt.Println("error initializing db", err)
 			os.Exit(1)
 		}
+		defer store.Close()
 
 		fmt.Println("db initialized: " + config.Config.DBPath)
 	},
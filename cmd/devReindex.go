@@ -21,15 +21,34 @@ var reindexCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		dbConn, err := persistence.InitDb(cmd.Context(), config.Config)
+		rebuild, err := cmd.Flags().GetBool("rebuild")
+		if err != nil {
+			fmt.Println("could not parse --rebuild:", err)
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
 		if err != nil {
 			fmt.Println("could not open our db", err)
 			os.Exit(1)
 		}
+		defer store.Close()
+
+		if rebuild {
+			fmt.Println("Rebuilding the search index...")
+			t := time.Now()
+			n, stale, err := populate.RebuildIndex(cmd.Context(), store)
+			if err != nil {
+				fmt.Println("encountered an error rebuilding the search index", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Rebuilt the search index from %d records in %v, dropped %d stale fragments\n", n, time.Since(t), stale)
+			return
+		}
 
 		fmt.Println("Reindexing everything...")
 		t := time.Now()
-		n, err := populate.ReindexWithLimit(cmd.Context(), dbConn, limit)
+		n, err := populate.ReindexWithLimit(cmd.Context(), store, limit)
 		if err != nil {
 			fmt.Println("encountered an error building the search index", err)
 			os.Exit(1)
@@ -40,5 +59,6 @@ var reindexCmd = &cobra.Command{
 
 func init() {
 	reindexCmd.Flags().Int("limit", 0, "Limit the number of records to index")
+	reindexCmd.Flags().Bool("rebuild", false, "reindex everything, dropping text pages no longer have and whatever is left of urls that no longer exist")
 	devCmd.AddCommand(reindexCmd)
 }
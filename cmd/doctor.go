@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the database for corruption and inconsistencies",
+	Long: `Run SQLite and full-text index integrity checks, and look for rows that
+reference data which no longer exists. Use --fix to repair what can be repaired.
+
+Example:
+
+	browser-gopher doctor
+	browser-gopher doctor --fix
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fix, err := cmd.Flags().GetBool("fix")
+		if err != nil {
+			fmt.Println("could not parse --fix:", err)
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		findings, err := store.Diagnose(cmd.Context())
+		if err != nil {
+			fmt.Println("could not run checks", err)
+			os.Exit(1)
+		}
+
+		problems := printFindings(findings)
+
+		if problems == 0 {
+			fmt.Println("No problems found.")
+			return
+		}
+
+		if !fix {
+			fmt.Printf("Found %d problems. Run with --fix to repair them.\n", problems)
+			os.Exit(1)
+		}
+
+		fmt.Println("Repairing...")
+		err = store.Repair(cmd.Context(), findings)
+		if err != nil {
+			fmt.Println("could not repair", err)
+			os.Exit(1)
+		}
+
+		findings, err = store.Diagnose(cmd.Context())
+		if err != nil {
+			fmt.Println("could not run checks", err)
+			os.Exit(1)
+		}
+
+		problems = printFindings(findings)
+		if problems > 0 {
+			fmt.Printf("%d problems could not be repaired.\n", problems)
+			os.Exit(1)
+		}
+
+		fmt.Println("All problems repaired.")
+	},
+}
+
+// Print findings and return the number of problems
+func printFindings(findings []persistence.Finding) int {
+	problems := 0
+
+	for _, f := range findings {
+		if f.Ok() {
+			fmt.Printf("[ok]   %s\n", f.Check)
+			continue
+		}
+
+		problems++
+		note := ""
+		if !f.Fixable {
+			note = " (not repaired by --fix)"
+		}
+		if f.Count > 0 {
+			fmt.Printf("[fail] %s: %d %s%s\n", f.Check, f.Count, f.Problem, note)
+		} else {
+			fmt.Printf("[fail] %s: %s%s\n", f.Check, f.Problem, note)
+		}
+	}
+
+	return problems
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.Flags().Bool("fix", false, "Repair problems: rebuild the search index, recompute visit counts and last visit times, and delete orphaned rows other than visits and bookmarks")
+}
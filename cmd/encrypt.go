@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/crypt"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/spf13/cobra"
+)
+
+var encryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt the full-text of pages you've visited",
+	Long: `Create an encryption key from a passphrase, if there is none yet, and encrypt
+all full-text already in the database with it. The passphrase can't be
+recovered. Without it encrypted full-text and backups are lost.
+
+To encrypt full-text as it is scraped, and backups, also set the following
+in config.json:
+
+	{ "encryption": { "enabled": true } }
+
+Commands that need the key ask for the passphrase, or read it from the
+` + crypt.PassphraseEnv + ` environment variable.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		keyring := config.Config.Keyring
+
+		if !keyring.Exists() {
+			passphrase, err := crypt.PromptNewPassphrase()
+			if err != nil {
+				fmt.Println("could not read passphrase:", err)
+				os.Exit(1)
+			}
+
+			err = keyring.Create(passphrase)
+			if err != nil {
+				fmt.Println("could not create key", err)
+				os.Exit(1)
+			}
+
+			fmt.Println("Created encryption key:", keyring.Path())
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		encrypted, ok := store.(*persistence.EncryptedStore)
+		if !ok {
+			fmt.Println("could not open the database for encryption")
+			os.Exit(1)
+		}
+
+		n, err := encrypted.EncryptBodies(cmd.Context())
+		if err != nil {
+			fmt.Println("could not encrypt", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Encrypted %d documents\n", n)
+
+		// Plaintext would otherwise linger in the free pages of the file
+		if n > 0 && config.Config.Database.Backend != config.BackendPostgres {
+			err = persistence.VacuumDb(cmd.Context(), config.Config.DBPath)
+			if err != nil {
+				fmt.Println("could not vacuum", err)
+				os.Exit(1)
+			}
+		}
+
+		if !config.Config.Encryption.Enabled {
+			fmt.Println(`Encryption is not enabled in config.json, so new full-text and backups will not be encrypted. Add "encryption": { "enabled": true } to enable it.`)
+		}
+		if n > 0 {
+			fmt.Println("Existing backups are not encrypted. Delete them from", config.Config.BackupDir, "once you have made a new one.")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(encryptCmd)
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/archive"
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export your history as JSON Lines",
+	Long: `Write every url to a file, or stdout, one JSON object per line. Each url
+includes its visits, every title it has had and any full-text that was
+scraped. The file can be read back in with 'import jsonl', including into a
+new or empty database.
+
+Examples:
+
+	browser-gopher export --output history.jsonl
+	browser-gopher export --since 2022-01-01 --until 2022-07-01 --domain github.com | jq .url
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			fmt.Println("could not parse --format:", err)
+			os.Exit(1)
+		}
+		if format != "jsonl" {
+			fmt.Println("unsupported --format:", format)
+			os.Exit(1)
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fmt.Println("could not parse --output:", err)
+			os.Exit(1)
+		}
+
+		domains, err := cmd.Flags().GetStringArray("domain")
+		if err != nil {
+			fmt.Println("could not parse --domain:", err)
+			os.Exit(1)
+		}
+
+		opts := archive.ExportOptions{Domains: domains}
+
+		for flag, target := range map[string]**time.Time{"since": &opts.Since, "until": &opts.Until} {
+			if !cmd.Flags().Changed(flag) {
+				continue
+			}
+
+			s, err := cmd.Flags().GetString(flag)
+			if err != nil {
+				fmt.Printf("could not parse --%s: %s\n", flag, err)
+				os.Exit(1)
+			}
+
+			t, err := parseDate(s)
+			if err != nil {
+				fmt.Printf("could not parse --%s: %s\n", flag, err)
+				os.Exit(1)
+			}
+			*target = &t
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		var w io.Writer = os.Stdout
+		if output != "" && output != "-" {
+			f, err := os.Create(util.Expanduser(output))
+			if err != nil {
+				fmt.Println("could not create output file", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		n, err := archive.Export(cmd.Context(), store, w, opts)
+		if err != nil {
+			fmt.Println("could not export", err)
+			os.Exit(1)
+		}
+
+		// @note stderr, so it doesn't end up in the export when writing to stdout
+		fmt.Fprintf(os.Stderr, "exported %d urls\n", n)
+	},
+}
+
+// Accepts a date, which is taken to be midnight local time, or an RFC 3339 timestamp
+func parseDate(s string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().String("format", "jsonl", "Output format. Only jsonl is supported")
+	exportCmd.Flags().StringP("output", "o", "", "File to write to. Defaults to stdout")
+	exportCmd.Flags().String("since", "", "Only export visits on or after this date, e.g. 2022-01-31 or 2022-01-31T15:04:05Z")
+	exportCmd.Flags().String("until", "", "Only export visits before this date")
+	exportCmd.Flags().StringArray("domain", nil, "Only export urls on this domain or its subdomains. Can be repeated")
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/iansinnott/browser-gopher/pkg/config"
 	"github.com/iansinnott/browser-gopher/pkg/extractors"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
 	"github.com/iansinnott/browser-gopher/pkg/populate"
 	"github.com/iansinnott/browser-gopher/pkg/util"
 	"github.com/spf13/cobra"
@@ -28,11 +30,18 @@ BrowserParrot database, and should work in most cases.`,
 			os.Exit(1)
 		}
 
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
 		browserparrot := &extractors.BrowserParrotExtractor{
 			HistoryDBPath: util.Expanduser(dbPath),
 			Name:          "browserparrot",
 		}
-		err = populate.PopulateAll(browserparrot)
+		err = populate.PopulateAll(cmd.Context(), store, browserparrot)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
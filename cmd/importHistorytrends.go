@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/iansinnott/browser-gopher/pkg/config"
 	"github.com/iansinnott/browser-gopher/pkg/extractors"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
 	"github.com/iansinnott/browser-gopher/pkg/populate"
 	"github.com/iansinnott/browser-gopher/pkg/util"
 	"github.com/spf13/cobra"
@@ -37,13 +39,20 @@ the BrowserParrot database, and should work in most cases.`,
 			os.Exit(0)
 		}
 
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
 		for _, dbPath := range dbs {
 			extractor := &extractors.HistoryTrendsExtractor{
 				HistoryDBPath: util.Expanduser(dbPath),
 				Name:          "historytrends",
 			}
 			fmt.Println("importing:", dbPath)
-			err = populate.PopulateAll(extractor)
+			err = populate.PopulateAll(cmd.Context(), store, extractor)
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
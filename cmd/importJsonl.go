@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/iansinnott/browser-gopher/pkg/archive"
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+var importJsonlCmd = &cobra.Command{
+	Use:   "jsonl <file>",
+	Short: "Import a JSON Lines file written by the export command",
+	Long: `Read a file written by 'browser-gopher export', or - for stdin. Urls that
+are already in the database are merged the same way as during populate, so
+importing the same file twice does not duplicate anything.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var r io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(util.Expanduser(args[0]))
+			if err != nil {
+				fmt.Println("could not open file", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			r = f
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		n, err := archive.Import(cmd.Context(), store, r)
+		if err != nil {
+			fmt.Println("could not import", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("imported %d urls\n", n)
+
+		_, err = populate.BuildIndex(cmd.Context(), store, 0)
+		if err != nil {
+			fmt.Println("could not index imported urls", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	importCmd.AddCommand(importJsonlCmd)
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge <other-db>",
+	Short: "Merge the history from another browser-gopher database into this one",
+	Long: `Import urls, visits and full-text from another browser-gopher database, e.g.
+the db.sqlite of another machine. The other database is not modified.
+
+Visits that are in both databases are only kept once. For each url the latest
+last visit wins, and so do the title and description of whichever database saw
+the url most recently. Anything new or changed is re-indexed afterwards.
+
+Example:
+
+	browser-gopher merge ~/Downloads/desktop-db.sqlite
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		src, cleanup, err := persistence.OpenSnapshot(cmd.Context(), util.Expanduser(args[0]))
+		if err != nil {
+			fmt.Println("could not open other db", err)
+			os.Exit(1)
+		}
+		defer cleanup()
+
+		report, err := persistence.Merge(cmd.Context(), store, src)
+		if err != nil {
+			fmt.Println("could not merge", err)
+			os.Exit(1)
+		}
+
+		printMergeReport(report)
+
+		_, err = populate.BuildIndex(cmd.Context(), store, 0)
+		if err != nil {
+			fmt.Println("could not index merged urls", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func printMergeReport(report *persistence.MergeReport) {
+	fmt.Printf("urls:      %d read, %d new\n", report.Urls, report.NewUrls)
+	fmt.Printf("visits:    %d new\n", report.NewVisits)
+	fmt.Printf("documents: %d new\n", report.Documents)
+	if report.ForeignDocuments > 0 {
+		fmt.Printf("           %d skipped, encrypted with another key. Copy key.json from the machine they came from to merge them.\n", report.ForeignDocuments)
+	}
+	fmt.Printf("reindex:   %d urls\n", report.Reindex)
+}
+
+func init() {
+	rootCmd.AddCommand(mergeCmd)
+}
@@ -56,18 +56,27 @@ var populateCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		shouldPrune := config.Config.Retention.PruneOnPopulate
+		if cmd.Flags().Changed("prune") {
+			shouldPrune, err = cmd.Flags().GetBool("prune")
+			if err != nil {
+				fmt.Println("could not parse --prune:", err)
+				os.Exit(1)
+			}
+		}
+
 		extractors, err := ex.BuildExtractorList()
 		if err != nil {
 			log.Println("error getting extractors", err)
 			os.Exit(1)
 		}
 
-		dbConn, err := persistence.InitDb(cmd.Context(), config.Config)
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
 		if err != nil {
 			fmt.Println("could not open our db", err)
 			os.Exit(1)
 		}
-		defer dbConn.Close()
+		defer store.Close()
 
 		errs := []error{}
 
@@ -79,7 +88,7 @@ var populateCmd = &cobra.Command{
 
 			since := time.Unix(0, 0) // 1970-01-01
 			if onlyLatest {
-				latestTime, err := persistence.GetLatestTime(cmd.Context(), dbConn, x)
+				latestTime, err := store.LatestVisitTime(cmd.Context(), x.GetName())
 				if err != nil {
 					fmt.Println("could not get latest time", err)
 					os.Exit(1)
@@ -92,9 +101,9 @@ var populateCmd = &cobra.Command{
 
 			var err error
 			if onlyLatest {
-				err = populate.PopulateSinceTime(x, since, &populate.PopulateOptions{KeepTmpFiles: keepTmpFiles})
+				err = populate.PopulateSinceTime(cmd.Context(), store, x, since, &populate.PopulateOptions{KeepTmpFiles: keepTmpFiles})
 			} else {
-				err = populate.PopulateAll(x)
+				err = populate.PopulateAll(cmd.Context(), store, x)
 			}
 			if err != nil {
 				errs = append(errs, errors.Wrap(err, x.GetName()+" populate:"))
@@ -126,7 +135,7 @@ var populateCmd = &cobra.Command{
 			// there should be only one goroutine accessing the database.
 			// The retry loop is a workaround for episodic sqlite busy errors.
 			for retries > 0 {
-				n, err = populate.PopulateFulltext(cmd.Context(), dbConn)
+				n, err = populate.PopulateFulltext(cmd.Context(), store)
 				if err != nil {
 					// if the error is sqlite_busy then retry once
 					if strings.Contains(err.Error(), "database is locked") {
@@ -150,13 +159,22 @@ var populateCmd = &cobra.Command{
 		if shouldBuildIndex {
 			fmt.Println("Indexing results...")
 			t := time.Now()
-			n, err := populate.BuildIndex(cmd.Context(), dbConn, 0)
+			n, err := populate.BuildIndex(cmd.Context(), store, 0)
 			if err != nil {
 				logging.Error().Printf("building the search index: %v\n", err)
 				os.Exit(1)
 			}
 			log.Printf("Indexed %d records in %v\n", n, time.Since(t))
 		}
+
+		if shouldPrune {
+			fmt.Println("Pruning...")
+			err := runPrune(cmd.Context(), store, config.Config.Retention, false)
+			if err != nil {
+				logging.Error().Printf("pruning: %v\n", err)
+				os.Exit(1)
+			}
+		}
 	},
 }
 
@@ -166,5 +184,6 @@ func init() {
 	populateCmd.Flags().Bool("latest", false, "Only populate data that's newer than last import (Recommended, likely will be default in future version)")
 	populateCmd.Flags().Bool("build-index", true, "Whether or not to build the search index. Required for search to work.")
 	populateCmd.Flags().Bool("fulltext", false, "Whether or not to collect the full-text of each page in your browsing history and make it searchable.")
+	populateCmd.Flags().Bool("prune", false, "Apply retention settings after populating. Defaults to prune_on_populate from config.json")
 	populateCmd.Flags().Bool("keep-tmp-files", false, "Whether or not to keep temporary files created during the populate process. Probably only useful for debugging.")
 }
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/spf13/cobra"
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete old visits and full-text according to your retention settings",
+	Long: `Apply the retention settings from config.json, or the ones passed as flags.
+URLs are always kept. Only visits and scraped full-text bodies are removed.
+
+Example:
+
+	# Keep two years of visits and 90 days of full-text, but only report what
+	# would be deleted
+	browser-gopher prune --max-visit-age-days 730 --max-document-age-days 90 --dry-run
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			fmt.Println("could not parse --dry-run:", err)
+			os.Exit(1)
+		}
+
+		retention := config.Config.Retention
+
+		for flag, target := range map[string]*int{
+			"max-visit-age-days":    &retention.MaxVisitAgeDays,
+			"max-document-age-days": &retention.MaxDocumentAgeDays,
+			"max-db-size-mb":        &retention.MaxDBSizeMB,
+		} {
+			if !cmd.Flags().Changed(flag) {
+				continue
+			}
+
+			*target, err = cmd.Flags().GetInt(flag)
+			if err != nil {
+				fmt.Printf("could not parse --%s: %s\n", flag, err)
+				os.Exit(1)
+			}
+		}
+
+		if retention.MaxVisitAgeDays == 0 && retention.MaxDocumentAgeDays == 0 && retention.MaxDBSizeMB == 0 {
+			fmt.Println("No retention settings configured. Nothing to prune.")
+			return
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		err = runPrune(cmd.Context(), store, retention, dryRun)
+		if err != nil {
+			fmt.Println("could not prune", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func runPrune(ctx context.Context, store persistence.Store, retention config.RetentionConfig, dryRun bool) error {
+	opts := persistence.PruneOptions{
+		MaxDBSize: int64(retention.MaxDBSizeMB) * 1024 * 1024,
+		DryRun:    dryRun,
+	}
+
+	if retention.MaxVisitAgeDays > 0 {
+		t := time.Now().AddDate(0, 0, -retention.MaxVisitAgeDays)
+		opts.VisitsBefore = &t
+	}
+
+	if retention.MaxDocumentAgeDays > 0 {
+		t := time.Now().AddDate(0, 0, -retention.MaxDocumentAgeDays)
+		opts.DocumentsBefore = &t
+	}
+
+	report, err := store.Prune(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+
+	fmt.Printf("%s %d visits, %d full-text bodies, %d index fragments, the term vectors of %d urls and %d suggested words\n",
+		verb, report.Visits, report.Documents, report.Fragments, report.TermVectors, report.Words)
+	fmt.Printf("Database size: %.1f MB -> %.1f MB\n", float64(report.DBSizeBefore)/1024/1024, float64(report.DBSizeAfter)/1024/1024)
+
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().Bool("dry-run", false, "Report what would be deleted without deleting anything")
+	pruneCmd.Flags().Int("max-visit-age-days", 0, "Delete visits older than this many days. Overrides config.json")
+	pruneCmd.Flags().Int("max-document-age-days", 0, "Delete full-text scraped more than this many days ago. Overrides config.json")
+	pruneCmd.Flags().Int("max-db-size-mb", 0, "Delete the oldest full-text until the database is smaller than this. Overrides config.json")
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/redact"
+	"github.com/spf13/cobra"
+)
+
+var redactCmd = &cobra.Command{
+	Use:   "redact",
+	Short: "Remove sensitive query parameters from URLs already in the database",
+	Long: `New URLs are redacted automatically as they are written, by populate, merge,
+sync and imports. This command applies the same redaction to data imported
+before redaction was enabled (or after the list of redacted parameters was
+changed in config.json).
+
+Any scraped full-text for an affected URL is removed, since it may contain
+data that was only visible with the original URL.
+
+Example:
+
+	# See what would change
+	browser-gopher redact --dry-run
+
+	browser-gopher redact
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			fmt.Println("could not parse --dry-run:", err)
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		urls, err := store.UrlsWithParams(cmd.Context())
+		if err != nil {
+			fmt.Println("could not list urls", err)
+			os.Exit(1)
+		}
+
+		redactor := redact.NewRedactor(config.Config.Redaction)
+		n := 0
+
+		for _, u := range urls {
+			redacted, ok := redactor.RedactUrl(u)
+			if !ok {
+				continue
+			}
+
+			n++
+
+			if dryRun {
+				fmt.Println(redacted)
+				continue
+			}
+
+			err := store.RewriteUrl(cmd.Context(), u, redacted)
+			if err != nil {
+				fmt.Println("could not redact url", err)
+				os.Exit(1)
+			}
+		}
+
+		if dryRun {
+			fmt.Printf("Would redact %d urls\n", n)
+			return
+		}
+
+		// Redacted urls are new rows as far as the search index is concerned
+		_, err = populate.BuildIndex(cmd.Context(), store, 0)
+		if err != nil {
+			fmt.Println("could not index redacted urls", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Redacted %d urls\n", n)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(redactCmd)
+	redactCmd.Flags().Bool("dry-run", false, "Print the redacted form of affected URLs without changing anything")
+}
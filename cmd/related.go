@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+var relatedCmd = &cobra.Command{
+	Use:   "related <url>",
+	Short: "Find pages like one you've visited",
+	Long: `Find the pages in your history that are most like the one at url, by the
+words they have in common in their titles, descriptions and full-text. Words
+that few pages use count for more than common ones.
+
+Nothing is sent anywhere, pages are compared when they are indexed. Encrypted
+full-text is left out. If you indexed your history with an older version, run
+browser-gopher dev reindex first.
+
+Example:
+
+  browser-gopher related https://go.dev/doc/effective_go
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fmtJson, err := cmd.Flags().GetBool("json")
+		if err != nil {
+			fmt.Println("could not parse --json:", err)
+			os.Exit(1)
+		}
+
+		limit, err := cmd.Flags().GetUint("limit")
+		if err != nil {
+			fmt.Println("could not parse --limit:", err)
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		url := args[0]
+		provider := search.NewSqlSearchProvider(cmd.Context(), store, config.Config.Ranking)
+		result, err := provider.Related(url, limit)
+		if err == search.ErrUnknownUrl {
+			fmt.Printf("%s is not in your history. Urls have to match exactly, try searching for it first.\n", url)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Println("could not find related pages:", err)
+			os.Exit(1)
+		}
+
+		if fmtJson {
+			bs, err := json.MarshalIndent(struct {
+				Results []types.SearchableEntity `json:"results"`
+				Count   uint                     `json:"count"`
+				Url     string                   `json:"url"`
+			}{result.Urls, result.Count, url}, "", "  ")
+			if err != nil {
+				fmt.Println("could not marshal json", err)
+				os.Exit(1)
+			}
+			fmt.Println(string(bs))
+			return
+		}
+
+		if len(result.Urls) == 0 {
+			fmt.Printf("Found nothing related to %s. If it was indexed by an older version, run browser-gopher dev reindex.\n", url)
+			return
+		}
+
+		// @note most related last, closest to the prompt, like search
+		for _, x := range util.ReverseSlice(result.Urls) {
+			title := "<UNTITLED>"
+			if x.Title != nil {
+				title = *x.Title
+			}
+
+			var lastVisit string
+			if x.LastVisit != nil {
+				lastVisit = x.LastVisit.Format("2006-01-02")
+			}
+
+			fmt.Printf("%v %s %s\n", lastVisit, title, x.Url)
+		}
+		fmt.Printf("Found %d pages related to %s\n", result.Count, url)
+	},
+}
+
+func init() {
+	relatedCmd.Flags().Bool("json", false, "output results as json")
+	relatedCmd.Flags().Uint("limit", 20, "number of related pages to show")
+	rootCmd.AddCommand(relatedCmd)
+}
@@ -4,17 +4,83 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"regexp/syntax"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/logging"
+	"github.com/iansinnott/browser-gopher/pkg/output"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/query"
 	"github.com/iansinnott/browser-gopher/pkg/search"
 	"github.com/iansinnott/browser-gopher/pkg/tui"
 	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 var searchCmd = &cobra.Command{
-	Use:   "search",
+	Use:   "search [query]",
 	Short: "Find URLs you've visited",
+	Long: `Find URLs you've visited. Every word must appear in the url, title or
+full-text of a page. Quote a phrase to search for it as is, and put - in front
+of a word to exclude pages that contain it. Results can be filtered with:
+
+  site:github.com    on github.com or one of its subdomains
+  title:gopher       the title contains gopher
+  url:issues         the url contains issues
+  browser:firefox    visited in firefox
+  after:2022-01-01   visited on or after the first of January
+  before:2022-02-01  visited before the first of February
+  has:fulltext       the full-text of the page has been scraped
+  is:bookmarked      the page is bookmarked in a browser
+
+Filters can be negated with -, except after: and before:.
+
+Results are sorted by relevance, which blends how well the text matched (title
+matches count more than url matches, which count more than full-text matches)
+with how often and how recently a page was visited, and whether it is
+bookmarked. Use --sort recent or
+--sort frequent to sort by last visit or visit count instead.
+
+Versions of the same page, e.g. its AMP version, its mobile site, its url with
+tracking parameters or a mirror with the same full-text, are grouped under the
+best of them. Press ctrl+o to list them, or use --all-variants to list each
+one as a result of its own.
+
+Use --regex to match a regular expression instead, e.g. to find a url by a
+pattern, or --literal to match text exactly, punctuation and case included.
+The whole query is the expression or text, filters don't apply. Add (?i) to
+the start of an expression to ignore case.
+
+Every search is added to the search history. Save one under a name with
+'searches save' and run it again with --saved, adding words to narrow it down.
+
+Use --format to print the results for other tools instead of searching
+interactively: json, ndjson (an object per line), csv, tsv, markdown (a list of
+links) or a Go template of the fields of a result by their json names, e.g.
+'{{.url}}\t{{.title}}'. The fields are id, url, title, description,
+last_visit, visit_count, match, snippets, match_count, sum_rank, score and
+variants. Each snippet has the attribute it is of, e.g. title or content, the
+section of the page it is in, e.g. "Installation > Linux", its text and the
+spans of it that matched, by byte offsets.
+
+Use --on or --between to see what you were looking at on those days instead.
+Every visit to the matching pages is listed in the order it happened, grouped
+into sessions wherever there was a break of more than half an hour.
+
+Examples:
+
+  browser-gopher search 'golang "error handling" site:github.com -gitlab after:2022-01-01'
+  browser-gopher search --regex 'github.com/golang/go/issues/\d{4}$'
+  browser-gopher search --literal 'panic: runtime error: index out of range'
+  browser-gopher search --format ndjson golang | jq .url
+  browser-gopher search --format '{{.title}}\t{{.url}}' golang | fzf
+  browser-gopher search --on 2024-03-12
+  browser-gopher search --between 2024-03-11,2024-03-15 golang
+`,
 	Run: func(cmd *cobra.Command, args []string) {
 		noInteractive, err := cmd.Flags().GetBool("no-interactive")
 		if err != nil {
@@ -28,62 +94,209 @@ var searchCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		dataProvider := search.NewSqlSearchProvider(cmd.Context(), config.Config)
+		format, err := cmd.Flags().GetString("format")
+		if err != nil {
+			fmt.Println("could not parse --format:", err)
+			os.Exit(1)
+		}
+		// @note --json prints an array of the results, as it always has. The
+		// count, suggestion and facets are only printed by --format json.
+		if fmtJson && cmd.Flags().Changed("format") {
+			fmt.Println("--json can't be used with --format")
+			os.Exit(1)
+		}
+
+		// @note any format but text is for piping into something else
+		if fmtJson || format != string(output.Text) {
+			noInteractive = true
+		}
+
+		sortFlag, err := cmd.Flags().GetString("sort")
+		if err != nil {
+			fmt.Println("could not parse --sort:", err)
+			os.Exit(1)
+		}
+		sortOrder, err := persistence.ParseSortOrder(sortFlag)
+		if err != nil {
+			fmt.Println("could not parse --sort:", err)
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		limit, err := cmd.Flags().GetUint("limit")
+		if err != nil {
+			fmt.Println("could not parse --limit:", err)
+			os.Exit(1)
+		}
+
+		offset, err := cmd.Flags().GetUint("offset")
+		if err != nil {
+			fmt.Println("could not parse --offset:", err)
+			os.Exit(1)
+		}
+
+		mode, err := matchMode(cmd)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		allVariants, err := cmd.Flags().GetBool("all-variants")
+		if err != nil {
+			fmt.Println("could not parse --all-variants:", err)
+			os.Exit(1)
+		}
+
+		dataProvider := search.NewSqlSearchProvider(cmd.Context(), store, config.Config.Ranking)
+		opts := search.SearchOptions{Sort: sortOrder, Limit: limit, Offset: offset, Facets: format == string(output.Json), Mode: mode, AllVariants: allVariants}
 		initialQuery := ""
 
 		if len(args) > 0 {
-			initialQuery = args[0]
+			initialQuery = strings.Join(args, " ")
 		}
 
-		if noInteractive {
-			if len(args) < 1 {
-				fmt.Println("No search query provided.")
+		saved, err := cmd.Flags().GetString("saved")
+		if err != nil {
+			fmt.Println("could not parse --saved:", err)
+			os.Exit(1)
+		}
+		if saved != "" {
+			s, err := store.SavedSearch(cmd.Context(), saved)
+			if err != nil {
+				fmt.Println("could not get saved search", err)
+				os.Exit(1)
+			}
+			if s == nil {
+				fmt.Printf("There is no saved search named %q, see: browser-gopher searches list\n", saved)
 				os.Exit(1)
-				return
 			}
 
-			result, err := dataProvider.SearchUrls(initialQuery)
+			// @note words given along with --saved narrow the saved search down
+			initialQuery = strings.TrimSpace(s.Query + " " + initialQuery)
+			if mode == search.MatchQuery {
+				mode = search.MatchMode(s.Mode)
+				opts.Mode = mode
+			}
+		}
+
+		on, err := cmd.Flags().GetString("on")
+		if err != nil {
+			fmt.Println("could not parse --on:", err)
+			os.Exit(1)
+		}
+
+		between, err := cmd.Flags().GetStringSlice("between")
+		if err != nil {
+			fmt.Println("could not parse --between:", err)
+			os.Exit(1)
+		}
+
+		if on != "" || len(between) > 0 {
+			if mode != search.MatchQuery {
+				fmt.Println("--regex and --literal can't be used with --on or --between")
+				os.Exit(1)
+			}
+
+			initialQuery, err = timelineQuery(initialQuery, on, between)
+			exitOnParseError(initialQuery, err)
 			if err != nil {
-				fmt.Println("search error", err)
+				fmt.Println(err)
 				os.Exit(1)
+			}
+
+			if format != string(output.Text) && format != string(output.Json) {
+				fmt.Println("--on and --between only support --format text and json")
+				os.Exit(1)
+			}
+
+			if noInteractive {
+				printTimeline(dataProvider, initialQuery, opts, fmtJson || format == string(output.Json))
 				return
 			}
 
-			if fmtJson {
-				// output x as a JSON string
-				bs, err := json.MarshalIndent(result.Urls, "", "  ")
+			p, err := tui.GetTimelineProgram(cmd.Context(), initialQuery, dataProvider, nil)
+			if err != nil {
+				fmt.Println("could not get timeline program:", err)
+				os.Exit(1)
+			}
 
-				if err != nil {
-					fmt.Println("could not marshal json:", err)
-					os.Exit(1)
-				}
+			if err := p.Start(); err != nil {
+				fmt.Println("Error running program:", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		if noInteractive {
+			if initialQuery == "" {
+				fmt.Println("No search query provided.")
+				os.Exit(1)
+				return
+			}
 
-				fmt.Println(string(bs))
+			var formatter output.Formatter
+			if fmtJson {
+				formatter = output.NewArray(os.Stdout)
 			} else {
-				for _, x := range util.ReverseSlice(result.Urls) {
-					var title string
-					var lastVisit string
-					if x.Title != nil {
-						title = *x.Title
-					} else {
-						title = "<UNTITLED>"
-					}
+				formatter, err = output.New(os.Stdout, format)
+			}
+			if err != nil {
+				fmt.Println("could not parse --format:", err)
+				os.Exit(1)
+			}
 
-					if x.LastVisit != nil {
-						lastVisit = x.LastVisit.Format("2006-01-02")
+			var result *search.SearchResult
+			if limit == 0 {
+				opts.Limit = persistence.DefaultSearchLimit
+				result, err = search.Each(dataProvider, initialQuery, opts, formatter.Result)
+			} else {
+				result, err = dataProvider.SearchUrls(initialQuery, opts)
+				if err == nil {
+					for _, x := range result.Urls {
+						if err = formatter.Result(x); err != nil {
+							break
+						}
 					}
-
-					fmt.Printf("%v %s %sv\n", lastVisit, title, x.Url)
 				}
+			}
 
-				fmt.Printf("Found %d results for \"%s\"\n", result.Count, initialQuery)
-				os.Exit(0)
+			exitOnParseError(initialQuery, err)
+			exitOnRegexError(err)
+			if err != nil {
+				fmt.Println("search error", err)
+				os.Exit(1)
+				return
 			}
 
+			recordSearch(dataProvider, initialQuery, mode, result.Count)
+
+			err = formatter.End(output.Summary{Query: initialQuery, Offset: offset, Result: result})
+			if err != nil {
+				fmt.Println("could not write results", err)
+				os.Exit(1)
+			}
 			return
 		}
 
-		p, err := tui.GetSearchProgram(cmd.Context(), initialQuery, dataProvider, dataProvider, nil)
+		// Ask for the passphrase before the UI takes over the terminal
+		if encrypted, ok := store.(*persistence.EncryptedStore); ok {
+			needed, err := encrypted.HasEncryptedBodies(cmd.Context())
+			if err == nil && needed {
+				err = encrypted.Unlock()
+			}
+			if err != nil {
+				fmt.Println("could not unlock encrypted documents:", err)
+				os.Exit(1)
+			}
+		}
+
+		p, err := tui.GetSearchProgram(cmd.Context(), initialQuery, dataProvider, dataProvider, search.SearchOptions{Sort: sortOrder, Mode: mode, AllVariants: allVariants}, nil)
 		if err != nil {
 			fmt.Println("could not get search program:", err)
 			os.Exit(1)
@@ -96,8 +309,177 @@ var searchCmd = &cobra.Command{
 	},
 }
 
+// Point out where q is invalid and exit, if err is a *query.ParseError
+func exitOnParseError(q string, err error) {
+	var parseErr *query.ParseError
+	if errors.As(err, &parseErr) {
+		fmt.Println("invalid search query:", parseErr.Msg)
+		fmt.Println("  " + q)
+		fmt.Println("  " + strings.Repeat(" ", utf8.RuneCountInString(q[:parseErr.Pos])) + "^")
+		os.Exit(1)
+	}
+}
+
+// Explain an invalid --regex and exit, if err is one
+func exitOnRegexError(err error) {
+	var regexErr *syntax.Error
+	if errors.As(err, &regexErr) {
+		fmt.Println("invalid regular expression:", regexErr)
+		os.Exit(1)
+	}
+}
+
+// How the query is matched, by --regex or --literal
+func matchMode(cmd *cobra.Command) (search.MatchMode, error) {
+	regex, err := cmd.Flags().GetBool("regex")
+	if err != nil {
+		return "", errors.Wrap(err, "could not parse --regex")
+	}
+	literal, err := cmd.Flags().GetBool("literal")
+	if err != nil {
+		return "", errors.Wrap(err, "could not parse --literal")
+	}
+
+	switch {
+	case regex && literal:
+		return "", errors.New("only one of --regex and --literal can be given")
+	case regex:
+		return search.MatchRegex, nil
+	case literal:
+		return search.MatchLiteral, nil
+	default:
+		return search.MatchQuery, nil
+	}
+}
+
+// Narrow q down to the day of --on or the days of --between. The last day of
+// --between is included, unless it is a time rather than a date.
+func timelineQuery(s string, on string, between []string) (string, error) {
+	q, err := query.Parse(s)
+	if err != nil {
+		return s, err
+	}
+
+	var from, to string
+	switch {
+	case on != "" && len(between) > 0:
+		return s, errors.New("only one of --on and --between can be given")
+	case on != "":
+		from, to = on, on
+	case len(between) == 2:
+		from, to = between[0], between[1]
+	default:
+		return s, errors.New("--between takes two dates, e.g. --between 2024-03-11,2024-03-15")
+	}
+
+	after, err := query.ParseDate(from)
+	if err != nil {
+		return s, err
+	}
+	before, err := query.ParseDate(to)
+	if err != nil {
+		return s, err
+	}
+
+	if on != "" {
+		y, m, d := after.In(time.Local).Date()
+		after = time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+		before = after.AddDate(0, 0, 1)
+	} else if _, err := time.Parse(util.FormatDateOnly, to); err == nil {
+		before = before.AddDate(0, 0, 1)
+	}
+
+	return search.RefineDates(q, &after, &before).String(), nil
+}
+
+// Print every visit to the urls matching q, or a page of them, grouped into sessions
+// Add a search to the search history, as the interactive search does with the
+// query the user ends up with
+func recordSearch(p search.HistoryProvider, q string, mode search.MatchMode, count uint) {
+	// @note a search that can't be recorded, e.g. because the database is
+	// locked, is still a search
+	if err := p.RecordSearch(q, mode, count); err != nil {
+		logging.Warn().Println(err)
+	}
+}
+
+func printTimeline(p search.TimelineProvider, q string, opts search.SearchOptions, fmtJson bool) {
+	visits := []search.TimelineVisit{}
+	var count uint
+	var err error
+	if opts.Limit == 0 {
+		opts.Limit = persistence.DefaultSearchLimit
+		count, err = search.EachVisit(p, q, opts, func(v search.TimelineVisit) error {
+			visits = append(visits, v)
+			return nil
+		})
+	} else {
+		var result *search.TimelineResult
+		result, err = p.Timeline(q, opts)
+		if err == nil {
+			visits, count = result.Visits, result.Count
+		}
+	}
+	exitOnParseError(q, err)
+	if err != nil {
+		fmt.Println("search error", err)
+		os.Exit(1)
+	}
+
+	if history, ok := p.(search.HistoryProvider); ok {
+		recordSearch(history, q, search.MatchQuery, count)
+	}
+
+	sessions := search.Sessions(visits)
+
+	if fmtJson {
+		bs, err := json.MarshalIndent(struct {
+			Sessions []search.Session `json:"sessions"`
+			Count    uint             `json:"count"`
+			Query    string           `json:"query"`
+		}{sessions, count, q}, "", "  ")
+		if err != nil {
+			fmt.Println("could not marshal json", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(bs))
+		return
+	}
+
+	for _, session := range sessions {
+		visitCount := "1 visit"
+		if len(session.Visits) != 1 {
+			visitCount = fmt.Sprintf("%d visits", len(session.Visits))
+		}
+		fmt.Printf("\nSession at %s, %s\n", session.Start.Format("15:04 on Mon, 2 Jan 2006"), visitCount)
+		for _, v := range session.Visits {
+			title := "<UNTITLED>"
+			if v.Title != nil {
+				title = *v.Title
+			}
+			fmt.Printf("  %s %s %s (%s)\n", v.Time.Format("15:04"), title, v.Url, v.Browser)
+		}
+	}
+
+	if uint(len(visits)) < count {
+		fmt.Printf("\nShowing %d-%d of %d visits for \"%s\", use --offset and --limit for more\n", opts.Offset+1, opts.Offset+uint(len(visits)), count, q)
+	} else {
+		fmt.Printf("\nFound %d visits for \"%s\"\n", count, q)
+	}
+}
+
 func init() {
 	searchCmd.Flags().Bool("no-interactive", false, "disable interactive terminal interface. useful for scripting")
-	searchCmd.Flags().Bool("json", false, "output results as json. only works with --no-interactive")
+	searchCmd.Flags().Bool("json", false, "output results as a json array. use --format json for their count, suggestions and facets as well")
+	searchCmd.Flags().String("format", string(output.Text), "output results as text, json, ndjson, csv, tsv, markdown or a Go template of their json fields, e.g. '{{.url}}'. implies --no-interactive unless it is text")
+	searchCmd.Flags().String("sort", string(persistence.SortRelevance), "order of results: relevance, recent or frequent")
+	searchCmd.Flags().Uint("limit", persistence.DefaultSearchLimit, "number of results to show, or 0 for all of them. only works with --no-interactive")
+	searchCmd.Flags().Uint("offset", 0, "number of results to skip. only works with --no-interactive")
+	searchCmd.Flags().Bool("regex", false, "match a regular expression, e.g. '/issues/\\d{4}', against urls, titles and full-text instead of searching for words")
+	searchCmd.Flags().Bool("literal", false, "match the exact text, punctuation and case included, instead of searching for words")
+	searchCmd.Flags().Bool("all-variants", false, "list every version of a page, e.g. its AMP version, as a result of its own instead of grouping them")
+	searchCmd.Flags().String("saved", "", "run the search saved under this name, see the searches command")
+	searchCmd.Flags().String("on", "", "list the visits on a day, e.g. 2024-03-12, in the order they happened")
+	searchCmd.Flags().StringSlice("between", nil, "list the visits from one day to another, e.g. 2024-03-11,2024-03-15, in the order they happened")
 	rootCmd.AddCommand(searchCmd)
 }
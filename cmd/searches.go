@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+var searchesCmd = &cobra.Command{
+	Use:   "searches",
+	Short: "Saved searches and search history",
+	Long: `Every search is added to the search history, and can be saved under a name to
+run it again with 'search --saved <name>'. In the interactive search, press up
+at the top of the results to recall earlier searches.`,
+}
+
+var searchesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List saved searches, by name",
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		saved, err := store.SavedSearches(cmd.Context())
+		if err != nil {
+			fmt.Println("could not list saved searches", err)
+			os.Exit(1)
+		}
+
+		if len(saved) == 0 {
+			fmt.Println("No saved searches. Save one with: browser-gopher searches save <name> <query>")
+			return
+		}
+
+		for _, s := range saved {
+			fmt.Printf("%-20s  %s\n", s.Name, describeSearch(s.Query, search.MatchMode(s.Mode)))
+		}
+	},
+}
+
+var searchesHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List recent searches, the most recent last like a shell's history",
+	Run: func(cmd *cobra.Command, args []string) {
+		limit, err := cmd.Flags().GetUint("limit")
+		if err != nil {
+			fmt.Println("could not parse --limit:", err)
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		searches, err := store.SearchHistory(cmd.Context(), int(limit))
+		if err != nil {
+			fmt.Println("could not list search history", err)
+			os.Exit(1)
+		}
+
+		for _, s := range util.ReverseSlice(searches) {
+			fmt.Printf("%s  %6d  %s\n", s.SearchedAt.Format("2006-01-02 15:04"), s.ResultCount, describeSearch(s.Query, search.MatchMode(s.Mode)))
+		}
+	},
+}
+
+var searchesSaveCmd = &cobra.Command{
+	Use:   "save <name> [query]",
+	Short: "Save a search under a name",
+	Long: `Save a search under a name, to run it again with 'search --saved <name>'.
+Without a query the most recent search is saved. A search saved under the same
+name is replaced.
+
+Examples:
+
+  browser-gopher searches save generics 'site:go.dev generics'
+  browser-gopher searches save --regex issues 'golang/go/issues/\d+'
+  browser-gopher searches save last
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		mode, err := matchMode(cmd)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		name := args[0]
+		q := strings.Join(args[1:], " ")
+		if q == "" {
+			recent, err := store.SearchHistory(cmd.Context(), 1)
+			if err != nil {
+				fmt.Println("could not get search history", err)
+				os.Exit(1)
+			}
+			if len(recent) == 0 {
+				fmt.Println("There is no search to save yet, give a query to save")
+				os.Exit(1)
+			}
+			q, mode = recent[0].Query, search.MatchMode(recent[0].Mode)
+		}
+
+		err = validateSearch(q, mode)
+		exitOnParseError(q, err)
+		exitOnRegexError(err)
+		if err != nil {
+			fmt.Println("invalid search:", err)
+			os.Exit(1)
+		}
+
+		err = store.SaveSearch(cmd.Context(), types.SavedSearchRow{Name: name, Query: q, Mode: string(mode), CreatedAt: time.Now()})
+		if err != nil {
+			fmt.Println("could not save search", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Saved %s as %q, run it with: browser-gopher search --saved %s\n", describeSearch(q, mode), name, name)
+	},
+}
+
+var searchesDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a saved search",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		deleted, err := store.DeleteSavedSearch(cmd.Context(), args[0])
+		if err != nil {
+			fmt.Println("could not delete saved search", err)
+			os.Exit(1)
+		}
+		if !deleted {
+			fmt.Printf("There is no saved search named %q\n", args[0])
+			os.Exit(1)
+		}
+
+		fmt.Println("Deleted", args[0])
+	},
+}
+
+// A query as it would be typed, with the flag for its mode if it isn't the
+// query syntax
+func describeSearch(q string, mode search.MatchMode) string {
+	if mode == search.MatchQuery {
+		return q
+	}
+	return fmt.Sprintf("--%s %s", mode, q)
+}
+
+// Check that q can be searched for in the mode, so that nothing invalid is saved
+func validateSearch(q string, mode search.MatchMode) error {
+	if mode == search.MatchQuery {
+		_, err := query.Parse(q)
+		return err
+	}
+	_, err := persistence.NewPattern(q, mode == search.MatchLiteral)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(searchesCmd)
+	searchesCmd.AddCommand(searchesListCmd)
+	searchesCmd.AddCommand(searchesHistoryCmd)
+	searchesCmd.AddCommand(searchesSaveCmd)
+	searchesCmd.AddCommand(searchesDeleteCmd)
+	searchesHistoryCmd.Flags().Uint("limit", 20, "number of searches to show")
+	searchesSaveCmd.Flags().Bool("regex", false, "the query is a regular expression, see search --regex")
+	searchesSaveCmd.Flags().Bool("literal", false, "the query is exact text, see search --literal")
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/dbsync"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/spf13/cobra"
+)
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Exchange history with other machines through a shared folder",
+	Long: `Share history between machines without a server, using a folder that is
+kept in sync by Syncthing, Dropbox or similar.
+
+Each run writes what changed locally since the last run to <dir>/<name>/, then
+merges whatever the other machines have written. Run it on every machine, e.g.
+after populate.
+
+Example:
+
+	browser-gopher populate --latest && browser-gopher sync --dir ~/Sync/browser-gopher
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, err := cmd.Flags().GetString("dir")
+		if err != nil {
+			fmt.Println("could not parse --dir:", err)
+			os.Exit(1)
+		}
+
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			fmt.Println("could not parse --name:", err)
+			os.Exit(1)
+		}
+
+		full, err := cmd.Flags().GetBool("full")
+		if err != nil {
+			fmt.Println("could not parse --full:", err)
+			os.Exit(1)
+		}
+
+		if config.Config.Database.Backend == config.BackendPostgres {
+			fmt.Println("sync is for local sqlite databases. With postgres every machine already shares one database.")
+			os.Exit(1)
+		}
+
+		store, err := persistence.OpenStore(cmd.Context(), config.Config)
+		if err != nil {
+			fmt.Println("could not open our db", err)
+			os.Exit(1)
+		}
+		defer store.Close()
+
+		report, err := dbsync.Sync(cmd.Context(), store, config.Config.DBPath, dbsync.Options{
+			Dir:  util.Expanduser(dir),
+			Name: name,
+			Full: full,
+		})
+		if err != nil {
+			fmt.Println("could not sync", err)
+			os.Exit(1)
+		}
+
+		if report.Exported != "" {
+			fmt.Println("wrote", report.Exported)
+		}
+
+		for _, rel := range report.Imported {
+			fmt.Println("merged", rel)
+		}
+
+		if len(report.Imported) == 0 {
+			return
+		}
+
+		printMergeReport(&report.Merge)
+
+		_, err = populate.BuildIndex(cmd.Context(), store, 0)
+		if err != nil {
+			fmt.Println("could not index merged urls", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(syncCmd)
+	syncCmd.Flags().String("dir", "", "The shared folder")
+	syncCmd.MarkFlagRequired("dir")
+	syncCmd.Flags().String("name", "", "Name of this machine's subfolder. Defaults to the hostname")
+	syncCmd.Flags().Bool("full", false, "Write all local history rather than only what changed since the last sync")
+}
@@ -0,0 +1,102 @@
+// Package archive reads and writes the whole database as JSON Lines, one url
+// per line along with its title history, visits and full-text documents. The
+// format doesn't depend on the storage backend or schema version, so it can
+// be used to move history between them or to process it with other tools.
+package archive
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+)
+
+type ExportOptions struct {
+	Since *time.Time // Nullable. Only include visits at or after this time
+	Until *time.Time // Nullable. Only include visits before this time
+	// Only include urls on these domains, or their subdomains. All urls if empty.
+	Domains []string
+}
+
+// Export writes a record for every url in store matching opts to w, one JSON
+// object per line. Returns the number of records written.
+func Export(ctx context.Context, store persistence.Store, w io.Writer, opts ExportOptions) (int, error) {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	// Keep urls readable, e.g. & rather than \u0026
+	enc.SetEscapeHTML(false)
+
+	var n int
+
+	err := store.Records(ctx, persistence.RecordOptions{Since: opts.Since, Until: opts.Until}, func(rec *types.UrlRecord) error {
+		if !matchesDomain(rec.Url, opts.Domains) {
+			return nil
+		}
+
+		n++
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, buf.Flush()
+}
+
+func matchesDomain(rawUrl string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Import reads records written by Export from r and adds them to store. Records
+// are merged with anything already stored, so importing the same file twice
+// is harmless. Returns the number of records read. Nothing is indexed for
+// search, run populate.BuildIndex afterwards.
+func Import(ctx context.Context, store persistence.Store, r io.Reader) (int, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var n int
+
+	for {
+		var rec types.UrlRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "could not read record %d", n+1)
+		}
+
+		if rec.Url == "" {
+			return n, errors.Errorf("record %d has no url", n+1)
+		}
+
+		err = persistence.InsertRecord(ctx, store, &rec)
+		if err != nil {
+			return n, errors.Wrap(err, rec.Url)
+		}
+		n++
+	}
+}
@@ -0,0 +1,111 @@
+package archive_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/archive"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func newStore(t *testing.T) persistence.Store {
+	store, err := testutils.GetTestStore(t)
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func visit(t *testing.T, store persistence.Store, url string, title string, ts int64) {
+	ctx := context.Background()
+	at := time.Unix(ts, 0)
+	require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title, LastVisit: &at}))
+	require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: at, ExtractorName: "chrome"}))
+}
+
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src := newStore(t)
+
+	visit(t, src, "https://go.dev", "Go", 1000)
+	visit(t, src, "https://go.dev", "The Go Programming Language", 2000)
+	visit(t, src, "https://pkg.go.dev/?q=a&b", "Go Packages", 3000)
+	visit(t, src, "https://rust-lang.org", "Rust", 4000)
+
+	body := "Go is an open source programming language"
+	accessedAt := time.Unix(2500, 0)
+	require.NoError(t, src.InsertDocument(ctx, &types.DocumentRow{
+		DocumentMd5: util.HashMd5String(body),
+		UrlMd5:      util.HashMd5String("https://go.dev"),
+		StatusCode:  200,
+		AccessedAt:  &accessedAt,
+		Body:        &body,
+	}))
+
+	var exported bytes.Buffer
+	n, err := archive.Export(ctx, src, &exported, archive.ExportOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	require.Contains(t, exported.String(), "https://pkg.go.dev/?q=a&b", "urls are not html escaped")
+
+	dst := newStore(t)
+	n, err = archive.Import(ctx, dst, bytes.NewReader(exported.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	var reexported bytes.Buffer
+	_, err = archive.Export(ctx, dst, &reexported, archive.ExportOptions{})
+	require.NoError(t, err)
+	require.Equal(t, exported.String(), reexported.String())
+
+	urls, err := dst.UrlsById(ctx, util.HashMd5String("https://go.dev"))
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	require.Equal(t, "The Go Programming Language", *urls[0].Title)
+	require.Equal(t, 2, urls[0].VisitCount)
+
+	// Importing again changes nothing
+	_, err = archive.Import(ctx, dst, bytes.NewReader(exported.Bytes()))
+	require.NoError(t, err)
+	urls, err = dst.UrlsById(ctx, util.HashMd5String("https://go.dev"))
+	require.NoError(t, err)
+	require.Equal(t, 2, urls[0].VisitCount)
+}
+
+func TestExportFilters(t *testing.T) {
+	ctx := context.Background()
+	store := newStore(t)
+
+	visit(t, store, "https://go.dev", "Go", 1000)
+	visit(t, store, "https://pkg.go.dev", "Go Packages", 2000)
+	visit(t, store, "https://notgo.dev", "Not Go", 2000)
+	visit(t, store, "https://rust-lang.org", "Rust", 3000)
+
+	export := func(opts archive.ExportOptions) []string {
+		var buf bytes.Buffer
+		_, err := archive.Export(ctx, store, &buf, opts)
+		require.NoError(t, err)
+
+		dst := persistence.NewMemoryStore()
+		_, err = archive.Import(ctx, dst, &buf)
+		require.NoError(t, err)
+
+		var urls []string
+		require.NoError(t, dst.Records(ctx, persistence.RecordOptions{}, func(rec *types.UrlRecord) error {
+			urls = append(urls, rec.Url)
+			return nil
+		}))
+		return urls
+	}
+
+	require.ElementsMatch(t, []string{"https://go.dev", "https://pkg.go.dev"}, export(archive.ExportOptions{Domains: []string{"go.dev"}}))
+
+	since := time.Unix(2000, 0)
+	until := time.Unix(3000, 0)
+	require.ElementsMatch(t, []string{"https://pkg.go.dev", "https://notgo.dev"}, export(archive.ExportOptions{Since: &since, Until: &until}))
+}
@@ -0,0 +1,562 @@
+// Package backup makes compressed snapshots of the sqlite database, keeps a
+// limited number of them around and restores them.
+//
+// A backup is a tar.gz archive in the backup dir named after the time it was
+// made, e.g. backup_20221030120000.tar.gz, containing db.sqlite and, if they
+// exist, config.json and the encryption key file. With encryption enabled the
+// whole archive is encrypted as well, and gets an extra .enc extension.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/crypt"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/pkg/errors"
+)
+
+const (
+	namePrefix      = "backup_"
+	nameSuffix      = ".tar.gz"
+	encryptedSuffix = ".enc"
+	timeLayout      = "20060102150405"
+	dbName          = "db.sqlite"
+	configName      = "config.json"
+	keyName         = "key.json"
+)
+
+type Backup struct {
+	Name string
+	Path string
+	Time time.Time
+	Size int64
+	// Needs the passphrase to be read
+	Encrypted bool
+	// Made by an earlier version, which copied the app data dir as is rather than archiving it
+	Legacy bool
+}
+
+// Create writes a new backup of the database to the backup dir. The database
+// is copied with VACUUM INTO, so it is consistent even if populate is running
+// at the same time. The archive is checked by restoring the database from it
+// before it is given its final name.
+func Create(ctx context.Context, c *config.AppConfig) (*Backup, error) {
+	if _, err := os.Stat(c.DBPath); err != nil {
+		return nil, err
+	}
+
+	name := namePrefix + time.Now().Format(timeLayout) + nameSuffix
+	if c.Encryption.Enabled {
+		name += encryptedSuffix
+	}
+	path := filepath.Join(c.BackupDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, errors.New(path + " already exists")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "browser-gopher-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	snapshot := filepath.Join(tmpDir, dbName)
+	err = persistence.CopyDb(ctx, c.DBPath, snapshot)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not copy database")
+	}
+
+	err = persistence.CheckIntegrity(ctx, snapshot)
+	if err != nil {
+		return nil, errors.Wrap(err, "refusing to back up a damaged database")
+	}
+
+	files := []string{snapshot}
+	for _, extra := range []string{filepath.Join(c.AppDataPath, configName), keyPath(c)} {
+		if _, err := os.Stat(extra); err == nil {
+			files = append(files, extra)
+		}
+	}
+
+	// @note hidden until verified, so that List and Rotate never see a partial backup
+	tmp := filepath.Join(c.BackupDir, "."+name+".tmp")
+	b := &Backup{Name: name, Path: tmp, Time: parseTime(name), Encrypted: c.Encryption.Enabled}
+
+	err = writeArchive(c, b, files)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, errors.Wrap(err, "could not write archive")
+	}
+
+	err = Verify(ctx, c, b)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, errors.Wrap(err, "backup failed verification")
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return nil, err
+	}
+	b.Path = path
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	b.Size = info.Size()
+
+	return b, nil
+}
+
+func keyPath(c *config.AppConfig) string {
+	if c.Keyring != nil {
+		return c.Keyring.Path()
+	}
+	return filepath.Join(c.AppDataPath, keyName)
+}
+
+// Write files to a gzipped tarball at b.Path, flat, under their base names
+func writeArchive(c *config.AppConfig, b *Backup, files []string) error {
+	f, err := os.Create(b.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var enc io.WriteCloser
+
+	if b.Encrypted {
+		if c.Keyring == nil {
+			return errors.New("encryption is enabled but there is no keyring")
+		}
+
+		key, err := c.Keyring.Key()
+		if err != nil {
+			return err
+		}
+
+		kf, err := c.Keyring.KeyFile()
+		if err != nil {
+			return err
+		}
+
+		enc, err = crypt.NewWriter(f, kf, key)
+		if err != nil {
+			return err
+		}
+		w = enc
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, file := range files {
+		err := addFile(tw, file)
+		if err != nil {
+			return errors.Wrap(err, file)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+
+	if enc != nil {
+		err = enc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+func addFile(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.Base(path)
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// Verify checks that the database can be read back out of a backup and passes
+// sqlite's integrity check. Encrypted backups need the passphrase.
+func Verify(ctx context.Context, c *config.AppConfig, b *Backup) error {
+	tmpDir, err := os.MkdirTemp("", "browser-gopher-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db := filepath.Join(tmpDir, dbName)
+	err = extractDb(ctx, c, b, db)
+	if err != nil {
+		return err
+	}
+
+	return persistence.CheckIntegrity(ctx, db)
+}
+
+// Write the database in b to dst
+func extractDb(ctx context.Context, c *config.AppConfig, b *Backup, dst string) error {
+	if b.Legacy {
+		return persistence.CopyDb(ctx, filepath.Join(b.Path, dbName), dst)
+	}
+
+	found := false
+	err := readArchive(c, b, func(name string, r io.Reader) error {
+		if name != dbName {
+			return nil
+		}
+		found = true
+
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, r)
+		if err != nil {
+			out.Close()
+			return err
+		}
+
+		return out.Close()
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return errors.New(dbName + " not found in " + b.Name)
+	}
+
+	return nil
+}
+
+// Call fn with the name and contents of every file in the archive of b
+func readArchive(c *config.AppConfig, b *Backup, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(b.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+
+	if b.Encrypted {
+		if c.Keyring == nil {
+			return errors.New(b.Name + " is encrypted but there is no keyring")
+		}
+
+		br := bufio.NewReader(f)
+		kf, err := crypt.ReadKeyFileHeader(br)
+		if err != nil {
+			return err
+		}
+
+		// @note the backup may have been made with a key other than the current one
+		key, err := c.Keyring.KeyFor(kf)
+		if err != nil {
+			return err
+		}
+
+		r = crypt.NewReader(br, key)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// Read to the end, so that damage after the last file is noticed as well
+			_, err = io.Copy(io.Discard, gz)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(hdr.Name, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Zero if name is not a backup name
+func parseTime(name string) time.Time {
+	if !strings.HasPrefix(name, namePrefix) {
+		return time.Time{}
+	}
+
+	ts := strings.TrimPrefix(name, namePrefix)
+	ts = strings.TrimSuffix(strings.TrimSuffix(ts, encryptedSuffix), nameSuffix)
+	t, err := time.ParseInLocation(timeLayout, ts, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return t
+}
+
+// List returns the backups in dir, newest first
+func List(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []Backup
+
+	for _, e := range entries {
+		t := parseTime(e.Name())
+		if t.IsZero() {
+			continue
+		}
+
+		b := Backup{Name: e.Name(), Path: filepath.Join(dir, e.Name()), Time: t}
+		sizePath := b.Path
+
+		switch {
+		case e.IsDir() && !strings.HasSuffix(e.Name(), nameSuffix):
+			b.Legacy = true
+			sizePath = filepath.Join(b.Path, dbName)
+		case strings.HasSuffix(e.Name(), nameSuffix):
+		case strings.HasSuffix(e.Name(), nameSuffix+encryptedSuffix):
+			b.Encrypted = true
+		default:
+			continue
+		}
+
+		if info, err := os.Stat(sizePath); err == nil {
+			b.Size = info.Size()
+		}
+
+		backups = append(backups, b)
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+
+	return backups, nil
+}
+
+// Find the backup in dir called name. The extension is optional.
+func Find(dir string, name string) (*Backup, error) {
+	backups, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range backups {
+		b := &backups[i]
+		if b.Name == name || b.Name == name+nameSuffix || b.Name == name+nameSuffix+encryptedSuffix {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no backup named %s in %s", name, dir)
+}
+
+// Expired returns the backups that none of the rules in policy keep. backups
+// must be sorted newest first, as returned by List.
+func Expired(backups []Backup, policy config.BackupConfig) []Backup {
+	if policy.KeepLast <= 0 && policy.KeepDaily <= 0 && policy.KeepWeekly <= 0 {
+		return nil
+	}
+
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	var expired []Backup
+
+	for i, b := range backups {
+		keep := i < policy.KeepLast
+
+		// @note newest first, so the first backup seen on a day is the latest of that day
+		day := b.Time.Format("2006-01-02")
+		if !days[day] && len(days) < policy.KeepDaily {
+			days[day] = true
+			keep = true
+		}
+
+		year, w := b.Time.ISOWeek()
+		week := fmt.Sprintf("%d-%02d", year, w)
+		if !weeks[week] && len(weeks) < policy.KeepWeekly {
+			weeks[week] = true
+			keep = true
+		}
+
+		if !keep {
+			expired = append(expired, b)
+		}
+	}
+
+	return expired
+}
+
+// Rotate deletes the backups in dir that policy doesn't keep, and returns them
+func Rotate(dir string, policy config.BackupConfig) ([]Backup, error) {
+	backups, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := Expired(backups, policy)
+	for _, b := range expired {
+		err := os.RemoveAll(b.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, nil
+}
+
+// Restore replaces the database with the one in the backup called name, after
+// checking its integrity. The current database is kept next to it, and its new
+// path is returned. Empty if there was no database.
+//
+// If the backup has an encryption key file and there is none yet, e.g. when
+// restoring on a new machine, it is restored as well.
+func Restore(ctx context.Context, c *config.AppConfig, name string) (string, error) {
+	b, err := Find(c.BackupDir, name)
+	if err != nil {
+		return "", err
+	}
+
+	// A hot journal would be rolled back into the restored database the next time it's opened
+	for _, suffix := range []string{"-journal", "-wal"} {
+		if _, err := os.Stat(c.DBPath + suffix); err == nil {
+			return "", errors.New("the database is in use, stop any running browser-gopher commands and try again")
+		}
+	}
+
+	keyFile, err := backupKeyFile(c, b)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read "+b.Name)
+	}
+
+	// @note next to the database so the final rename can't cross file systems
+	tmp := c.DBPath + ".restore"
+	os.Remove(tmp)
+
+	err = extractDb(ctx, c, b, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", errors.Wrap(err, "could not read "+b.Name)
+	}
+
+	err = persistence.CheckIntegrity(ctx, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", errors.Wrap(err, b.Name+" is damaged")
+	}
+
+	if keyFile != nil {
+		err = crypt.WriteKeyFile(keyPath(c), keyFile)
+		if err != nil {
+			os.Remove(tmp)
+			return "", errors.Wrap(err, "could not restore the encryption key")
+		}
+	}
+
+	var previous string
+	if _, err := os.Stat(c.DBPath); err == nil {
+		previous = c.DBPath + ".before-restore-" + time.Now().Format(timeLayout)
+		err = os.Rename(c.DBPath, previous)
+		if err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+
+	return previous, os.Rename(tmp, c.DBPath)
+}
+
+// The key file in b, if it needs to be restored. Errors if it differs from
+// the current one, since the restored database would then be unreadable.
+func backupKeyFile(c *config.AppConfig, b *Backup) (*crypt.KeyFile, error) {
+	if b.Legacy {
+		return nil, nil
+	}
+
+	var bs []byte
+	err := readArchive(c, b, func(name string, r io.Reader) error {
+		if name != keyName {
+			return nil
+		}
+
+		var err error
+		bs, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil || bs == nil {
+		return nil, err
+	}
+
+	current, err := crypt.ReadKeyFile(keyPath(c))
+	if errors.Is(err, os.ErrNotExist) {
+		kf := &crypt.KeyFile{}
+		return kf, json.Unmarshal(bs, kf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	kf := &crypt.KeyFile{}
+	err = json.Unmarshal(bs, kf)
+	if err != nil {
+		return nil, err
+	}
+
+	if !current.Same(kf) {
+		return nil, errors.New("the backup was made with a different encryption key than the current one at " + keyPath(c))
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,154 @@
+package backup_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/backup"
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/crypt"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateAndRestore(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	conf := &config.AppConfig{
+		AppDataPath: tmp,
+		DBPath:      filepath.Join(tmp, "db.sqlite"),
+		BackupDir:   filepath.Join(tmp, "backups"),
+	}
+	require.NoError(t, os.Mkdir(conf.BackupDir, 0755))
+
+	store, err := persistence.OpenStore(ctx, conf)
+	require.NoError(t, err)
+	require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: "https://go.dev"}))
+
+	// @note while the store is still open, like populate would be
+	b, err := backup.Create(ctx, conf)
+	require.NoError(t, err)
+	require.NoError(t, backup.Verify(ctx, conf, b))
+
+	require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: "https://rust-lang.org"}))
+	require.NoError(t, store.Close())
+
+	backups, err := backup.List(conf.BackupDir)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	require.Equal(t, b.Name, backups[0].Name)
+
+	previous, err := backup.Restore(ctx, conf, b.Name[:len(b.Name)-len(".tar.gz")])
+	require.NoError(t, err)
+	require.FileExists(t, previous)
+
+	store, err = persistence.OpenStore(ctx, conf)
+	require.NoError(t, err)
+	defer store.Close()
+
+	urls, err := store.UrlsById(ctx, util.HashMd5String("https://go.dev"), util.HashMd5String("https://rust-lang.org"))
+	require.NoError(t, err)
+	require.Len(t, urls, 1, "only what was in the database at the time of the backup")
+	require.Equal(t, "https://go.dev", urls[0].Url)
+}
+
+func TestExpired(t *testing.T) {
+	at := func(s string) backup.Backup {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return backup.Backup{Name: s, Time: t}
+	}
+
+	// Newest first. 2022-10-31 is a Monday.
+	backups := []backup.Backup{
+		at("2022-11-02 18:00"),
+		at("2022-11-02 09:00"),
+		at("2022-11-01 18:00"),
+		at("2022-11-01 09:00"),
+		at("2022-10-31 09:00"),
+		at("2022-10-30 09:00"),
+		at("2022-10-23 09:00"),
+		at("2022-10-16 09:00"),
+	}
+
+	names := func(xs []backup.Backup) []string {
+		var names []string
+		for _, b := range xs {
+			names = append(names, b.Name)
+		}
+		return names
+	}
+
+	require.Empty(t, backup.Expired(backups, config.BackupConfig{}), "no policy keeps everything")
+
+	require.Equal(t, names(backups[2:]), names(backup.Expired(backups, config.BackupConfig{KeepLast: 2})))
+
+	require.Equal(t,
+		[]string{"2022-11-02 09:00", "2022-11-01 09:00", "2022-10-30 09:00", "2022-10-23 09:00", "2022-10-16 09:00"},
+		names(backup.Expired(backups, config.BackupConfig{KeepDaily: 3})),
+	)
+
+	require.Equal(t,
+		[]string{"2022-11-02 09:00", "2022-11-01 18:00", "2022-11-01 09:00", "2022-10-31 09:00", "2022-10-16 09:00"},
+		names(backup.Expired(backups, config.BackupConfig{KeepWeekly: 3})),
+	)
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	ctx := context.Background()
+	newConfig := func() *config.AppConfig {
+		tmp := t.TempDir()
+		c := &config.AppConfig{
+			AppDataPath: tmp,
+			DBPath:      filepath.Join(tmp, "db.sqlite"),
+			BackupDir:   filepath.Join(tmp, "backups"),
+			Keyring: crypt.NewKeyring(filepath.Join(tmp, "key.json"), func() (string, error) {
+				return "hunter2", nil
+			}),
+		}
+		c.Encryption.Enabled = true
+		require.NoError(t, os.Mkdir(c.BackupDir, 0755))
+		return c
+	}
+
+	conf := newConfig()
+	require.NoError(t, conf.Keyring.Create("hunter2"))
+
+	store, err := persistence.OpenStore(ctx, conf)
+	require.NoError(t, err)
+	require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: "https://go.dev"}))
+	require.NoError(t, store.Close())
+
+	b, err := backup.Create(ctx, conf)
+	require.NoError(t, err)
+	require.True(t, b.Encrypted)
+	require.True(t, strings.HasSuffix(b.Name, ".tar.gz.enc"))
+
+	raw, err := os.ReadFile(b.Path)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), "SQLite format")
+
+	// A new machine, with only the backup and the passphrase
+	other := newConfig()
+	require.NoError(t, os.Rename(b.Path, filepath.Join(other.BackupDir, b.Name)))
+
+	_, err = backup.Restore(ctx, other, b.Name)
+	require.NoError(t, err)
+	require.True(t, other.Keyring.Exists(), "the key is restored along with the database")
+
+	store, err = persistence.OpenStore(ctx, other)
+	require.NoError(t, err)
+	defer store.Close()
+
+	urls, err := store.UrlsById(ctx, util.HashMd5String("https://go.dev"))
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+}
@@ -0,0 +1,297 @@
+// Package chunk splits the markdown full-text of pages into the chunks that
+// are indexed and searched, along the structure of the document.
+package chunk
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	stripmd "github.com/writeas/go-strip-markdown"
+)
+
+const (
+	// Chunks are filled with whole paragraphs, lists and code blocks up to
+	// about this many characters. Longer ones are split at line breaks, or
+	// at spaces where a line is too long.
+	Size = 400
+	// About this many characters at the end of a chunk start the next one in
+	// the same section, so that text around the split can still be found
+	Overlap = 80
+)
+
+// Chunk is a part of a document, and the headings of the section it is in
+type Chunk struct {
+	// Plain text, without markdown. Code is kept as it is.
+	Text string
+	// The headings above the chunk, outermost first, e.g. [Installation Linux]
+	Section []string
+}
+
+// SectionPath is the section of the chunk as it is shown and stored, e.g.
+// "Installation > Linux", or empty outside of any section
+func (c Chunk) SectionPath() string {
+	return strings.Join(c.Section, " > ")
+}
+
+type blockKind int
+
+const (
+	paragraph blockKind = iota
+	heading
+	code
+	list
+)
+
+// A paragraph, heading, code block or list, as its markdown lines
+type block struct {
+	kind  blockKind
+	level int // of headings, 1 for #
+	lines []string
+}
+
+var (
+	fenceRe   = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	headingRe = regexp.MustCompile(`^ {0,3}(#{1,6})\s+(.+?)(?:\s+#+)?\s*$`)
+	setextRe  = regexp.MustCompile(`^ {0,3}(=+|-+)\s*$`)
+	listRe    = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+`)
+)
+
+// The blocks of a markdown document, in order
+func parse(body string) []block {
+	blocks := []block{}
+	var cur *block
+	flush := func() {
+		if cur != nil {
+			blocks = append(blocks, *cur)
+			cur = nil
+		}
+	}
+
+	var fence string
+	blank := false
+	for _, line := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		if fence != "" {
+			// @note a fence is closed by at least as many of the same character
+			if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+				fence = ""
+				flush()
+				continue
+			}
+			cur.lines = append(cur.lines, line)
+			continue
+		}
+
+		if m := fenceRe.FindStringSubmatch(line); m != nil {
+			flush()
+			fence = m[1]
+			cur = &block{kind: code}
+			blank = false
+			continue
+		}
+
+		if m := headingRe.FindStringSubmatch(line); m != nil {
+			flush()
+			blocks = append(blocks, block{kind: heading, level: len(m[1]), lines: []string{m[2]}})
+			blank = false
+			continue
+		}
+
+		if trimmed == "" {
+			blank = true
+			if cur != nil && cur.kind == paragraph {
+				flush()
+			}
+			continue
+		}
+
+		// A single line underlined with = or - is a heading
+		if cur != nil && cur.kind == paragraph && len(cur.lines) == 1 && setextRe.MatchString(line) {
+			cur.kind = heading
+			cur.level = 1
+			if strings.HasPrefix(trimmed, "-") {
+				cur.level = 2
+			}
+			flush()
+			continue
+		}
+
+		// @note items of a list stay together, along with the indented lines
+		// under them, even when there are blank lines between them
+		item := listRe.MatchString(line)
+		if cur != nil && cur.kind == list && (item || unicode.IsSpace(rune(line[0])) || !blank) {
+			cur.lines = append(cur.lines, line)
+			blank = false
+			continue
+		}
+		if item {
+			flush()
+			cur = &block{kind: list, lines: []string{line}}
+			blank = false
+			continue
+		}
+
+		if cur == nil || cur.kind != paragraph {
+			flush()
+			cur = &block{kind: paragraph}
+		}
+		cur.lines = append(cur.lines, line)
+		blank = false
+	}
+	flush()
+
+	return blocks
+}
+
+// The plain text of b
+func (b block) text() string {
+	md := strings.Join(b.lines, "\n")
+	if b.kind == code {
+		return strings.Trim(md, "\n")
+	}
+	return strings.TrimSpace(stripmd.Strip(md))
+}
+
+// Markdown splits a markdown document into chunks of about Size characters.
+// Chunks don't cross headings, and paragraphs, list items and code blocks are
+// only split when they are too long for a chunk of their own.
+func Markdown(body string) []Chunk {
+	b := &builder{}
+	levels := []int{}
+	for _, bl := range parse(body) {
+		text := bl.text()
+
+		if bl.kind == heading {
+			b.flush(false)
+			for len(levels) > 0 && levels[len(levels)-1] >= bl.level {
+				levels = levels[:len(levels)-1]
+				b.section = b.section[:len(b.section)-1]
+			}
+			if text == "" {
+				continue
+			}
+			levels = append(levels, bl.level)
+			b.section = append(b.section, text)
+		}
+
+		// @note headings are part of the text too, so that they can be
+		// searched for
+		for _, piece := range split(text) {
+			b.add(piece, bl.kind == heading)
+		}
+	}
+	b.flush(false)
+
+	return b.chunks
+}
+
+type builder struct {
+	chunks  []Chunk
+	section []string
+	text    string
+	// Whether text has more than what overlaps with the previous chunk
+	added bool
+	// Whether text ends with a heading, which stays with what comes after it
+	heading bool
+}
+
+func (b *builder) add(piece string, heading bool) {
+	if b.added && !b.heading && length(b.text)+1+length(piece) > Size {
+		b.flush(true)
+	}
+	if b.text != "" {
+		b.text += "\n"
+	}
+	b.text += piece
+	b.added = true
+	b.heading = heading
+}
+
+// End the current chunk, starting the next one with its tail if it is in the
+// same section
+func (b *builder) flush(overlap bool) {
+	if b.added {
+		b.chunks = append(b.chunks, Chunk{Text: b.text, Section: append([]string{}, b.section...)})
+	}
+
+	text := b.text
+	b.text = ""
+	b.added = false
+	b.heading = false
+	if overlap {
+		b.text = tail(text)
+	}
+}
+
+// About the last Overlap characters of text, from the start of a word, or
+// nothing if there are no words to start from
+func tail(text string) string {
+	n := length(text)
+	if n <= Overlap {
+		return ""
+	}
+
+	i := 0
+	for skip := n - Overlap; skip > 0; skip-- {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+	}
+	j := strings.IndexFunc(text[i:], unicode.IsSpace)
+	if j < 0 {
+		return ""
+	}
+	return strings.TrimSpace(text[i+j:])
+}
+
+// Split text longer than Size at line breaks, or at spaces where a line is too
+// long, into pieces that leave room for the overlap in a chunk. Words are never
+// split.
+func split(text string) []string {
+	if text == "" {
+		return nil
+	}
+	if length(text) <= Size {
+		return []string{text}
+	}
+
+	const max = Size - Overlap
+
+	pieces := []string{}
+	cur := ""
+	add := func(s string, sep string) {
+		if cur != "" && length(cur)+len(sep)+length(s) > max {
+			pieces = append(pieces, cur)
+			cur = ""
+		}
+		if cur != "" {
+			cur += sep
+		}
+		cur += s
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		if length(line) <= max {
+			add(line, "\n")
+			continue
+		}
+		for i, word := range strings.Fields(line) {
+			sep := " "
+			if i == 0 {
+				sep = "\n"
+			}
+			add(word, sep)
+		}
+	}
+	if strings.TrimSpace(cur) != "" {
+		pieces = append(pieces, cur)
+	}
+
+	return pieces
+}
+
+func length(s string) int {
+	return utf8.RuneCountInString(s)
+}
@@ -0,0 +1,82 @@
+package chunk_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/chunk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarkdown(t *testing.T) {
+	doc := `Gopher is a **command line** tool.
+
+# Installation
+
+Pick your platform.
+
+## Linux
+
+` + "```sh" + `
+curl -L https://example.com/install.sh
+
+sh install.sh
+` + "```" + `
+
+## macOS
+
+- Install [Homebrew](https://brew.sh)
+- Run the following:
+
+    brew install gopher
+
+Usage
+=====
+
+Run it.
+`
+
+	chunks := chunk.Markdown(doc)
+	sections := []string{}
+	for _, c := range chunks {
+		sections = append(sections, c.SectionPath())
+	}
+	require.Equal(t, []string{"", "Installation", "Installation > Linux", "Installation > macOS", "Usage"}, sections)
+
+	require.Equal(t, "Gopher is a command line tool.", chunks[0].Text, "markdown is removed")
+	require.Equal(t, "Installation\nPick your platform.", chunks[1].Text, "headings can be searched for")
+	require.Contains(t, chunks[2].Text, "curl -L https://example.com/install.sh\n\nsh install.sh", "code is kept as it is")
+	require.Contains(t, chunks[3].Text, "Homebrew")
+	require.Contains(t, chunks[3].Text, "brew install gopher", "indented lines are part of the list")
+	require.Equal(t, "Usage\nRun it.", chunks[4].Text)
+}
+
+func TestMarkdownLongText(t *testing.T) {
+	words := []string{}
+	for i := 0; i < 300; i++ {
+		words = append(words, "word")
+	}
+	paragraph := strings.Join(words, " ")
+
+	chunks := chunk.Markdown("# Long\n\n" + paragraph + "\n\n```\n" + strings.Repeat("x := 1\n", 40) + "```\n")
+	require.Greater(t, len(chunks), 3)
+
+	for i, c := range chunks {
+		require.LessOrEqual(t, len([]rune(c.Text)), chunk.Size)
+		require.Equal(t, "Long", c.SectionPath())
+		if i > 0 {
+			prev := chunks[i-1].Text
+			first := strings.Fields(c.Text)[0]
+			require.Contains(t, prev[len(prev)-chunk.Overlap:], first, "chunks overlap")
+		}
+	}
+
+	last := chunks[len(chunks)-1].Text
+	require.True(t, strings.HasSuffix(last, "x := 1"), "code is split at line breaks")
+	require.NotContains(t, last, "x := 1 x", "lines of code aren't joined")
+}
+
+func TestMarkdownEmpty(t *testing.T) {
+	require.Empty(t, chunk.Markdown(""))
+	require.Empty(t, chunk.Markdown("\n\n# \n\n"))
+}
@@ -0,0 +1,195 @@
+// Package crypt encrypts data with a key derived from a passphrase.
+//
+// The passphrase is never stored. A KeyFile holds what is needed to derive the
+// key again, the salt and argon2id parameters, along with a value encrypted
+// with the key so that a wrong passphrase can be told apart from damaged data.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// Prefix of strings encrypted with EncryptString. Anything without it is plaintext.
+const StringPrefix = "enc:v1:"
+
+// Plaintext of KeyFile.Check
+var checkValue = []byte("browser-gopher")
+
+type KeyFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+	Check   []byte `json:"check"`
+}
+
+type Key struct {
+	aead cipher.AEAD
+}
+
+// NewKeyFile creates the key for passphrase with a new random salt
+func NewKeyFile(passphrase string) (*KeyFile, *Key, error) {
+	kf := &KeyFile{
+		Version: 1,
+		Salt:    make([]byte, 16),
+		// The argon2id parameters recommended by RFC 9106 for memory constrained environments
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+	}
+
+	_, err := rand.Read(kf.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := kf.derive(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kf.Check, err = key.Seal(checkValue, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return kf, key, nil
+}
+
+func (kf *KeyFile) derive(passphrase string) (*Key, error) {
+	if passphrase == "" {
+		return nil, errors.New("the passphrase is empty")
+	}
+
+	block, err := aes.NewCipher(argon2.IDKey([]byte(passphrase), kf.Salt, kf.Time, kf.Memory, kf.Threads, 32))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{aead: aead}, nil
+}
+
+// Unlock derives the key from passphrase. Returns ErrWrongPassphrase if it
+// isn't the passphrase the key file was created with.
+func (kf *KeyFile) Unlock(passphrase string) (*Key, error) {
+	key, err := kf.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = key.Open(kf.Check, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	return key, nil
+}
+
+// Same reports whether both key files are for the same key
+func (kf *KeyFile) Same(other *KeyFile) bool {
+	return string(kf.Salt) == string(other.Salt) && string(kf.Check) == string(other.Check)
+}
+
+func ReadKeyFile(path string) (*KeyFile, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	kf := &KeyFile{}
+	return kf, json.Unmarshal(bs, kf)
+}
+
+func WriteKeyFile(path string, kf *KeyFile) error {
+	bs, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// @note O_EXCL, overwriting the key file would make everything encrypted with it unreadable
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(bs)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Seal encrypts plaintext. The nonce is prepended to the result. ad is
+// authenticated but not encrypted, and must be passed to Open as well.
+func (k *Key) Seal(plaintext []byte, ad []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(plaintext)+k.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func (k *Key) Open(sealed []byte, ad []byte) ([]byte, error) {
+	if len(sealed) < k.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// IsEncrypted reports whether s was returned by EncryptString
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, StringPrefix)
+}
+
+// EncryptString encrypts s into a string that can be stored in a text column
+func (k *Key) EncryptString(s string) (string, error) {
+	sealed, err := k.Seal([]byte(s), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return StringPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptString reverses EncryptString. Strings that aren't encrypted are
+// returned as they are.
+func (k *Key) DecryptString(s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(s, StringPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := k.Open(sealed, nil)
+	if err != nil {
+		return "", errors.New("could not decrypt, it may have been encrypted with another key")
+	}
+
+	return string(plaintext), nil
+}
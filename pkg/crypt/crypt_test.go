@@ -0,0 +1,101 @@
+package crypt_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/crypt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptString(t *testing.T) {
+	kf, key, err := crypt.NewKeyFile("hunter2")
+	require.NoError(t, err)
+
+	encrypted, err := key.EncryptString("some page text")
+	require.NoError(t, err)
+	require.True(t, crypt.IsEncrypted(encrypted))
+	require.NotContains(t, encrypted, "page")
+
+	unlocked, err := kf.Unlock("hunter2")
+	require.NoError(t, err)
+
+	plaintext, err := unlocked.DecryptString(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, "some page text", plaintext)
+
+	plaintext, err = unlocked.DecryptString("not encrypted")
+	require.NoError(t, err)
+	require.Equal(t, "not encrypted", plaintext)
+
+	_, err = kf.Unlock("hunter3")
+	require.ErrorIs(t, err, crypt.ErrWrongPassphrase)
+}
+
+func TestStream(t *testing.T) {
+	kf, key, err := crypt.NewKeyFile("hunter2")
+	require.NoError(t, err)
+
+	// Several chunks, the last of them short
+	data := []byte(strings.Repeat("browser history ", 20000))
+
+	var buf bytes.Buffer
+	w, err := crypt.NewWriter(&buf, kf, key)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.False(t, bytes.Contains(buf.Bytes(), []byte("browser history")))
+
+	read := func(bs []byte) ([]byte, error) {
+		r := bufio.NewReader(bytes.NewReader(bs))
+		require.True(t, crypt.IsEncryptedStream(r))
+
+		header, err := crypt.ReadKeyFileHeader(r)
+		require.NoError(t, err)
+		require.True(t, header.Same(kf))
+
+		return io.ReadAll(crypt.NewReader(r, key))
+	}
+
+	decrypted, err := read(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, data, decrypted)
+
+	_, err = read(buf.Bytes()[:buf.Len()-100])
+	require.Error(t, err, "truncated")
+
+	tampered := append([]byte{}, buf.Bytes()...)
+	tampered[len(tampered)/2] ^= 1
+	_, err = read(tampered)
+	require.Error(t, err, "tampered")
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.json")
+	prompts := 0
+	passphrase := func() (string, error) {
+		prompts++
+		return "hunter2", nil
+	}
+	keyring := crypt.NewKeyring(path, passphrase)
+
+	require.False(t, keyring.Exists())
+	_, err := keyring.Key()
+	require.Error(t, err)
+
+	require.NoError(t, keyring.Create("hunter2"))
+	require.Error(t, keyring.Create("hunter2"), "never overwrite an existing key")
+
+	// A fresh keyring, as in the next run of the program
+	keyring = crypt.NewKeyring(path, passphrase)
+	_, err = keyring.Key()
+	require.NoError(t, err)
+	_, err = keyring.Key()
+	require.NoError(t, err)
+	require.Equal(t, 1, prompts, "the key is kept once unlocked")
+}
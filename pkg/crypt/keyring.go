@@ -0,0 +1,173 @@
+package crypt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// PassphraseEnv can be set to provide the passphrase non-interactively, e.g. when
+// running populate from cron
+const PassphraseEnv = "BROWSER_GOPHER_PASSPHRASE"
+
+// Keyring unlocks the key in a key file the first time it is needed, asking
+// for the passphrase, and keeps it in memory for the rest of the process.
+type Keyring struct {
+	path       string
+	passphrase func() (string, error)
+
+	lock sync.Mutex
+	kf   *KeyFile
+	key  *Key
+}
+
+// NewKeyring returns a keyring for the key file at path. passphrase is called
+// when a key needs to be unlocked.
+func NewKeyring(path string, passphrase func() (string, error)) *Keyring {
+	return &Keyring{path: path, passphrase: passphrase}
+}
+
+func (k *Keyring) Path() string {
+	return k.path
+}
+
+// Exists reports whether the key file has been created
+func (k *Keyring) Exists() bool {
+	_, err := os.Stat(k.path)
+	return err == nil
+}
+
+// Create makes a new key file for passphrase, and unlocks it
+func (k *Keyring) Create(passphrase string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	kf, key, err := NewKeyFile(passphrase)
+	if err != nil {
+		return err
+	}
+
+	err = WriteKeyFile(k.path, kf)
+	if err != nil {
+		return err
+	}
+
+	k.kf, k.key = kf, key
+	return nil
+}
+
+// KeyFile returns the key file, without unlocking it
+func (k *Keyring) KeyFile() (*KeyFile, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.keyFile()
+}
+
+func (k *Keyring) keyFile() (*KeyFile, error) {
+	if k.kf != nil {
+		return k.kf, nil
+	}
+
+	kf, err := ReadKeyFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no encryption key at %s, run the encrypt command to create one", k.path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k.kf = kf
+	return kf, nil
+}
+
+// Key returns the unlocked key of the key file
+func (k *Keyring) Key() (*Key, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.key != nil {
+		return k.key, nil
+	}
+
+	kf, err := k.keyFile()
+	if err != nil {
+		return nil, err
+	}
+
+	k.key, err = k.unlock(kf)
+	return k.key, err
+}
+
+// KeyFor returns the key for kf, which may be a different key file than the
+// keyring's own, e.g. the one a backup was made with.
+func (k *Keyring) KeyFor(kf *KeyFile) (*Key, error) {
+	own, err := k.KeyFile()
+	if err == nil && own.Same(kf) {
+		return k.Key()
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	return k.unlock(kf)
+}
+
+func (k *Keyring) unlock(kf *KeyFile) (*Key, error) {
+	passphrase, err := k.passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	return kf.Unlock(passphrase)
+}
+
+// PromptPassphrase reads the passphrase from PassphraseEnv, or else asks for it
+// on the terminal.
+func PromptPassphrase() (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("a passphrase is needed, set %s when not running in a terminal", PassphraseEnv)
+	}
+
+	// @note stderr, so the prompt doesn't end up in piped output
+	fmt.Fprint(os.Stderr, "Passphrase: ")
+	bs, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bs), nil
+}
+
+// PromptNewPassphrase is PromptPassphrase, but asks twice to rule out typos
+func PromptNewPassphrase() (string, error) {
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	passphrase, err := PromptPassphrase()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat passphrase: ")
+	bs, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(bs) != passphrase {
+		return "", errors.New("the passphrases do not match")
+	}
+
+	return passphrase, nil
+}
@@ -0,0 +1,212 @@
+package crypt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Encrypted streams start with the magic bytes and the key file of the key
+// they were encrypted with, so that they can be decrypted with nothing but the
+// passphrase. The data follows in chunks, each sealed with its index and
+// whether it is the last, so chunks can't be reordered, dropped or truncated
+// without Read returning an error:
+//
+//	magic | uint32 length | key file json | (uint32 length | sealed chunk)...
+var magic = []byte("BGCRYPT1")
+
+const chunkSize = 64 * 1024
+
+// IsEncryptedStream reports whether r starts with the magic bytes of a stream
+// written by NewWriter, without consuming them.
+func IsEncryptedStream(r *bufio.Reader) bool {
+	bs, err := r.Peek(len(magic))
+	return err == nil && bytes.Equal(bs, magic)
+}
+
+type writer struct {
+	w     io.Writer
+	key   *Key
+	buf   []byte
+	index uint64
+}
+
+// NewWriter returns a writer that encrypts everything written to it with key
+// and writes it to w. Close must be called to write the last chunk. It does
+// not close w.
+func NewWriter(w io.Writer, kf *KeyFile, key *Key) (io.WriteCloser, error) {
+	header, err := json.Marshal(kf)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(magic)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFrame(w, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{w: w, key: key, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func writeFrame(w io.Writer, bs []byte) error {
+	err := binary.Write(w, binary.BigEndian, uint32(len(bs)))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(bs)
+	return err
+}
+
+func chunkAd(index uint64, last bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, index)
+	if last {
+		ad[8] = 1
+	}
+	return ad
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		if len(w.buf) == chunkSize {
+			err := w.flush(false)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		take := chunkSize - len(w.buf)
+		if take > len(p) {
+			take = len(p)
+		}
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+	}
+
+	return n, nil
+}
+
+func (w *writer) flush(last bool) error {
+	sealed, err := w.key.Seal(w.buf, chunkAd(w.index, last))
+	if err != nil {
+		return err
+	}
+
+	w.index++
+	w.buf = w.buf[:0]
+
+	return writeFrame(w.w, sealed)
+}
+
+// @note the last chunk is written even if it is empty, that's how the reader
+// knows the stream wasn't cut short
+func (w *writer) Close() error {
+	return w.flush(true)
+}
+
+type reader struct {
+	r     *bufio.Reader
+	key   *Key
+	buf   []byte
+	index uint64
+	done  bool
+}
+
+// ReadKeyFileHeader reads the key file at the start of a stream written by
+// NewWriter. Pass it, and the key it describes, to NewReader.
+func ReadKeyFileHeader(r *bufio.Reader) (*KeyFile, error) {
+	bs := make([]byte, len(magic))
+	_, err := io.ReadFull(r, bs)
+	if err != nil || !bytes.Equal(bs, magic) {
+		return nil, errors.New("not an encrypted file")
+	}
+
+	header, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	kf := &KeyFile{}
+	return kf, json.Unmarshal(header, kf)
+}
+
+// NewReader decrypts the rest of a stream after ReadKeyFileHeader
+func NewReader(r *bufio.Reader, key *Key) io.Reader {
+	return &reader{r: r, key: key}
+}
+
+// @note the largest frame is a full chunk plus the nonce and tag, anything
+// bigger means the data is damaged
+const maxFrame = chunkSize + 1024
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var n uint32
+	err := binary.Read(r, binary.BigEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrame {
+		return nil, errors.New("damaged encrypted file")
+	}
+
+	bs := make([]byte, n)
+	_, err = io.ReadFull(r, bs)
+	return bs, err
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		err := r.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) next() error {
+	sealed, err := readFrame(r.r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("encrypted file is truncated")
+	}
+	if err != nil {
+		return err
+	}
+
+	// @note the only way to tell the last chunk apart is that it opens with the last flag set
+	if plaintext, err := r.key.Open(sealed, chunkAd(r.index, true)); err == nil {
+		r.buf = plaintext
+		r.done = true
+		if _, err := r.r.Peek(1); err != io.EOF {
+			return errors.New("unexpected data after the end of the encrypted file")
+		}
+		return nil
+	}
+
+	plaintext, err := r.key.Open(sealed, chunkAd(r.index, false))
+	if err != nil {
+		return errors.New("could not decrypt, the file is damaged or was encrypted with another key")
+	}
+
+	r.index++
+	r.buf = plaintext
+	return nil
+}
@@ -0,0 +1,236 @@
+// Package dbsync shares history between machines through a directory that is
+// kept in sync by something else, e.g. Syncthing or Dropbox. No server needed.
+//
+// Every machine writes changesets to its own subdirectory and reads the
+// changesets of every other machine:
+//
+//	<dir>/
+//	  laptop/
+//	    state.json
+//	    1667001600000000000.sqlite
+//	  desktop/
+//	    state.json
+//	    1667005200000000000.sqlite
+//
+// A changeset is a browser-gopher database containing only what changed since
+// the previous one. Since every file is only ever written by one machine the
+// sync tool never has to resolve conflicts.
+package dbsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/pkg/errors"
+)
+
+type state struct {
+	// How far the last changeset written by this machine went
+	Exported persistence.ChangesetMarks `json:"exported"`
+	// Changesets from other machines that have been merged, relative to the sync dir
+	Imported []string `json:"imported"`
+}
+
+type Report struct {
+	Exported string   // Path of the changeset written, if there were any changes
+	Imported []string // Changesets merged from other machines
+	Merge    persistence.MergeReport
+}
+
+type Options struct {
+	Dir  string // The shared directory
+	Name string // This machine's subdirectory. Defaults to the hostname.
+	// Write everything, rather than only what changed. Useful if the local
+	// database was replaced, e.g. restored from a backup.
+	Full bool
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// MachineName is the default name of this machine's subdirectory
+func MachineName() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	return unsafeNameChars.ReplaceAllString(strings.TrimSuffix(hostname, ".local"), "-"), nil
+}
+
+func statePath(machineDir string) string {
+	return filepath.Join(machineDir, "state.json")
+}
+
+func loadState(machineDir string) (*state, error) {
+	s := &state{}
+	bs, err := os.ReadFile(statePath(machineDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s, json.Unmarshal(bs, s)
+}
+
+// Write via a temp file, so the sync tool never sees a partial file
+func saveState(machineDir string, s *state) error {
+	bs, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := statePath(machineDir) + ".tmp"
+	err = os.WriteFile(tmp, bs, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, statePath(machineDir))
+}
+
+// Sync writes a changeset of local changes to the shared directory, then merges
+// every changeset from other machines that has not been merged yet. dbPath is
+// the local sqlite database that store was opened on.
+func Sync(ctx context.Context, store persistence.Store, dbPath string, opts Options) (*Report, error) {
+	name := opts.Name
+	if name == "" {
+		var err error
+		name, err = MachineName()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get hostname")
+		}
+	}
+
+	machineDir := filepath.Join(opts.Dir, name)
+	err := os.MkdirAll(machineDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := loadState(machineDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read "+statePath(machineDir))
+	}
+
+	if opts.Full {
+		s.Exported = persistence.ChangesetMarks{}
+	}
+
+	report := &Report{}
+
+	// @note export before importing, so that what we import isn't written
+	// straight back out as a local change
+	report.Exported, err = exportChangeset(ctx, dbPath, machineDir, s)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not write changeset")
+	}
+
+	err = saveState(machineDir, s)
+	if err != nil {
+		return nil, err
+	}
+
+	changesets, err := pendingChangesets(opts.Dir, name, s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rel := range changesets {
+		db, cleanup, err := persistence.OpenSnapshot(ctx, filepath.Join(opts.Dir, rel))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open "+rel)
+		}
+
+		merged, err := persistence.Merge(ctx, store, db)
+		if err != nil {
+			cleanup()
+			return nil, errors.Wrap(err, "could not merge "+rel)
+		}
+
+		// Skip over the rows just imported. They came from the other machine
+		// so there is no need to send them back.
+		marks, err := persistence.ImportedMarks(ctx, dbPath, db, s.Exported)
+		cleanup()
+		if err != nil {
+			return nil, err
+		}
+		s.Exported = *marks
+
+		report.Merge.Add(merged)
+		report.Imported = append(report.Imported, rel)
+		s.Imported = append(s.Imported, rel)
+	}
+
+	return report, saveState(machineDir, s)
+}
+
+// Write a changeset if anything changed since the last one, and advance the
+// marks in s. Returns the path of the changeset.
+func exportChangeset(ctx context.Context, dbPath string, machineDir string, s *state) (string, error) {
+	name := fmt.Sprintf("%d.sqlite", time.Now().UnixNano())
+	path := filepath.Join(machineDir, name)
+	tmp := filepath.Join(machineDir, "."+name+".tmp")
+
+	marks, n, err := persistence.ExportChangeset(ctx, dbPath, tmp, s.Exported)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	s.Exported = *marks
+
+	if n == 0 {
+		return "", os.Remove(tmp)
+	}
+
+	return path, os.Rename(tmp, path)
+}
+
+// Changesets written by other machines that have not been merged, oldest first
+func pendingChangesets(dir string, name string, s *state) ([]string, error) {
+	imported := map[string]bool{}
+	for _, rel := range s.Imported {
+		imported[rel] = true
+	}
+
+	machines, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []string
+
+	for _, m := range machines {
+		if !m.IsDir() || m.Name() == name || strings.HasPrefix(m.Name(), ".") {
+			continue
+		}
+
+		files, err := os.ReadDir(filepath.Join(dir, m.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			rel := filepath.Join(m.Name(), f.Name())
+			if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".sqlite") || imported[rel] {
+				continue
+			}
+			pending = append(pending, rel)
+		}
+	}
+
+	// @note names are unix timestamps, so this is oldest first within each machine
+	sort.Strings(pending)
+
+	return pending, nil
+}
@@ -0,0 +1,132 @@
+package dbsync_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/dbsync"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func openStore(t *testing.T, path string) persistence.Store {
+	store, err := persistence.OpenStore(context.Background(), &config.AppConfig{DBPath: path})
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func visit(t *testing.T, store persistence.Store, url string, ts int64) {
+	ctx := context.Background()
+	at := time.Unix(ts, 0)
+	require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, LastVisit: &at}))
+	require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: at, ExtractorName: "chrome"}))
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	shared := filepath.Join(tmp, "shared")
+	require.NoError(t, os.Mkdir(shared, 0755))
+
+	laptopPath := filepath.Join(tmp, "laptop.sqlite")
+	desktopPath := filepath.Join(tmp, "desktop.sqlite")
+	laptop := openStore(t, laptopPath)
+	desktop := openStore(t, desktopPath)
+
+	visit(t, laptop, "https://go.dev", 1000)
+	visit(t, desktop, "https://rust-lang.org", 2000)
+
+	report, err := dbsync.Sync(ctx, laptop, laptopPath, dbsync.Options{Dir: shared, Name: "laptop"})
+	require.NoError(t, err)
+	require.NotEmpty(t, report.Exported)
+	require.Empty(t, report.Imported)
+
+	report, err = dbsync.Sync(ctx, desktop, desktopPath, dbsync.Options{Dir: shared, Name: "desktop"})
+	require.NoError(t, err)
+	require.NotEmpty(t, report.Exported)
+	require.Len(t, report.Imported, 1)
+	require.Equal(t, 1, report.Merge.NewUrls)
+
+	report, err = dbsync.Sync(ctx, laptop, laptopPath, dbsync.Options{Dir: shared, Name: "laptop"})
+	require.NoError(t, err)
+	require.Empty(t, report.Exported, "nothing changed locally since the last sync")
+	require.Len(t, report.Imported, 1)
+	require.Equal(t, 1, report.Merge.NewUrls, "only the desktop's own url, not the one it got from the laptop")
+
+	// Only new visits are sent
+	visit(t, laptop, "https://go.dev", 3000)
+
+	report, err = dbsync.Sync(ctx, laptop, laptopPath, dbsync.Options{Dir: shared, Name: "laptop"})
+	require.NoError(t, err)
+	require.NotEmpty(t, report.Exported)
+
+	report, err = dbsync.Sync(ctx, desktop, desktopPath, dbsync.Options{Dir: shared, Name: "desktop"})
+	require.NoError(t, err)
+	require.Len(t, report.Imported, 1)
+	require.Equal(t, persistence.MergeReport{Urls: 1, NewVisits: 1}, report.Merge)
+
+	for _, store := range []persistence.Store{laptop, desktop} {
+		urls, count, err := store.RecentUrls(ctx, 10, 0)
+		require.NoError(t, err)
+		require.Equal(t, uint(2), count)
+		require.Equal(t, "https://go.dev", urls[0].Url)
+		require.Equal(t, 2, urls[0].VisitCount)
+	}
+}
+
+// Visits a url locally the first time a url is merged into it, as if populate
+// ran while syncing
+type populatingStore struct {
+	persistence.Store
+	t       *testing.T
+	visited bool
+}
+
+func (s *populatingStore) InsertUrl(ctx context.Context, row *types.UrlRow) error {
+	err := s.Store.InsertUrl(ctx, row)
+	if err == nil && !s.visited {
+		s.visited = true
+		visit(s.t, s.Store, "https://zig.dev", 4000)
+	}
+	return err
+}
+
+func TestSyncWhileWritingLocally(t *testing.T) {
+	ctx := context.Background()
+	tmp := t.TempDir()
+	shared := filepath.Join(tmp, "shared")
+	require.NoError(t, os.Mkdir(shared, 0755))
+
+	laptopPath := filepath.Join(tmp, "laptop.sqlite")
+	desktopPath := filepath.Join(tmp, "desktop.sqlite")
+	laptop := openStore(t, laptopPath)
+	desktop := openStore(t, desktopPath)
+
+	visit(t, laptop, "https://go.dev", 1000)
+	_, err := dbsync.Sync(ctx, laptop, laptopPath, dbsync.Options{Dir: shared, Name: "laptop"})
+	require.NoError(t, err)
+
+	report, err := dbsync.Sync(ctx, &populatingStore{Store: desktop, t: t}, desktopPath, dbsync.Options{Dir: shared, Name: "desktop"})
+	require.NoError(t, err)
+	require.Empty(t, report.Exported)
+	require.Len(t, report.Imported, 1)
+
+	report, err = dbsync.Sync(ctx, desktop, desktopPath, dbsync.Options{Dir: shared, Name: "desktop"})
+	require.NoError(t, err)
+	require.NotEmpty(t, report.Exported, "what was written locally while merging is still exported")
+
+	report, err = dbsync.Sync(ctx, laptop, laptopPath, dbsync.Options{Dir: shared, Name: "laptop"})
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Merge.NewUrls)
+
+	urls, count, err := laptop.RecentUrls(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), count)
+	require.Equal(t, "https://zig.dev", urls[0].Url)
+}
@@ -3,9 +3,13 @@ package extractors
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/iansinnott/browser-gopher/pkg/logging"
@@ -40,8 +44,13 @@ ORDER BY
 type ChromiumExtractor struct {
 	Name          string
 	HistoryDBPath string
+	// The Bookmarks file of the profile. Defaults to the one next to HistoryDBPath.
+	BookmarksPath string
 }
 
+// Compile time check that bookmarks are imported from chromium browsers
+var _ types.BookmarkExtractor = (*ChromiumExtractor)(nil)
+
 func (a *ChromiumExtractor) GetName() string {
 	return a.Name
 }
@@ -50,10 +59,20 @@ func (a *ChromiumExtractor) GetDBPath() string {
 	return a.HistoryDBPath
 }
 
+// @note the Bookmarks file stays next to the original history db when populate
+// switches to a copy of a locked one
 func (a *ChromiumExtractor) SetDBPath(s string) {
+	a.BookmarksPath = a.bookmarksPath()
 	a.HistoryDBPath = s
 }
 
+func (a *ChromiumExtractor) bookmarksPath() string {
+	if a.BookmarksPath != "" {
+		return a.BookmarksPath
+	}
+	return filepath.Join(filepath.Dir(a.HistoryDBPath), "Bookmarks")
+}
+
 func (a *ChromiumExtractor) VerifyConnection(ctx context.Context, conn *sql.DB) (bool, error) {
 	row := conn.QueryRowContext(ctx, "SELECT count(*) FROM urls;")
 	err := row.Err()
@@ -139,6 +158,68 @@ func (a *ChromiumExtractor) GetAllVisitsSince(ctx context.Context, conn *sql.DB,
 	return visits, nil
 }
 
+// A folder or bookmark in the Bookmarks file, which is json
+type chromiumBookmarkNode struct {
+	Type string `json:"type"` // url or folder
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// Microseconds since 1601-01-01, as a string
+	DateAdded string                 `json:"date_added"`
+	Children  []chromiumBookmarkNode `json:"children"`
+}
+
+// Seconds from 1601-01-01, the epoch of chromium timestamps, to 1970-01-01
+const chromiumEpochOffset = 11644473600
+
+// @note bookmarks aren't in the history db, conn is unused
+func (a *ChromiumExtractor) GetBookmarks(ctx context.Context, conn *sql.DB) ([]types.BookmarkRow, error) {
+	data, err := os.ReadFile(a.bookmarksPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing has been bookmarked in this profile
+		return []types.BookmarkRow{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Roots map[string]json.RawMessage `json:"roots"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", a.bookmarksPath(), err)
+	}
+
+	bookmarks := []types.BookmarkRow{}
+	var walk func(n chromiumBookmarkNode)
+	walk = func(n chromiumBookmarkNode) {
+		if n.Type == "url" && n.Url != "" {
+			x := types.BookmarkRow{Url: n.Url, ExtractorName: a.Name}
+			if n.Name != "" {
+				x.Title = &n.Name
+			}
+			if us, err := strconv.ParseInt(n.DateAdded, 10, 64); err == nil && us > 0 {
+				t := time.UnixMicro(us - chromiumEpochOffset*1e6)
+				x.AddedAt = &t
+			}
+			bookmarks = append(bookmarks, x)
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+
+	// @note roots also has entries that aren't folders, e.g. sync_transaction_version
+	for _, raw := range file.Roots {
+		var root chromiumBookmarkNode
+		if json.Unmarshal(raw, &root) == nil {
+			walk(root)
+		}
+	}
+
+	return bookmarks, nil
+}
+
 func FindChromiumDBs(root string) ([]string, error) {
 	results := []string{}
 
@@ -0,0 +1,57 @@
+package extractors_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/extractors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChromiumBookmarks(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "Bookmarks"), []byte(`{
+  "checksum": "abc",
+  "roots": {
+    "bookmark_bar": {
+      "type": "folder",
+      "name": "Bookmarks bar",
+      "children": [
+        {"type": "url", "name": "The Go Blog", "url": "https://go.dev/blog", "date_added": "13300000000000000"},
+        {"type": "folder", "name": "Docs", "children": [
+          {"type": "url", "name": "", "url": "https://pkg.go.dev"}
+        ]}
+      ]
+    },
+    "other": {"type": "folder", "name": "Other bookmarks", "children": []},
+    "sync_transaction_version": "1"
+  },
+  "version": 1
+}`), 0644)
+	require.NoError(t, err)
+
+	extractor := &extractors.ChromiumExtractor{Name: "chrome", HistoryDBPath: filepath.Join(dir, "History")}
+	// As populate does when the history db is locked
+	extractor.SetDBPath(filepath.Join(t.TempDir(), "chrome_backup.sqlite"))
+
+	bookmarks, err := extractor.GetBookmarks(context.Background(), nil)
+	require.NoError(t, err)
+	require.Len(t, bookmarks, 2)
+
+	require.Equal(t, "https://go.dev/blog", bookmarks[0].Url)
+	require.Equal(t, "The Go Blog", *bookmarks[0].Title)
+	require.Equal(t, "chrome", bookmarks[0].ExtractorName)
+	require.Equal(t, time.Date(2022, 6, 18, 4, 26, 40, 0, time.UTC), bookmarks[0].AddedAt.UTC())
+
+	require.Equal(t, "https://pkg.go.dev", bookmarks[1].Url, "folders are walked")
+	require.Nil(t, bookmarks[1].Title)
+	require.Nil(t, bookmarks[1].AddedAt)
+
+	none := &extractors.ChromiumExtractor{Name: "chrome", HistoryDBPath: filepath.Join(t.TempDir(), "History")}
+	bookmarks, err = none.GetBookmarks(context.Background(), nil)
+	require.NoError(t, err)
+	require.Empty(t, bookmarks, "profiles without bookmarks have no Bookmarks file")
+}
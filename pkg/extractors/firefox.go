@@ -17,6 +17,9 @@ type FirefoxExtractor struct {
 	HistoryDBPath string
 }
 
+// Compile time check that bookmarks are imported from firefox
+var _ types.BookmarkExtractor = (*FirefoxExtractor)(nil)
+
 const firefoxUrls = `
 SELECT
 	url,
@@ -44,6 +47,21 @@ ORDER BY
 ;
 `
 
+// @note type 1 is a bookmark rather than a folder or separator, and place:
+// urls are saved searches like "Recently Bookmarked"
+const firefoxBookmarks = `
+SELECT
+  u.url,
+  b.title,
+  b.dateAdded
+FROM
+  moz_bookmarks b
+  INNER JOIN moz_places u ON b.fk = u.id
+WHERE
+  b.type = 1
+  AND u.url NOT LIKE 'place:%';
+`
+
 func (a *FirefoxExtractor) GetName() string {
 	return a.Name
 }
@@ -139,6 +157,41 @@ func (a *FirefoxExtractor) GetAllVisitsSince(ctx context.Context, conn *sql.DB,
 	return visits, nil
 }
 
+func (a *FirefoxExtractor) GetBookmarks(ctx context.Context, conn *sql.DB) ([]types.BookmarkRow, error) {
+	rows, err := conn.QueryContext(ctx, firefoxBookmarks)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookmarks := []types.BookmarkRow{}
+
+	for rows.Next() {
+		x := types.BookmarkRow{ExtractorName: a.Name}
+		var dateAdded sql.NullInt64
+		err = rows.Scan(&x.Url, &x.Title, &dateAdded)
+		if err != nil {
+			fmt.Println("individual row error", err)
+			return nil, err
+		}
+		// Microseconds since the epoch
+		if dateAdded.Valid {
+			t := time.UnixMicro(dateAdded.Int64)
+			x.AddedAt = &t
+		}
+		bookmarks = append(bookmarks, x)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		fmt.Println("row error", err)
+		return nil, err
+	}
+
+	return bookmarks, nil
+}
+
 func FindFirefoxDBs(root string) ([]string, error) {
 	results := []string{}
 
@@ -0,0 +1,385 @@
+// Package output writes search results in the formats of search --format, so
+// that they can be piped into other tools.
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+)
+
+type Format string
+
+const (
+	// A line per result, the best match first, and how many there were
+	Text Format = "text"
+	// An object with the results, their count, any suggestion and the facets
+	Json Format = "json"
+	// A compact json object per result, without anything else
+	Ndjson Format = "ndjson"
+	// A header of the field names and a row per result
+	Csv Format = "csv"
+	// Like Csv, with tabs and newlines in values replaced with spaces
+	Tsv Format = "tsv"
+	// A list of links
+	Markdown Format = "markdown"
+)
+
+var Formats = []Format{Text, Json, Ndjson, Csv, Tsv, Markdown}
+
+// The columns of csv and tsv, the fields of a result by the names they have in
+// json. Snippets are left out, match is their text.
+var Fields = []string{"id", "url", "title", "description", "last_visit", "visit_count", "match", "match_count", "sum_rank", "score", "variants"}
+
+// Formatter writes the results of a search as they are found
+type Formatter interface {
+	Result(x types.SearchableEntity) error
+	// Write anything that comes after the results
+	End(s Summary) error
+}
+
+// Summary is what is known about a search once all of its results are written
+type Summary struct {
+	Query string
+	// The number of results that were skipped before the first one
+	Offset uint
+	// The count, suggestion and facets of the search, not its urls
+	Result *search.SearchResult
+}
+
+// New returns a Formatter writing to w in the named format, or executing it
+// as a text/template for each result if it isn't one of Formats. Templates
+// are given the fields of a result by their json names, e.g. {{.url}}, and a
+// newline is added after each unless the template ends with one. \t and \n in
+// templates are a tab and a newline, since they are awkward to type in a shell.
+func New(w io.Writer, format string) (Formatter, error) {
+	switch Format(format) {
+	case Text:
+		return &textFormatter{w: w}, nil
+	case Json:
+		return &jsonFormatter{w: w}, nil
+	case Ndjson:
+		return &ndjsonFormatter{enc: json.NewEncoder(w)}, nil
+	case Csv:
+		return &tableFormatter{w: w, csv: csv.NewWriter(w)}, nil
+	case Tsv:
+		return &tableFormatter{w: w}, nil
+	case Markdown:
+		return &markdownFormatter{w: w}, nil
+	}
+
+	if !strings.Contains(format, "{{") {
+		names := make([]string, len(Formats))
+		for i, f := range Formats {
+			names[i] = string(f)
+		}
+		return nil, fmt.Errorf("unknown format %q, expected one of %s or a template like '{{.url}}'", format, strings.Join(names, ", "))
+	}
+
+	format = templateEscapes.Replace(format)
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	t, err := template.New("format").Parse(format)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid template")
+	}
+	return &templateFormatter{w: w, t: t}, nil
+}
+
+var templateEscapes = strings.NewReplacer(`\t`, "\t", `\n`, "\n")
+
+// The fields of x by their json names, with null ones empty so that templates
+// don't print them as <nil>
+func fields(x types.SearchableEntity) (map[string]any, error) {
+	bs, err := json.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+	var xm map[string]any
+	err = json.Unmarshal(bs, &xm)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range xm {
+		if v == nil {
+			xm[k] = ""
+		}
+	}
+	if _, ok := xm["variants"]; !ok {
+		xm["variants"] = []any{}
+	}
+	return xm, nil
+}
+
+// NewArray returns a Formatter writing the results as a json array and
+// nothing else, which is what search --json has always printed
+func NewArray(w io.Writer) Formatter {
+	return &arrayFormatter{w: w}
+}
+
+type textFormatter struct {
+	w io.Writer
+	n uint
+}
+
+func (f *textFormatter) Result(x types.SearchableEntity) error {
+	title := "<UNTITLED>"
+	if x.Title != nil {
+		title = *x.Title
+	}
+
+	var lastVisit string
+	if x.LastVisit != nil {
+		lastVisit = x.LastVisit.Format(util.FormatDateOnly)
+	}
+
+	var variants string
+	if len(x.Variants) > 0 {
+		variants = fmt.Sprintf(" (+%d variants)", len(x.Variants))
+	}
+
+	f.n++
+	_, err := fmt.Fprintf(f.w, "%v %s %s%s\n", lastVisit, title, x.Url, variants)
+	return err
+}
+
+func (f *textFormatter) End(s Summary) error {
+	q := s.Query
+	if s.Result.Fuzzy {
+		fmt.Fprintf(f.w, "No results for \"%s\", showing results for \"%s\" instead\n", q, s.Result.Suggestion)
+		q = s.Result.Suggestion
+	} else if s.Result.Suggestion != "" {
+		fmt.Fprintf(f.w, "Did you mean \"%s\"?\n", s.Result.Suggestion)
+	}
+
+	n := f.n
+	var err error
+	if n < s.Result.Count {
+		of := "of"
+		if s.Result.CountIsEstimate {
+			of = "of at most"
+		}
+		_, err = fmt.Fprintf(f.w, "Showing %d-%d %s %d results for \"%s\", use --offset and --limit for more\n", s.Offset+1, s.Offset+n, of, s.Result.Count, q)
+	} else {
+		_, err = fmt.Fprintf(f.w, "Found %d results for \"%s\"\n", s.Result.Count, q)
+	}
+	return err
+}
+
+// @note json is written as it comes, so that every result needn't be held in
+// memory
+type jsonFormatter struct {
+	w io.Writer
+	n int
+}
+
+func (f *jsonFormatter) Result(x types.SearchableEntity) error {
+	bs, err := json.MarshalIndent(x, "    ", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal json")
+	}
+	if f.n == 0 {
+		fmt.Fprint(f.w, "{\n  \"results\": [\n    ")
+	} else {
+		fmt.Fprint(f.w, ",\n    ")
+	}
+	f.n++
+	_, err = f.w.Write(bs)
+	return err
+}
+
+func (f *jsonFormatter) End(s Summary) error {
+	if f.n == 0 {
+		fmt.Fprint(f.w, "{\n  \"results\": [],\n")
+	} else {
+		fmt.Fprint(f.w, "\n  ],\n")
+	}
+	fmt.Fprintf(f.w, "  \"count\": %d,\n  \"count_is_estimate\": %t,\n  \"query\": %s", s.Result.Count, s.Result.CountIsEstimate, jsonString(s.Query))
+	if s.Result.Suggestion != "" {
+		fmt.Fprintf(f.w, ",\n  \"suggestion\": %s,\n  \"fuzzy\": %t", jsonString(s.Result.Suggestion), s.Result.Fuzzy)
+	}
+	if s.Result.Facets != nil {
+		bs, err := json.MarshalIndent(s.Result.Facets, "  ", "  ")
+		if err != nil {
+			return errors.Wrap(err, "could not marshal json")
+		}
+		fmt.Fprintf(f.w, ",\n  \"facets\": %s", bs)
+	}
+	_, err := fmt.Fprintln(f.w, "\n}")
+	return err
+}
+
+type arrayFormatter struct {
+	w io.Writer
+	n int
+}
+
+func (f *arrayFormatter) Result(x types.SearchableEntity) error {
+	bs, err := json.MarshalIndent(x, "  ", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal json")
+	}
+	if f.n == 0 {
+		fmt.Fprint(f.w, "[\n  ")
+	} else {
+		fmt.Fprint(f.w, ",\n  ")
+	}
+	f.n++
+	_, err = f.w.Write(bs)
+	return err
+}
+
+func (f *arrayFormatter) End(s Summary) error {
+	var err error
+	if f.n == 0 {
+		_, err = fmt.Fprintln(f.w, "[]")
+	} else {
+		_, err = fmt.Fprintln(f.w, "\n]")
+	}
+	return err
+}
+
+func jsonString(s string) string {
+	bs, _ := json.Marshal(s)
+	return string(bs)
+}
+
+type ndjsonFormatter struct {
+	enc *json.Encoder
+}
+
+func (f *ndjsonFormatter) Result(x types.SearchableEntity) error {
+	return f.enc.Encode(x)
+}
+
+func (f *ndjsonFormatter) End(s Summary) error { return nil }
+
+// Writes csv, or tsv if csv is nil
+type tableFormatter struct {
+	w      io.Writer
+	csv    *csv.Writer
+	header bool
+}
+
+// The values of Fields for x. Variants are their urls separated by spaces.
+func row(x types.SearchableEntity) []string {
+	str := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	num := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*f, 'f', -1, 64)
+	}
+
+	var lastVisit, matchCount string
+	if x.LastVisit != nil {
+		lastVisit = x.LastVisit.Format(time.RFC3339)
+	}
+	if x.MatchCount != nil {
+		matchCount = strconv.Itoa(*x.MatchCount)
+	}
+	variants := make([]string, len(x.Variants))
+	for i, v := range x.Variants {
+		variants[i] = v.Url
+	}
+
+	return []string{
+		x.Id, x.Url, str(x.Title), str(x.Description), lastVisit, strconv.Itoa(x.VisitCount),
+		str(x.Match), matchCount, num(x.SumRank), num(x.Score), strings.Join(variants, " "),
+	}
+}
+
+func (f *tableFormatter) write(values []string) error {
+	if f.csv != nil {
+		return f.csv.Write(values)
+	}
+
+	for i, v := range values {
+		values[i] = strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, v)
+	}
+	_, err := fmt.Fprintln(f.w, strings.Join(values, "\t"))
+	return err
+}
+
+// Write the header, unless it has been already. It is written even if there
+// are no results, so that the columns are known.
+func (f *tableFormatter) writeHeader() error {
+	if f.header {
+		return nil
+	}
+	f.header = true
+	return f.write(append([]string{}, Fields...))
+}
+
+func (f *tableFormatter) Result(x types.SearchableEntity) error {
+	if err := f.writeHeader(); err != nil {
+		return err
+	}
+	return f.write(row(x))
+}
+
+func (f *tableFormatter) End(s Summary) error {
+	if err := f.writeHeader(); err != nil {
+		return err
+	}
+	if f.csv != nil {
+		f.csv.Flush()
+		return f.csv.Error()
+	}
+	return nil
+}
+
+type markdownFormatter struct {
+	w io.Writer
+}
+
+var markdownText = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "\n", " ")
+var markdownUrl = strings.NewReplacer("(", "%28", ")", "%29", " ", "%20")
+
+func (f *markdownFormatter) Result(x types.SearchableEntity) error {
+	title := x.Url
+	if x.Title != nil && strings.TrimSpace(*x.Title) != "" {
+		title = *x.Title
+	}
+	_, err := fmt.Fprintf(f.w, "- [%s](%s)\n", markdownText.Replace(title), markdownUrl.Replace(x.Url))
+	return err
+}
+
+func (f *markdownFormatter) End(s Summary) error { return nil }
+
+type templateFormatter struct {
+	w io.Writer
+	t *template.Template
+}
+
+func (f *templateFormatter) Result(x types.SearchableEntity) error {
+	data, err := fields(x)
+	if err != nil {
+		return err
+	}
+	return f.t.Execute(f.w, data)
+}
+
+func (f *templateFormatter) End(s Summary) error { return nil }
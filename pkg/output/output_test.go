@@ -0,0 +1,120 @@
+package output_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/output"
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormats(t *testing.T) {
+	title := "Effective Go [draft]"
+	match := "Effective <mark>Go</mark>\twith a tab\nand a newline"
+	score := 4.5
+	lastVisit := time.Date(2024, 3, 12, 9, 30, 0, 0, time.UTC)
+	results := []types.SearchableEntity{
+		{
+			Id: "1", Url: "https://go.dev/doc/effective_go", Title: &title, LastVisit: &lastVisit, VisitCount: 2, Match: &match, Score: &score,
+			Variants: []types.SearchableEntity{{Id: "2", Url: "https://go.dev/doc/effective_go?utm_source=hn"}},
+		},
+		{Id: "3", Url: "https://example.com/a_(b)"},
+	}
+	summary := output.Summary{Query: "go", Result: &search.SearchResult{Count: 5}}
+
+	write := func(formatter output.Formatter) {
+		for _, x := range results {
+			require.NoError(t, formatter.Result(x))
+		}
+		require.NoError(t, formatter.End(summary))
+	}
+	format := func(f string) string {
+		var buf bytes.Buffer
+		formatter, err := output.New(&buf, f)
+		require.NoError(t, err)
+		write(formatter)
+		return buf.String()
+	}
+
+	t.Run("text", func(t *testing.T) {
+		require.Equal(t, `2024-03-12 Effective Go [draft] https://go.dev/doc/effective_go (+1 variants)
+ <UNTITLED> https://example.com/a_(b)
+Showing 1-2 of 5 results for "go", use --offset and --limit for more
+`, format("text"), "the best match first")
+	})
+
+	t.Run("array", func(t *testing.T) {
+		var buf bytes.Buffer
+		write(output.NewArray(&buf))
+		var v []types.SearchableEntity
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &v), "only the results")
+		require.Len(t, v, 2)
+		require.Equal(t, "https://example.com/a_(b)", v[1].Url)
+
+		buf.Reset()
+		require.NoError(t, output.NewArray(&buf).End(summary))
+		require.Equal(t, "[]\n", buf.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var v struct {
+			Results []types.SearchableEntity `json:"results"`
+			Count   uint                     `json:"count"`
+			Query   string                   `json:"query"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(format("json")), &v))
+		require.Len(t, v.Results, 2)
+		require.Equal(t, uint(5), v.Count)
+		require.Equal(t, "https://go.dev/doc/effective_go?utm_source=hn", v.Results[0].Variants[0].Url)
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(format("ndjson")), "\n")
+		require.Len(t, lines, 2, "an object per line and nothing else")
+		var x map[string]any
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &x))
+		require.Equal(t, "https://example.com/a_(b)", x["url"])
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		rows, err := csv.NewReader(strings.NewReader(format("csv"))).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, rows, 3)
+		require.Equal(t, output.Fields, rows[0])
+		require.Equal(t, []string{
+			"1", "https://go.dev/doc/effective_go", title, "", "2024-03-12T09:30:00Z", "2",
+			match, "", "", "4.5", "https://go.dev/doc/effective_go?utm_source=hn",
+		}, rows[1])
+	})
+
+	t.Run("tsv", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSuffix(format("tsv"), "\n"), "\n")
+		require.Len(t, lines, 3, "newlines in values don't break rows")
+		for _, l := range lines {
+			require.Len(t, strings.Split(l, "\t"), len(output.Fields), "nor do tabs")
+		}
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		require.Equal(t, `- [Effective Go \[draft\]](https://go.dev/doc/effective_go)
+- [https://example.com/a_(b)](https://example.com/a_%28b%29)
+`, format("markdown"))
+	})
+
+	t.Run("template", func(t *testing.T) {
+		require.Equal(t, "Effective Go [draft]\thttps://go.dev/doc/effective_go 2 1\n\thttps://example.com/a_(b) 0 0\n", format(`{{.title}}\t{{.url}} {{.visit_count}} {{len .variants}}`))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := output.New(&bytes.Buffer{}, "yaml")
+		require.Error(t, err)
+		_, err = output.New(&bytes.Buffer{}, "{{.url")
+		require.Error(t, err)
+	})
+}
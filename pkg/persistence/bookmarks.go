@@ -0,0 +1,61 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// @note bookmarks only use standard SQL and are shared by every sql backend
+
+func replaceBookmarks(ctx context.Context, db *sql.DB, dialect sqlDialect, extractorName string, rows []types.BookmarkRow) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+
+	f := &queryFilter{dialect: dialect}
+	_, err = tx.ExecContext(ctx, `DELETE FROM bookmarks WHERE extractor_name = `+f.arg(extractorName)+`;`, f.args...)
+	if err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "error deleting bookmarks")
+	}
+
+	for _, row := range rows {
+		var addedAt *int64
+		if row.AddedAt != nil {
+			addedAt = lo.ToPtr(row.AddedAt.Unix())
+		}
+
+		// @note the same page can be bookmarked more than once in a browser,
+		// the first of them is kept
+		f := &queryFilter{dialect: dialect}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO
+				bookmarks(url_md5, extractor_name, title, added_at)
+					VALUES(`+f.values([]string{util.HashMd5String(row.Url), extractorName})+`, `+f.arg(row.Title)+`, `+f.arg(addedAt)+`)
+			ON CONFLICT DO NOTHING;
+		`, f.args...)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error inserting bookmark")
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteStore) ReplaceBookmarks(ctx context.Context, extractorName string, rows ...types.BookmarkRow) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	return replaceBookmarks(ctx, s.db, dialectSqlite, extractorName, rows)
+}
+
+func (s *PostgresStore) ReplaceBookmarks(ctx context.Context, extractorName string, rows ...types.BookmarkRow) error {
+	return replaceBookmarks(ctx, s.db, dialectPostgres, extractorName, rows)
+}
@@ -0,0 +1,66 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBookmarks(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			visited := time.Now().Add(-time.Hour)
+			for _, url := range []string{"https://a.example", "https://b.example", "https://c.example"} {
+				title := "Gopher tips"
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title, LastVisit: &visited}))
+				require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: visited, ExtractorName: "chrome"}))
+				require.NoError(t, store.InsertFragments(ctx, types.Fragment{E: util.HashMd5String(url), T: "urls", A: "title", V: title}))
+			}
+
+			search := func(s string, opts persistence.SearchOptions) []string {
+				results, _, err := store.SearchUrls(ctx, query.MustParse(s), opts)
+				require.NoError(t, err)
+				urls := []string{}
+				for _, r := range results {
+					urls = append(urls, r.Url)
+				}
+				return urls
+			}
+
+			require.NoError(t, store.ReplaceBookmarks(ctx, "chrome", types.BookmarkRow{Url: "https://a.example"}, types.BookmarkRow{Url: "https://a.example"}))
+			require.NoError(t, store.ReplaceBookmarks(ctx, "firefox", types.BookmarkRow{Url: "https://c.example"}))
+
+			require.ElementsMatch(t, []string{"https://a.example", "https://c.example"}, search("gopher is:bookmarked", persistence.SearchOptions{}),
+				"bookmarks from every browser count")
+			require.Equal(t, []string{"https://b.example"}, search("gopher -is:bookmarked", persistence.SearchOptions{}))
+			require.ElementsMatch(t, []string{"https://a.example", "https://c.example"}, search("is:bookmarked", persistence.SearchOptions{}),
+				"filters alone match too")
+
+			// @note without the boost the tie is broken by url_md5, which puts a.example last
+			noBoost := config.DefaultRanking
+			noBoost.BookmarkWeight = 0
+			require.Equal(t, "https://a.example", search("gopher", persistence.SearchOptions{Ranking: noBoost})[2])
+			require.Equal(t, "https://b.example", search("gopher", persistence.SearchOptions{})[2], "bookmarks rank higher")
+
+			require.NoError(t, store.ReplaceBookmarks(ctx, "chrome"))
+			require.Equal(t, []string{"https://c.example"}, search("gopher is:bookmarked", persistence.SearchOptions{}),
+				"removed bookmarks are forgotten")
+
+			require.NoError(t, store.RewriteUrl(ctx, "https://c.example", "https://c.example/moved"))
+			require.Equal(t, []string{"https://c.example/moved"}, search("is:bookmarked", persistence.SearchOptions{}),
+				"bookmarks move with their url")
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// ChangesetMarks records how far into each table a changeset went, by rowid.
+// Rows that are added, or replaced, get a rowid larger than any before them,
+// so everything above the marks of the last changeset is new.
+type ChangesetMarks struct {
+	Urls      int64 `json:"urls"`
+	Visits    int64 `json:"visits"`
+	Edges     int64 `json:"edges"`
+	Documents int64 `json:"documents"`
+}
+
+// CurrentMarks returns the largest rowid of every table in the sqlite database at dbPath
+func CurrentMarks(ctx context.Context, dbPath string) (*ChangesetMarks, error) {
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	marks := &ChangesetMarks{}
+	err = db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT coalesce(max(rowid), 0) FROM urls),
+			(SELECT coalesce(max(rowid), 0) FROM visits),
+			(SELECT coalesce(max(rowid), 0) FROM url_document_edges),
+			(SELECT coalesce(max(rowid), 0) FROM documents);
+	`).Scan(&marks.Urls, &marks.Visits, &marks.Edges, &marks.Documents)
+	if err != nil {
+		return nil, err
+	}
+
+	return marks, nil
+}
+
+// ExportChangeset writes everything in the sqlite database at dbPath that was
+// added after since to a new browser-gopher database at outPath, which can be
+// read with Merge. Urls are included if they are new or have new visits or
+// documents. Returns the marks to pass as since for the next changeset, and the
+// number of urls written. Nothing changed if that is zero.
+func ExportChangeset(ctx context.Context, dbPath string, outPath string, since ChangesetMarks) (*ChangesetMarks, int, error) {
+	until, err := CurrentMarks(ctx, dbPath)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not read "+dbPath)
+	}
+
+	out, err := InitDb(ctx, &config.AppConfig{DBPath: outPath})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer out.Close()
+
+	// @note attached databases are per connection, so everything has to run on this one
+	conn, err := out.Conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `ATTACH DATABASE ? AS src;`, "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not attach "+dbPath)
+	}
+
+	stmts := []struct {
+		name string
+		qry  string
+		args []any
+	}{
+		{
+			name: "copy document edges",
+			qry: `
+				INSERT INTO main.url_document_edges(url_md5, document_md5)
+				SELECT
+					url_md5,
+					document_md5
+				FROM
+					src.url_document_edges
+				WHERE
+					(id > ? AND id <= ?)
+					OR document_md5 IN (SELECT document_md5 FROM src.documents WHERE rowid > ? AND rowid <= ?);
+			`,
+			args: []any{since.Edges, until.Edges, since.Documents, until.Documents},
+		},
+		{
+			name: "copy documents",
+			qry: `
+				INSERT INTO main.documents(document_md5, body, status_code, accessed_at)
+				SELECT
+					document_md5,
+					body,
+					status_code,
+					accessed_at
+				FROM
+					src.documents
+				WHERE
+					document_md5 IN (SELECT document_md5 FROM main.url_document_edges);
+			`,
+		},
+		{
+			name: "copy urls",
+			qry: `
+				INSERT INTO main.urls(url_md5, url, title, description, last_visit, redacted)
+				SELECT
+					url_md5,
+					url,
+					title,
+					description,
+					last_visit,
+					redacted
+				FROM
+					src.urls
+				WHERE
+					(rowid > ? AND rowid <= ?)
+					OR url_md5 IN (SELECT url_md5 FROM src.visits WHERE id > ? AND id <= ?)
+					OR url_md5 IN (SELECT url_md5 FROM main.url_document_edges);
+			`,
+			args: []any{since.Urls, until.Urls, since.Visits, until.Visits},
+		},
+		{
+			name: "copy visits",
+			qry: `
+				INSERT INTO main.visits(url_md5, visit_time, extractor_name)
+				SELECT
+					url_md5,
+					visit_time,
+					extractor_name
+				FROM
+					src.visits
+				WHERE
+					id > ? AND id <= ?;
+			`,
+			args: []any{since.Visits, until.Visits},
+		},
+	}
+
+	for _, stmt := range stmts {
+		_, err := conn.ExecContext(ctx, stmt.qry, stmt.args...)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, stmt.name)
+		}
+	}
+
+	var n int
+	err = conn.QueryRowContext(ctx, `SELECT count(*) FROM main.urls;`).Scan(&n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	_, err = conn.ExecContext(ctx, `DETACH DATABASE src;`)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return until, n, nil
+}
+
+// ImportedMarks returns marks advanced from since past the rows of the sqlite
+// database at dbPath that were merged from src, a changeset, so that they
+// aren't exported straight back to where they came from. Each table stops at
+// its first row that src doesn't have, so that anything written locally in
+// the meantime, e.g. by populate running while merging, is still exported.
+// Rows merged after it are then exported again, which Merge ignores.
+func ImportedMarks(ctx context.Context, dbPath string, src *sql.DB, since ChangesetMarks) (*ChangesetMarks, error) {
+	db, err := sql.Open("sqlite", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	marks := since
+	tables := []struct {
+		mark *int64
+		// The rows after a rowid, as their rowid and the columns that identify
+		// them, NULL for those a table doesn't need
+		rows string
+		// Whether src has a row, by the columns that identify it
+		exists string
+		keys   int
+	}{
+		{
+			mark:   &marks.Urls,
+			rows:   `SELECT rowid, url_md5, NULL FROM urls WHERE rowid > ? ORDER BY rowid;`,
+			exists: `SELECT count(*) FROM urls WHERE url_md5 = ?;`,
+			keys:   1,
+		},
+		{
+			mark:   &marks.Visits,
+			rows:   `SELECT rowid, url_md5, visit_time FROM visits WHERE rowid > ? ORDER BY rowid;`,
+			exists: `SELECT count(*) FROM visits WHERE url_md5 = ? AND visit_time IS ?;`,
+			keys:   2,
+		},
+		{
+			mark:   &marks.Edges,
+			rows:   `SELECT rowid, url_md5, document_md5 FROM url_document_edges WHERE rowid > ? ORDER BY rowid;`,
+			exists: `SELECT count(*) FROM url_document_edges WHERE url_md5 = ? AND document_md5 = ?;`,
+			keys:   2,
+		},
+		{
+			mark:   &marks.Documents,
+			rows:   `SELECT rowid, document_md5, NULL FROM documents WHERE rowid > ? ORDER BY rowid;`,
+			exists: `SELECT count(*) FROM documents WHERE document_md5 = ?;`,
+			keys:   1,
+		},
+	}
+
+	for _, table := range tables {
+		err := func() error {
+			rows, err := db.QueryContext(ctx, table.rows, *table.mark)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var rowid int64
+				keys := make([]any, 2)
+				if err := rows.Scan(&rowid, &keys[0], &keys[1]); err != nil {
+					return err
+				}
+
+				var n int
+				if err := src.QueryRowContext(ctx, table.exists, keys[:table.keys]...).Scan(&n); err != nil {
+					return err
+				}
+				if n == 0 {
+					return nil
+				}
+				*table.mark = rowid
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not compare with the changeset")
+		}
+	}
+
+	return &marks, nil
+}
@@ -0,0 +1,57 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// CopyDb writes a consistent copy of the sqlite database at src to dst, which
+// must not exist yet. The original is only read, and may be written to by
+// another process at the same time.
+func CopyDb(ctx context.Context, src string, dst string) error {
+	db, err := sql.Open("sqlite", "file:"+src+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// @note VACUUM INTO gives a consistent copy even if the other database is
+	// being written to, unlike copying the file.
+	_, err = db.ExecContext(ctx, `VACUUM INTO ?;`, dst)
+	return err
+}
+
+// CheckIntegrity runs sqlite's integrity check on the database at path, and
+// returns an error describing the problems found, if any.
+func CheckIntegrity(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	problem, err := sqliteIntegrityCheck.run(ctx, db)
+	if err != nil {
+		return err
+	}
+	if problem != "" {
+		return errors.New(problem)
+	}
+
+	return nil
+}
+
+// VacuumDb rebuilds the sqlite database at path, so that nothing deleted or
+// overwritten is left behind in free pages
+func VacuumDb(ctx context.Context, path string) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.ExecContext(ctx, `VACUUM;`)
+	return err
+}
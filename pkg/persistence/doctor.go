@@ -0,0 +1,305 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Finding is the result of a single consistency check
+type Finding struct {
+	Check   string
+	Problem string // Empty when the check passed
+	Count   int    // Number of affected rows, where that makes sense
+	Fixable bool
+}
+
+func (f Finding) Ok() bool {
+	return f.Problem == ""
+}
+
+type consistencyCheck struct {
+	name string
+	// Count of affected rows. Only used if run is nil
+	countQuery string
+	problem    string
+	// Custom check for things that aren't a simple count
+	run func(ctx context.Context, db *sql.DB) (string, error)
+	fix func(ctx context.Context, db *sql.DB) error
+}
+
+func execFix(qry string) func(ctx context.Context, db *sql.DB) error {
+	return func(ctx context.Context, db *sql.DB) error {
+		_, err := db.ExecContext(ctx, qry)
+		return err
+	}
+}
+
+var sqliteIntegrityCheck = consistencyCheck{
+	name: "sqlite integrity",
+	run: func(ctx context.Context, db *sql.DB) (string, error) {
+		rows, err := db.QueryContext(ctx, "PRAGMA integrity_check;")
+		if err != nil {
+			return "", err
+		}
+		defer rows.Close()
+
+		var msgs []string
+		for rows.Next() {
+			var msg string
+			err := rows.Scan(&msg)
+			if err != nil {
+				return "", err
+			}
+			if msg != "ok" {
+				msgs = append(msgs, msg)
+			}
+		}
+
+		if len(msgs) > 0 {
+			return "database file is corrupt, restore from a backup: " + strings.Join(msgs, "; "), rows.Err()
+		}
+
+		return "", rows.Err()
+	},
+}
+
+// @note these only use standard SQL and are shared by every sql backend
+var orphanChecks = []consistencyCheck{
+	{
+		name: "orphaned url meta",
+		countQuery: `
+			SELECT count(*) FROM urls_meta
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`,
+		problem: "url meta rows without a url",
+		fix: execFix(`
+			DELETE FROM urls_meta
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`),
+	},
+	{
+		name: "orphaned fragments",
+		countQuery: `
+			SELECT count(*) FROM fragment
+			WHERE e NOT IN (SELECT url_md5 FROM urls);
+		`,
+		problem: "search index fragments for urls that no longer exist",
+		fix: execFix(`
+			DELETE FROM fragment
+			WHERE e NOT IN (SELECT url_md5 FROM urls);
+		`),
+	},
+	{
+		name: "orphaned term vectors",
+		countQuery: `
+			SELECT count(*) FROM term_vectors
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`,
+		problem: "term vectors for urls that no longer exist",
+		fix: execFix(`
+			DELETE FROM term_vectors
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`),
+	},
+	{
+		name: "orphaned words",
+		countQuery: `
+			SELECT count(*) FROM url_vocabulary
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`,
+		problem: "search suggestions from urls that no longer exist",
+		fix: execFix(`
+			DELETE FROM url_vocabulary
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`),
+	},
+	{
+		name: "orphaned document edges",
+		countQuery: `
+			SELECT count(*) FROM url_document_edges
+			WHERE
+				url_md5 NOT IN (SELECT url_md5 FROM urls)
+				OR document_md5 NOT IN (SELECT document_md5 FROM documents);
+		`,
+		problem: "url to document links where either side is missing",
+		fix: execFix(`
+			DELETE FROM url_document_edges
+			WHERE
+				url_md5 NOT IN (SELECT url_md5 FROM urls)
+				OR document_md5 NOT IN (SELECT document_md5 FROM documents);
+		`),
+	},
+	{
+		name: "orphaned documents",
+		countQuery: `
+			SELECT count(*) FROM documents
+			WHERE document_md5 NOT IN (SELECT document_md5 FROM url_document_edges);
+		`,
+		problem: "documents not linked to any url",
+		fix: execFix(`
+			DELETE FROM documents
+			WHERE document_md5 NOT IN (SELECT document_md5 FROM url_document_edges);
+		`),
+	},
+	{
+		name: "orphaned url titles",
+		countQuery: `
+			SELECT count(*) FROM url_titles
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`,
+		problem: "title history for urls that do not exist",
+		fix: execFix(`
+			DELETE FROM url_titles
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`),
+	},
+	{
+		name: "orphaned visits",
+		countQuery: `
+			SELECT count(*) FROM visits
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`,
+		// @note these are all that is left of the history of those urls, they
+		// are not deleted
+		problem: "visits for urls that do not exist",
+	},
+	{
+		name: "orphaned bookmarks",
+		countQuery: `
+			SELECT count(*) FROM bookmarks
+			WHERE url_md5 NOT IN (SELECT url_md5 FROM urls);
+		`,
+		// @note kept for the same reason as visits. They are replaced on the
+		// next populate anyway.
+		problem: "bookmarks for urls that do not exist",
+	},
+}
+
+var consistencyChecks = append(append([]consistencyCheck{sqliteIntegrityCheck}, orphanChecks...),
+	consistencyCheck{
+		name: "visit stats",
+		countQuery: `
+			SELECT count(*) FROM urls u
+			LEFT JOIN (SELECT url_md5, count(*) AS n, max(visit_time) AS visit_time FROM visits GROUP BY url_md5) v ON v.url_md5 = u.url_md5
+			WHERE
+				u.visit_count != coalesce(v.n, 0)
+				OR (v.url_md5 NOT NULL AND u.last_visit IS NOT v.visit_time);
+		`,
+		problem: "urls whose last_visit or visit_count does not match their visits",
+		fix:     RecomputeVisitStats,
+	},
+	// @note keep this last. Fixing the checks above deletes fragments, so the
+	// index should be rebuilt afterwards.
+	consistencyCheck{
+		name: "search index integrity",
+		run: func(ctx context.Context, db *sql.DB) (string, error) {
+			// @note rank = 1 also compares the index against the content of the fragment table
+			for _, index := range []string{trigramIndex, wordIndex} {
+				_, err := db.ExecContext(ctx, `INSERT INTO `+index+`(`+index+`, rank) VALUES('integrity-check', 1);`)
+				if err != nil {
+					return index + " search index is out of sync with fragments: " + err.Error(), nil
+				}
+			}
+			return "", nil
+		},
+		fix: RebuildSearchIndex,
+	},
+)
+
+// Diagnose runs every consistency check against the database. Errors are only
+// returned if a check could not be run at all.
+func (s *SqliteStore) Diagnose(ctx context.Context) ([]Finding, error) {
+	return runChecks(ctx, s.db, consistencyChecks)
+}
+
+// Repair fixes every fixable problem in findings
+func (s *SqliteStore) Repair(ctx context.Context, findings []Finding) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	return repairFindings(ctx, s.db, consistencyChecks, findings)
+}
+
+func runChecks(ctx context.Context, db *sql.DB, checks []consistencyCheck) ([]Finding, error) {
+	findings := []Finding{}
+
+	for _, c := range checks {
+		finding := Finding{Check: c.name, Fixable: c.fix != nil}
+
+		if c.run != nil {
+			problem, err := c.run(ctx, db)
+			if err != nil {
+				return nil, errors.Wrap(err, c.name)
+			}
+			finding.Problem = problem
+		} else {
+			err := db.QueryRowContext(ctx, c.countQuery).Scan(&finding.Count)
+			if err != nil {
+				return nil, errors.Wrap(err, c.name)
+			}
+			if finding.Count > 0 {
+				finding.Problem = c.problem
+			}
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+func repairFindings(ctx context.Context, db *sql.DB, checks []consistencyCheck, findings []Finding) error {
+	for _, f := range findings {
+		if f.Ok() || !f.Fixable {
+			continue
+		}
+
+		for _, c := range checks {
+			if c.name != f.Check {
+				continue
+			}
+
+			err := c.fix(ctx, db)
+			if err != nil {
+				return errors.Wrap(err, "could not fix "+c.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// RebuildSearchIndex regenerates the full-text indexes from the fragment table
+func RebuildSearchIndex(ctx context.Context, db *sql.DB) error {
+	for _, index := range []string{trigramIndex, wordIndex} {
+		_, err := db.ExecContext(ctx, `INSERT INTO `+index+`(`+index+`) VALUES('rebuild');`)
+		if err != nil {
+			return errors.Wrap(err, index)
+		}
+	}
+	return nil
+}
+
+// RecomputeVisitStats sets urls.visit_count and urls.last_visit from the
+// visits table. These are normally kept up to date by triggers. Urls without
+// visits keep whatever last_visit they were imported with.
+func RecomputeVisitStats(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE urls
+		SET
+			visit_count = coalesce(v.n, 0),
+			last_visit = coalesce(v.visit_time, urls.last_visit)
+		FROM (
+			SELECT u.url_md5, count(visits.id) AS n, max(visits.visit_time) AS visit_time
+			FROM urls u LEFT JOIN visits ON visits.url_md5 = u.url_md5
+			GROUP BY u.url_md5
+		) AS v
+		WHERE
+			v.url_md5 = urls.url_md5
+			AND (urls.visit_count != coalesce(v.n, 0) OR urls.last_visit IS NOT coalesce(v.visit_time, urls.last_visit));
+	`)
+	return err
+}
@@ -0,0 +1,50 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// The document_md5 of an empty body, which many pages that failed to render
+// have in common
+var emptyDocumentMd5 = util.HashMd5String("")
+
+func documentMd5s(ctx context.Context, db *sql.DB, dialect sqlDialect, ids []string) (map[string]string, error) {
+	xm := map[string]string{}
+	if len(ids) == 0 {
+		return xm, nil
+	}
+
+	f := &queryFilter{dialect: dialect}
+	rows, err := db.QueryContext(ctx, `
+SELECT
+  edge.url_md5,
+  d.document_md5
+FROM
+  url_document_edges edge
+  JOIN documents d ON d.document_md5 = edge.document_md5
+WHERE
+  edge.url_md5 `+f.in(ids)+`
+  AND d.status_code >= 200
+  AND d.status_code < 300
+  AND d.document_md5 != `+f.arg(emptyDocumentMd5)+`;
+	`, f.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var urlMd5, docMd5 string
+		err := rows.Scan(&urlMd5, &docMd5)
+		if err != nil {
+			return nil, errors.Wrap(err, "row error")
+		}
+		xm[urlMd5] = docMd5
+	}
+
+	return xm, errors.Wrap(rows.Err(), "query error")
+}
@@ -0,0 +1,664 @@
+package persistence
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/iansinnott/browser-gopher/pkg/chunk"
+	"github.com/iansinnott/browser-gopher/pkg/crypt"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// EncryptedStore wraps a Store so that full-text bodies are encrypted before
+// they are written and decrypted when they are read. Urls, titles and visits
+// are stored as they are.
+//
+// The text of encrypted bodies is kept out of the search index, which would
+// otherwise hold it in plaintext. Instead SearchUrls decrypts the bodies and
+// searches them directly, which is slower but means the index never needs the
+// passphrase. Bodies are only decrypted once while the store is open, see
+// encryptedBodies.
+type EncryptedStore struct {
+	Store
+	keyring *crypt.Keyring
+	// When false, bodies are written as they are, and only bodies that were
+	// encrypted before encryption was turned off are decrypted
+	encrypt bool
+
+	lock sync.Mutex
+	// Decrypted bodies by url_md5, nil until they are first needed or after
+	// they have changed, see encryptedBodies
+	plain map[string]*plainBody
+}
+
+// A decrypted body and its chunks, see chunk.Markdown
+type plainBody struct {
+	text   string
+	chunks []chunk.Chunk
+}
+
+func newPlainBody(text string) *plainBody {
+	return &plainBody{text: text, chunks: chunk.Markdown(text)}
+}
+
+// Compile time check that EncryptedStore satisfies the Store interface
+var _ Store = (*EncryptedStore)(nil)
+
+func NewEncryptedStore(store Store, keyring *crypt.Keyring, encrypt bool) *EncryptedStore {
+	return &EncryptedStore{Store: store, keyring: keyring, encrypt: encrypt}
+}
+
+// Unlock asks for the passphrase now rather than when it is first needed,
+// e.g. before starting an interactive UI that takes over the terminal.
+func (s *EncryptedStore) Unlock() error {
+	_, err := s.keyring.Key()
+	return err
+}
+
+var errStop = errors.New("stop")
+
+// ErrForeignKey is returned when inserting a body that was encrypted with
+// another key than the store's, e.g. one merged from a machine that made a
+// key of its own. It could never be decrypted to search it.
+var ErrForeignKey = errors.New("the full-text was encrypted with another key")
+
+// HasEncryptedBodies reports whether there is anything that needs the passphrase to search
+func (s *EncryptedStore) HasEncryptedBodies(ctx context.Context) (bool, error) {
+	err := s.Store.Bodies(ctx, crypt.StringPrefix, func(urlMd5 string, body string) error {
+		return errStop
+	})
+	if err == errStop {
+		return true, nil
+	}
+	return false, err
+}
+
+// EncryptBodies encrypts every body that isn't yet, e.g. those scraped before
+// encryption was turned on, and removes their text from the search index, the
+// vocabulary and term vectors. Returns the number of bodies encrypted.
+func (s *EncryptedStore) EncryptBodies(ctx context.Context) (int, error) {
+	key, err := s.keyring.Key()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := s.UpdateBodies(ctx, func(body string) (string, error) {
+		if body == "" || crypt.IsEncrypted(body) {
+			return body, nil
+		}
+		return key.EncryptString(body)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	_, err = s.Store.DeleteFragments(ctx, "documents")
+	if err != nil {
+		return n, err
+	}
+
+	// @note the vocabulary is what searches are corrected to, so words only
+	// in the bodies would otherwise still be suggested
+	_, err = RebuildVocabulary(ctx, s.Store)
+	if err != nil {
+		return n, err
+	}
+
+	// @note term vectors are made from bodies too. The urls are reindexed so
+	// that they get new ones from what isn't encrypted.
+	ids := []string{}
+	err = s.Store.Bodies(ctx, crypt.StringPrefix, func(urlMd5 string, body string) error {
+		ids = append(ids, urlMd5)
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	_, err = s.Store.DeleteTermVectors(ctx, ids...)
+	if err != nil {
+		return n, err
+	}
+
+	return n, s.Store.MarkUnindexed(ctx, ids...)
+}
+
+func (s *EncryptedStore) InsertDocument(ctx context.Context, row *types.DocumentRow) error {
+	if row.Body == nil || *row.Body == "" || (!s.encrypt && !crypt.IsEncrypted(*row.Body)) {
+		s.cache(row.UrlMd5, nil)
+		return s.Store.InsertDocument(ctx, row)
+	}
+
+	key, err := s.keyring.Key()
+	if err != nil {
+		return err
+	}
+
+	// @note bodies that are already encrypted, e.g. merged from another
+	// machine, are written as they are if they are encrypted with our key
+	if crypt.IsEncrypted(*row.Body) {
+		text, err := key.DecryptString(*row.Body)
+		if err != nil {
+			return ErrForeignKey
+		}
+		err = s.Store.InsertDocument(ctx, row)
+		if err == nil {
+			s.cache(row.UrlMd5, newPlainBody(text))
+		}
+		return err
+	}
+
+	body, err := key.EncryptString(*row.Body)
+	if err != nil {
+		return err
+	}
+
+	encrypted := *row
+	encrypted.Body = &body
+	err = s.Store.InsertDocument(ctx, &encrypted)
+	if err == nil {
+		s.cache(row.UrlMd5, newPlainBody(*row.Body))
+	}
+	return err
+}
+
+// Keep the decrypted body of a url that was just written, or forget it if it
+// isn't encrypted, if the bodies have been decrypted already
+func (s *EncryptedStore) cache(urlMd5 string, body *plainBody) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.plain == nil {
+		return
+	}
+	if body == nil {
+		delete(s.plain, urlMd5)
+	} else {
+		s.plain[urlMd5] = body
+	}
+}
+
+// Forget every decrypted body, they are decrypted again when next needed
+func (s *EncryptedStore) invalidate() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.plain = nil
+}
+
+func (s *EncryptedStore) UpdateBodies(ctx context.Context, fn func(body string) (string, error)) (int, error) {
+	defer s.invalidate()
+	return s.Store.UpdateBodies(ctx, fn)
+}
+
+func (s *EncryptedStore) Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error) {
+	defer s.invalidate()
+	return s.Store.Prune(ctx, opts)
+}
+
+func (s *EncryptedStore) RewriteUrl(ctx context.Context, oldUrl string, newUrl string) error {
+	defer s.invalidate()
+	return s.Store.RewriteUrl(ctx, oldUrl, newUrl)
+}
+
+func (s *EncryptedStore) Repair(ctx context.Context, findings []Finding) error {
+	defer s.invalidate()
+	return s.Store.Repair(ctx, findings)
+}
+
+func (s *EncryptedStore) decrypt(body *string) (*string, error) {
+	if body == nil || !crypt.IsEncrypted(*body) {
+		return body, nil
+	}
+
+	key, err := s.keyring.Key()
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := key.DecryptString(*body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &plaintext, nil
+}
+
+// Encrypted bodies are left out, so they are never indexed. See EncryptedStore.
+func withoutEncryptedBodies(xs []types.UrlDbEntity, err error) ([]types.UrlDbEntity, error) {
+	for i := range xs {
+		if xs[i].Body != nil && crypt.IsEncrypted(*xs[i].Body) {
+			xs[i].Body = nil
+		}
+	}
+	return xs, err
+}
+
+func (s *EncryptedStore) Unindexed(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	return withoutEncryptedBodies(s.Store.Unindexed(ctx, limit))
+}
+
+func (s *EncryptedStore) UnindexedDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	return withoutEncryptedBodies(s.Store.UnindexedDocuments(ctx, limit))
+}
+
+func (s *EncryptedStore) Records(ctx context.Context, opts RecordOptions, fn func(*types.UrlRecord) error) error {
+	return s.Store.Records(ctx, opts, func(rec *types.UrlRecord) error {
+		for i := range rec.Documents {
+			body, err := s.decrypt(rec.Documents[i].Body)
+			if err != nil {
+				return errors.Wrap(err, rec.Url)
+			}
+			rec.Documents[i].Body = body
+		}
+		return fn(rec)
+	})
+}
+
+func (s *EncryptedStore) Bodies(ctx context.Context, prefix string, fn func(urlMd5 string, body string) error) error {
+	return s.Store.Bodies(ctx, prefix, func(urlMd5 string, body string) error {
+		plaintext, err := s.decrypt(&body)
+		if err != nil {
+			return err
+		}
+		return fn(urlMd5, *plaintext)
+	})
+}
+
+// Call fn with every encrypted body, decrypted and split into chunks, in the
+// order of their urls' url_md5.
+//
+// @note decrypting and chunking every body is what makes searching encrypted
+// full-text slow, so they are kept for as long as the store is open. Only the
+// plaintext is kept, not the key. Bodies are read once, when they are first
+// needed, and kept up to date with what is written through this store after
+// that. Bodies written by another process, e.g. a populate running meanwhile,
+// are only searched once the store is opened again.
+func (s *EncryptedStore) encryptedBodies(ctx context.Context, fn func(urlMd5 string, body *plainBody) error) error {
+	s.lock.Lock()
+	loaded := s.plain != nil
+	s.lock.Unlock()
+
+	if !loaded {
+		plain := map[string]*plainBody{}
+		err := s.Store.Bodies(ctx, crypt.StringPrefix, func(urlMd5 string, ciphertext string) error {
+			text, err := s.decrypt(&ciphertext)
+			if err != nil {
+				return err
+			}
+			plain[urlMd5] = newPlainBody(*text)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		s.lock.Lock()
+		s.plain = plain
+		s.lock.Unlock()
+	}
+
+	// @note fn is called without the lock, it may use the store
+	s.lock.Lock()
+	bodies := lo.Assign(s.plain)
+	s.lock.Unlock()
+	ids := lo.Keys(bodies)
+
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := fn(id, bodies[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Number of words around the first match shown in a snippet
+const snippetWords = 32
+
+// SearchUrls adds matches in encrypted bodies to the results of the wrapped
+// store, and drops results whose encrypted body has an excluded word. Like the
+// search index, every positive word of the query has to appear in the same
+// chunk, see chunk.Markdown.
+func (s *EncryptedStore) SearchUrls(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+	matches, excluded, err := s.searchBodies(ctx, q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(matches) == 0 && len(excluded) == 0 {
+		return s.Store.SearchUrls(ctx, q, opts)
+	}
+
+	// @note urls whose body matched are searched apart from the rest, so that
+	// neither is counted twice. The page is cut from the merged results, so
+	// the rest has to be fetched from the start.
+	bodyMatched := lo.Keys(matches)
+	rest := opts
+	rest.exclude = append(append(append([]string{}, opts.exclude...), excluded...), bodyMatched...)
+	rest.Offset = 0
+	rest.Limit = opts.Offset + opts.limit()
+	results, count, err := s.Store.SearchUrls(ctx, q, rest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(bodyMatched) == 0 {
+		return paginate(results, opts), count, nil
+	}
+
+	urls, err := s.Store.FilterUrls(ctx, q, opts, bodyMatched...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Those that also matched in the index keep its snippets and score
+	indexed := opts
+	indexed.only = bodyMatched
+	indexed.Offset = 0
+	indexed.Limit = uint(len(bodyMatched))
+	alsoIndexed, _, err := s.Store.SearchUrls(ctx, q, indexed)
+	if err != nil {
+		return nil, 0, err
+	}
+	byUrl := lo.KeyBy(alsoIndexed, func(x types.UrlDbSearchEntity) string { return x.UrlMd5 })
+
+	// @note there is no bm25 for a plain text search, so a match in an
+	// encrypted body counts as a content match of average quality
+	textScore := opts.ranking().ContentWeight
+
+	for _, u := range urls {
+		if !opts.includes(u.UrlMd5) {
+			continue
+		}
+
+		snippets := matches[u.UrlMd5]
+		matchCount := len(snippets)
+		if x, ok := byUrl[u.UrlMd5]; ok {
+			u = x
+			snippets = append(append([]types.Snippet{}, u.Snippets...), snippets...)
+			if u.MatchCount != nil {
+				matchCount += *u.MatchCount
+			}
+		}
+		score := textScore
+		if u.Score != nil {
+			score += *u.Score
+		}
+
+		u.Snippets = snippets
+		u.MatchCount = &matchCount
+		u.Score = &score
+		results = append(results, u)
+		count++
+	}
+
+	sortResults(results, opts.sort())
+
+	return paginate(results, opts), count, nil
+}
+
+// Search the encrypted bodies for the text terms of q. Returns snippets of the
+// chunks that match by url_md5, and the url_md5s of bodies with an
+// excluded word.
+func (s *EncryptedStore) searchBodies(ctx context.Context, q *query.Query) (map[string][]types.Snippet, []string, error) {
+	positive := query.Positive(q.Text)
+	negated := query.Negated(q.Text)
+	matches := map[string][]types.Snippet{}
+	excluded := []string{}
+	if len(positive) == 0 && len(negated) == 0 {
+		return matches, excluded, nil
+	}
+
+	termRe := termsRegexp(positive)
+
+	err := s.encryptedBodies(ctx, func(urlMd5 string, body *plainBody) error {
+		if query.ContainsAny(body.text, negated) {
+			excluded = append(excluded, urlMd5)
+			return nil
+		}
+
+		if len(positive) == 0 {
+			return nil
+		}
+
+		for _, c := range body.chunks {
+			if query.ContainsAll(c.Text, positive) {
+				sn := snippet(c.Text, termRe)
+				sn.Section = c.SectionPath()
+				matches[urlMd5] = append(matches[urlMd5], sn)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not search encrypted documents")
+	}
+
+	return matches, excluded, nil
+}
+
+// Fragments includes the chunks of encrypted bodies, which are never in
+// the index, as if they were fragments of it
+func (s *EncryptedStore) Fragments(ctx context.Context, contains []string, fn func(f types.Fragment) error) error {
+	err := s.Store.Fragments(ctx, contains, fn)
+	if err != nil {
+		return err
+	}
+
+	terms := containsTerms(contains)
+	err = s.encryptedBodies(ctx, func(urlMd5 string, body *plainBody) error {
+		for _, c := range body.chunks {
+			if query.ContainsAll(c.Text, terms) {
+				if err := fn(types.Fragment{E: urlMd5, T: "documents", A: "content", V: c.Text, Section: c.SectionPath()}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "could not search encrypted documents")
+}
+
+// bodySplit splits a search in two like SearchUrls does, into the urls whose
+// encrypted body matched, which only have to satisfy the rest of the query,
+// and every other url, which is searched as usual
+type bodySplit struct {
+	rest SearchOptions
+	// q without its positive text terms, for the urls whose body matched
+	filtered *query.Query
+	matched  SearchOptions
+}
+
+// Split a search for q, or return nil if no encrypted body matched or was
+// excluded
+func (s *EncryptedStore) splitSearch(ctx context.Context, q *query.Query, opts SearchOptions) (*bodySplit, error) {
+	matches, excluded, err := s.searchBodies(ctx, q)
+	if err != nil || (len(matches) == 0 && len(excluded) == 0) {
+		return nil, err
+	}
+
+	bodyMatched := lo.Keys(matches)
+	split := &bodySplit{rest: opts, matched: opts}
+	split.rest.exclude = append(append(append([]string{}, opts.exclude...), excluded...), bodyMatched...)
+
+	filtered := *q
+	filtered.Text = query.Negated(q.Text)
+	split.filtered = &filtered
+	split.matched.only = lo.Filter(bodyMatched, func(urlMd5 string, _ int) bool { return opts.includes(urlMd5) })
+
+	return split, nil
+}
+
+// SearchFacets counts the urls SearchUrls would add or drop for their
+// encrypted body along with those of the wrapped store
+func (s *EncryptedStore) SearchFacets(ctx context.Context, q *query.Query, opts SearchOptions) (*types.Facets, error) {
+	split, err := s.splitSearch(ctx, q, opts)
+	if err != nil {
+		return nil, err
+	}
+	if split == nil {
+		return s.Store.SearchFacets(ctx, q, opts)
+	}
+
+	facets, err := s.Store.SearchFacets(ctx, q, split.rest)
+	if err != nil || len(split.matched.only) == 0 {
+		return facets, err
+	}
+
+	more, err := s.Store.SearchFacets(ctx, split.filtered, split.matched)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newFacetCounts()
+	c.addFacets(facets)
+	c.addFacets(more)
+	return c.facets(), nil
+}
+
+// SearchVisits includes visits to the urls SearchUrls would add for their
+// encrypted body, and leaves out those it would drop
+func (s *EncryptedStore) SearchVisits(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.VisitDbSearchEntity, uint, error) {
+	split, err := s.splitSearch(ctx, q, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	if split == nil {
+		return s.Store.SearchVisits(ctx, q, opts)
+	}
+
+	// @note the page is cut from the merged visits, so both have to be
+	// fetched from the start
+	split.rest.Offset, split.matched.Offset = 0, 0
+	split.rest.Limit = opts.Offset + opts.limit()
+	split.matched.Limit = split.rest.Limit
+
+	visits, count, err := s.Store.SearchVisits(ctx, q, split.rest)
+	if err != nil || len(split.matched.only) == 0 {
+		return paginate(visits, opts), count, err
+	}
+
+	more, moreCount, err := s.Store.SearchVisits(ctx, split.filtered, split.matched)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	visits = append(visits, more...)
+	sortVisits(visits)
+	return paginate(visits, opts), count + moreCount, nil
+}
+
+// A few words around the first match in text, with every match in them
+func snippet(text string, termRe *regexp.Regexp) types.Snippet {
+	words := strings.Fields(text)
+
+	first := 0
+	for i, w := range words {
+		if termRe.MatchString(w) {
+			first = i
+			break
+		}
+	}
+
+	start := first - snippetWords/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWords
+	if end > len(words) {
+		end = len(words)
+	}
+
+	s := strings.Join(words[start:end], " ")
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(words) {
+		s = s + "…"
+	}
+
+	return highlight("content", s, termRe)
+}
+
+// @note queries say as much about what is in the database as the bodies, so
+// those in the search history and saved searches are encrypted as well
+
+// The text encrypted, or as it is if encryption is off
+func (s *EncryptedStore) encryptText(text string) (string, error) {
+	if !s.encrypt || text == "" {
+		return text, nil
+	}
+
+	key, err := s.keyring.Key()
+	if err != nil {
+		return "", err
+	}
+	return key.EncryptString(text)
+}
+
+func (s *EncryptedStore) InsertSearchHistory(ctx context.Context, row types.SearchHistoryRow) error {
+	query, err := s.encryptText(row.Query)
+	if err != nil {
+		return err
+	}
+	row.Query = query
+	return s.Store.InsertSearchHistory(ctx, row)
+}
+
+func (s *EncryptedStore) SearchHistory(ctx context.Context, limit int) ([]types.SearchHistoryRow, error) {
+	xs, err := s.Store.SearchHistory(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range xs {
+		query, err := s.decrypt(&xs[i].Query)
+		if err != nil {
+			return nil, err
+		}
+		xs[i].Query = *query
+	}
+	return xs, nil
+}
+
+func (s *EncryptedStore) SaveSearch(ctx context.Context, row types.SavedSearchRow) error {
+	query, err := s.encryptText(row.Query)
+	if err != nil {
+		return err
+	}
+	row.Query = query
+	return s.Store.SaveSearch(ctx, row)
+}
+
+func (s *EncryptedStore) SavedSearch(ctx context.Context, name string) (*types.SavedSearchRow, error) {
+	x, err := s.Store.SavedSearch(ctx, name)
+	if err != nil || x == nil {
+		return x, err
+	}
+	query, err := s.decrypt(&x.Query)
+	if err != nil {
+		return nil, err
+	}
+	x.Query = *query
+	return x, nil
+}
+
+func (s *EncryptedStore) SavedSearches(ctx context.Context) ([]types.SavedSearchRow, error) {
+	xs, err := s.Store.SavedSearches(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range xs {
+		query, err := s.decrypt(&xs[i].Query)
+		if err != nil {
+			return nil, err
+		}
+		xs[i].Query = *query
+	}
+	return xs, nil
+}
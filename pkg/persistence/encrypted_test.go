@@ -0,0 +1,353 @@
+package persistence_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/crypt"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	inner, err := testutils.GetTestStore(t)
+	require.NoError(t, err)
+	defer inner.Close()
+
+	keyring := crypt.NewKeyring(filepath.Join(t.TempDir(), "key.json"), func() (string, error) {
+		return "hunter2", nil
+	})
+	require.NoError(t, keyring.Create("hunter2"))
+
+	now := time.Now()
+	insert := func(store persistence.Store, url string, body string) {
+		require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, LastVisit: &now}))
+		require.NoError(t, store.InsertDocument(ctx, &types.DocumentRow{
+			DocumentMd5: util.HashMd5String(body),
+			UrlMd5:      util.HashMd5String(url),
+			AccessedAt:  &now,
+			Body:        &body,
+		}))
+	}
+
+	// Scraped before encryption was turned on
+	insert(inner, "https://go.dev", "Go is an open source programming language")
+
+	counting := &bodiesCounter{Store: inner}
+	store := persistence.NewEncryptedStore(counting, keyring, true)
+	insert(store, "https://rust-lang.org", "Rust is a systems programming language")
+
+	plaintext := 0
+	require.NoError(t, inner.Bodies(ctx, "", func(urlMd5 string, body string) error {
+		if !crypt.IsEncrypted(body) {
+			plaintext++
+		}
+		return nil
+	}))
+	require.Equal(t, 1, plaintext)
+
+	for _, url := range []string{"https://go.dev", "https://rust-lang.org"} {
+		require.NoError(t, store.InsertTermVectors(ctx, types.TermVector{
+			UrlMd5: util.HashMd5String(url),
+			Terms:  map[string]float64{"programming": 1},
+		}))
+	}
+
+	n, err := store.EncryptBodies(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	related, err := store.RelatedUrls(ctx, util.HashMd5String("https://go.dev"), 10)
+	require.NoError(t, err)
+	require.Empty(t, related, "term vectors made from encrypted bodies are deleted")
+
+	require.NoError(t, inner.Bodies(ctx, "", func(urlMd5 string, body string) error {
+		require.True(t, crypt.IsEncrypted(body))
+		return nil
+	}))
+
+	unindexed, err := store.Unindexed(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, unindexed, 2)
+	for _, u := range unindexed {
+		require.Nil(t, u.Body, "encrypted bodies are never indexed")
+	}
+
+	results, count, err := store.SearchUrls(ctx, query.MustParse("open source"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), count)
+	require.Len(t, results, 1)
+	require.Equal(t, "https://go.dev", results[0].Url)
+	require.Contains(t, marked(results[0].Snippets), "<mark>open</mark> <mark>source</mark>")
+
+	results, _, err = store.SearchUrls(ctx, query.MustParse("programming"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	paged := []string{}
+	for offset := uint(0); offset < 3; offset++ {
+		page, count, err := store.SearchUrls(ctx, query.MustParse("programming"), persistence.SearchOptions{Limit: 1, Offset: offset})
+		require.NoError(t, err)
+		require.Equal(t, uint(2), count, "matches in encrypted bodies are counted once")
+		for _, r := range page {
+			paged = append(paged, r.Url)
+		}
+	}
+	require.Equal(t, []string{results[0].Url, results[1].Url}, paged, "pages of merged results don't overlap")
+
+	results, _, err = store.SearchUrls(ctx, query.MustParse("programming -systems"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1, "excluded words are found in encrypted bodies")
+	require.Equal(t, "https://go.dev", results[0].Url)
+
+	results, _, err = store.SearchUrls(ctx, query.MustParse("programming site:rust-lang.org"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1, "filters apply to matches in encrypted bodies")
+	require.Equal(t, "https://rust-lang.org", results[0].Url)
+
+	facets, err := store.SearchFacets(ctx, query.MustParse("programming"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, facets.Domains, 2, "matches in encrypted bodies are counted")
+	require.Equal(t, 2, facets.HasFulltext)
+
+	facets, err = store.SearchFacets(ctx, query.MustParse("programming -systems"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []types.FacetCount{{Value: "go.dev", Count: 1}}, facets.Domains)
+
+	for _, url := range []string{"https://go.dev", "https://rust-lang.org"} {
+		require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: now, ExtractorName: "chrome"}))
+	}
+	visits, visitCount, err := store.SearchVisits(ctx, query.MustParse("programming -systems"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), visitCount, "visits are found through encrypted bodies")
+	require.Equal(t, "https://go.dev", visits[0].Url)
+
+	pattern, err := persistence.NewPattern(`(Go|Rust) is an? \w+`, false)
+	require.NoError(t, err)
+	results, count, err = persistence.SearchPattern(ctx, store, pattern, persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(2), count, "patterns are matched against encrypted bodies")
+	require.Len(t, results, 2)
+
+	require.NoError(t, store.Records(ctx, persistence.RecordOptions{}, func(rec *types.UrlRecord) error {
+		require.Len(t, rec.Documents, 1)
+		require.True(t, strings.HasSuffix(*rec.Documents[0].Body, "programming language"))
+		return nil
+	}))
+
+	// Bodies are read once and kept up to date with what is written after that
+	reads := counting.reads
+	require.Positive(t, reads)
+	insert(store, "https://ziglang.org", "Zig is a systems programming language")
+	results, _, err = store.SearchUrls(ctx, query.MustParse("systems"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"https://rust-lang.org", "https://ziglang.org"}, lo.Map(results, func(r types.UrlDbSearchEntity, _ int) string { return r.Url }))
+	require.Equal(t, reads, counting.reads, "searches don't read every body again")
+
+	// ...but not once they are changed
+	key, err := keyring.Key()
+	require.NoError(t, err)
+	_, err = store.UpdateBodies(ctx, func(body string) (string, error) {
+		plaintext, err := key.DecryptString(body)
+		if err != nil || !strings.HasPrefix(plaintext, "Rust") {
+			return body, err
+		}
+		return key.EncryptString("Rust is a memory safe language")
+	})
+	require.NoError(t, err)
+
+	results, _, err = store.SearchUrls(ctx, query.MustParse("systems"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, "https://ziglang.org", results[0].Url)
+	results, _, err = store.SearchUrls(ctx, query.MustParse("memory safe"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, "https://rust-lang.org", results[0].Url)
+	require.Equal(t, reads+1, counting.reads)
+}
+
+// A store that counts how often every body is read
+type bodiesCounter struct {
+	persistence.Store
+	reads int
+}
+
+func (s *bodiesCounter) Bodies(ctx context.Context, prefix string, fn func(urlMd5 string, body string) error) error {
+	s.reads++
+	return s.Store.Bodies(ctx, prefix, fn)
+}
+
+func TestEncryptedSearchHistory(t *testing.T) {
+	ctx := context.Background()
+	inner := persistence.NewMemoryStore()
+	keyring := crypt.NewKeyring(filepath.Join(t.TempDir(), "key.json"), func() (string, error) {
+		return "hunter2", nil
+	})
+	require.NoError(t, keyring.Create("hunter2"))
+	store := persistence.NewEncryptedStore(inner, keyring, true)
+
+	require.NoError(t, store.InsertSearchHistory(ctx, types.SearchHistoryRow{Query: "symptoms of flu", SearchedAt: time.Now()}))
+	require.NoError(t, store.SaveSearch(ctx, types.SavedSearchRow{Name: "health", Query: "doctor near me", CreatedAt: time.Now()}))
+
+	stored, err := inner.SearchHistory(ctx, 10)
+	require.NoError(t, err)
+	require.True(t, crypt.IsEncrypted(stored[0].Query), "queries aren't stored in plaintext")
+	saved, err := inner.SavedSearch(ctx, "health")
+	require.NoError(t, err)
+	require.True(t, crypt.IsEncrypted(saved.Query))
+
+	searches, err := store.SearchHistory(ctx, 10)
+	require.NoError(t, err)
+	require.Equal(t, "symptoms of flu", searches[0].Query)
+	saved, err = store.SavedSearch(ctx, "health")
+	require.NoError(t, err)
+	require.Equal(t, "doctor near me", saved.Query)
+	all, err := store.SavedSearches(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "doctor near me", all[0].Query)
+}
+
+func TestMergeEncryptedWithAnotherKey(t *testing.T) {
+	ctx := context.Background()
+	newKeyring := func() *crypt.Keyring {
+		// @note the same passphrase, but every key file has a salt of its own
+		keyring := crypt.NewKeyring(filepath.Join(t.TempDir(), "key.json"), func() (string, error) {
+			return "hunter2", nil
+		})
+		require.NoError(t, keyring.Create("hunter2"))
+		return keyring
+	}
+	ours, theirs := newKeyring(), newKeyring()
+
+	srcConn, err := testutils.GetTestDBConn(t)
+	require.NoError(t, err)
+	src := persistence.NewEncryptedStore(persistence.NewSqliteStore(srcConn), theirs, true)
+	defer src.Close()
+
+	now := time.Now()
+	body := "Go is an open source programming language"
+	require.NoError(t, src.InsertUrl(ctx, &types.UrlRow{Url: "https://go.dev", LastVisit: &now}))
+	require.NoError(t, src.InsertDocument(ctx, &types.DocumentRow{
+		DocumentMd5: util.HashMd5String(body),
+		UrlMd5:      util.HashMd5String("https://go.dev"),
+		AccessedAt:  &now,
+		Body:        &body,
+	}))
+
+	stores := map[string]func() persistence.Store{
+		"another key": func() persistence.Store {
+			inner, err := testutils.GetTestStore(t)
+			require.NoError(t, err)
+			return persistence.NewEncryptedStore(inner, ours, true)
+		},
+		"no key": func() persistence.Store {
+			store, err := testutils.GetTestStore(t)
+			require.NoError(t, err)
+			return store
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			dst := newStore()
+			defer dst.Close()
+
+			report, err := persistence.Merge(ctx, dst, srcConn)
+			require.NoError(t, err)
+			require.Equal(t, 1, report.NewUrls, "urls and visits are merged")
+			require.Equal(t, 0, report.Documents)
+			require.Equal(t, 1, report.ForeignDocuments)
+
+			withDocs, err := dst.UrlsWithDocuments(ctx, util.HashMd5String("https://go.dev"))
+			require.NoError(t, err)
+			require.Empty(t, withDocs, "the ciphertext isn't stored")
+
+			unindexed, err := dst.Unindexed(ctx, 10)
+			require.NoError(t, err)
+			require.Len(t, unindexed, 1)
+			require.Nil(t, unindexed[0].Body, "nor indexed as text")
+		})
+	}
+
+	t.Run("the same key", func(t *testing.T) {
+		inner, err := testutils.GetTestStore(t)
+		require.NoError(t, err)
+		dst := persistence.NewEncryptedStore(inner, theirs, true)
+		defer dst.Close()
+
+		report, err := persistence.Merge(ctx, dst, srcConn)
+		require.NoError(t, err)
+		require.Equal(t, 1, report.Documents)
+		require.Equal(t, 0, report.ForeignDocuments)
+
+		n := 0
+		require.NoError(t, dst.Bodies(ctx, "", func(urlMd5 string, b string) error {
+			require.Equal(t, body, b)
+			n++
+			return nil
+		}))
+		require.Equal(t, 1, n)
+	})
+}
+
+func TestEncryptBodiesVocabulary(t *testing.T) {
+	ctx := context.Background()
+	inner, err := testutils.GetTestStore(t)
+	require.NoError(t, err)
+	defer inner.Close()
+
+	keyring := crypt.NewKeyring(filepath.Join(t.TempDir(), "key.json"), func() (string, error) {
+		return "hunter2", nil
+	})
+	require.NoError(t, keyring.Create("hunter2"))
+
+	now := time.Now()
+	url := "https://example.com/gophers"
+	title := "Gophers"
+	body := "Notes on gopherology and burrows"
+	id := util.HashMd5String(url)
+	require.NoError(t, inner.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title, LastVisit: &now}))
+	require.NoError(t, inner.InsertDocument(ctx, &types.DocumentRow{
+		DocumentMd5: util.HashMd5String(body),
+		UrlMd5:      id,
+		AccessedAt:  &now,
+		Body:        &body,
+	}))
+	fragments := []types.Fragment{
+		{E: id, T: "urls", A: "title", V: title},
+		{E: id, T: "documents", A: "content", V: body},
+	}
+	_, err = inner.ReplaceFragments(ctx, []string{id}, fragments...)
+	require.NoError(t, err)
+	require.NoError(t, inner.ReplaceVocabulary(ctx, []string{id}, persistence.Vocabulary(fragments)...))
+
+	words := func(word string) []string {
+		xs, err := inner.SimilarWords(ctx, word, 10)
+		require.NoError(t, err)
+		ws := []string{}
+		for _, x := range xs {
+			ws = append(ws, x.Word)
+		}
+		return ws
+	}
+	require.Contains(t, words("gopherolgy"), "gopherology")
+
+	store := persistence.NewEncryptedStore(inner, keyring, true)
+	n, err := store.EncryptBodies(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	require.NotContains(t, words("gopherolgy"), "gopherology", "words of encrypted bodies aren't suggested")
+	require.NotContains(t, words("burows"), "burrows")
+	require.Contains(t, words("gophes"), "gophers", "words that are still indexed are")
+}
@@ -0,0 +1,162 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// The kinds of facet, as selected by facet queries
+const (
+	facetDomain   = "domain"
+	facetBrowser  = "browser"
+	facetMonth    = "month"
+	facetFulltext = "fulltext"
+)
+
+// The format of the months in types.Facets
+const facetMonthLayout = "2006-01"
+
+// facetCounts adds up the urls with each facet value, see Store.SearchFacets
+type facetCounts struct {
+	domains  map[string]int
+	browsers map[string]int
+	months   map[string]int
+	fulltext int
+}
+
+func newFacetCounts() *facetCounts {
+	return &facetCounts{domains: map[string]int{}, browsers: map[string]int{}, months: map[string]int{}}
+}
+
+// Count n more urls with the value of a kind of facet. Hosts that only differ
+// by www. are counted as one domain, as site: doesn't tell them apart.
+func (c *facetCounts) add(kind string, value string, n int) {
+	if kind == facetDomain {
+		value = strings.TrimPrefix(value, "www.")
+	}
+	if value == "" && kind != facetFulltext {
+		return
+	}
+
+	switch kind {
+	case facetDomain:
+		c.domains[value] += n
+	case facetBrowser:
+		c.browsers[strings.ToLower(value)] += n
+	case facetMonth:
+		c.months[value] += n
+	case facetFulltext:
+		c.fulltext += n
+	}
+}
+
+// Add the counts of facets of other urls
+func (c *facetCounts) addFacets(f *types.Facets) {
+	for _, x := range f.Domains {
+		c.add(facetDomain, x.Value, x.Count)
+	}
+	for _, x := range f.Browsers {
+		c.add(facetBrowser, x.Value, x.Count)
+	}
+	for _, x := range f.Months {
+		c.add(facetMonth, x.Value, x.Count)
+	}
+	c.add(facetFulltext, "", f.HasFulltext)
+}
+
+func (c *facetCounts) facets() *types.Facets {
+	months := facetCountsOf(c.months)
+	sort.SliceStable(months, func(i, j int) bool { return months[i].Value > months[j].Value })
+
+	return &types.Facets{
+		Domains:     mostCommon(c.domains),
+		Browsers:    mostCommon(c.browsers),
+		Months:      months,
+		HasFulltext: c.fulltext,
+	}
+}
+
+// Counts sorted by value
+func facetCountsOf(m map[string]int) []types.FacetCount {
+	xs := make([]types.FacetCount, 0, len(m))
+	for v, n := range m {
+		xs = append(xs, types.FacetCount{Value: v, Count: n})
+	}
+	sort.Slice(xs, func(i, j int) bool { return xs[i].Value < xs[j].Value })
+	return xs
+}
+
+// Counts sorted by count, highest first, and then by value
+func mostCommon(m map[string]int) []types.FacetCount {
+	xs := facetCountsOf(m)
+	sort.SliceStable(xs, func(i, j int) bool { return xs[i].Count > xs[j].Count })
+	return xs
+}
+
+// Facets of the urls selected by matched, SQL with a url_md5 column that can
+// use the arguments of f. Browsers and months only count visits that satisfy q.
+func searchFacets(ctx context.Context, db *sql.DB, f *queryFilter, q *query.Query, matched string) (*types.Facets, error) {
+	host := "url_host(u.url)"
+	month := `strftime('%Y-%m', v.visit_time, 'unixepoch', 'localtime')`
+	if f.dialect == dialectPostgres {
+		host = postgresUrlHost
+		month = `to_char(to_timestamp(v.visit_time), 'YYYY-MM')`
+	}
+
+	visit := "1 = 1"
+	if conds := f.visitConds(q); len(conds) > 0 {
+		visit = strings.Join(conds, " AND ")
+	}
+
+	// @note a url is counted once per browser and month however many of its
+	// visits there were
+	rows, err := db.QueryContext(ctx, `
+WITH
+  matched AS (
+    `+matched+`
+  )
+SELECT '`+facetDomain+`', `+host+`, count(*)
+FROM matched m INNER JOIN urls u ON u.url_md5 = m.url_md5
+GROUP BY 2
+UNION ALL
+SELECT '`+facetBrowser+`', lower(v.extractor_name), count(DISTINCT v.url_md5)
+FROM matched m INNER JOIN visits v ON v.url_md5 = m.url_md5
+WHERE `+visit+`
+GROUP BY 2
+UNION ALL
+SELECT '`+facetMonth+`', `+month+`, count(DISTINCT v.url_md5)
+FROM matched m INNER JOIN visits v ON v.url_md5 = m.url_md5
+WHERE `+visit+`
+GROUP BY 2
+UNION ALL
+SELECT '`+facetFulltext+`', '', count(*)
+FROM matched m
+WHERE EXISTS (
+  SELECT 1 FROM url_document_edges ed INNER JOIN documents d ON d.document_md5 = ed.document_md5
+  WHERE ed.url_md5 = m.url_md5 AND d.body IS NOT NULL
+);
+`, f.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "facet query error")
+	}
+	defer rows.Close()
+
+	c := newFacetCounts()
+	for rows.Next() {
+		var kind string
+		var value sql.NullString
+		var n int
+		if err := rows.Scan(&kind, &value, &n); err != nil {
+			return nil, errors.Wrap(err, "row error")
+		}
+		c.add(kind, value.String, n)
+	}
+
+	return c.facets(), errors.Wrap(rows.Err(), "facet query error")
+}
@@ -0,0 +1,68 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchFacets(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			jan := time.Date(2022, 1, 15, 12, 0, 0, 0, time.Local)
+			feb := time.Date(2022, 2, 15, 12, 0, 0, 0, time.Local)
+			insert := func(url, title string, visits map[time.Time]string) {
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title}))
+				for v, browser := range visits {
+					require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: v, ExtractorName: browser}))
+				}
+				require.NoError(t, store.InsertFragments(ctx, types.Fragment{E: util.HashMd5String(url), T: "urls", A: "title", V: title}))
+			}
+
+			insert("https://github.com/golang/go", "Go issues", map[time.Time]string{jan: "chrome", feb: "firefox"})
+			insert("https://www.github.com/golang/tools", "Go tools", map[time.Time]string{jan: "chrome", jan.Add(time.Hour): "chrome"})
+			insert("https://go.dev", "The Go programming language", map[time.Time]string{feb: "Firefox"})
+			insert("https://rust-lang.org", "Rust", map[time.Time]string{feb: "chrome"})
+
+			body := "Go is an open source programming language"
+			require.NoError(t, store.InsertDocument(ctx, &types.DocumentRow{
+				DocumentMd5: util.HashMd5String(body),
+				UrlMd5:      util.HashMd5String("https://go.dev"),
+				Body:        &body,
+			}))
+
+			facets, err := store.SearchFacets(ctx, query.MustParse("go"), persistence.SearchOptions{Limit: 1})
+			require.NoError(t, err)
+			require.Equal(t, []types.FacetCount{{Value: "github.com", Count: 2}, {Value: "go.dev", Count: 1}}, facets.Domains, "www. is left out and the limit ignored")
+			require.Equal(t, []types.FacetCount{{Value: "chrome", Count: 2}, {Value: "firefox", Count: 2}}, facets.Browsers, "lowercased, ties in order of name")
+			require.Equal(t, []types.FacetCount{{Value: "2022-02", Count: 2}, {Value: "2022-01", Count: 2}}, facets.Months, "most recent first, each url counted once")
+			require.Equal(t, 1, facets.HasFulltext)
+
+			facets, err = store.SearchFacets(ctx, query.MustParse("go browser:firefox"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, []types.FacetCount{{Value: "firefox", Count: 2}}, facets.Browsers, "only visits that match are counted")
+			require.Equal(t, []types.FacetCount{{Value: "2022-02", Count: 2}}, facets.Months)
+
+			facets, err = store.SearchFacets(ctx, query.MustParse("go before:2022-02-01"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, []types.FacetCount{{Value: "github.com", Count: 2}}, facets.Domains)
+			require.Equal(t, []types.FacetCount{{Value: "2022-01", Count: 2}}, facets.Months)
+			require.Equal(t, 0, facets.HasFulltext)
+
+			facets, err = store.SearchFacets(ctx, query.MustParse("site:rust-lang.org"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, []types.FacetCount{{Value: "rust-lang.org", Count: 1}}, facets.Domains, "filters alone are faceted too")
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// The ids of fragments, see generateEavId
+func fragmentIds(fragments []types.Fragment) (map[int64]bool, error) {
+	ids := map[int64]bool{}
+	for _, f := range fragments {
+		id, err := generateEavId(f.E, f.T, f.A, f.V)
+		if err != nil {
+			return nil, errors.Wrap(err, "error generating eav id")
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// Delete the fragments of the entities with the given ids, other than those in
+// keep. Returns how many were deleted.
+//
+// @note fragments are deleted one at a time rather than replaced, so that
+// sqlite's fragment_ad trigger removes them from the full-text indexes. Those
+// in keep are left alone, so that the indexes don't churn for what hasn't
+// changed.
+func deleteStaleFragments(ctx context.Context, tx *sql.Tx, dialect sqlDialect, ids []string, keep map[int64]bool) (int, error) {
+	stale := []int64{}
+	for _, batch := range lo.Chunk(ids, recordBatchSize) {
+		f := &queryFilter{dialect: dialect}
+		rows, err := tx.QueryContext(ctx, `SELECT id FROM fragment WHERE e `+f.in(batch)+`;`, f.args...)
+		if err != nil {
+			return 0, errors.Wrap(err, "query error")
+		}
+
+		for rows.Next() {
+			var id int64
+			err := rows.Scan(&id)
+			if err != nil {
+				rows.Close()
+				return 0, errors.Wrap(err, "row error")
+			}
+			if !keep[id] {
+				stale = append(stale, id)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, errors.Wrap(err, "query error")
+		}
+	}
+
+	for _, id := range stale {
+		f := &queryFilter{dialect: dialect}
+		_, err := tx.ExecContext(ctx, `DELETE FROM fragment WHERE id = `+f.arg(id)+`;`, f.args...)
+		if err != nil {
+			return 0, errors.Wrap(err, "error deleting fragment")
+		}
+	}
+
+	return len(stale), nil
+}
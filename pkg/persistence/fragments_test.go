@@ -0,0 +1,65 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaceFragments(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			search := func(q string) []string {
+				results, _, err := store.SearchUrls(ctx, query.MustParse(q), persistence.SearchOptions{})
+				require.NoError(t, err)
+				urls := []string{}
+				for _, x := range results {
+					urls = append(urls, x.Url)
+				}
+				return urls
+			}
+
+			gophers := "https://gophers.example/care"
+			ferrets := "https://ferrets.example/care"
+			for _, url := range []string{gophers, ferrets} {
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url}))
+			}
+			md5 := util.HashMd5String(gophers)
+			require.NoError(t, store.InsertFragments(ctx,
+				types.Fragment{E: md5, T: "urls", A: "title", V: "Caring for gophers"},
+				types.Fragment{E: md5, T: "documents", A: "content", V: "Gophers dig burrows in meadows."},
+				types.Fragment{E: util.HashMd5String(ferrets), T: "urls", A: "title", V: "Caring for ferrets"},
+			))
+
+			stale, err := store.ReplaceFragments(ctx, []string{md5},
+				types.Fragment{E: md5, T: "urls", A: "title", V: "Caring for gophers"},
+				types.Fragment{E: md5, T: "documents", A: "content", V: "Gophers sleep in winter."},
+			)
+			require.NoError(t, err)
+			require.Equal(t, 1, stale, "only the content that changed is stale")
+			require.Empty(t, search("meadows"))
+			require.Equal(t, []string{gophers}, search("winter"))
+			require.Len(t, search("caring"), 2, "other urls are left alone")
+
+			stale, err = store.ReplaceFragments(ctx, []string{md5})
+			require.NoError(t, err)
+			require.Equal(t, 2, stale)
+			require.Equal(t, []string{ferrets}, search("caring"))
+
+			n, err := store.DeleteEntityFragments(ctx, util.HashMd5String(ferrets), "unknown")
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			require.Empty(t, search("caring"))
+		})
+	}
+}
@@ -0,0 +1,496 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// @note the `order by random()` is meant to avoid trying to scrape from the same website all at once. No DoS!
+// @note redacted urls are never scraped. The page they point to is not the one that was visited.
+const queryUrlsWithoutDocuments = `
+SELECT
+	u.url_md5,
+  u.url,
+	u.title,
+	u.description,
+  u.last_visit
+FROM
+  urls u
+  LEFT OUTER JOIN url_document_edges edge ON u.url_md5 = edge.url_md5
+WHERE
+  edge.url_md5 IS NULL
+  AND u.redacted = 0
+ORDER BY
+	RANDOM()
+LIMIT ?;
+`
+
+const countUrlsWithoutDocuments = `
+SELECT
+	COUNT(*)
+FROM
+  urls u
+  LEFT OUTER JOIN url_document_edges edge ON u.url_md5 = edge.url_md5
+WHERE
+  edge.url_md5 IS NULL
+  AND u.redacted = 0;
+`
+
+const whereUnindexedDocuments = `
+	documents.body NOT NULL
+	AND documents.body != ''
+	AND urls_meta.indexed_at < documents.accessed_at`
+
+func (s *SqliteStore) CountUrlsWithoutDocuments(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, countUrlsWithoutDocuments).Scan(&n)
+	return n, err
+}
+
+func (s *SqliteStore) UrlsWithoutDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	rows, err := s.db.QueryContext(ctx, queryUrlsWithoutDocuments, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query for urls without documents")
+	}
+	defer rows.Close()
+
+	var urls []types.UrlDbEntity
+
+	for rows.Next() {
+		var u types.UrlDbEntity
+		var ts int64
+
+		err := rows.Scan(&u.UrlMd5, &u.Url, &u.Title, &u.Description, &ts)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		u.LastVisit = unixOrNil(ts)
+		urls = append(urls, u)
+	}
+
+	return urls, rows.Err()
+}
+
+func (s *SqliteStore) UrlsWithDocuments(ctx context.Context, ids ...string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	in, args := placeholders(ids)
+	rows, err := s.db.QueryContext(ctx, `SELECT url_md5 FROM url_document_edges WHERE url_md5 IN (`+in+`);`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var xs []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, id)
+	}
+
+	return xs, rows.Err()
+}
+
+func (s *SqliteStore) DocumentMd5s(ctx context.Context, ids ...string) (map[string]string, error) {
+	return documentMd5s(ctx, s.db, dialectSqlite, ids)
+}
+
+func (s *SqliteStore) CountUnindexed(ctx context.Context) (int, error) {
+	return s.countUrlsWhere(ctx, "indexed_at IS NULL")
+}
+
+func (s *SqliteStore) Unindexed(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	const qry = `
+		SELECT
+			u.url_md5,
+			u.url,
+			u.title,
+			u.description,
+			u.last_visit,
+			doc.document_md5,
+			doc.body
+		FROM
+			urls u
+			LEFT OUTER JOIN urls_meta um ON u.url_md5 = um.url_md5
+			LEFT OUTER JOIN url_document_edges ON u.url_md5 = url_document_edges.url_md5
+			LEFT OUTER JOIN documents doc ON url_document_edges.document_md5 = doc.document_md5
+		WHERE
+			um.indexed_at IS NULL
+		ORDER BY
+			last_visit DESC
+		LIMIT ?;
+	`
+
+	rows, err := s.db.QueryContext(ctx, qry, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying unindexed urls")
+	}
+	defer rows.Close()
+
+	var docs []types.UrlDbEntity
+
+	for rows.Next() {
+		var ent types.UrlDbEntity
+		var ts int64
+		err := rows.Scan(&ent.UrlMd5, &ent.Url, &ent.Title, &ent.Description, &ts, &ent.BodyMd5, &ent.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		ent.LastVisit = unixOrNil(ts)
+		docs = append(docs, ent)
+	}
+
+	return docs, rows.Err()
+}
+
+func (s *SqliteStore) CountUnindexedDocuments(ctx context.Context) (int, error) {
+	return s.countUrlsWhere(ctx, whereUnindexedDocuments)
+}
+
+func (s *SqliteStore) UnindexedDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	qry := `
+			SELECT
+				u.url_md5,
+				u.url,
+				u.title,
+				u.description,
+				u.last_visit,
+				d.document_md5,
+				d.body
+			FROM
+				urls u
+				JOIN url_document_edges edge ON u.url_md5 = edge.url_md5
+				JOIN documents d ON edge.document_md5 = d.document_md5
+				JOIN urls_meta m ON u.url_md5 = m.url_md5
+			WHERE
+				d.body NOT NULL
+				AND d.body != ''
+				AND m.indexed_at < d.accessed_at
+			LIMIT ?;
+		`
+
+	rows, err := s.db.QueryContext(ctx, qry, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query for urls with unindexed documents")
+	}
+	defer rows.Close()
+
+	var ents []types.UrlDbEntity
+
+	for rows.Next() {
+		var ent types.UrlDbEntity
+		var ts int64
+
+		err := rows.Scan(
+			&ent.UrlMd5,
+			&ent.Url,
+			&ent.Title,
+			&ent.Description,
+			&ts,
+			&ent.BodyMd5,
+			&ent.Body,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+
+		ent.LastVisit = unixOrNil(ts)
+		ents = append(ents, ent)
+	}
+
+	return ents, rows.Err()
+}
+
+// The reason we need an int ID is due to the int requirement on rowid in the fts table.
+func generateEavId(e string, t string, a string, v string) (int64, error) {
+	shasum := util.HashSha1String(fmt.Sprintf("%s%s%s%s", e, t, a, v))
+
+	// take the first 15 characters of the sha1 hash, as this is the max that will
+	// fit into sqlite int column (it's signed, i think. otherwise we could take
+	// 16 chars)
+	hexId := shasum[0:15]
+
+	// convert to a base 10 number
+	return strconv.ParseInt(hexId, 16, 64)
+}
+
+/**
+ * Index an entity
+ */
+func indexEav(ctx context.Context, db *sql.Tx, f types.Fragment) error {
+	// insert into the fragments table
+	// @note not INSERT OR REPLACE. The implicit delete of a replace does not fire
+	// the fragment_ad trigger, which leaves a duplicate entry in fragment_fts.
+	// The id is a hash of the content, so an existing row is already identical
+	// but for the section it is in.
+	const qry = `
+		INSERT INTO
+			fragment(id, e, t, a, v, section)
+				VALUES(?, ?, ?, ?, ?, nullif(?, ''))
+		ON CONFLICT(id) DO UPDATE SET
+			section = excluded.section
+		WHERE
+			section IS NOT excluded.section;
+	`
+
+	id, err := generateEavId(f.E, f.T, f.A, f.V)
+	if err != nil {
+		return errors.Wrap(err, "error generating eav id")
+	}
+
+	_, err = db.ExecContext(ctx, qry, id, f.E, f.T, f.A, f.V, f.Section)
+	if err != nil {
+		return errors.Wrap(err, "error inserting fragment")
+	}
+
+	return nil
+}
+
+func (s *SqliteStore) InsertFragments(ctx context.Context, fragments ...types.Fragment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fragments {
+		err := indexEav(ctx, tx, f)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteStore) ReplaceFragments(ctx context.Context, ids []string, fragments ...types.Fragment) (int, error) {
+	keep, err := fragmentIds(fragments)
+	if err != nil {
+		return 0, err
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := deleteStaleFragments(ctx, tx, dialectSqlite, ids, keep)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, f := range fragments {
+		err := indexEav(ctx, tx, f)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return n, tx.Commit()
+}
+
+func (s *SqliteStore) DeleteEntityFragments(ctx context.Context, ids ...string) (int, error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	var n int
+	for _, batch := range lo.Chunk(ids, recordBatchSize) {
+		f := &queryFilter{dialect: dialectSqlite}
+		res, err := s.db.ExecContext(ctx, `DELETE FROM fragment WHERE e `+f.in(batch)+`;`, f.args...)
+		if err != nil {
+			return n, err
+		}
+
+		count, err := res.RowsAffected()
+		if err != nil {
+			return n, err
+		}
+		n += int(count)
+	}
+
+	return n, nil
+}
+
+func (s *SqliteStore) ReplaceVocabulary(ctx context.Context, ids []string, rows ...types.VocabularyRow) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	return replaceVocabulary(ctx, s.db, dialectSqlite, ids, rows)
+}
+
+// @note the vocabulary is only ever changed by the url_vocabulary triggers
+func replaceVocabulary(ctx context.Context, db *sql.DB, dialect sqlDialect, ids []string, rows []types.VocabularyRow) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range lo.Chunk(ids, recordBatchSize) {
+		f := &queryFilter{dialect: dialect}
+		_, err := tx.ExecContext(ctx, `DELETE FROM url_vocabulary WHERE url_md5 `+f.in(batch)+`;`, f.args...)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error deleting words")
+		}
+	}
+
+	for _, row := range rows {
+		f := &queryFilter{dialect: dialect}
+		_, err := tx.ExecContext(ctx, `INSERT INTO url_vocabulary(url_md5, word, count) VALUES(`+f.values([]string{row.UrlMd5, row.Word})+`, `+f.arg(row.Count)+`);`, f.args...)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error inserting word")
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteStore) DeleteVocabulary(ctx context.Context) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	return deleteVocabulary(ctx, s.db)
+}
+
+// @note the vocabulary goes first so that the triggers have nothing to update
+func deleteVocabulary(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"vocabulary", "url_vocabulary"} {
+		_, err := tx.ExecContext(ctx, `DELETE FROM `+table+`;`)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "error deleting %s", table)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteStore) InsertTermVectors(ctx context.Context, vectors ...types.TermVector) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vectors {
+		_, err := tx.ExecContext(ctx, `DELETE FROM term_vectors WHERE url_md5 = ?;`, v.UrlMd5)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error deleting term vector")
+		}
+
+		for term, weight := range v.Terms {
+			_, err := tx.ExecContext(ctx, `INSERT INTO term_vectors(url_md5, term, weight) VALUES(?, ?, ?);`, v.UrlMd5, term, weight)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "error inserting term")
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteStore) DeleteTermVectors(ctx context.Context, ids ...string) (int, error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	var n int
+	for _, batch := range lo.Chunk(ids, recordBatchSize) {
+		f := &queryFilter{dialect: dialectSqlite}
+		in := f.in(batch)
+
+		var count int
+		err := s.db.QueryRowContext(ctx, `SELECT count(DISTINCT url_md5) FROM term_vectors WHERE url_md5 `+in+`;`, f.args...).Scan(&count)
+		if err != nil {
+			return n, err
+		}
+
+		_, err = s.db.ExecContext(ctx, `DELETE FROM term_vectors WHERE url_md5 `+in+`;`, f.args...)
+		if err != nil {
+			return n, err
+		}
+		n += count
+	}
+
+	return n, nil
+}
+
+func (s *SqliteStore) ResetIndexed(ctx context.Context) error {
+	qry := `
+		UPDATE
+			urls_meta
+		SET
+			indexed_at = NULL
+		WHERE
+			indexed_at NOT NULL;
+	`
+	_, err := s.db.ExecContext(ctx, qry)
+	return err
+}
+
+func (s *SqliteStore) MarkUnindexed(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	in, args := placeholders(ids)
+	_, err := s.db.ExecContext(ctx, `UPDATE urls_meta SET indexed_at = NULL WHERE url_md5 IN (`+in+`);`, args...)
+	return err
+}
+
+func (s *SqliteStore) DeleteFragments(ctx context.Context, t string) (int, error) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM fragment WHERE t = ?;`, t)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *SqliteStore) RebuildSearchIndex(ctx context.Context) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	return RebuildSearchIndex(ctx, s.db)
+}
+
+// @note last visit time can be zero, indicating unknown visit time. This
+// will happen if importing from browserparrot/persistory because the visits
+// table had a bug
+func unixOrNil(ts int64) *time.Time {
+	if ts <= 0 {
+		return nil
+	}
+	t := time.Unix(ts, 0)
+	return &t
+}
@@ -0,0 +1,1272 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/samber/lo"
+)
+
+// MemoryStore is a Store that keeps everything in maps. It is meant for unit
+// tests, where it is much quicker to set up than a migrated database. Search
+// is a naive case-insensitive substring match rather than real full-text
+// search, and Diagnose always reports a healthy store.
+type MemoryStore struct {
+	lock sync.RWMutex
+
+	urls      map[string]*memoryUrl
+	visits    map[memoryVisitKey]string               // -> extractor name
+	bookmarks map[string]map[string]types.BookmarkRow // extractor name -> url_md5 -> bookmark
+	documents map[string]*types.DocumentRow
+	edges     map[string]string    // url_md5 -> document_md5
+	meta      map[string]time.Time // url_md5 -> indexed_at
+	fragments map[int64]types.Fragment
+	titles    map[string]map[string]*types.TitleRecord // url_md5 -> title -> history
+	words     map[string]map[string]int                // vocabulary, url_md5 -> word -> count
+	vectors   map[string]map[string]float64            // url_md5 -> term -> weight
+	searches  []types.SearchHistoryRow                 // oldest first
+	saved     map[string]types.SavedSearchRow
+}
+
+type memoryUrl struct {
+	types.UrlDbEntity
+	Redacted bool
+}
+
+type memoryVisitKey struct {
+	urlMd5    string
+	visitTime int64
+}
+
+// Compile time check that MemoryStore satisfies the Store interface
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		urls:      map[string]*memoryUrl{},
+		visits:    map[memoryVisitKey]string{},
+		bookmarks: map[string]map[string]types.BookmarkRow{},
+		documents: map[string]*types.DocumentRow{},
+		edges:     map[string]string{},
+		meta:      map[string]time.Time{},
+		fragments: map[int64]types.Fragment{},
+		titles:    map[string]map[string]*types.TitleRecord{},
+		words:     map[string]map[string]int{},
+		vectors:   map[string]map[string]float64{},
+		saved:     map[string]types.SavedSearchRow{},
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) InsertUrl(ctx context.Context, row *types.UrlRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	md5 := util.HashMd5String(row.Url)
+	if row.Title != nil && *row.Title != "" {
+		s.addTitle(md5, types.TitleRecord{Title: *row.Title, FirstSeen: row.LastVisit, LastSeen: row.LastVisit})
+	}
+
+	existing, ok := s.urls[md5]
+	if !ok {
+		s.urls[md5] = &memoryUrl{
+			UrlDbEntity: types.UrlDbEntity{
+				UrlMd5:      md5,
+				Url:         row.Url,
+				Title:       row.Title,
+				Description: row.Description,
+				LastVisit:   row.LastVisit,
+			},
+			Redacted: row.Redacted,
+		}
+		return nil
+	}
+
+	// Same rules as the sqlite upsert: newer data wins, and last_visit never moves backwards
+	if laterOrEqual(row.LastVisit, existing.LastVisit) {
+		existing.Title = coalesce(row.Title, existing.Title)
+		existing.Description = coalesce(row.Description, existing.Description)
+		existing.LastVisit = coalesceTime(row.LastVisit, existing.LastVisit)
+	} else {
+		existing.Title = coalesce(existing.Title, row.Title)
+		existing.Description = coalesce(existing.Description, row.Description)
+	}
+	existing.Redacted = existing.Redacted || row.Redacted
+
+	return nil
+}
+
+func (s *MemoryStore) UrlsById(ctx context.Context, ids ...string) ([]types.UrlDbEntity, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var urls []types.UrlDbEntity
+	for _, id := range ids {
+		if u, ok := s.urls[id]; ok {
+			urls = append(urls, u.UrlDbEntity)
+		}
+	}
+
+	return urls, nil
+}
+
+func (s *MemoryStore) UrlsWithParams(ctx context.Context) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var urls []string
+	for _, u := range s.urls {
+		if strings.ContainsAny(u.Url, "?#") {
+			urls = append(urls, u.Url)
+		}
+	}
+	sort.Strings(urls)
+
+	return urls, nil
+}
+
+func (s *MemoryStore) RewriteUrl(ctx context.Context, oldUrl string, newUrl string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	oldMd5 := util.HashMd5String(oldUrl)
+	newMd5 := util.HashMd5String(newUrl)
+	old, ok := s.urls[oldMd5]
+	if !ok || oldMd5 == newMd5 {
+		return nil
+	}
+
+	if existing, ok := s.urls[newMd5]; ok {
+		existing.LastVisit = maxTime(existing.LastVisit, old.LastVisit)
+		existing.Redacted = true
+	} else {
+		moved := *old
+		moved.UrlMd5 = newMd5
+		moved.Url = newUrl
+		moved.VisitCount = 0
+		moved.Redacted = true
+		s.urls[newMd5] = &moved
+	}
+
+	for k, extractor := range s.visits {
+		if k.urlMd5 != oldMd5 {
+			continue
+		}
+		delete(s.visits, k)
+		s.addVisit(memoryVisitKey{urlMd5: newMd5, visitTime: k.visitTime}, extractor)
+	}
+
+	for _, t := range s.titles[oldMd5] {
+		s.addTitle(newMd5, *t)
+	}
+	delete(s.titles, oldMd5)
+
+	for id, f := range s.fragments {
+		if f.E == oldMd5 {
+			delete(s.fragments, id)
+		}
+	}
+
+	if docMd5, ok := s.edges[oldMd5]; ok {
+		delete(s.edges, oldMd5)
+		if !s.documentIsLinked(docMd5) {
+			delete(s.documents, docMd5)
+		}
+	}
+
+	for _, bookmarks := range s.bookmarks {
+		if b, ok := bookmarks[oldMd5]; ok {
+			delete(bookmarks, oldMd5)
+			if _, ok := bookmarks[newMd5]; !ok {
+				bookmarks[newMd5] = b
+			}
+		}
+	}
+
+	delete(s.vectors, oldMd5)
+	delete(s.words, oldMd5)
+	delete(s.meta, oldMd5)
+	delete(s.meta, newMd5)
+	delete(s.urls, oldMd5)
+
+	return nil
+}
+
+func (s *MemoryStore) InsertTitles(ctx context.Context, url string, titles ...types.TitleRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	md5 := util.HashMd5String(url)
+	for _, t := range titles {
+		if t.Title != "" {
+			s.addTitle(md5, t)
+		}
+	}
+
+	return nil
+}
+
+// Same rules as the sqlite upsert: the earliest first_seen and the latest
+// last_seen win. The caller must hold the write lock.
+func (s *MemoryStore) addTitle(urlMd5 string, t types.TitleRecord) {
+	if t.FirstSeen != nil && t.FirstSeen.Unix() <= 0 {
+		t.FirstSeen = nil
+	}
+	if t.LastSeen != nil && t.LastSeen.Unix() <= 0 {
+		t.LastSeen = nil
+	}
+
+	if s.titles[urlMd5] == nil {
+		s.titles[urlMd5] = map[string]*types.TitleRecord{}
+	}
+
+	existing, ok := s.titles[urlMd5][t.Title]
+	if !ok {
+		s.titles[urlMd5][t.Title] = &t
+		return
+	}
+
+	if t.FirstSeen != nil && (existing.FirstSeen == nil || t.FirstSeen.Before(*existing.FirstSeen)) {
+		existing.FirstSeen = t.FirstSeen
+	}
+	existing.LastSeen = maxTime(existing.LastSeen, t.LastSeen)
+}
+
+func (s *MemoryStore) InsertVisit(ctx context.Context, row *types.VisitRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := memoryVisitKey{urlMd5: util.HashMd5String(row.Url), visitTime: row.Datetime.Unix()}
+	s.addVisit(key, row.ExtractorName)
+
+	return nil
+}
+
+func (s *MemoryStore) ReplaceBookmarks(ctx context.Context, extractorName string, rows ...types.BookmarkRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	bookmarks := map[string]types.BookmarkRow{}
+	for _, row := range rows {
+		md5 := util.HashMd5String(row.Url)
+		if _, ok := bookmarks[md5]; !ok {
+			bookmarks[md5] = row
+		}
+	}
+	s.bookmarks[extractorName] = bookmarks
+
+	return nil
+}
+
+// Whether the url with the given url_md5 is bookmarked in any browser. The
+// caller must hold the lock.
+func (s *MemoryStore) isBookmarked(urlMd5 string) bool {
+	for _, bookmarks := range s.bookmarks {
+		if _, ok := bookmarks[urlMd5]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a visit unless it is already present, keeping url stats in sync like the
+// sqlite triggers do. The caller must hold the write lock.
+func (s *MemoryStore) addVisit(key memoryVisitKey, extractorName string) {
+	if _, ok := s.visits[key]; ok {
+		return
+	}
+
+	s.visits[key] = extractorName
+
+	if u, ok := s.urls[key.urlMd5]; ok {
+		t := time.Unix(key.visitTime, 0)
+		u.VisitCount++
+		u.LastVisit = maxTime(u.LastVisit, &t)
+	}
+}
+
+func (s *MemoryStore) LatestVisitTime(ctx context.Context, extractorName string) (*time.Time, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var latest *time.Time
+	for k, name := range s.visits {
+		if name != extractorName {
+			continue
+		}
+		t := time.Unix(k.visitTime, 0)
+		latest = maxTime(latest, &t)
+	}
+
+	if latest == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	return latest, nil
+}
+
+func (s *MemoryStore) InsertDocument(ctx context.Context, row *types.DocumentRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	doc := *row
+	s.documents[row.DocumentMd5] = &doc
+
+	if _, ok := s.edges[row.UrlMd5]; !ok {
+		s.edges[row.UrlMd5] = row.DocumentMd5
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) UrlsWithDocuments(ctx context.Context, ids ...string) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var xs []string
+	for _, id := range ids {
+		if _, ok := s.edges[id]; ok {
+			xs = append(xs, id)
+		}
+	}
+
+	return xs, nil
+}
+
+func (s *MemoryStore) DocumentMd5s(ctx context.Context, ids ...string) (map[string]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	xm := map[string]string{}
+	for _, id := range ids {
+		d, ok := s.documents[s.edges[id]]
+		if ok && d.DocumentMd5 != emptyDocumentMd5 && d.StatusCode >= 200 && d.StatusCode < 300 {
+			xm[id] = d.DocumentMd5
+		}
+	}
+
+	return xm, nil
+}
+
+func (s *MemoryStore) UpdateBodies(ctx context.Context, fn func(body string) (string, error)) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int
+	for _, d := range s.documents {
+		if d.Body == nil {
+			continue
+		}
+
+		body, err := fn(*d.Body)
+		if err != nil {
+			return n, err
+		}
+		if body != *d.Body {
+			d.Body = &body
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) Bodies(ctx context.Context, prefix string, fn func(urlMd5 string, body string) error) error {
+	// @note collected up front so fn is free to use the store
+	s.lock.RLock()
+	bodies := map[string]string{}
+	for urlMd5, docMd5 := range s.edges {
+		if d, ok := s.documents[docMd5]; ok && d.Body != nil && strings.HasPrefix(*d.Body, prefix) {
+			bodies[urlMd5] = *d.Body
+		}
+	}
+	s.lock.RUnlock()
+
+	for urlMd5, body := range bodies {
+		err := fn(urlMd5, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) documentIsLinked(docMd5 string) bool {
+	for _, d := range s.edges {
+		if d == docMd5 {
+			return true
+		}
+	}
+	return false
+}
+
+// Urls sorted by last visit, most recent first, that satisfy pred. The caller must hold the read lock.
+func (s *MemoryStore) sortedUrls(pred func(u *memoryUrl) bool) []*memoryUrl {
+	var urls []*memoryUrl
+	for _, u := range s.urls {
+		if pred(u) {
+			urls = append(urls, u)
+		}
+	}
+
+	sort.Slice(urls, func(i, j int) bool {
+		a, b := unixOrZero(urls[i].LastVisit), unixOrZero(urls[j].LastVisit)
+		if a != b {
+			return a > b
+		}
+		return urls[i].UrlMd5 < urls[j].UrlMd5
+	})
+
+	return urls
+}
+
+func (s *MemoryStore) withoutDocument(u *memoryUrl) bool {
+	_, ok := s.edges[u.UrlMd5]
+	return !ok && !u.Redacted
+}
+
+func (s *MemoryStore) CountUrlsWithoutDocuments(ctx context.Context) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.sortedUrls(s.withoutDocument)), nil
+}
+
+func (s *MemoryStore) UrlsWithoutDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.withBodies(s.sortedUrls(s.withoutDocument), limit, false), nil
+}
+
+// Convert to entities, optionally joining in the document body. The caller must hold the read lock.
+func (s *MemoryStore) withBodies(urls []*memoryUrl, limit int, includeBody bool) []types.UrlDbEntity {
+	var ents []types.UrlDbEntity
+	for _, u := range urls {
+		if limit > 0 && len(ents) >= limit {
+			break
+		}
+
+		ent := u.UrlDbEntity
+		if docMd5, ok := s.edges[u.UrlMd5]; ok && includeBody {
+			if doc, ok := s.documents[docMd5]; ok {
+				md5 := docMd5
+				ent.BodyMd5 = &md5
+				ent.Body = doc.Body
+			}
+		}
+		ents = append(ents, ent)
+	}
+	return ents
+}
+
+func (s *MemoryStore) InsertUrlMeta(ctx context.Context, rows ...types.UrlMetaRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, row := range rows {
+		var t time.Time
+		if row.IndexedAt != nil {
+			t = *row.IndexedAt
+		}
+		s.meta[util.HashMd5String(row.Url)] = t
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) unindexed(u *memoryUrl) bool {
+	_, ok := s.meta[u.UrlMd5]
+	return !ok
+}
+
+func (s *MemoryStore) CountUnindexed(ctx context.Context) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.sortedUrls(s.unindexed)), nil
+}
+
+func (s *MemoryStore) Unindexed(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.withBodies(s.sortedUrls(s.unindexed), limit, true), nil
+}
+
+func (s *MemoryStore) unindexedDocument(u *memoryUrl) bool {
+	indexedAt, ok := s.meta[u.UrlMd5]
+	if !ok {
+		return false
+	}
+
+	doc, ok := s.documents[s.edges[u.UrlMd5]]
+	if !ok || doc.Body == nil || *doc.Body == "" || doc.AccessedAt == nil {
+		return false
+	}
+
+	return indexedAt.Unix() < doc.AccessedAt.Unix()
+}
+
+func (s *MemoryStore) CountUnindexedDocuments(ctx context.Context) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return len(s.sortedUrls(s.unindexedDocument)), nil
+}
+
+func (s *MemoryStore) UnindexedDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.withBodies(s.sortedUrls(s.unindexedDocument), limit, true), nil
+}
+
+func (s *MemoryStore) InsertFragments(ctx context.Context, fragments ...types.Fragment) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, f := range fragments {
+		id, err := generateEavId(f.E, f.T, f.A, f.V)
+		if err != nil {
+			return err
+		}
+		s.fragments[id] = f
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) ReplaceFragments(ctx context.Context, ids []string, fragments ...types.Fragment) (int, error) {
+	keep, err := fragmentIds(fragments)
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entities := lo.SliceToMap(ids, func(id string) (string, bool) { return id, true })
+	var n int
+	for id, f := range s.fragments {
+		if entities[f.E] && !keep[id] {
+			delete(s.fragments, id)
+			n++
+		}
+	}
+
+	for _, f := range fragments {
+		id, err := generateEavId(f.E, f.T, f.A, f.V)
+		if err != nil {
+			return n, err
+		}
+		s.fragments[id] = f
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) DeleteEntityFragments(ctx context.Context, ids ...string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entities := lo.SliceToMap(ids, func(id string) (string, bool) { return id, true })
+	var n int
+	for id, f := range s.fragments {
+		if entities[f.E] {
+			delete(s.fragments, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) ResetIndexed(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.meta = map[string]time.Time{}
+
+	return nil
+}
+
+func (s *MemoryStore) MarkUnindexed(ctx context.Context, ids ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, id := range ids {
+		delete(s.meta, id)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteFragments(ctx context.Context, t string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int
+	for id, f := range s.fragments {
+		if f.T == t {
+			delete(s.fragments, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) ReplaceVocabulary(ctx context.Context, ids []string, rows ...types.VocabularyRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, id := range ids {
+		delete(s.words, id)
+	}
+	for _, row := range rows {
+		if s.words[row.UrlMd5] == nil {
+			s.words[row.UrlMd5] = map[string]int{}
+		}
+		s.words[row.UrlMd5][row.Word] += row.Count
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteVocabulary(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.words = map[string]map[string]int{}
+	return nil
+}
+
+// The count of every word over all urls
+func (s *MemoryStore) vocabulary() map[string]int {
+	counts := map[string]int{}
+	for _, words := range s.words {
+		for w, n := range words {
+			counts[w] += n
+		}
+	}
+	return counts
+}
+
+func (s *MemoryStore) InsertTermVectors(ctx context.Context, vectors ...types.TermVector) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, v := range vectors {
+		terms := make(map[string]float64, len(v.Terms))
+		for term, weight := range v.Terms {
+			terms[term] = weight
+		}
+		s.vectors[v.UrlMd5] = terms
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteTermVectors(ctx context.Context, ids ...string) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var n int
+	for _, id := range ids {
+		if _, ok := s.vectors[id]; ok {
+			delete(s.vectors, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Fragments(ctx context.Context, contains []string, fn func(f types.Fragment) error) error {
+	s.lock.RLock()
+	fragments := []types.Fragment{}
+	for _, f := range s.fragments {
+		if query.ContainsAll(f.V, containsTerms(contains)) {
+			fragments = append(fragments, f)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, f := range fragments {
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Words sharing the most trigrams first, then the most common
+func (s *MemoryStore) SimilarWords(ctx context.Context, word string, limit int) ([]types.VocabularyRow, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	vocabulary := s.vocabulary()
+	tris := trigrams(word)
+	shared := map[string]int{}
+	for w := range vocabulary {
+		if w == strings.ToLower(word) {
+			shared[w] = len(tris) + 1
+			continue
+		}
+		for _, t := range tris {
+			if strings.Contains(w, t) {
+				shared[w]++
+			}
+		}
+	}
+
+	xs := []types.VocabularyRow{}
+	for w, n := range shared {
+		if n > 0 {
+			xs = append(xs, types.VocabularyRow{Word: w, Count: vocabulary[w]})
+		}
+	}
+	sort.Slice(xs, func(i, j int) bool {
+		a, b := xs[i], xs[j]
+		if shared[a.Word] != shared[b.Word] {
+			return shared[a.Word] > shared[b.Word]
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Word < b.Word
+	})
+	if len(xs) > limit {
+		xs = xs[:limit]
+	}
+	return xs, nil
+}
+
+// Fragments are searched as they are, there is no index to rebuild
+func (s *MemoryStore) RebuildSearchIndex(ctx context.Context) error {
+	return nil
+}
+
+// Everything a query is matched against, by url_md5. Text is the url's
+// fragments, as that is what the search index would match.
+func (s *MemoryStore) pages() map[string]*query.Page {
+	pages := map[string]*query.Page{}
+	for md5, u := range s.urls {
+		p := &query.Page{Url: u.Url}
+		if u.Title != nil {
+			p.Title = *u.Title
+		}
+		if docMd5, ok := s.edges[md5]; ok {
+			if doc, ok := s.documents[docMd5]; ok && doc.Body != nil {
+				p.HasFulltext = true
+			}
+		}
+		p.Bookmarked = s.isBookmarked(md5)
+		pages[md5] = p
+	}
+
+	for k, extractorName := range s.visits {
+		if p, ok := pages[k.urlMd5]; ok {
+			p.Visits = append(p.Visits, query.Visit{Time: time.Unix(k.visitTime, 0), Browser: extractorName})
+		}
+	}
+
+	for _, f := range s.fragments {
+		if p, ok := pages[f.E]; ok {
+			p.Text = append(p.Text, f.V)
+		}
+	}
+
+	return pages
+}
+
+// @note all positive terms must appear in the same fragment, mirroring an
+// fts5 query with implicit AND. Every matching fragment counts the same, so
+// the text score is the weight of the best attribute that matched.
+func (s *MemoryStore) SearchUrls(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if q.IsEmpty() {
+		return []types.UrlDbSearchEntity{}, 0, nil
+	}
+
+	positive := query.Positive(q.Text)
+	ranking := opts.ranking()
+	pages := s.pages()
+	termRe := termsRegexp(positive)
+	matches := map[string][]types.Snippet{}
+	textScores := map[string]float64{}
+
+	for _, f := range s.fragments {
+		if len(positive) == 0 || !query.ContainsAll(f.V, positive) {
+			continue
+		}
+		sn := highlight(f.A, f.V, termRe)
+		sn.Section = f.Section
+		matches[f.E] = append(matches[f.E], sn)
+		textScores[f.E] = math.Max(textScores[f.E], attributeWeight(f.A, ranking))
+	}
+
+	urls := s.sortedUrls(func(u *memoryUrl) bool {
+		_, matched := matches[u.UrlMd5]
+		return (len(positive) == 0 || matched) && opts.includes(u.UrlMd5) && q.MatchesFilters(*pages[u.UrlMd5])
+	})
+
+	xs := s.scored(urls, pages, ranking)
+	for i := range xs {
+		xs[i].Score = lo.ToPtr(*xs[i].Score + textScores[xs[i].UrlMd5])
+
+		if snippets, ok := matches[xs[i].UrlMd5]; ok {
+			sort.Slice(snippets, func(i, j int) bool { return snippets[i].Text < snippets[j].Text })
+			matchCount := len(snippets)
+			xs[i].Snippets = snippets
+			xs[i].MatchCount = &matchCount
+		}
+	}
+
+	sortResults(xs, opts.sort())
+
+	return paginate(xs, opts), uint(len(urls)), nil
+}
+
+// Search results for urls, scored by their visits alone
+func (s *MemoryStore) scored(urls []*memoryUrl, pages map[string]*query.Page, ranking config.RankingConfig) []types.UrlDbSearchEntity {
+	now := time.Now()
+	xs := []types.UrlDbSearchEntity{}
+	for _, u := range urls {
+		var visits []time.Time
+		for _, v := range pages[u.UrlMd5].Visits {
+			visits = append(visits, v.Time)
+		}
+
+		xs = append(xs, types.UrlDbSearchEntity{
+			UrlMd5:      u.UrlMd5,
+			Url:         u.Url,
+			Title:       u.Title,
+			Description: u.Description,
+			LastVisit:   u.LastVisit,
+			VisitCount:  u.VisitCount,
+			Score:       lo.ToPtr(visitScore(visits, now, ranking) + bookmarkScore(pages[u.UrlMd5].Bookmarked, ranking)),
+		})
+	}
+	return xs
+}
+
+func (s *MemoryStore) FilterUrls(ctx context.Context, q *query.Query, opts SearchOptions, ids ...string) ([]types.UrlDbSearchEntity, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	pages := s.pages()
+	wanted := lo.SliceToMap(ids, func(id string) (string, bool) { return id, true })
+
+	urls := s.sortedUrls(func(u *memoryUrl) bool {
+		return wanted[u.UrlMd5] && q.MatchesFilters(*pages[u.UrlMd5])
+	})
+
+	xs := s.scored(urls, pages, opts.ranking())
+	sortResults(xs, opts.sort())
+	return xs, nil
+}
+
+// The pages of every url SearchUrls would find for q, by url_md5
+func (s *MemoryStore) matchedPages(q *query.Query, opts SearchOptions) map[string]*query.Page {
+	positive := query.Positive(q.Text)
+	matched := map[string]bool{}
+	for _, f := range s.fragments {
+		if len(positive) > 0 && query.ContainsAll(f.V, positive) {
+			matched[f.E] = true
+		}
+	}
+
+	pages := s.pages()
+	for md5, p := range pages {
+		if (len(positive) > 0 && !matched[md5]) || !opts.includes(md5) || !q.MatchesFilters(*p) {
+			delete(pages, md5)
+		}
+	}
+	return pages
+}
+
+func (s *MemoryStore) SearchFacets(ctx context.Context, q *query.Query, opts SearchOptions) (*types.Facets, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	c := newFacetCounts()
+	for _, p := range s.matchedPages(q, opts) {
+		c.add(facetDomain, query.Host(p.Url), 1)
+		if p.HasFulltext {
+			c.add(facetFulltext, "", 1)
+		}
+
+		browsers, months := map[string]bool{}, map[string]bool{}
+		for _, v := range p.Visits {
+			if q.MatchesVisit(v) {
+				browsers[strings.ToLower(v.Browser)] = true
+				months[v.Time.Local().Format(facetMonthLayout)] = true
+			}
+		}
+		for b := range browsers {
+			c.add(facetBrowser, b, 1)
+		}
+		for m := range months {
+			c.add(facetMonth, m, 1)
+		}
+	}
+
+	return c.facets(), nil
+}
+
+func (s *MemoryStore) SearchVisits(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.VisitDbSearchEntity, uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	xs := []types.VisitDbSearchEntity{}
+	for md5, p := range s.matchedPages(q, opts) {
+		u := s.urls[md5]
+		for _, v := range p.Visits {
+			if !q.MatchesVisit(v) {
+				continue
+			}
+			xs = append(xs, types.VisitDbSearchEntity{
+				VisitTime:     v.Time,
+				ExtractorName: v.Browser,
+				UrlMd5:        md5,
+				Url:           u.Url,
+				Title:         u.Title,
+				Description:   u.Description,
+			})
+		}
+	}
+
+	sortVisits(xs)
+	return paginate(xs, opts), uint(len(xs)), nil
+}
+
+func (s *MemoryStore) RelatedUrls(ctx context.Context, urlMd5 string, limit int) ([]types.UrlDbSearchEntity, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	scores := relatedScores(s.vectors, urlMd5)
+	xs := []types.UrlDbSearchEntity{}
+	for _, id := range topScores(scores, limit) {
+		u, ok := s.urls[id]
+		if !ok {
+			continue
+		}
+		score := scores[id]
+		xs = append(xs, types.UrlDbSearchEntity{
+			UrlMd5:      u.UrlMd5,
+			Url:         u.Url,
+			Title:       u.Title,
+			Description: u.Description,
+			LastVisit:   u.LastVisit,
+			VisitCount:  u.VisitCount,
+			Score:       &score,
+		})
+	}
+	return xs, nil
+}
+
+func (s *MemoryStore) InsertSearchHistory(ctx context.Context, row types.SearchHistoryRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.searches = append(s.searches, row)
+	return nil
+}
+
+func (s *MemoryStore) SearchHistory(ctx context.Context, limit int) ([]types.SearchHistoryRow, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// @note the last inserted comes first among those searched in the same second
+	xs := util.ReverseSlice(s.searches)
+	sort.SliceStable(xs, func(i, j int) bool { return xs[i].SearchedAt.Unix() > xs[j].SearchedAt.Unix() })
+	if len(xs) > limit {
+		xs = xs[:limit]
+	}
+	return xs, nil
+}
+
+func (s *MemoryStore) SaveSearch(ctx context.Context, row types.SavedSearchRow) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.saved[row.Name] = row
+	return nil
+}
+
+func (s *MemoryStore) SavedSearch(ctx context.Context, name string) (*types.SavedSearchRow, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	row, ok := s.saved[name]
+	if !ok {
+		return nil, nil
+	}
+	return &row, nil
+}
+
+func (s *MemoryStore) SavedSearches(ctx context.Context) ([]types.SavedSearchRow, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	xs := lo.Values(s.saved)
+	sort.Slice(xs, func(i, j int) bool { return xs[i].Name < xs[j].Name })
+	return xs, nil
+}
+
+func (s *MemoryStore) DeleteSavedSearch(ctx context.Context, name string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.saved[name]
+	delete(s.saved, name)
+	return ok, nil
+}
+
+func (s *MemoryStore) RecentUrls(ctx context.Context, limit, offset uint) ([]types.UrlDbEntity, uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	urls := s.sortedUrls(func(u *memoryUrl) bool { return true })
+	urls = paginate(urls, SearchOptions{Limit: limit, Offset: offset})
+
+	return s.withBodies(urls, int(limit), false), uint(len(s.urls)), nil
+}
+
+func (s *MemoryStore) Records(ctx context.Context, opts RecordOptions, fn func(*types.UrlRecord) error) error {
+	since, until := opts.bounds()
+	inRange := func(ts int64) bool { return ts >= since && ts < until }
+
+	// @note collected up front so fn is free to use the store
+	s.lock.RLock()
+	var records []*types.UrlRecord
+	for _, u := range s.sortedUrls(func(u *memoryUrl) bool { return true }) {
+		rec := &types.UrlRecord{
+			Url:         u.Url,
+			Title:       u.Title,
+			Description: u.Description,
+			LastVisit:   u.LastVisit,
+			Redacted:    u.Redacted,
+			Titles:      []types.TitleRecord{},
+			Visits:      []types.VisitRecord{},
+		}
+
+		for k, extractor := range s.visits {
+			if k.urlMd5 == u.UrlMd5 && inRange(k.visitTime) {
+				rec.Visits = append(rec.Visits, types.VisitRecord{Time: time.Unix(k.visitTime, 0), ExtractorName: extractor})
+			}
+		}
+		if len(rec.Visits) == 0 && (u.VisitCount > 0 || !inRange(unixOrZero(u.LastVisit))) {
+			continue
+		}
+		sort.Slice(rec.Visits, func(i, j int) bool { return rec.Visits[i].Time.Before(rec.Visits[j].Time) })
+
+		for _, t := range s.titles[u.UrlMd5] {
+			rec.Titles = append(rec.Titles, *t)
+		}
+		sort.Slice(rec.Titles, func(i, j int) bool {
+			return unixOrZero(rec.Titles[i].FirstSeen) < unixOrZero(rec.Titles[j].FirstSeen)
+		})
+
+		if docMd5, ok := s.edges[u.UrlMd5]; ok {
+			if d, ok := s.documents[docMd5]; ok {
+				rec.Documents = append(rec.Documents, types.DocumentRecord{
+					DocumentMd5: d.DocumentMd5,
+					StatusCode:  d.StatusCode,
+					AccessedAt:  d.AccessedAt,
+					Body:        d.Body,
+				})
+			}
+		}
+
+		records = append(records, rec)
+	}
+	s.lock.RUnlock()
+
+	for _, rec := range records {
+		err := fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Size is the total length of all stored strings, which is close enough for
+// testing size based pruning.
+func (s *MemoryStore) Size(ctx context.Context) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var size int64
+	for _, u := range s.urls {
+		size += int64(len(u.Url))
+	}
+	for _, d := range s.documents {
+		if d.Body != nil {
+			size += int64(len(*d.Body))
+		}
+	}
+	for _, f := range s.fragments {
+		size += int64(len(f.V))
+	}
+
+	return size, nil
+}
+
+func (s *MemoryStore) Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error) {
+	var err error
+	report := &PruneReport{}
+
+	report.DBSizeBefore, err = s.Size(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	words := len(s.vocabulary())
+	var urls []string
+
+	if opts.VisitsBefore != nil {
+		for k := range s.visits {
+			if k.visitTime >= opts.VisitsBefore.Unix() {
+				continue
+			}
+
+			report.Visits++
+			if !opts.DryRun {
+				delete(s.visits, k)
+				if u, ok := s.urls[k.urlMd5]; ok && u.VisitCount > 0 {
+					u.VisitCount--
+				}
+			}
+		}
+	}
+
+	// Oldest first, so that the size limit removes the oldest bodies
+	var docs []*types.DocumentRow
+	for _, d := range s.documents {
+		if d.Body != nil {
+			docs = append(docs, d)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return unixOrZero(docs[i].AccessedAt) < unixOrZero(docs[j].AccessedAt)
+	})
+
+	size := report.DBSizeBefore
+	for _, d := range docs {
+		tooOld := opts.DocumentsBefore != nil && unixOrZero(d.AccessedAt) < opts.DocumentsBefore.Unix()
+		tooBig := opts.MaxDBSize > 0 && size > opts.MaxDBSize
+		if !tooOld && !tooBig {
+			continue
+		}
+
+		report.Documents++
+		size -= int64(len(*d.Body))
+
+		for urlMd5, docMd5 := range s.edges {
+			if docMd5 != d.DocumentMd5 {
+				continue
+			}
+			urls = append(urls, urlMd5)
+			if _, ok := s.vectors[urlMd5]; ok {
+				report.TermVectors++
+				if !opts.DryRun {
+					delete(s.vectors, urlMd5)
+					delete(s.meta, urlMd5)
+				}
+			}
+			for id, f := range s.fragments {
+				if f.E == urlMd5 && f.T == "documents" {
+					report.Fragments++
+					size -= int64(len(f.V))
+					if !opts.DryRun {
+						delete(s.fragments, id)
+					}
+				}
+			}
+		}
+
+		if !opts.DryRun {
+			d.Body = nil
+		}
+	}
+
+	s.lock.Unlock()
+
+	if opts.DryRun {
+		report.Words, err = prunedWords(ctx, s, urls)
+		report.DBSizeAfter = size
+		return report, err
+	}
+
+	if report.Documents > 0 {
+		report.Words, err = pruneVocabulary(ctx, s, words)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.DBSizeAfter, err = s.Size(ctx)
+	return report, err
+}
+
+func (s *MemoryStore) Diagnose(ctx context.Context) ([]Finding, error) {
+	return []Finding{}, nil
+}
+
+func (s *MemoryStore) Repair(ctx context.Context, findings []Finding) error {
+	return nil
+}
+
+func coalesce(xs ...*string) *string {
+	for _, x := range xs {
+		if x != nil {
+			return x
+		}
+	}
+	return nil
+}
+
+func coalesceTime(xs ...*time.Time) *time.Time {
+	for _, x := range xs {
+		if x != nil {
+			return x
+		}
+	}
+	return nil
+}
+
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func laterOrEqual(a, b *time.Time) bool {
+	return unixOrZero(a) >= unixOrZero(b)
+}
+
+func maxTime(a, b *time.Time) *time.Time {
+	if laterOrEqual(a, b) {
+		return coalesceTime(a, b)
+	}
+	return b
+}
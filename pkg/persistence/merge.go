@@ -0,0 +1,363 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/crypt"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// Number of urls merged at once, along with their visits and documents
+const mergeBatchSize = 500
+
+type MergeReport struct {
+	Urls      int // Urls read from the other database
+	NewUrls   int
+	NewVisits int
+	Documents int // Full-text documents copied
+	// Encrypted documents skipped because dst doesn't have the key they were
+	// encrypted with
+	ForeignDocuments int
+	Reindex          int // Urls marked for re-indexing
+}
+
+func (r *MergeReport) Add(other *MergeReport) {
+	r.Urls += other.Urls
+	r.NewUrls += other.NewUrls
+	r.NewVisits += other.NewVisits
+	r.Documents += other.Documents
+	r.ForeignDocuments += other.ForeignDocuments
+	r.Reindex += other.Reindex
+}
+
+// OpenSnapshot opens a copy of the browser-gopher database at path, migrated to
+// the current schema. The original is only read, so it is safe to use on a
+// database that is in use or lives in a synced folder. Call the returned
+// cleanup func when done.
+func OpenSnapshot(ctx context.Context, path string) (*sql.DB, func(), error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "browser-gopher-snapshot-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		os.RemoveAll(tmpDir)
+	}
+
+	snapshotPath := filepath.Join(tmpDir, "db.sqlite")
+
+	err = CopyDb(ctx, path, snapshotPath)
+	if err != nil {
+		cleanup()
+		return nil, nil, errors.Wrap(err, "could not copy "+path)
+	}
+
+	db, err := InitDb(ctx, &config.AppConfig{DBPath: snapshotPath})
+	if err != nil {
+		cleanup()
+		return nil, nil, errors.Wrap(err, "could not migrate "+path)
+	}
+
+	return db, func() {
+		db.Close()
+		cleanup()
+	}, nil
+}
+
+// Merge copies urls, visits and full-text documents from src, another
+// browser-gopher sqlite database, into dst. Conflicts are resolved the same
+// way as during populate:
+//
+//   - visits are unique by url and time, so visits both databases have are only kept once
+//   - last_visit is the latest of the two
+//   - title and description come from whichever database saw the url more recently
+//   - a url that already has a document in dst keeps it
+//
+// Documents whose body was pruned in src are skipped, and so are those
+// encrypted with a key dst doesn't have, see ErrForeignKey. Urls are redacted
+// the way dst redacts them, see RedactUrl. Urls that are new or
+// changed are marked for re-indexing. The search index of src is not copied.
+func Merge(ctx context.Context, dst Store, src *sql.DB) (*MergeReport, error) {
+	report := &MergeReport{}
+	var lastRowid int64
+
+	for {
+		urls, rowid, err := sourceUrls(ctx, src, lastRowid, mergeBatchSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read urls")
+		}
+		if len(urls) == 0 {
+			break
+		}
+		lastRowid = rowid
+
+		batch, err := mergeBatch(ctx, dst, src, urls)
+		if err != nil {
+			return nil, err
+		}
+		report.Add(batch)
+	}
+
+	return report, nil
+}
+
+func mergeBatch(ctx context.Context, dst Store, src *sql.DB, urls []types.UrlRow) (*MergeReport, error) {
+	report := &MergeReport{Urls: len(urls)}
+	srcIds := lo.Map(urls, func(u types.UrlRow, _ int) string { return util.HashMd5String(u.Url) })
+
+	// @note src may not have been redacted the way dst is, so urls are
+	// redacted before they are looked up in dst, and what src has for them is
+	// moved to the redacted url
+	dstIds := map[string]string{}
+	for i := range urls {
+		var redacted bool
+		urls[i].Url, redacted = RedactUrl(dst, urls[i].Url)
+		urls[i].Redacted = urls[i].Redacted || redacted
+		dstIds[srcIds[i]] = util.HashMd5String(urls[i].Url)
+	}
+	ids := lo.Uniq(lo.Values(dstIds))
+
+	before, err := dst.UrlsById(ctx, ids...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read existing urls")
+	}
+	existing := lo.KeyBy(before, func(u types.UrlDbEntity) string { return u.UrlMd5 })
+
+	for i := range urls {
+		err := dst.InsertUrl(ctx, &urls[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "could not insert url")
+		}
+	}
+
+	visits, err := sourceVisits(ctx, src, srcIds)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read visits")
+	}
+	for i := range visits {
+		err := dst.InsertVisit(ctx, &visits[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "could not insert visit")
+		}
+	}
+
+	reindex := map[string]bool{}
+
+	withDocs, err := dst.UrlsWithDocuments(ctx, ids...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read existing documents")
+	}
+	hasDoc := lo.SliceToMap(withDocs, func(id string) (string, bool) { return id, true })
+
+	docs, err := sourceDocuments(ctx, src, srcIds)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read documents")
+	}
+	for i := range docs {
+		docs[i].UrlMd5 = dstIds[docs[i].UrlMd5]
+	}
+	docs = lo.UniqBy(docs, func(d types.DocumentRow) string { return d.UrlMd5 })
+	docs = lo.Filter(docs, func(d types.DocumentRow, _ int) bool { return !hasDoc[d.UrlMd5] })
+
+	for i := range docs {
+		// @note a store without a key would index the ciphertext as if it were
+		// text, and an encrypted store checks that it has the key
+		if docs[i].Body != nil && crypt.IsEncrypted(*docs[i].Body) {
+			if _, ok := dst.(*EncryptedStore); !ok {
+				report.ForeignDocuments++
+				continue
+			}
+		}
+
+		err := dst.InsertDocument(ctx, &docs[i])
+		if errors.Is(err, ErrForeignKey) {
+			report.ForeignDocuments++
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not insert document")
+		}
+		reindex[docs[i].UrlMd5] = true
+		report.Documents++
+	}
+
+	after, err := dst.UrlsById(ctx, ids...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read merged urls")
+	}
+
+	for _, u := range after {
+		prev, ok := existing[u.UrlMd5]
+		if !ok {
+			report.NewUrls++
+			report.NewVisits += u.VisitCount
+			reindex[u.UrlMd5] = true
+			continue
+		}
+
+		report.NewVisits += u.VisitCount - prev.VisitCount
+		if !equalStringPtr(u.Title, prev.Title) || !equalStringPtr(u.Description, prev.Description) {
+			reindex[u.UrlMd5] = true
+		}
+	}
+
+	err = dst.MarkUnindexed(ctx, lo.Keys(reindex)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not mark urls for re-indexing")
+	}
+	report.Reindex = len(reindex)
+
+	return report, nil
+}
+
+func equalStringPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Read up to limit urls with a rowid greater than after. Returns the largest rowid read.
+func sourceUrls(ctx context.Context, src *sql.DB, after int64, limit int) ([]types.UrlRow, int64, error) {
+	rows, err := src.QueryContext(ctx, `
+		SELECT
+			rowid,
+			url,
+			title,
+			description,
+			last_visit,
+			redacted
+		FROM
+			urls
+		WHERE
+			rowid > ?
+		ORDER BY
+			rowid ASC
+		LIMIT ?;
+	`, after, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var urls []types.UrlRow
+	last := after
+
+	for rows.Next() {
+		var u types.UrlRow
+		var ts sql.NullInt64
+
+		err := rows.Scan(&last, &u.Url, &u.Title, &u.Description, &ts, &u.Redacted)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		u.LastVisit = unixOrNil(ts.Int64)
+		urls = append(urls, u)
+	}
+
+	return urls, last, rows.Err()
+}
+
+// Placeholders and args for an `IN (...)` clause.
+// @note sqlite allows up to 32766 variables per statement, far more than mergeBatchSize
+func placeholders(ids []string) (string, []any) {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","), args
+}
+
+func sourceVisits(ctx context.Context, src *sql.DB, ids []string) ([]types.VisitRow, error) {
+	in, args := placeholders(ids)
+	rows, err := src.QueryContext(ctx, fmt.Sprintf(`
+		SELECT
+			u.url,
+			v.visit_time,
+			v.extractor_name
+		FROM
+			visits v
+			JOIN urls u ON u.url_md5 = v.url_md5
+		WHERE
+			v.url_md5 IN (%s)
+			AND v.visit_time NOT NULL;
+	`, in), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var visits []types.VisitRow
+
+	for rows.Next() {
+		var v types.VisitRow
+		var ts int64
+		var extractorName sql.NullString
+
+		err := rows.Scan(&v.Url, &ts, &extractorName)
+		if err != nil {
+			return nil, err
+		}
+
+		v.Datetime = time.Unix(ts, 0)
+		v.ExtractorName = extractorName.String
+		visits = append(visits, v)
+	}
+
+	return visits, rows.Err()
+}
+
+func sourceDocuments(ctx context.Context, src *sql.DB, ids []string) ([]types.DocumentRow, error) {
+	in, args := placeholders(ids)
+	rows, err := src.QueryContext(ctx, fmt.Sprintf(`
+		SELECT
+			d.document_md5,
+			edge.url_md5,
+			coalesce(d.status_code, 0),
+			coalesce(d.accessed_at, 0),
+			d.body
+		FROM
+			url_document_edges edge
+			JOIN documents d ON d.document_md5 = edge.document_md5
+		WHERE
+			edge.url_md5 IN (%s)
+			AND d.body NOT NULL
+			AND d.body != '';
+	`, in), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs []types.DocumentRow
+
+	for rows.Next() {
+		var d types.DocumentRow
+		var ts int64
+
+		err := rows.Scan(&d.DocumentMd5, &d.UrlMd5, &d.StatusCode, &ts, &d.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		d.AccessedAt = unixOrNil(ts)
+		docs = append(docs, d)
+	}
+
+	return docs, rows.Err()
+}
@@ -0,0 +1,3 @@
+-- set when sensitive query parameters were scrubbed from the url. redacted urls
+-- are not scraped, since the original url is no longer known.
+ALTER TABLE "urls" ADD COLUMN "redacted" INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,68 @@
+-- last_visit and visit_count are derived from the visits table so that they are
+-- correct regardless of the order in which browsers and imports are populated.
+ALTER TABLE "urls" ADD COLUMN "visit_count" INTEGER NOT NULL DEFAULT 0;
+
+UPDATE
+  "urls"
+SET
+  "visit_count" = v."visit_count",
+  "last_visit" = v."last_visit"
+FROM (
+  SELECT
+    "url_md5",
+    count(*) AS "visit_count",
+    max("visit_time") AS "last_visit"
+  FROM
+    "visits"
+  GROUP BY
+    "url_md5"
+) AS v
+WHERE
+  v."url_md5" = "urls"."url_md5";
+
+CREATE TRIGGER IF NOT EXISTS "visits_ai" AFTER INSERT ON "visits" BEGIN
+UPDATE
+  "urls"
+SET
+  "visit_count" = "visit_count" + 1,
+  "last_visit" = max(coalesce("last_visit", 0), NEW."visit_time")
+WHERE
+  "url_md5" = NEW."url_md5";
+
+END;
+
+CREATE TRIGGER IF NOT EXISTS "visits_ad" AFTER DELETE ON "visits" BEGIN
+UPDATE
+  "urls"
+SET
+  "visit_count" = max("visit_count" - 1, 0),
+  "last_visit" = coalesce(
+    (SELECT max("visit_time") FROM "visits" WHERE "url_md5" = OLD."url_md5"),
+    "last_visit"
+  )
+WHERE
+  "url_md5" = OLD."url_md5";
+
+END;
+
+CREATE TRIGGER IF NOT EXISTS "visits_au" AFTER UPDATE OF "url_md5", "visit_time" ON "visits" BEGIN
+UPDATE
+  "urls"
+SET
+  "visit_count" = max("visit_count" - 1, 0),
+  "last_visit" = coalesce(
+    (SELECT max("visit_time") FROM "visits" WHERE "url_md5" = OLD."url_md5"),
+    "last_visit"
+  )
+WHERE
+  "url_md5" = OLD."url_md5";
+
+UPDATE
+  "urls"
+SET
+  "visit_count" = "visit_count" + 1,
+  "last_visit" = max(coalesce("last_visit", 0), NEW."visit_time")
+WHERE
+  "url_md5" = NEW."url_md5";
+
+END;
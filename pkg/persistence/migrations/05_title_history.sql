@@ -0,0 +1,24 @@
+-- Every title a url has been seen with. Pages change their title over time,
+-- and urls only keep the most recent one.
+CREATE TABLE IF NOT EXISTS "url_titles" (
+  "id" INTEGER PRIMARY KEY AUTOINCREMENT,
+  "url_md5" VARCHAR(32) NOT NULL REFERENCES urls(url_md5),
+  "title" TEXT NOT NULL,
+  "first_seen" INTEGER,
+  "last_seen" INTEGER
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS url_titles_unique ON url_titles(url_md5, title);
+
+INSERT OR IGNORE INTO
+  "url_titles" ("url_md5", "title", "first_seen", "last_seen")
+SELECT
+  "url_md5",
+  "title",
+  "last_visit",
+  "last_visit"
+FROM
+  "urls"
+WHERE
+  "title" NOT NULL
+  AND "title" != '';
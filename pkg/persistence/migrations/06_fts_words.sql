@@ -0,0 +1,95 @@
+-- A word level index over the same fragments as fragment_fts. The trigram index
+-- matches substrings but nothing shorter than three characters, this one
+-- matches whole words, and other forms of them thanks to the porter stemmer.
+CREATE VIRTUAL TABLE if NOT EXISTS "fragment_words" USING fts5 (
+  "e" UNINDEXED,
+  "t" UNINDEXED,
+  "a",
+  "v",
+  "created_at" UNINDEXED,
+  content = "fragment",
+  content_rowid = "id",
+  tokenize = "porter unicode61 remove_diacritics 2"
+);
+
+CREATE TRIGGER if NOT EXISTS "fragment_words_ai" AFTER INSERT ON "fragment" BEGIN
+INSERT INTO
+  "fragment_words" ("rowid", "e", "t", "a", "v", "created_at")
+VALUES
+  (
+    NEW."id",
+    NEW."e",
+    NEW."t",
+    NEW."a",
+    NEW."v",
+    NEW."created_at"
+  );
+
+END;
+
+CREATE TRIGGER if NOT EXISTS "fragment_words_ad" AFTER DELETE ON "fragment" BEGIN
+INSERT INTO
+  "fragment_words" (
+    "fragment_words",
+    "rowid",
+    "e",
+    "t",
+    "a",
+    "v",
+    "created_at"
+  )
+VALUES
+  (
+    'delete',
+    OLD."id",
+    OLD."e",
+    OLD."t",
+    OLD."a",
+    OLD."v",
+    OLD."created_at"
+  );
+
+END;
+
+CREATE TRIGGER if NOT EXISTS "fragment_words_au" AFTER
+UPDATE ON "fragment" BEGIN
+INSERT INTO
+  "fragment_words" (
+    "fragment_words",
+    "rowid",
+    "e",
+    "t",
+    "a",
+    "v",
+    "created_at"
+  )
+VALUES
+  (
+    'delete',
+    OLD."id",
+    OLD."e",
+    OLD."t",
+    OLD."a",
+    OLD."v",
+    OLD."created_at"
+  );
+
+INSERT INTO
+  "fragment_words" ("rowid", "e", "t", "a", "v", "created_at")
+VALUES
+  (
+    NEW."id",
+    NEW."e",
+    NEW."t",
+    NEW."a",
+    NEW."v",
+    NEW."created_at"
+  );
+
+END;
+
+-- Index everything that was indexed before this migration
+INSERT INTO
+  "fragment_words" ("fragment_words")
+VALUES
+  ('rebuild');
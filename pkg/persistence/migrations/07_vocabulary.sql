@@ -0,0 +1,34 @@
+-- Every word that has been indexed, for suggesting corrections to misspelled
+-- searches. count is how often the word was indexed, which only needs to be
+-- roughly right since it only breaks ties between suggestions.
+CREATE TABLE IF NOT EXISTS "vocabulary" (
+  "id" INTEGER PRIMARY KEY, -- must be int for use in fts rowid, and kept by VACUUM unlike an implicit rowid
+  "word" TEXT NOT NULL UNIQUE,
+  "count" INTEGER NOT NULL DEFAULT 0
+);
+
+-- Candidates for a correction are the words that share trigrams with it
+CREATE VIRTUAL TABLE if NOT EXISTS "vocabulary_fts" USING fts5 (
+  "word",
+  content = "vocabulary",
+  content_rowid = "id",
+  tokenize = "trigram"
+);
+
+-- @note words are never changed, only their count, which isn't indexed, so
+-- there is no update trigger
+CREATE TRIGGER if NOT EXISTS "vocabulary_ai" AFTER INSERT ON "vocabulary" BEGIN
+INSERT INTO
+  "vocabulary_fts" ("rowid", "word")
+VALUES
+  (NEW."id", NEW."word");
+
+END;
+
+CREATE TRIGGER if NOT EXISTS "vocabulary_ad" AFTER DELETE ON "vocabulary" BEGIN
+INSERT INTO
+  "vocabulary_fts" ("vocabulary_fts", "rowid", "word")
+VALUES
+  ('delete', OLD."id", OLD."word");
+
+END;
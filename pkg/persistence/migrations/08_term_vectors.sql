@@ -0,0 +1,12 @@
+-- What each url is about, as the weights of the words in its title,
+-- description and full-text, for finding related urls. Only the most
+-- frequent words of each url are kept, and its weights have a length of 1.
+CREATE TABLE IF NOT EXISTS "term_vectors" (
+  "url_md5" VARCHAR(32) NOT NULL REFERENCES urls(url_md5),
+  "term" TEXT NOT NULL,
+  "weight" REAL NOT NULL,
+  PRIMARY KEY ("url_md5", "term")
+);
+
+-- Related urls are those that share terms
+CREATE INDEX IF NOT EXISTS "term_vectors_term" ON "term_vectors" ("term");
@@ -0,0 +1,19 @@
+-- Every search that was run, for recalling it later. mode is how the query was
+-- matched, empty for the query syntax, see search.MatchMode.
+CREATE TABLE IF NOT EXISTS "search_history" (
+  "id" INTEGER PRIMARY KEY,
+  "query" TEXT NOT NULL,
+  "mode" TEXT NOT NULL DEFAULT '',
+  "searched_at" INTEGER NOT NULL,
+  "result_count" INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "search_history_searched_at" ON "search_history" ("searched_at");
+
+-- Searches that were given a name, to run them again by it
+CREATE TABLE IF NOT EXISTS "saved_searches" (
+  "name" TEXT PRIMARY KEY NOT NULL,
+  "query" TEXT NOT NULL,
+  "mode" TEXT NOT NULL DEFAULT '',
+  "created_at" INTEGER NOT NULL
+);
@@ -0,0 +1,3 @@
+-- The headings above a chunk of full-text in its document, e.g. "Installation >
+-- Linux", shown along with snippets of it. Not in the full-text indexes.
+ALTER TABLE "fragment" ADD COLUMN "section" TEXT;
@@ -0,0 +1,9 @@
+-- Pages bookmarked in a browser, as of the last time it was imported. A page
+-- bookmarked in more than one browser has a row for each.
+CREATE TABLE IF NOT EXISTS "bookmarks" (
+  "url_md5" VARCHAR(32) NOT NULL,
+  "extractor_name" TEXT NOT NULL,
+  "title" TEXT,
+  "added_at" INTEGER,
+  PRIMARY KEY ("url_md5", "extractor_name")
+);
@@ -0,0 +1,48 @@
+-- Each url's own count of the words it was indexed with. The vocabulary is the
+-- total over every url, kept up to date by the triggers below, so reindexing a
+-- url replaces its share of the counts rather than adding to them, and words
+-- that are no longer in any url are forgotten.
+CREATE TABLE IF NOT EXISTS "url_vocabulary" (
+  "url_md5" VARCHAR(32) NOT NULL,
+  "word" TEXT NOT NULL,
+  "count" INTEGER NOT NULL,
+  PRIMARY KEY ("url_md5", "word")
+);
+
+CREATE TRIGGER IF NOT EXISTS "url_vocabulary_ai" AFTER INSERT ON "url_vocabulary" BEGIN
+INSERT INTO
+  "vocabulary" ("word", "count")
+VALUES
+  (NEW."word", NEW."count") ON CONFLICT ("word") DO
+UPDATE
+SET
+  "count" = "count" + excluded."count";
+
+END;
+
+CREATE TRIGGER IF NOT EXISTS "url_vocabulary_ad" AFTER DELETE ON "url_vocabulary" BEGIN
+UPDATE
+  "vocabulary"
+SET
+  "count" = "count" - OLD."count"
+WHERE
+  "word" = OLD."word";
+
+DELETE FROM
+  "vocabulary"
+WHERE
+  "word" = OLD."word"
+  AND "count" <= 0;
+
+END;
+
+-- The counts so far were added to every time a url was indexed and can't be
+-- split between urls, so the vocabulary is started over and every url is
+-- indexed again by the next populate.
+DELETE FROM
+  "vocabulary";
+
+UPDATE
+  "urls_meta"
+SET
+  "indexed_at" = NULL;
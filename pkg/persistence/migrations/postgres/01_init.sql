@@ -0,0 +1,92 @@
+-- The postgres schema mirrors the sqlite migrations in the parent directory.
+-- Times are unix seconds, as in sqlite. Foreign keys are declared but not
+-- enforced in sqlite, so they are left out here as well to keep both backends
+-- behaving the same. `browser-gopher doctor` finds orphaned rows.
+
+CREATE TABLE IF NOT EXISTS "urls" (
+  "url_md5" VARCHAR(32) PRIMARY KEY NOT NULL,
+  "url" TEXT UNIQUE NOT NULL,
+  "title" TEXT,
+  "description" TEXT,
+  "last_visit" BIGINT,
+  "redacted" BOOLEAN NOT NULL DEFAULT FALSE,
+  "visit_count" INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS "urls_meta" (
+  "id" BIGSERIAL PRIMARY KEY,
+  "url_md5" VARCHAR(32) UNIQUE NOT NULL,
+  "indexed_at" BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS "visits" (
+  "id" BIGSERIAL PRIMARY KEY,
+  "url_md5" VARCHAR(32) NOT NULL,
+  "visit_time" BIGINT,
+  "extractor_name" TEXT
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS visits_unique ON visits(url_md5, visit_time);
+CREATE INDEX IF NOT EXISTS visits_url_md5 ON visits(url_md5);
+
+CREATE TABLE IF NOT EXISTS "documents" (
+  "document_md5" VARCHAR(32) PRIMARY KEY NOT NULL,
+  "body" TEXT,
+  "status_code" INTEGER,
+  "accessed_at" BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS "url_document_edges" (
+  "id" BIGSERIAL PRIMARY KEY,
+  "url_md5" VARCHAR(32) UNIQUE NOT NULL,
+  "document_md5" VARCHAR(32) NOT NULL
+);
+
+-- @note the 'simple' config does no stemming or stop word removal, which is
+-- closer to the trigram index used with sqlite and works for any language.
+CREATE TABLE IF NOT EXISTS "fragment" (
+  "id" BIGINT PRIMARY KEY,
+  "e" VARCHAR(255),
+  "t" VARCHAR(255),
+  "a" VARCHAR(255),
+  "v" TEXT,
+  "created_at" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "tsv" TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', coalesce("v", ''))) STORED
+);
+
+CREATE INDEX IF NOT EXISTS fragment_tsv ON fragment USING GIN(tsv);
+CREATE INDEX IF NOT EXISTS fragment_e ON fragment(e);
+
+-- last_visit and visit_count are derived from the visits table, as in the sqlite 04_visit_stats.sql
+CREATE OR REPLACE FUNCTION visits_stats() RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_OP IN ('DELETE', 'UPDATE') THEN
+    UPDATE
+      "urls"
+    SET
+      "visit_count" = greatest("visit_count" - 1, 0),
+      "last_visit" = coalesce(
+        (SELECT max("visit_time") FROM "visits" WHERE "url_md5" = OLD."url_md5"),
+        "last_visit"
+      )
+    WHERE
+      "url_md5" = OLD."url_md5";
+  END IF;
+
+  IF TG_OP IN ('INSERT', 'UPDATE') THEN
+    UPDATE
+      "urls"
+    SET
+      "visit_count" = "visit_count" + 1,
+      "last_visit" = greatest(coalesce("last_visit", 0), NEW."visit_time")
+    WHERE
+      "url_md5" = NEW."url_md5";
+  END IF;
+
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS "visits_stats" ON "visits";
+CREATE TRIGGER "visits_stats" AFTER INSERT OR DELETE OR UPDATE OF "url_md5", "visit_time" ON "visits"
+  FOR EACH ROW EXECUTE FUNCTION visits_stats();
@@ -0,0 +1,24 @@
+-- See the sqlite 05_title_history.sql
+CREATE TABLE IF NOT EXISTS "url_titles" (
+  "id" BIGSERIAL PRIMARY KEY,
+  "url_md5" VARCHAR(32) NOT NULL,
+  "title" TEXT NOT NULL,
+  "first_seen" BIGINT,
+  "last_seen" BIGINT
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS url_titles_unique ON url_titles(url_md5, title);
+
+INSERT INTO
+  "url_titles" ("url_md5", "title", "first_seen", "last_seen")
+SELECT
+  "url_md5",
+  "title",
+  "last_visit",
+  "last_visit"
+FROM
+  "urls"
+WHERE
+  "title" IS NOT NULL
+  AND "title" != ''
+ON CONFLICT DO NOTHING;
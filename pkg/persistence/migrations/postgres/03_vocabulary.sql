@@ -0,0 +1,5 @@
+-- See the sqlite 07_vocabulary.sql
+CREATE TABLE IF NOT EXISTS "vocabulary" (
+  "word" TEXT PRIMARY KEY,
+  "count" BIGINT NOT NULL DEFAULT 0
+);
@@ -0,0 +1,9 @@
+-- See the sqlite 08_term_vectors.sql
+CREATE TABLE IF NOT EXISTS "term_vectors" (
+  "url_md5" VARCHAR(32) NOT NULL REFERENCES urls(url_md5),
+  "term" TEXT NOT NULL,
+  "weight" DOUBLE PRECISION NOT NULL,
+  PRIMARY KEY ("url_md5", "term")
+);
+
+CREATE INDEX IF NOT EXISTS "term_vectors_term" ON "term_vectors" ("term");
@@ -0,0 +1,17 @@
+-- See the sqlite 09_search_history.sql
+CREATE TABLE IF NOT EXISTS "search_history" (
+  "id" BIGSERIAL PRIMARY KEY,
+  "query" TEXT NOT NULL,
+  "mode" TEXT NOT NULL DEFAULT '',
+  "searched_at" BIGINT NOT NULL,
+  "result_count" BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS "search_history_searched_at" ON "search_history" ("searched_at");
+
+CREATE TABLE IF NOT EXISTS "saved_searches" (
+  "name" TEXT PRIMARY KEY,
+  "query" TEXT NOT NULL,
+  "mode" TEXT NOT NULL DEFAULT '',
+  "created_at" BIGINT NOT NULL
+);
@@ -0,0 +1,2 @@
+-- See the sqlite 10_fragment_sections.sql
+ALTER TABLE fragment ADD COLUMN IF NOT EXISTS section TEXT;
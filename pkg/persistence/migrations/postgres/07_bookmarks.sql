@@ -0,0 +1,8 @@
+-- See the sqlite 11_bookmarks.sql
+CREATE TABLE IF NOT EXISTS "bookmarks" (
+  "url_md5" VARCHAR(32) NOT NULL,
+  "extractor_name" TEXT NOT NULL,
+  "title" TEXT,
+  "added_at" BIGINT,
+  PRIMARY KEY ("url_md5", "extractor_name")
+);
@@ -0,0 +1,8 @@
+-- Substring search with pg_trgm, like the sqlite trigram indexes. The indexes
+-- are used by ILIKE '%...%' on fragments and by the % similarity operator on
+-- the vocabulary. pg_trgm is a trusted extension from postgres 13, so the
+-- owner of the database can create it.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS fragment_v_trgm ON fragment USING GIN (v gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS vocabulary_word_trgm ON vocabulary USING GIN (word gin_trgm_ops);
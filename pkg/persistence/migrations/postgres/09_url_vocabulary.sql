@@ -0,0 +1,44 @@
+-- See the sqlite 12_url_vocabulary.sql
+CREATE TABLE IF NOT EXISTS "url_vocabulary" (
+  "url_md5" VARCHAR(32) NOT NULL,
+  "word" TEXT NOT NULL,
+  "count" BIGINT NOT NULL,
+  PRIMARY KEY ("url_md5", "word")
+);
+
+CREATE OR REPLACE FUNCTION url_vocabulary_counts() RETURNS TRIGGER AS $$
+BEGIN
+  IF TG_OP = 'DELETE' THEN
+    UPDATE
+      "vocabulary"
+    SET
+      "count" = "count" - OLD."count"
+    WHERE
+      "word" = OLD."word";
+
+    DELETE FROM
+      "vocabulary"
+    WHERE
+      "word" = OLD."word"
+      AND "count" <= 0;
+  END IF;
+
+  IF TG_OP = 'INSERT' THEN
+    INSERT INTO
+      "vocabulary" ("word", "count")
+    VALUES
+      (NEW."word", NEW."count")
+    ON CONFLICT ("word") DO UPDATE SET
+      "count" = "vocabulary"."count" + excluded."count";
+  END IF;
+
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS "url_vocabulary_counts" ON "url_vocabulary";
+CREATE TRIGGER "url_vocabulary_counts" AFTER INSERT OR DELETE ON "url_vocabulary"
+  FOR EACH ROW EXECUTE FUNCTION url_vocabulary_counts();
+
+DELETE FROM "vocabulary";
+UPDATE "urls_meta" SET "indexed_at" = NULL;
@@ -0,0 +1,200 @@
+package persistence
+
+import (
+	"context"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// Pattern is a regular expression, or an exact string, that fragments are
+// matched against as they are rather than through the search index. See
+// SearchPattern.
+type Pattern struct {
+	re *regexp.Regexp
+	// Strings every match contains, ignoring case, for narrowing down the
+	// fragments to match against
+	literals []string
+}
+
+// NewPattern compiles s, a regular expression in the syntax of the regexp
+// package, or an exact string if literal is set. Both are case-sensitive,
+// unless the expression starts with (?i).
+func NewPattern(s string, literal bool) (*Pattern, error) {
+	if literal {
+		s = regexp.QuoteMeta(s)
+	}
+
+	parsed, err := syntax.Parse(s, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pattern{re: re, literals: requiredLiterals(parsed.Simplify())}, nil
+}
+
+func (p *Pattern) String() string {
+	return p.re.String()
+}
+
+// Strings that anything re matches contains, e.g. "issues/" and "/go" for
+// issues/\d+/go. Alternatives are not looked into, so this can be empty.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		xs := []string{}
+		for _, sub := range re.Sub {
+			xs = append(xs, requiredLiterals(sub)...)
+		}
+		return xs
+	}
+	return nil
+}
+
+// The literals of p long enough to be looked up in a trigram index. If there
+// are none every fragment has to be matched.
+func (p *Pattern) trigramLiterals() []string {
+	return lo.Filter(p.literals, func(s string, _ int) bool { return utf8.RuneCountInString(s) >= 3 })
+}
+
+// Strings a fragment has to contain as terms, so that they can be looked up
+// like a quoted phrase
+func containsTerms(contains []string) []query.Term {
+	return lo.Map(contains, func(s string, _ int) query.Term { return query.Term{Value: s, Phrase: true} })
+}
+
+// Characters of context on either side of the first match in a snippet
+const patternContext = 80
+
+// A snippet of the attribute a with the text around the first of the matches
+// in v, and every match in it
+func patternSnippet(a string, v string, matches [][]int) types.Snippet {
+	start := matches[0][0] - patternContext
+	if start < 0 {
+		start = 0
+	}
+	end := matches[0][1] + patternContext
+	if end > len(v) {
+		end = len(v)
+	}
+	for start > 0 && !utf8.RuneStart(v[start]) {
+		start--
+	}
+	for end < len(v) && !utf8.RuneStart(v[end]) {
+		end++
+	}
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("…")
+	}
+	pos := start
+	for _, m := range matches {
+		if m[0] == m[1] || m[0] < start || m[1] > end {
+			continue
+		}
+		sb.WriteString(v[pos:m[0]])
+		sb.WriteString(markStart + v[m[0]:m[1]] + markEnd)
+		pos = m[1]
+	}
+	sb.WriteString(v[pos:end])
+	if end < len(v) {
+		sb.WriteString("…")
+	}
+
+	return parseSnippet(a, strings.Join(strings.Fields(sb.String()), " "))
+}
+
+// SearchPattern finds the urls with a fragment that p matches, e.g. a title
+// with punctuation that full-text search would ignore. Returns a page of them
+// in the order of opts, with a snippet of every fragment that matched, and the
+// total number of them.
+//
+// @note relevance is the weight of the best attribute that matched, title,
+// url or content, along with visits
+func SearchPattern(ctx context.Context, store Store, p *Pattern, opts SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+	type match struct {
+		a       string
+		snippet types.Snippet
+	}
+
+	ranking := opts.ranking()
+	weight := func(a string) float64 {
+		switch a {
+		case "title":
+			return ranking.TitleWeight
+		case "url":
+			return ranking.UrlWeight
+		default:
+			return ranking.ContentWeight
+		}
+	}
+
+	matches := map[string][]match{}
+	err := store.Fragments(ctx, p.trigramLiterals(), func(f types.Fragment) error {
+		if !opts.includes(f.E) {
+			return nil
+		}
+		if spans := p.re.FindAllStringIndex(f.V, -1); len(spans) > 0 {
+			sn := patternSnippet(f.A, f.V, spans)
+			sn.Section = f.Section
+			matches[f.E] = append(matches[f.E], match{a: f.A, snippet: sn})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not match fragments")
+	}
+
+	xs := []types.UrlDbSearchEntity{}
+	for _, batch := range lo.Chunk(lo.Keys(matches), recordBatchSize) {
+		urls, err := store.FilterUrls(ctx, &query.Query{}, opts, batch...)
+		if err != nil {
+			return nil, 0, err
+		}
+		xs = append(xs, urls...)
+	}
+
+	for i, x := range xs {
+		ms := matches[x.UrlMd5]
+		sort.SliceStable(ms, func(i, j int) bool {
+			if weight(ms[i].a) != weight(ms[j].a) {
+				return weight(ms[i].a) > weight(ms[j].a)
+			}
+			return ms[i].snippet.Text < ms[j].snippet.Text
+		})
+
+		snippets := lo.UniqBy(lo.Map(ms, func(m match, _ int) types.Snippet { return m.snippet }), func(s types.Snippet) string { return s.Text })
+		count := len(ms)
+		score := weight(ms[0].a)
+		if x.Score != nil {
+			score += *x.Score
+		}
+
+		xs[i].Snippets = snippets
+		xs[i].MatchCount = &count
+		xs[i].Score = &score
+	}
+
+	sortResults(xs, opts.sort())
+	return paginate(xs, opts), uint(len(xs)), nil
+}
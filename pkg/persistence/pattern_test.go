@@ -0,0 +1,81 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchPattern(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			insert := func(url, title string, content ...string) {
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title}))
+				md5 := util.HashMd5String(url)
+				fragments := []types.Fragment{{E: md5, T: "urls", A: "url", V: url}, {E: md5, T: "urls", A: "title", V: title}}
+				for _, c := range content {
+					fragments = append(fragments, types.Fragment{E: md5, T: "documents", A: "content", V: c})
+				}
+				require.NoError(t, store.InsertFragments(ctx, fragments...))
+			}
+
+			insert("https://github.com/golang/go/issues/1234", "cmd/go: build fails")
+			insert("https://github.com/golang/go/issues/56789", "spec: generics")
+			insert("https://github.com/golang/go/pulls", "Pull requests")
+			insert("https://go.dev/blog", "The Go Blog", "The program crashed with panic: runtime error: index out of range [3] with length 3, again.")
+
+			search := func(s string, literal bool, opts persistence.SearchOptions) ([]string, []types.UrlDbSearchEntity) {
+				p, err := persistence.NewPattern(s, literal)
+				require.NoError(t, err)
+				results, count, err := persistence.SearchPattern(ctx, store, p, opts)
+				require.NoError(t, err)
+				require.GreaterOrEqual(t, count, uint(len(results)))
+				urls := []string{}
+				for _, x := range results {
+					urls = append(urls, x.Url)
+				}
+				return urls, results
+			}
+
+			urls, results := search(`/issues/\d{4}$`, false, persistence.SearchOptions{})
+			require.Equal(t, []string{"https://github.com/golang/go/issues/1234"}, urls)
+			require.Equal(t, "https://github.com/golang/go<mark>/issues/1234</mark>", marked(results[0].Snippets))
+			require.Equal(t, 1, *results[0].MatchCount)
+
+			urls, _ = search(`/issues/\d+`, false, persistence.SearchOptions{})
+			require.Len(t, urls, 2)
+
+			urls, results = search("index out of range [3]", true, persistence.SearchOptions{})
+			require.Equal(t, []string{"https://go.dev/blog"}, urls, "punctuation is matched as it is")
+			require.Contains(t, marked(results[0].Snippets), "panic: runtime error: <mark>index out of range [3]</mark> with length 3")
+
+			urls, _ = search("Index Out Of Range", true, persistence.SearchOptions{})
+			require.Empty(t, urls, "exact strings are case-sensitive")
+			urls, _ = search("(?i)Index Out Of Range", false, persistence.SearchOptions{})
+			require.Len(t, urls, 1, "unless the expression ignores case")
+
+			urls, _ = search(`go|blog`, false, persistence.SearchOptions{})
+			require.Len(t, urls, 4, "expressions without a literal match every fragment")
+
+			// Paging
+			p, err := persistence.NewPattern("golang", true)
+			require.NoError(t, err)
+			results, count, err := persistence.SearchPattern(ctx, store, p, persistence.SearchOptions{Sort: persistence.SortRecent, Limit: 2, Offset: 2})
+			require.NoError(t, err)
+			require.Equal(t, uint(3), count)
+			require.Len(t, results, 1)
+
+			_, err = persistence.NewPattern(`(unclosed`, false)
+			require.Error(t, err)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,8 +17,10 @@ import (
 
 	"github.com/iansinnott/browser-gopher/pkg/config"
 	"github.com/iansinnott/browser-gopher/pkg/logging"
+	"github.com/iansinnott/browser-gopher/pkg/redact"
 	"github.com/iansinnott/browser-gopher/pkg/types"
 	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
 	"github.com/samber/lo"
 )
 
@@ -59,13 +62,13 @@ func InitDb(ctx context.Context, c *config.AppConfig) (*sql.DB, error) {
 
 	// pull out `select current_timestamp;` from the database
 	// this is used to set the version of the database
-	var version string
+	var version int
 	err = conn.QueryRowContext(ctx, "PRAGMA user_version;").Scan(&version)
 	if err != nil {
 		return nil, err
 	}
 
-	if version == "0" {
+	if version == 0 {
 		_, err = conn.ExecContext(ctx, "PRAGMA user_version = 1;")
 		if err != nil {
 			return nil, err
@@ -83,8 +86,11 @@ func InitDb(ctx context.Context, c *config.AppConfig) (*sql.DB, error) {
 			continue
 		}
 
-		migrationVersion := strings.Split(entry.Name(), "_")[0]
-		migrationVersion = strings.TrimPrefix(migrationVersion, "0")
+		// @note compared as numbers, "10" sorts before "9" as a string
+		migrationVersion, err := strconv.Atoi(strings.Split(entry.Name(), "_")[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid migration name "+entry.Name())
+		}
 
 		// skip migrations that have already been run
 		if migrationVersion <= version {
@@ -103,7 +109,7 @@ func InitDb(ctx context.Context, c *config.AppConfig) (*sql.DB, error) {
 			return nil, err
 		}
 
-		_, err = conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %s;", migrationVersion))
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d;", migrationVersion))
 		if err != nil {
 			return nil, err
 		}
@@ -114,7 +120,71 @@ func InitDb(ctx context.Context, c *config.AppConfig) (*sql.DB, error) {
 	return conn, err
 }
 
-func GetLatestTime(ctx context.Context, db *sql.DB, extractor types.Extractor) (*time.Time, error) {
+// SqliteStore is the default Store, backed by the sqlite database at config.DBPath
+type SqliteStore struct {
+	db *sql.DB
+}
+
+// Compile time check that SqliteStore satisfies the Store interface
+var _ Store = (*SqliteStore)(nil)
+
+// NewSqliteStore wraps an existing, already migrated, connection
+func NewSqliteStore(db *sql.DB) *SqliteStore {
+	return &SqliteStore{db: db}
+}
+
+// OpenStore opens and migrates the database of the configured backend. Calling
+// code should close the store when done. If redaction is enabled urls are
+// redacted as they are written, see RedactedStore. If encryption is enabled,
+// or was before, the store is an *EncryptedStore.
+func OpenStore(ctx context.Context, c *config.AppConfig) (Store, error) {
+	store, err := openBackend(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Redaction.Enabled {
+		store = NewRedactedStore(store, redact.NewRedactor(c.Redaction))
+	}
+
+	if c.Keyring == nil || !(c.Encryption.Enabled || c.Keyring.Exists()) {
+		return store, nil
+	}
+
+	if !c.Keyring.Exists() {
+		store.Close()
+		return nil, fmt.Errorf("encryption is enabled but there is no key at %s, run the encrypt command to create one", c.Keyring.Path())
+	}
+
+	return NewEncryptedStore(store, c.Keyring, c.Encryption.Enabled), nil
+}
+
+func openBackend(ctx context.Context, c *config.AppConfig) (Store, error) {
+	switch c.Database.Backend {
+	case "", config.BackendSqlite:
+	case config.BackendPostgres:
+		db, err := InitPostgresDb(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgresStore(db), nil
+	default:
+		return nil, fmt.Errorf("unknown database backend: %s", c.Database.Backend)
+	}
+
+	db, err := InitDb(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSqliteStore(db), nil
+}
+
+func (s *SqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SqliteStore) LatestVisitTime(ctx context.Context, extractorName string) (*time.Time, error) {
 	qry := `
 SELECT
   visit_time
@@ -125,7 +195,7 @@ ORDER BY
   visit_time DESC
 LIMIT 1;
 	`
-	row := db.QueryRowContext(ctx, qry, extractor.GetName())
+	row := s.db.QueryRowContext(ctx, qry, extractorName)
 	if err := row.Err(); err != nil {
 		return nil, err
 	}
@@ -142,11 +212,27 @@ LIMIT 1;
 
 }
 
-func InsertUrl(ctx context.Context, db *sql.DB, row *types.UrlRow) error {
+// InsertUrl inserts or updates a url. last_visit only ever moves forward, and
+// the title and description are only overwritten by data that is at least as
+// recent as what is already stored, so the import order does not matter.
+// visit_count is maintained by triggers on the visits table. The title is
+// added to the url's title history. A url that was redacted once stays flagged.
+func (s *SqliteStore) InsertUrl(ctx context.Context, row *types.UrlRow) error {
 	const qry = `
-		INSERT OR REPLACE INTO 
-			urls(url_md5, url, title, description, last_visit)
-				VALUES(?, ?, ?, ?, ?);
+		INSERT INTO
+			urls(url_md5, url, title, description, last_visit, redacted)
+				VALUES(?, ?, ?, ?, ?, ?)
+		ON CONFLICT(url_md5) DO UPDATE SET
+			title = CASE
+				WHEN excluded.last_visit >= coalesce(urls.last_visit, 0) THEN coalesce(excluded.title, urls.title)
+				ELSE coalesce(urls.title, excluded.title)
+			END,
+			description = CASE
+				WHEN excluded.last_visit >= coalesce(urls.last_visit, 0) THEN coalesce(excluded.description, urls.description)
+				ELSE coalesce(urls.description, excluded.description)
+			END,
+			last_visit = max(coalesce(urls.last_visit, 0), excluded.last_visit),
+			redacted = max(urls.redacted, excluded.redacted);
 	`
 	var lastVisit int64
 	if row.LastVisit != nil {
@@ -154,11 +240,20 @@ func InsertUrl(ctx context.Context, db *sql.DB, row *types.UrlRow) error {
 	}
 	md5 := util.HashMd5String(row.Url)
 
-	_, err := db.ExecContext(ctx, qry, md5, row.Url, row.Title, row.Description, lastVisit)
+	_, err := s.db.ExecContext(ctx, qry, md5, row.Url, row.Title, row.Description, lastVisit, row.Redacted)
+	if err != nil || row.Title == nil || *row.Title == "" {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, sqliteUpsertTitle, md5, *row.Title, unixOrNull(row.LastVisit), unixOrNull(row.LastVisit))
 	return err
 }
 
-func InsertUrlMeta(ctx context.Context, db *sql.DB, rows ...types.UrlMetaRow) error {
+func (s *SqliteStore) InsertUrlMeta(ctx context.Context, rows ...types.UrlMetaRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
 	// sql to insert multiple rows at once
 	qry := `
 		INSERT OR REPLACE INTO 
@@ -188,7 +283,7 @@ func InsertUrlMeta(ctx context.Context, db *sql.DB, rows ...types.UrlMetaRow) er
 		}
 	}
 
-	_, err := db.ExecContext(ctx, qry)
+	_, err := s.db.ExecContext(ctx, qry)
 
 	if err != nil {
 		logging.Debug().Println("error sql", qry)
@@ -197,7 +292,7 @@ func InsertUrlMeta(ctx context.Context, db *sql.DB, rows ...types.UrlMetaRow) er
 	return err
 }
 
-func InsertDocument(ctx context.Context, db *sql.DB, row *types.DocumentRow) error {
+func (s *SqliteStore) InsertDocument(ctx context.Context, row *types.DocumentRow) error {
 	writeLock.Lock()
 	defer writeLock.Unlock()
 
@@ -213,7 +308,7 @@ func InsertDocument(ctx context.Context, db *sql.DB, row *types.DocumentRow) err
 	// args to subsequent statements, the arg list order is reset for each one.
 	// I.e. the first positional arg is the first in _all_ statements.
 
-	_, err = db.ExecContext(ctx,
+	_, err = s.db.ExecContext(ctx,
 		`
 		INSERT OR REPLACE INTO 
 			documents(document_md5, status_code, accessed_at, body)
@@ -225,7 +320,7 @@ func InsertDocument(ctx context.Context, db *sql.DB, row *types.DocumentRow) err
 		return err
 	}
 
-	_, err = db.ExecContext(ctx,
+	_, err = s.db.ExecContext(ctx,
 		`
 		INSERT OR IGNORE INTO
 			url_document_edges(url_md5, document_md5)
@@ -240,7 +335,134 @@ func InsertDocument(ctx context.Context, db *sql.DB, row *types.DocumentRow) err
 	return nil
 }
 
-func InsertVisit(ctx context.Context, db *sql.DB, row *types.VisitRow) error {
+func (s *SqliteStore) UpdateBodies(ctx context.Context, fn func(body string) (string, error)) (int, error) {
+	var lastRowid int64
+	var n int
+
+	for {
+		bodies, rowid, err := s.bodiesAfter(ctx, lastRowid)
+		if err != nil {
+			return n, err
+		}
+		if len(bodies) == 0 {
+			return n, nil
+		}
+		lastRowid = rowid
+
+		updates := map[string]string{}
+		for md5, body := range bodies {
+			updated, err := fn(body)
+			if err != nil {
+				return n, err
+			}
+			if updated != body {
+				updates[md5] = updated
+			}
+		}
+
+		err = s.updateBodies(ctx, updates)
+		if err != nil {
+			return n, err
+		}
+		n += len(updates)
+	}
+}
+
+func (s *SqliteStore) Bodies(ctx context.Context, prefix string, fn func(urlMd5 string, body string) error) error {
+	// @note substr rather than LIKE, which treats _ and % in the prefix as wildcards
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			edge.url_md5,
+			d.body
+		FROM
+			url_document_edges edge
+			JOIN documents d ON d.document_md5 = edge.document_md5
+		WHERE
+			d.body NOT NULL
+			AND substr(d.body, 1, ?) = ?;
+	`, len(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var urlMd5, body string
+		err := rows.Scan(&urlMd5, &body)
+		if err != nil {
+			return err
+		}
+
+		err = fn(urlMd5, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Read a batch of bodies, by document_md5, with a rowid greater than after. Returns the largest rowid read.
+func (s *SqliteStore) bodiesAfter(ctx context.Context, after int64) (map[string]string, int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			rowid,
+			document_md5,
+			body
+		FROM
+			documents
+		WHERE
+			rowid > ?
+			AND body NOT NULL
+		ORDER BY
+			rowid ASC
+		LIMIT ?;
+	`, after, recordBatchSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	bodies := map[string]string{}
+	last := after
+
+	for rows.Next() {
+		var md5, body string
+		err := rows.Scan(&last, &md5, &body)
+		if err != nil {
+			return nil, 0, err
+		}
+		bodies[md5] = body
+	}
+
+	return bodies, last, rows.Err()
+}
+
+func (s *SqliteStore) updateBodies(ctx context.Context, bodies map[string]string) error {
+	if len(bodies) == 0 {
+		return nil
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for md5, body := range bodies {
+		_, err := tx.ExecContext(ctx, `UPDATE documents SET body = ? WHERE document_md5 = ?;`, body, md5)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SqliteStore) InsertVisit(ctx context.Context, row *types.VisitRow) error {
 	const qry = `
 		INSERT OR IGNORE INTO 
 			visits(url_md5, visit_time, extractor_name)
@@ -248,12 +470,12 @@ func InsertVisit(ctx context.Context, db *sql.DB, row *types.VisitRow) error {
 	`
 	md5 := util.HashMd5String(row.Url)
 
-	_, err := db.ExecContext(ctx, qry, md5, row.Datetime.Unix(), row.ExtractorName)
+	_, err := s.db.ExecContext(ctx, qry, md5, row.Datetime.Unix(), row.ExtractorName)
 	return err
 }
 
 // Count the number of urls that match the given where clause. URL meta is available in the where clause as well.
-func CountUrlsWhere(ctx context.Context, db *sql.DB, where string, args ...interface{}) (int, error) {
+func (s *SqliteStore) countUrlsWhere(ctx context.Context, where string, args ...interface{}) (int, error) {
 	var qry = `
 		SELECT 
 			COUNT(*)
@@ -265,7 +487,7 @@ func CountUrlsWhere(ctx context.Context, db *sql.DB, where string, args ...inter
 		WHERE %s;
 	`
 	qry = fmt.Sprintf(qry, where)
-	row := db.QueryRowContext(ctx, qry, args...)
+	row := s.db.QueryRowContext(ctx, qry, args...)
 	if err := row.Err(); err != nil {
 		return 0, err
 	}
@@ -279,14 +501,15 @@ func CountUrlsWhere(ctx context.Context, db *sql.DB, where string, args ...inter
 	return count, nil
 }
 
-func UrlsById(ctx context.Context, db *sql.DB, ids ...string) ([]types.UrlDbEntity, error) {
+func (s *SqliteStore) UrlsById(ctx context.Context, ids ...string) ([]types.UrlDbEntity, error) {
 	qry := fmt.Sprintf(
 		`SELECT 
 				url_md5,
 				url,
 				title,
 				description,
-				last_visit
+				last_visit,
+				visit_count
 			FROM 
 				urls 
 			WHERE 
@@ -306,7 +529,7 @@ func UrlsById(ctx context.Context, db *sql.DB, ids ...string) ([]types.UrlDbEnti
 		args = append(args, id)
 	}
 
-	rows, err := db.QueryContext(ctx, qry, args...)
+	rows, err := s.db.QueryContext(ctx, qry, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -317,7 +540,7 @@ func UrlsById(ctx context.Context, db *sql.DB, ids ...string) ([]types.UrlDbEnti
 		var url types.UrlDbEntity
 		var ts int64
 
-		err := rows.Scan(&url.UrlMd5, &url.Url, &url.Title, &url.Description, &ts)
+		err := rows.Scan(&url.UrlMd5, &url.Url, &url.Title, &url.Description, &ts, &url.VisitCount)
 		if err != nil {
 			return nil, err
 		}
@@ -2,10 +2,17 @@ package persistence_test
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/iansinnott/browser-gopher/pkg/config"
 	"github.com/iansinnott/browser-gopher/pkg/persistence"
 	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/redact"
 	"github.com/iansinnott/browser-gopher/pkg/types"
 	"github.com/iansinnott/browser-gopher/pkg/util"
 	"github.com/stretchr/testify/require"
@@ -14,14 +21,16 @@ import (
 func TestInitDb(t *testing.T) {
 	dbConn, err := testutils.GetTestDBConn(t)
 	require.NoError(t, err)
-	defer dbConn.Close()
+	store := persistence.NewSqliteStore(dbConn)
+	defer store.Close()
 }
 
 func TestInsertUrlMetadata(t *testing.T) {
 	ctx := context.Background()
 	dbConn, err := testutils.GetTestDBConn(t)
 	require.NoError(t, err)
-	defer dbConn.Close()
+	store := persistence.NewSqliteStore(dbConn)
+	defer store.Close()
 
 	table := []struct {
 		name     string
@@ -50,7 +59,7 @@ func TestInsertUrlMetadata(t *testing.T) {
 
 	for _, tt := range table {
 		t.Run(tt.name, func(t *testing.T) {
-			err = persistence.InsertUrlMeta(ctx, dbConn, tt.metas...)
+			err = store.InsertUrlMeta(ctx, tt.metas...)
 			require.NoError(t, err)
 
 			for i, expected := range tt.expected {
@@ -63,3 +72,389 @@ func TestInsertUrlMetadata(t *testing.T) {
 	}
 
 }
+
+func TestRewriteUrl(t *testing.T) {
+	ctx := context.Background()
+	dbConn, err := testutils.GetTestDBConn(t)
+	require.NoError(t, err)
+	store := persistence.NewSqliteStore(dbConn)
+	defer store.Close()
+
+	oldUrl := "https://example.com/login?token=abc"
+	newUrl := "https://example.com/login?token=REDACTED"
+	title := "Login"
+
+	err = store.InsertUrl(ctx, &types.UrlRow{Url: oldUrl, Title: &title})
+	require.NoError(t, err)
+	err = store.InsertVisit(ctx, &types.VisitRow{Url: oldUrl, Datetime: time.Unix(1000, 0), ExtractorName: "test"})
+	require.NoError(t, err)
+
+	err = store.RewriteUrl(ctx, oldUrl, newUrl)
+	require.NoError(t, err)
+
+	urls, err := store.UrlsById(ctx, util.HashMd5String(oldUrl), util.HashMd5String(newUrl))
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	require.Equal(t, newUrl, urls[0].Url)
+	require.Equal(t, title, *urls[0].Title)
+
+	var visitCount int
+	err = dbConn.QueryRow("SELECT count(*) FROM visits WHERE url_md5 = ?", util.HashMd5String(newUrl)).Scan(&visitCount)
+	require.NoError(t, err)
+	require.Equal(t, 1, visitCount)
+
+	var redacted bool
+	err = dbConn.QueryRow("SELECT redacted FROM urls WHERE url_md5 = ?", util.HashMd5String(newUrl)).Scan(&redacted)
+	require.NoError(t, err)
+	require.True(t, redacted)
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	dbConn, err := testutils.GetTestDBConn(t)
+	require.NoError(t, err)
+	store := persistence.NewSqliteStore(dbConn)
+	defer store.Close()
+
+	oldTime := time.Now().AddDate(-3, 0, 0)
+	newTime := time.Now()
+	bodies := []string{"some full text, sourdough", "some full text"}
+
+	for i, ts := range []time.Time{oldTime, newTime} {
+		u := fmt.Sprintf("https://example.com/%d", i)
+		body := bodies[i]
+		err = store.InsertUrl(ctx, &types.UrlRow{Url: u, LastVisit: &ts})
+		require.NoError(t, err)
+		err = store.InsertVisit(ctx, &types.VisitRow{Url: u, Datetime: ts, ExtractorName: "test"})
+		require.NoError(t, err)
+		err = store.InsertDocument(ctx, &types.DocumentRow{
+			DocumentMd5: util.HashMd5String(u + body),
+			UrlMd5:      util.HashMd5String(u),
+			AccessedAt:  &ts,
+			Body:        &body,
+		})
+		require.NoError(t, err)
+
+		id := util.HashMd5String(u)
+		fragments := []types.Fragment{{E: id, T: "documents", A: "content", V: body}}
+		_, err = store.ReplaceFragments(ctx, []string{id}, fragments...)
+		require.NoError(t, err)
+		err = store.ReplaceVocabulary(ctx, []string{id}, persistence.Vocabulary(fragments)...)
+		require.NoError(t, err)
+		err = store.InsertTermVectors(ctx, types.TermVector{UrlMd5: id, Terms: map[string]float64{"text": 1}})
+		require.NoError(t, err)
+	}
+
+	cutoff := time.Now().AddDate(-1, 0, 0)
+	opts := persistence.PruneOptions{VisitsBefore: &cutoff, DocumentsBefore: &cutoff, DryRun: true}
+
+	report, err := store.Prune(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Visits)
+	require.Equal(t, 1, report.Documents)
+	require.Equal(t, 1, report.Fragments)
+	require.Equal(t, 1, report.TermVectors)
+	require.Equal(t, 1, report.Words, "only words no other page has are pruned")
+
+	var n int
+	err = dbConn.QueryRow("SELECT count(*) FROM visits").Scan(&n)
+	require.NoError(t, err)
+	require.Equal(t, 2, n, "dry run should not delete anything")
+
+	opts.DryRun = false
+	report, err = store.Prune(ctx, opts)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Visits)
+	require.Equal(t, 1, report.Documents)
+	require.Equal(t, 1, report.Fragments)
+	require.Equal(t, 1, report.TermVectors)
+	require.Equal(t, 1, report.Words)
+
+	words, err := store.SimilarWords(ctx, "sourdough", 10)
+	require.NoError(t, err)
+	require.Empty(t, words, "words of pruned bodies are no longer suggested")
+	words, err = store.SimilarWords(ctx, "text", 10)
+	require.NoError(t, err)
+	require.NotEmpty(t, words)
+
+	err = dbConn.QueryRow("SELECT count(*) FROM term_vectors").Scan(&n)
+	require.NoError(t, err)
+	require.Equal(t, 1, n, "term vectors made from pruned bodies are dropped")
+
+	err = dbConn.QueryRow("SELECT count(*) FROM visits").Scan(&n)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	err = dbConn.QueryRow("SELECT count(*) FROM documents WHERE body NOT NULL").Scan(&n)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	err = dbConn.QueryRow("SELECT count(*) FROM urls").Scan(&n)
+	require.NoError(t, err)
+	require.Equal(t, 2, n, "urls are never pruned")
+}
+
+func TestDiagnoseAndRepair(t *testing.T) {
+	ctx := context.Background()
+	dbConn, err := testutils.GetTestDBConn(t)
+	require.NoError(t, err)
+	store := persistence.NewSqliteStore(dbConn)
+	defer store.Close()
+
+	u := "https://example.com"
+	err = store.InsertUrl(ctx, &types.UrlRow{Url: u})
+	require.NoError(t, err)
+	err = store.InsertVisit(ctx, &types.VisitRow{Url: u, Datetime: time.Unix(1000, 0), ExtractorName: "test"})
+	require.NoError(t, err)
+	err = store.InsertUrlMeta(ctx, types.UrlMetaRow{Url: "https://gone.example.com"})
+	require.NoError(t, err)
+	err = store.ReplaceVocabulary(ctx, nil, types.VocabularyRow{UrlMd5: util.HashMd5String("https://gone.example.com"), Word: "vanished", Count: 1})
+	require.NoError(t, err)
+	_, err = dbConn.Exec("UPDATE urls SET last_visit = 0, visit_count = 5")
+	require.NoError(t, err)
+	_, err = dbConn.Exec("INSERT INTO visits(url_md5, visit_time, extractor_name) VALUES(?, 1000, 'test')", util.HashMd5String("https://gone.example.com"))
+	require.NoError(t, err)
+
+	findings, err := store.Diagnose(ctx)
+	require.NoError(t, err)
+
+	problems := map[string]int{}
+	for _, f := range findings {
+		if !f.Ok() {
+			problems[f.Check] = f.Count
+		}
+	}
+	require.Equal(t, map[string]int{"orphaned url meta": 1, "orphaned words": 1, "orphaned visits": 1, "visit stats": 1}, problems)
+
+	err = store.Repair(ctx, findings)
+	require.NoError(t, err)
+
+	findings, err = store.Diagnose(ctx)
+	require.NoError(t, err)
+	for _, f := range findings {
+		if f.Check == "orphaned visits" {
+			require.False(t, f.Ok())
+			require.False(t, f.Fixable, "visits are never deleted")
+			continue
+		}
+		require.True(t, f.Ok(), f.Check)
+	}
+
+	words, err := store.SimilarWords(ctx, "vanished", 10)
+	require.NoError(t, err)
+	require.Empty(t, words, "their words are no longer suggested")
+}
+
+func TestVisitStats(t *testing.T) {
+	ctx := context.Background()
+	dbConn, err := testutils.GetTestDBConn(t)
+	require.NoError(t, err)
+	store := persistence.NewSqliteStore(dbConn)
+	defer store.Close()
+
+	u := "https://example.com"
+	newTitle := "New title"
+	oldTitle := "Old title"
+	recent := time.Unix(2000, 0)
+	old := time.Unix(1000, 0)
+
+	// Import the recent data first, then an older dump
+	err = store.InsertUrl(ctx, &types.UrlRow{Url: u, Title: &newTitle, LastVisit: &recent})
+	require.NoError(t, err)
+	err = store.InsertVisit(ctx, &types.VisitRow{Url: u, Datetime: recent, ExtractorName: "chrome"})
+	require.NoError(t, err)
+	err = store.InsertUrl(ctx, &types.UrlRow{Url: u, Title: &oldTitle, LastVisit: &old})
+	require.NoError(t, err)
+	err = store.InsertVisit(ctx, &types.VisitRow{Url: u, Datetime: old, ExtractorName: "takeout"})
+	require.NoError(t, err)
+	// Duplicate visits are ignored and should not be counted
+	err = store.InsertVisit(ctx, &types.VisitRow{Url: u, Datetime: old, ExtractorName: "takeout"})
+	require.NoError(t, err)
+
+	urls, err := store.UrlsById(ctx, util.HashMd5String(u))
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	require.Equal(t, recent.Unix(), urls[0].LastVisit.Unix())
+	require.Equal(t, 2, urls[0].VisitCount)
+	require.Equal(t, newTitle, *urls[0].Title)
+}
+
+func TestReindexKeepsSearchIndexIntact(t *testing.T) {
+	ctx := context.Background()
+	store, err := testutils.GetTestStore(t)
+	require.NoError(t, err)
+	defer store.Close()
+
+	f := types.Fragment{E: util.HashMd5String("https://example.com"), T: "urls", A: "title", V: "Example"}
+	require.NoError(t, store.InsertFragments(ctx, f))
+	require.NoError(t, store.InsertFragments(ctx, f))
+
+	findings, err := store.Diagnose(ctx)
+	require.NoError(t, err)
+	for _, f := range findings {
+		if f.Check == "search index integrity" {
+			require.True(t, f.Ok(), f.Problem)
+		}
+	}
+}
+
+func TestWordIndex(t *testing.T) {
+	ctx := context.Background()
+	store, err := testutils.GetTestStore(t)
+	require.NoError(t, err)
+	defer store.Close()
+
+	for url, title := range map[string]string{
+		"https://shoes.example":    "Running shoes review",
+		"https://k8s.example":      "Setting up a k8s cluster",
+		"https://frontrun.example": "Frontrunning explained",
+	} {
+		require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title}))
+		require.NoError(t, store.InsertFragments(ctx, types.Fragment{E: util.HashMd5String(url), T: "urls", A: "title", V: title}))
+	}
+
+	search := func(s string) []string {
+		results, count, err := store.SearchUrls(ctx, query.MustParse(s), persistence.SearchOptions{Sort: persistence.SortRecent})
+		require.NoError(t, err, s)
+		require.Equal(t, uint(len(results)), count, s)
+		urls := []string{}
+		for _, r := range results {
+			urls = append(urls, r.Url)
+		}
+		sort.Strings(urls)
+		return urls
+	}
+
+	require.Equal(t, []string{"https://k8s.example"}, search("k8"), "short terms are word prefixes")
+	require.Equal(t, []string{"https://k8s.example"}, search("up k8s"))
+	require.Equal(t, []string{"https://frontrun.example", "https://shoes.example"}, search("running"), "words match as substrings and by stem")
+	require.Equal(t, []string{"https://shoes.example"}, search("runs"), "other forms of a word")
+	require.Equal(t, []string{"https://shoes.example"}, search("run -k8 -explained"))
+	require.Empty(t, search(`"shoes running"`))
+
+	results, _, err := store.SearchUrls(ctx, query.MustParse("runs"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "<mark>Running</mark> shoes review", marked(results[0].Snippets))
+
+	require.NoError(t, store.RebuildSearchIndex(ctx))
+	require.Equal(t, []string{"https://shoes.example"}, search("runs"))
+
+	findings, err := store.Diagnose(ctx)
+	require.NoError(t, err)
+	for _, f := range findings {
+		if f.Check == "search index integrity" {
+			require.True(t, f.Ok(), f.Problem)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	dst, err := testutils.GetTestStore(t)
+	require.NoError(t, err)
+	defer dst.Close()
+	srcConn, err := testutils.GetTestDBConn(t)
+	require.NoError(t, err)
+	src := persistence.NewSqliteStore(srcConn)
+	defer src.Close()
+
+	shared := "https://go.dev"
+	oldTitle := "Go"
+	newTitle := "The Go Programming Language"
+	body := "Go is an open source programming language"
+	old := time.Unix(1000, 0)
+	recent := time.Unix(2000, 0)
+	indexedAt := time.Unix(3000, 0)
+
+	// dst saw the shared url first, and has indexed it
+	require.NoError(t, dst.InsertUrl(ctx, &types.UrlRow{Url: shared, Title: &oldTitle, LastVisit: &old}))
+	require.NoError(t, dst.InsertVisit(ctx, &types.VisitRow{Url: shared, Datetime: old, ExtractorName: "chrome"}))
+	require.NoError(t, dst.InsertUrlMeta(ctx, types.UrlMetaRow{Url: shared, IndexedAt: &indexedAt}))
+
+	require.NoError(t, src.InsertUrl(ctx, &types.UrlRow{Url: shared, Title: &newTitle, LastVisit: &recent}))
+	require.NoError(t, src.InsertVisit(ctx, &types.VisitRow{Url: shared, Datetime: old, ExtractorName: "chrome"}))
+	require.NoError(t, src.InsertVisit(ctx, &types.VisitRow{Url: shared, Datetime: recent, ExtractorName: "firefox"}))
+	require.NoError(t, src.InsertUrl(ctx, &types.UrlRow{Url: "https://rust-lang.org", LastVisit: &old}))
+	require.NoError(t, src.InsertDocument(ctx, &types.DocumentRow{
+		DocumentMd5: util.HashMd5String(body),
+		UrlMd5:      util.HashMd5String(shared),
+		AccessedAt:  &recent,
+		Body:        &body,
+	}))
+
+	report, err := persistence.Merge(ctx, dst, srcConn)
+	require.NoError(t, err)
+	require.Equal(t, &persistence.MergeReport{Urls: 2, NewUrls: 1, NewVisits: 1, Documents: 1, Reindex: 2}, report)
+
+	urls, err := dst.UrlsById(ctx, util.HashMd5String(shared))
+	require.NoError(t, err)
+	require.Len(t, urls, 1)
+	require.Equal(t, newTitle, *urls[0].Title)
+	require.Equal(t, recent.Unix(), urls[0].LastVisit.Unix())
+	require.Equal(t, 2, urls[0].VisitCount, "the visit in both databases is only counted once")
+
+	n, err := dst.CountUnindexed(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, n, "changed urls are re-indexed")
+
+	// Merging again changes nothing
+	report, err = persistence.Merge(ctx, dst, srcConn)
+	require.NoError(t, err)
+	require.Equal(t, &persistence.MergeReport{Urls: 2}, report)
+}
+
+func TestRedactedStore(t *testing.T) {
+	ctx := context.Background()
+	inner, err := testutils.GetTestStore(t)
+	require.NoError(t, err)
+	dst := persistence.NewRedactedStore(inner, redact.NewRedactor(config.RedactionConfig{
+		Enabled:     true,
+		Params:      []string{"token"},
+		Placeholder: "REDACTED",
+	}))
+	defer dst.Close()
+
+	srcConn, err := testutils.GetTestDBConn(t)
+	require.NoError(t, err)
+	src := persistence.NewSqliteStore(srcConn)
+	defer src.Close()
+
+	merged := "https://example.com/callback?token=abc"
+	imported := "https://example.com/login?token=xyz"
+	redacted := func(url string) string { return strings.Replace(url, "abc", "REDACTED", 1) }
+	body := "Signed in"
+	at := time.Unix(1000, 0)
+
+	require.NoError(t, src.InsertUrl(ctx, &types.UrlRow{Url: merged, LastVisit: &at}))
+	require.NoError(t, src.InsertVisit(ctx, &types.VisitRow{Url: merged, Datetime: at, ExtractorName: "chrome"}))
+	require.NoError(t, src.InsertDocument(ctx, &types.DocumentRow{
+		DocumentMd5: util.HashMd5String(body),
+		UrlMd5:      util.HashMd5String(merged),
+		AccessedAt:  &at,
+		Body:        &body,
+	}))
+
+	report, err := persistence.Merge(ctx, dst, srcConn)
+	require.NoError(t, err)
+	require.Equal(t, &persistence.MergeReport{Urls: 1, NewUrls: 1, NewVisits: 1, Documents: 1, Reindex: 1}, report)
+
+	require.NoError(t, persistence.InsertRecord(ctx, dst, &types.UrlRecord{
+		Url:    imported,
+		Visits: []types.VisitRecord{{Time: at, ExtractorName: "firefox"}},
+	}))
+
+	urls, err := dst.UrlsById(ctx, util.HashMd5String(merged), util.HashMd5String(imported))
+	require.NoError(t, err)
+	require.Empty(t, urls, "urls aren't written as they were")
+
+	urls, err = dst.UrlsById(ctx, util.HashMd5String(redacted(merged)), util.HashMd5String("https://example.com/login?token=REDACTED"))
+	require.NoError(t, err)
+	require.Len(t, urls, 2)
+	for _, u := range urls {
+		require.Equal(t, 1, u.VisitCount, "visits are of the redacted url")
+	}
+
+	withDocs, err := dst.UrlsWithDocuments(ctx, util.HashMd5String(redacted(merged)))
+	require.NoError(t, err)
+	require.Len(t, withDocs, 1, "and so are documents")
+}
@@ -0,0 +1,1261 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// Arbitrary key for pg_advisory_xact_lock, so that two clients starting at the
+// same time against a shared database don't both run the migrations.
+const postgresMigrationLock = 7262746
+
+// PostgresStore keeps history in a postgres database, e.g. a shared archive
+// for a team. Requires postgres 12 or later.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// Compile time check that PostgresStore satisfies the Store interface
+var _ Store = (*PostgresStore)(nil)
+
+// NewPostgresStore wraps an existing, already migrated, connection
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Open a connection to the postgres database at c.Database.PostgresDSN and run any pending migrations
+func InitPostgresDb(ctx context.Context, c *config.AppConfig) (*sql.DB, error) {
+	if c.Database.PostgresDSN == "" {
+		return nil, errors.New("database.postgres_dsn must be set to use the postgres backend")
+	}
+
+	conn, err := sql.Open("postgres", c.Database.PostgresDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	err = MigratePostgres(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// MigratePostgres runs every migration in migrations/postgres that has not
+// been run yet. Applied versions are tracked in the schema_migrations table,
+// since postgres has no equivalent of sqlite's user_version.
+func MigratePostgres(ctx context.Context, conn *sql.DB) error {
+	entries, err := MigrationsDir.ReadDir("migrations/postgres")
+	if err != nil {
+		return err
+	}
+
+	// make sure the migrations are sorted
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cleanupWithError := func(err error) error {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1);`, postgresMigrationLock)
+	if err != nil {
+		return cleanupWithError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS "schema_migrations" (
+			"version" INTEGER PRIMARY KEY,
+			"applied_at" TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+	`)
+	if err != nil {
+		return cleanupWithError(err)
+	}
+
+	var version int
+	err = tx.QueryRowContext(ctx, `SELECT coalesce(max(version), 0) FROM schema_migrations;`).Scan(&version)
+	if err != nil {
+		return cleanupWithError(err)
+	}
+
+	for _, entry := range entries {
+		// skip files that are not migrations
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+
+		migrationVersion, err := strconv.Atoi(strings.Split(entry.Name(), "_")[0])
+		if err != nil {
+			return cleanupWithError(errors.Wrap(err, "bad migration name "+entry.Name()))
+		}
+
+		// skip migrations that have already been run
+		if migrationVersion <= version {
+			continue
+		}
+
+		migration, err := MigrationsDir.ReadFile("migrations/postgres/" + entry.Name())
+		if err != nil {
+			return cleanupWithError(err)
+		}
+
+		_, err = tx.ExecContext(ctx, string(migration))
+		if err != nil {
+			return cleanupWithError(errors.Wrap(err, entry.Name()))
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations(version) VALUES($1);`, migrationVersion)
+		if err != nil {
+			return cleanupWithError(err)
+		}
+
+		version = migrationVersion
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *PostgresStore) LatestVisitTime(ctx context.Context, extractorName string) (*time.Time, error) {
+	qry := `
+SELECT
+  visit_time
+FROM
+  visits
+WHERE extractor_name = $1
+ORDER BY
+  visit_time DESC
+LIMIT 1;
+	`
+	var ts int64
+	err := s.db.QueryRowContext(ctx, qry, extractorName).Scan(&ts)
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.Unix(ts, 0)
+
+	return &t, nil
+}
+
+// See SqliteStore.InsertUrl
+func (s *PostgresStore) InsertUrl(ctx context.Context, row *types.UrlRow) error {
+	const qry = `
+		INSERT INTO
+			urls(url_md5, url, title, description, last_visit, redacted)
+				VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT(url_md5) DO UPDATE SET
+			title = CASE
+				WHEN excluded.last_visit >= coalesce(urls.last_visit, 0) THEN coalesce(excluded.title, urls.title)
+				ELSE coalesce(urls.title, excluded.title)
+			END,
+			description = CASE
+				WHEN excluded.last_visit >= coalesce(urls.last_visit, 0) THEN coalesce(excluded.description, urls.description)
+				ELSE coalesce(urls.description, excluded.description)
+			END,
+			last_visit = greatest(coalesce(urls.last_visit, 0), excluded.last_visit),
+			redacted = greatest(urls.redacted, excluded.redacted);
+	`
+	var lastVisit int64
+	if row.LastVisit != nil {
+		lastVisit = row.LastVisit.Unix()
+	}
+	md5 := util.HashMd5String(row.Url)
+
+	_, err := s.db.ExecContext(ctx, qry, md5, row.Url, row.Title, row.Description, lastVisit, row.Redacted)
+	if err != nil || row.Title == nil || *row.Title == "" {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, postgresUpsertTitle, md5, *row.Title, unixOrNull(row.LastVisit), unixOrNull(row.LastVisit))
+	return err
+}
+
+func (s *PostgresStore) InsertUrlMeta(ctx context.Context, rows ...types.UrlMetaRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	var values []string
+	var args []any
+
+	// @note a url may appear more than once in a batch, which postgres does not
+	// allow in a single upsert. Keep the last one, as INSERT OR REPLACE would.
+	seen := map[string]int{}
+
+	for _, row := range rows {
+		md5 := util.HashMd5String(row.Url)
+		var indexed_at int64
+
+		if row.IndexedAt != nil {
+			indexed_at = row.IndexedAt.Unix()
+		}
+
+		if i, ok := seen[md5]; ok {
+			args[i+1] = indexed_at
+			continue
+		}
+
+		seen[md5] = len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d)", len(args)+1, len(args)+2))
+		args = append(args, md5, indexed_at)
+	}
+
+	qry := `
+		INSERT INTO
+			urls_meta(url_md5, indexed_at)
+				VALUES ` + strings.Join(values, ",\n") + `
+		ON CONFLICT(url_md5) DO UPDATE SET
+			indexed_at = excluded.indexed_at;
+	`
+
+	_, err := s.db.ExecContext(ctx, qry, args...)
+	return err
+}
+
+func (s *PostgresStore) InsertDocument(ctx context.Context, row *types.DocumentRow) error {
+	var accessed_at int64
+
+	if row.AccessedAt != nil {
+		accessed_at = row.AccessedAt.Unix()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`
+		INSERT INTO
+			documents(document_md5, status_code, accessed_at, body)
+				VALUES($1, $2, $3, $4)
+		ON CONFLICT(document_md5) DO UPDATE SET
+			status_code = excluded.status_code,
+			accessed_at = excluded.accessed_at,
+			body = excluded.body;
+		`,
+		row.DocumentMd5, row.StatusCode, accessed_at, row.Body,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`
+		INSERT INTO
+			url_document_edges(url_md5, document_md5)
+				VALUES($1, $2)
+		ON CONFLICT DO NOTHING;
+		`,
+		row.UrlMd5, row.DocumentMd5,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) Bodies(ctx context.Context, prefix string, fn func(urlMd5 string, body string) error) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			edge.url_md5,
+			d.body
+		FROM
+			url_document_edges edge
+			JOIN documents d ON d.document_md5 = edge.document_md5
+		WHERE
+			d.body IS NOT NULL
+			AND starts_with(d.body, $1);
+	`, prefix)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var urlMd5, body string
+		err := rows.Scan(&urlMd5, &body)
+		if err != nil {
+			return err
+		}
+
+		err = fn(urlMd5, body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// See SqliteStore.UpdateBodies. Batches are by document_md5 since there is no rowid.
+func (s *PostgresStore) UpdateBodies(ctx context.Context, fn func(body string) (string, error)) (int, error) {
+	var lastMd5 string
+	var n int
+
+	for {
+		rows, err := s.db.QueryContext(ctx, `
+			SELECT
+				document_md5,
+				body
+			FROM
+				documents
+			WHERE
+				document_md5 > $1
+				AND body IS NOT NULL
+			ORDER BY
+				document_md5 ASC
+			LIMIT $2;
+		`, lastMd5, recordBatchSize)
+		if err != nil {
+			return n, err
+		}
+
+		bodies := map[string]string{}
+		for rows.Next() {
+			var body string
+			err := rows.Scan(&lastMd5, &body)
+			if err != nil {
+				rows.Close()
+				return n, err
+			}
+			bodies[lastMd5] = body
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return n, err
+		}
+		if len(bodies) == 0 {
+			return n, nil
+		}
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return n, err
+		}
+
+		var updated int
+		for md5, body := range bodies {
+			newBody, err := fn(body)
+			if err == nil && newBody != body {
+				_, err = tx.ExecContext(ctx, `UPDATE documents SET body = $1 WHERE document_md5 = $2;`, newBody, md5)
+				updated++
+			}
+			if err != nil {
+				tx.Rollback()
+				return n, err
+			}
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return n, err
+		}
+		n += updated
+	}
+}
+
+func (s *PostgresStore) InsertVisit(ctx context.Context, row *types.VisitRow) error {
+	const qry = `
+		INSERT INTO
+			visits(url_md5, visit_time, extractor_name)
+				VALUES($1, $2, $3)
+		ON CONFLICT DO NOTHING;
+	`
+	md5 := util.HashMd5String(row.Url)
+
+	_, err := s.db.ExecContext(ctx, qry, md5, row.Datetime.Unix(), row.ExtractorName)
+	return err
+}
+
+func (s *PostgresStore) UrlsById(ctx context.Context, ids ...string) ([]types.UrlDbEntity, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			url_md5,
+			url,
+			title,
+			description,
+			coalesce(last_visit, 0),
+			visit_count
+		FROM
+			urls
+		WHERE
+			url_md5 = ANY($1);
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []types.UrlDbEntity
+	for rows.Next() {
+		var url types.UrlDbEntity
+		var ts int64
+
+		err := rows.Scan(&url.UrlMd5, &url.Url, &url.Title, &url.Description, &ts, &url.VisitCount)
+		if err != nil {
+			return nil, err
+		}
+
+		url.LastVisit = unixOrNil(ts)
+		urls = append(urls, url)
+	}
+
+	return urls, rows.Err()
+}
+
+func (s *PostgresStore) UrlsWithParams(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			url
+		FROM
+			urls
+		WHERE
+			url LIKE '%?%' OR url LIKE '%#%';
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var u string
+		err := rows.Scan(&u)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+
+	return urls, rows.Err()
+}
+
+// See SqliteStore.RewriteUrl
+func (s *PostgresStore) RewriteUrl(ctx context.Context, oldUrl string, newUrl string) error {
+	oldMd5 := util.HashMd5String(oldUrl)
+	newMd5 := util.HashMd5String(newUrl)
+
+	if oldMd5 == newMd5 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cleanupWithError := func(err error) error {
+		tx.Rollback()
+		return err
+	}
+
+	stmts := []struct {
+		name string
+		qry  string
+		args []any
+	}{
+		{
+			name: "copy url",
+			qry: `
+				INSERT INTO
+					urls(url_md5, url, title, description, last_visit, redacted)
+				SELECT $1, $2, title, description, last_visit, TRUE FROM urls WHERE url_md5 = $3
+				ON CONFLICT(url_md5) DO UPDATE SET
+					last_visit = greatest(urls.last_visit, excluded.last_visit),
+					redacted = TRUE;
+			`,
+			args: []any{newMd5, newUrl, oldMd5},
+		},
+		{
+			name: "move visits",
+			qry: `
+				UPDATE visits SET url_md5 = $1
+				WHERE
+					url_md5 = $2
+					AND NOT EXISTS (SELECT 1 FROM visits v WHERE v.url_md5 = $1 AND v.visit_time = visits.visit_time);
+			`,
+			args: []any{newMd5, oldMd5},
+		},
+		{
+			name: "drop duplicate visits",
+			qry:  `DELETE FROM visits WHERE url_md5 = $1;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "move titles",
+			qry: `
+				UPDATE url_titles SET url_md5 = $1
+				WHERE
+					url_md5 = $2
+					AND NOT EXISTS (SELECT 1 FROM url_titles t WHERE t.url_md5 = $1 AND t.title = url_titles.title);
+			`,
+			args: []any{newMd5, oldMd5},
+		},
+		{
+			name: "drop duplicate titles",
+			qry:  `DELETE FROM url_titles WHERE url_md5 = $1;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "move bookmarks",
+			qry: `
+				UPDATE bookmarks SET url_md5 = $1
+				WHERE
+					url_md5 = $2
+					AND NOT EXISTS (SELECT 1 FROM bookmarks b WHERE b.url_md5 = $1 AND b.extractor_name = bookmarks.extractor_name);
+			`,
+			args: []any{newMd5, oldMd5},
+		},
+		{
+			name: "drop duplicate bookmarks",
+			qry:  `DELETE FROM bookmarks WHERE url_md5 = $1;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop fragments",
+			qry:  `DELETE FROM fragment WHERE e = $1;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop term vectors",
+			qry:  `DELETE FROM term_vectors WHERE url_md5 = $1;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop words",
+			qry:  `DELETE FROM url_vocabulary WHERE url_md5 = $1;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop documents",
+			qry: `
+				DELETE FROM documents
+				WHERE
+					document_md5 IN (SELECT document_md5 FROM url_document_edges WHERE url_md5 = $1)
+					AND document_md5 NOT IN (SELECT document_md5 FROM url_document_edges WHERE url_md5 != $1);
+			`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop document edges",
+			qry:  `DELETE FROM url_document_edges WHERE url_md5 = $1;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop url meta",
+			qry:  `DELETE FROM urls_meta WHERE url_md5 IN ($1, $2);`,
+			args: []any{oldMd5, newMd5},
+		},
+		{
+			name: "drop url",
+			qry:  `DELETE FROM urls WHERE url_md5 = $1;`,
+			args: []any{oldMd5},
+		},
+	}
+
+	for _, stmt := range stmts {
+		_, err := tx.ExecContext(ctx, stmt.qry, stmt.args...)
+		if err != nil {
+			return cleanupWithError(errors.Wrap(err, stmt.name))
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) CountUrlsWithoutDocuments(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			COUNT(*)
+		FROM
+			urls u
+			LEFT OUTER JOIN url_document_edges edge ON u.url_md5 = edge.url_md5
+		WHERE
+			edge.url_md5 IS NULL
+			AND NOT u.redacted;
+	`).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) UrlsWithoutDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			u.url_md5,
+			u.url,
+			u.title,
+			u.description,
+			coalesce(u.last_visit, 0)
+		FROM
+			urls u
+			LEFT OUTER JOIN url_document_edges edge ON u.url_md5 = edge.url_md5
+		WHERE
+			edge.url_md5 IS NULL
+			AND NOT u.redacted
+		ORDER BY
+			random()
+		LIMIT $1;
+	`, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query for urls without documents")
+	}
+	defer rows.Close()
+
+	var urls []types.UrlDbEntity
+
+	for rows.Next() {
+		var u types.UrlDbEntity
+		var ts int64
+
+		err := rows.Scan(&u.UrlMd5, &u.Url, &u.Title, &u.Description, &ts)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		u.LastVisit = unixOrNil(ts)
+		urls = append(urls, u)
+	}
+
+	return urls, rows.Err()
+}
+
+func (s *PostgresStore) UrlsWithDocuments(ctx context.Context, ids ...string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT url_md5 FROM url_document_edges WHERE url_md5 = ANY($1);`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var xs []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, id)
+	}
+
+	return xs, rows.Err()
+}
+
+func (s *PostgresStore) DocumentMd5s(ctx context.Context, ids ...string) (map[string]string, error) {
+	return documentMd5s(ctx, s.db, dialectPostgres, ids)
+}
+
+func (s *PostgresStore) CountUnindexed(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			COUNT(*)
+		FROM
+			urls u
+			LEFT OUTER JOIN urls_meta um ON u.url_md5 = um.url_md5
+		WHERE
+			um.indexed_at IS NULL;
+	`).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) Unindexed(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	return s.queryUrlsWithBody(ctx, `
+		SELECT
+			u.url_md5,
+			u.url,
+			u.title,
+			u.description,
+			coalesce(u.last_visit, 0),
+			doc.document_md5,
+			doc.body
+		FROM
+			urls u
+			LEFT OUTER JOIN urls_meta um ON u.url_md5 = um.url_md5
+			LEFT OUTER JOIN url_document_edges ON u.url_md5 = url_document_edges.url_md5
+			LEFT OUTER JOIN documents doc ON url_document_edges.document_md5 = doc.document_md5
+		WHERE
+			um.indexed_at IS NULL
+		ORDER BY
+			u.last_visit DESC NULLS LAST
+		LIMIT $1;
+	`, limit)
+}
+
+const postgresFromUnindexedDocuments = `
+	FROM
+		urls u
+		JOIN url_document_edges edge ON u.url_md5 = edge.url_md5
+		JOIN documents d ON edge.document_md5 = d.document_md5
+		JOIN urls_meta m ON u.url_md5 = m.url_md5
+	WHERE
+		d.body IS NOT NULL
+		AND d.body != ''
+		AND m.indexed_at < d.accessed_at`
+
+func (s *PostgresStore) CountUnindexedDocuments(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) `+postgresFromUnindexedDocuments+`;`).Scan(&n)
+	return n, err
+}
+
+func (s *PostgresStore) UnindexedDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error) {
+	return s.queryUrlsWithBody(ctx, `
+		SELECT
+			u.url_md5,
+			u.url,
+			u.title,
+			u.description,
+			coalesce(u.last_visit, 0),
+			d.document_md5,
+			d.body
+		`+postgresFromUnindexedDocuments+`
+		LIMIT $1;
+	`, limit)
+}
+
+func (s *PostgresStore) queryUrlsWithBody(ctx context.Context, qry string, args ...any) ([]types.UrlDbEntity, error) {
+	rows, err := s.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error querying unindexed urls")
+	}
+	defer rows.Close()
+
+	var ents []types.UrlDbEntity
+
+	for rows.Next() {
+		var ent types.UrlDbEntity
+		var ts int64
+		err := rows.Scan(&ent.UrlMd5, &ent.Url, &ent.Title, &ent.Description, &ts, &ent.BodyMd5, &ent.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "error scanning row")
+		}
+
+		ent.LastVisit = unixOrNil(ts)
+		ents = append(ents, ent)
+	}
+
+	return ents, rows.Err()
+}
+
+// See indexEav
+const insertFragmentQuery = `
+	INSERT INTO
+		fragment(id, e, t, a, v, section)
+			VALUES($1, $2, $3, $4, $5, nullif($6, ''))
+	ON CONFLICT(id) DO UPDATE SET
+		section = excluded.section
+	WHERE
+		fragment.section IS DISTINCT FROM excluded.section;
+`
+
+func (s *PostgresStore) InsertFragments(ctx context.Context, fragments ...types.Fragment) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range fragments {
+		id, err := generateEavId(f.E, f.T, f.A, f.V)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error generating eav id")
+		}
+
+		_, err = tx.ExecContext(ctx, insertFragmentQuery, id, f.E, f.T, f.A, f.V, f.Section)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error inserting fragment")
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) ReplaceFragments(ctx context.Context, ids []string, fragments ...types.Fragment) (int, error) {
+	keep, err := fragmentIds(fragments)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := deleteStaleFragments(ctx, tx, dialectPostgres, ids, keep)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, f := range fragments {
+		id, err := generateEavId(f.E, f.T, f.A, f.V)
+		if err != nil {
+			tx.Rollback()
+			return 0, errors.Wrap(err, "error generating eav id")
+		}
+
+		_, err = tx.ExecContext(ctx, insertFragmentQuery, id, f.E, f.T, f.A, f.V, f.Section)
+		if err != nil {
+			tx.Rollback()
+			return 0, errors.Wrap(err, "error inserting fragment")
+		}
+	}
+
+	return n, tx.Commit()
+}
+
+func (s *PostgresStore) DeleteEntityFragments(ctx context.Context, ids ...string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM fragment WHERE e = ANY($1);`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *PostgresStore) ResetIndexed(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE
+			urls_meta
+		SET
+			indexed_at = NULL
+		WHERE
+			indexed_at IS NOT NULL;
+	`)
+	return err
+}
+
+func (s *PostgresStore) MarkUnindexed(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx, `UPDATE urls_meta SET indexed_at = NULL WHERE url_md5 = ANY($1);`, pq.Array(ids))
+	return err
+}
+
+func (s *PostgresStore) DeleteFragments(ctx context.Context, t string) (int, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM fragment WHERE t = $1;`, t)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *PostgresStore) ReplaceVocabulary(ctx context.Context, ids []string, rows ...types.VocabularyRow) error {
+	return replaceVocabulary(ctx, s.db, dialectPostgres, ids, rows)
+}
+
+func (s *PostgresStore) DeleteVocabulary(ctx context.Context) error {
+	return deleteVocabulary(ctx, s.db)
+}
+
+func (s *PostgresStore) InsertTermVectors(ctx context.Context, vectors ...types.TermVector) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vectors {
+		_, err := tx.ExecContext(ctx, `DELETE FROM term_vectors WHERE url_md5 = $1;`, v.UrlMd5)
+		if err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "error deleting term vector")
+		}
+
+		for term, weight := range v.Terms {
+			_, err := tx.ExecContext(ctx, `INSERT INTO term_vectors(url_md5, term, weight) VALUES($1, $2, $3);`, v.UrlMd5, term, weight)
+			if err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "error inserting term")
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) DeleteTermVectors(ctx context.Context, ids ...string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT count(DISTINCT url_md5) FROM term_vectors WHERE url_md5 = ANY($1);`, pq.Array(ids)).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.db.ExecContext(ctx, `DELETE FROM term_vectors WHERE url_md5 = ANY($1);`, pq.Array(ids))
+	return n, err
+}
+
+// The tsvector of a fragment is a generated column, so only the indexes over
+// fragments need rebuilding
+func (s *PostgresStore) RebuildSearchIndex(ctx context.Context) error {
+	for _, index := range []string{"fragment_tsv", "fragment_v_trgm"} {
+		_, err := s.db.ExecContext(ctx, `REINDEX INDEX `+index+`;`)
+		if err != nil {
+			return errors.Wrap(err, "could not rebuild "+index)
+		}
+	}
+	return nil
+}
+
+// SQL for the rank of a fragment aliased as fr, with the words of the query in
+// q.query and its text in q.text. ts_rank counts how often the words appear,
+// but only those at the start of a word, so word_similarity adds how well the
+// text matches anywhere in the fragment.
+const postgresFragmentRank = `(ts_rank(fr.tsv, q.query) + word_similarity(q.text, fr.v))`
+
+// SQL for the q of postgresFragmentRank
+func (f *queryFilter) postgresRankQuery(terms []query.Term) string {
+	return `SELECT to_tsquery('simple', ` + f.arg(tsQuery(terms, " | ")) + `) AS query, ` + f.typed(strings.Join(termValues(terms), " "), "text") + ` AS text`
+}
+
+func (s *PostgresStore) SearchUrls(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+	if q.IsEmpty() {
+		return []types.UrlDbSearchEntity{}, 0, nil
+	}
+
+	positive := query.Positive(q.Text)
+	if len(positive) == 0 {
+		return searchFiltered(ctx, s.db, q, dialectPostgres, opts)
+	}
+
+	f := newQueryFilter(q, dialectPostgres)
+	f.restrict(opts)
+	var count uint
+	err := s.db.QueryRowContext(ctx, `
+SELECT
+  count(DISTINCT fr.e)
+FROM
+  fragment fr
+  INNER JOIN urls u ON u.url_md5 = fr.e
+WHERE
+  `+f.postgresMatches("fr", positive, " AND ")+`
+  AND `+f.where()+`;
+	`, f.args...).Scan(&count)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "row count error")
+	}
+
+	// @note rank is negated in sum_rank so that, as with fts5, lower is better
+	ranking := opts.ranking()
+	f = newQueryFilter(q, dialectPostgres)
+	f.restrict(opts)
+	rows, err := s.db.QueryContext(ctx, `
+WITH
+  q AS (
+    `+f.postgresRankQuery(positive)+`
+  ),
+  matches AS (
+    SELECT
+      fr.e,
+      `+postgresFragmentRank+` AS rank,
+      `+postgresFragmentRank+` * `+f.attributeWeight("fr.a", ranking)+` AS weighted_rank
+    FROM
+      fragment fr
+      CROSS JOIN q
+      INNER JOIN urls u ON u.url_md5 = fr.e
+    WHERE
+      `+f.postgresMatches("fr", positive, " AND ")+`
+      AND `+f.where()+`
+  ),
+  scored AS (
+    SELECT
+      e,
+      count(*) AS match_count,
+      - sum(rank) AS sum_rank,
+      max(weighted_rank) AS text_score
+    FROM
+      matches
+    GROUP BY
+      e
+  )
+SELECT
+  t.url_md5,
+  t.url,
+  t.title,
+  t.description,
+  coalesce(t.last_visit, 0),
+  t.visit_count,
+  m.match_count,
+  m.sum_rank,
+  m.text_score + `+f.visitScore("t.url_md5", time.Now(), ranking)+` + `+f.bookmarkScore("t.url_md5", ranking)+` AS score
+FROM
+  scored m
+  INNER JOIN urls t ON t.url_md5 = m.e
+ORDER BY
+  `+opts.orderBy("t")+`
+`+f.limit(opts)+`;
+	`, f.args...)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.UrlDbSearchEntity{}
+
+	for rows.Next() {
+		var x types.UrlDbSearchEntity
+		var ts int64
+		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts, &x.VisitCount, &x.MatchCount, &x.SumRank, &x.Score)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "row error")
+		}
+		x.LastVisit = unixOrNil(ts)
+		xs = append(xs, x)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, errors.Wrap(rows.Err(), "query error")
+	}
+
+	err = s.addSnippets(ctx, positive, xs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return xs, count, nil
+}
+
+// Set the snippets of each result to those of its fragments that match, best
+// first. Fragments are small enough to be shown whole, so they are highlighted
+// in Go, as ts_headline would miss matches in the middle of a word.
+func (s *PostgresStore) addSnippets(ctx context.Context, terms []query.Term, xs []types.UrlDbSearchEntity) error {
+	if len(xs) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(xs))
+	for i, x := range xs {
+		ids[i] = x.UrlMd5
+	}
+
+	f := &queryFilter{dialect: dialectPostgres}
+	rows, err := s.db.QueryContext(ctx, `
+WITH
+  q AS (
+    `+f.postgresRankQuery(terms)+`
+  )
+SELECT
+  fr.e,
+  fr.a,
+  coalesce(fr.section, '') AS section,
+  fr.v
+FROM
+  fragment fr
+  CROSS JOIN q
+WHERE
+  `+f.postgresMatches("fr", terms, " AND ")+`
+  AND fr.e = ANY(`+f.arg(pq.Array(ids))+`)
+ORDER BY
+  `+postgresFragmentRank+` DESC;
+	`, f.args...)
+	if err != nil {
+		return errors.Wrap(err, "snippet query error")
+	}
+	defer rows.Close()
+
+	termRe := termsRegexp(terms)
+	snippets := map[string][]types.Snippet{}
+	for rows.Next() {
+		var e, a, section, v string
+		err := rows.Scan(&e, &a, &section, &v)
+		if err != nil {
+			return errors.Wrap(err, "row error")
+		}
+		sn := highlight(a, v, termRe)
+		sn.Section = section
+		snippets[e] = append(snippets[e], sn)
+	}
+	if rows.Err() != nil {
+		return errors.Wrap(rows.Err(), "snippet query error")
+	}
+
+	for i := range xs {
+		xs[i].Snippets = append([]types.Snippet{}, snippets[xs[i].UrlMd5]...)
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) FilterUrls(ctx context.Context, q *query.Query, opts SearchOptions, ids ...string) ([]types.UrlDbSearchEntity, error) {
+	xs := []types.UrlDbSearchEntity{}
+	for _, batch := range lo.Chunk(ids, recordBatchSize) {
+		f := newQueryFilter(q, dialectPostgres)
+		f.add("u.url_md5 = ANY(" + f.arg(pq.Array(batch)) + ")")
+
+		urls, err := scoredUrls(ctx, s.db, f, opts, "")
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, urls...)
+	}
+	return xs, nil
+}
+
+func (s *PostgresStore) SearchFacets(ctx context.Context, q *query.Query, opts SearchOptions) (*types.Facets, error) {
+	f, matched := matchedUrls(q, dialectPostgres, opts)
+	return searchFacets(ctx, s.db, f, q, matched)
+}
+
+func (s *PostgresStore) SearchVisits(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.VisitDbSearchEntity, uint, error) {
+	f, matched := matchedUrls(q, dialectPostgres, opts)
+	return searchVisits(ctx, s.db, f, q, matched, opts)
+}
+
+func (s *PostgresStore) RelatedUrls(ctx context.Context, urlMd5 string, limit int) ([]types.UrlDbSearchEntity, error) {
+	return relatedUrls(ctx, s.db, dialectPostgres, urlMd5, limit)
+}
+
+// @note the pg_trgm index on v narrows the fragments down for any of contains
+// that are at least 3 characters, like the sqlite trigram index
+func (s *PostgresStore) Fragments(ctx context.Context, contains []string, fn func(f types.Fragment) error) error {
+	f := &queryFilter{dialect: dialectPostgres}
+	f.addLike("fr.v", containsTerms(contains))
+
+	rows, err := s.db.QueryContext(ctx, `SELECT fr.e, fr.t, fr.a, fr.v, coalesce(fr.section, '') FROM fragment fr WHERE `+f.where()+`;`, f.args...)
+	if err != nil {
+		return errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var x types.Fragment
+		err := rows.Scan(&x.E, &x.T, &x.A, &x.V, &x.Section)
+		if err != nil {
+			return errors.Wrap(err, "row error")
+		}
+		if err := fn(x); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "query error")
+}
+
+// Candidates for SimilarWords need this pg_trgm similarity. The default of 0.3
+// is too strict for misspellings, e.g. gopehr is only 0.27 similar to gopher.
+const similarWordThreshold = 0.1
+
+// @note the % operator uses the pg_trgm index on word, with the threshold set
+// for this transaction only
+func (s *PostgresStore) SimilarWords(ctx context.Context, word string, limit int) ([]types.VocabularyRow, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(`SET LOCAL pg_trgm.similarity_threshold = %g;`, similarWordThreshold))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not set similarity threshold")
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+SELECT
+  word,
+  count
+FROM
+  vocabulary
+WHERE
+  word = $1
+  OR word % $1
+ORDER BY
+  word = $1 DESC,
+  similarity(word, $1) DESC,
+  count DESC
+LIMIT $2;
+	`, strings.ToLower(word), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	return scanVocabulary(rows)
+}
+
+func (s *PostgresStore) RecentUrls(ctx context.Context, limit, offset uint) ([]types.UrlDbEntity, uint, error) {
+	var count uint
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM urls;`).Scan(&count)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "row count error")
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT
+  url_md5,
+  url,
+  title,
+  description,
+  coalesce(last_visit, 0),
+  visit_count
+FROM
+  urls
+ORDER BY
+  last_visit DESC NULLS LAST,
+  url_md5
+LIMIT $1 OFFSET $2;
+	`, limit, offset)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.UrlDbEntity{}
+
+	for rows.Next() {
+		var x types.UrlDbEntity
+		var ts int64
+		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts, &x.VisitCount)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "row error")
+		}
+		x.LastVisit = unixOrNil(ts)
+		xs = append(xs, x)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, errors.Wrap(rows.Err(), "query error")
+	}
+
+	return xs, count, nil
+}
@@ -0,0 +1,205 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// Size is the size of the live rows rather than pg_database_size. The latter
+// only shrinks after a VACUUM FULL, which locks every table of what may be a
+// shared database, so pruning to max_db_size would never converge.
+func (s *PostgresStore) Size(ctx context.Context) (int64, error) {
+	var size int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT coalesce(sum(pg_column_size(t.*)), 0) FROM urls t)
+			+ (SELECT coalesce(sum(pg_column_size(t.*)), 0) FROM urls_meta t)
+			+ (SELECT coalesce(sum(pg_column_size(t.*)), 0) FROM visits t)
+			+ (SELECT coalesce(sum(pg_column_size(t.*)), 0) FROM documents t)
+			+ (SELECT coalesce(sum(pg_column_size(t.*)), 0) FROM url_document_edges t)
+			+ (SELECT coalesce(sum(pg_column_size(t.*)), 0) FROM fragment t);
+	`).Scan(&size)
+	return size, err
+}
+
+// See SqliteStore.Prune. Space is reclaimed by autovacuum rather than an
+// explicit VACUUM.
+func (s *PostgresStore) Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error) {
+	var err error
+	report := &PruneReport{}
+
+	report.DBSizeBefore, err = s.Size(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get db size")
+	}
+
+	words, err := countVocabulary(ctx, s.db)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not count vocabulary")
+	}
+
+	var freed int64
+	var urls []string
+
+	if opts.VisitsBefore != nil {
+		// @note see pruneVisits, what is reported is what was deleted
+		before := opts.VisitsBefore.Unix()
+		if opts.DryRun {
+			err = s.db.QueryRowContext(ctx, `SELECT count(*) FROM visits WHERE visit_time < $1;`, before).Scan(&report.Visits)
+		} else {
+			var res sql.Result
+			res, err = s.db.ExecContext(ctx, `DELETE FROM visits WHERE visit_time < $1;`, before)
+			if err == nil {
+				var n int64
+				n, err = res.RowsAffected()
+				report.Visits = int(n)
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not prune visits")
+		}
+	}
+
+	if opts.DocumentsBefore != nil {
+		pruned, err := pruneDocuments(ctx, s.db, dialectPostgres, `d.accessed_at < $1`, []any{opts.DocumentsBefore.Unix()}, opts.DryRun)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not prune documents")
+		}
+		report.add(pruned)
+		urls = append(urls, pruned.urls...)
+		freed += pruned.size * documentSizeFactor
+	}
+
+	if opts.MaxDBSize > 0 && report.DBSizeBefore-freed > opts.MaxDBSize {
+		var since int64
+		if opts.DocumentsBefore != nil {
+			since = opts.DocumentsBefore.Unix()
+		}
+
+		excess := (report.DBSizeBefore - freed - opts.MaxDBSize) / documentSizeFactor
+		cutoff, err := s.documentCutoffForSize(ctx, excess, since)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not find documents to prune")
+		}
+
+		if cutoff != nil {
+			pruned, err := pruneDocuments(ctx, s.db, dialectPostgres, `d.accessed_at >= $1 AND d.accessed_at <= $2`, []any{since, *cutoff}, opts.DryRun)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not prune documents")
+			}
+			report.add(pruned)
+			urls = append(urls, pruned.urls...)
+			freed += pruned.size * documentSizeFactor
+		}
+	}
+
+	if opts.DryRun {
+		report.Words, err = prunedWords(ctx, s, urls)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not count pruned words")
+		}
+		report.DBSizeAfter = report.DBSizeBefore - freed
+		if report.DBSizeAfter < 0 {
+			report.DBSizeAfter = 0
+		}
+		return report, nil
+	}
+
+	if report.Documents > 0 {
+		report.Words, err = pruneVocabulary(ctx, s, words)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not prune vocabulary")
+		}
+	}
+
+	report.DBSizeAfter, err = s.Size(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get db size")
+	}
+
+	return report, nil
+}
+
+// See documentCutoffForSize
+func (s *PostgresStore) documentCutoffForSize(ctx context.Context, size int64, since int64) (*int64, error) {
+	// @note the running total is computed in the database so that bodies don't
+	// have to be sent over the network just to be measured
+	var cutoff sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			min(accessed_at)
+		FROM (
+			SELECT
+				accessed_at,
+				sum(length(body)) OVER (ORDER BY accessed_at ASC) AS total
+			FROM
+				documents
+			WHERE
+				body IS NOT NULL
+				AND accessed_at >= $1
+		) AS running
+		WHERE
+			total >= $2;
+	`, since, size).Scan(&cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	if cutoff.Valid {
+		return &cutoff.Int64, nil
+	}
+
+	var remaining int
+	err = s.db.QueryRowContext(ctx, `SELECT count(*) FROM documents WHERE body IS NOT NULL AND accessed_at >= $1;`, since).Scan(&remaining)
+	if err != nil {
+		return nil, err
+	}
+
+	// Not enough to get under the limit, so remove everything
+	if remaining > 0 {
+		var max int64 = 1<<63 - 1
+		return &max, nil
+	}
+
+	return nil, nil
+}
+
+// The sqlite integrity and search index checks don't apply. Postgres checks its
+// own storage, and the tsvector column can't drift from the fragment text.
+var postgresConsistencyChecks = append(append([]consistencyCheck{}, orphanChecks...),
+	consistencyCheck{
+		name: "visit stats",
+		countQuery: `
+			SELECT count(*) FROM urls u
+			LEFT JOIN (SELECT url_md5, count(*) AS n, max(visit_time) AS visit_time FROM visits GROUP BY url_md5) v ON v.url_md5 = u.url_md5
+			WHERE
+				u.visit_count != coalesce(v.n, 0)
+				OR (v.url_md5 IS NOT NULL AND u.last_visit IS DISTINCT FROM v.visit_time);
+		`,
+		problem: "urls whose last_visit or visit_count does not match their visits",
+		fix: execFix(`
+			UPDATE urls
+			SET
+				visit_count = coalesce(v.n, 0),
+				last_visit = coalesce(v.visit_time, urls.last_visit)
+			FROM (
+				SELECT u.url_md5, count(visits.id) AS n, max(visits.visit_time) AS visit_time
+				FROM urls u LEFT JOIN visits ON visits.url_md5 = u.url_md5
+				GROUP BY u.url_md5
+			) AS v
+			WHERE
+				v.url_md5 = urls.url_md5
+				AND (urls.visit_count != coalesce(v.n, 0) OR urls.last_visit IS DISTINCT FROM coalesce(v.visit_time, urls.last_visit));
+		`),
+	},
+)
+
+func (s *PostgresStore) Diagnose(ctx context.Context) ([]Finding, error) {
+	return runChecks(ctx, s.db, postgresConsistencyChecks)
+}
+
+func (s *PostgresStore) Repair(ctx context.Context, findings []Finding) error {
+	return repairFindings(ctx, s.db, postgresConsistencyChecks, findings)
+}
@@ -0,0 +1,236 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// @note unlike sqlite's min and max, least and greatest ignore nulls
+const postgresUpsertTitle = `
+	INSERT INTO
+		url_titles(url_md5, title, first_seen, last_seen)
+			VALUES($1, $2, $3, $4)
+	ON CONFLICT(url_md5, title) DO UPDATE SET
+		first_seen = least(url_titles.first_seen, excluded.first_seen),
+		last_seen = greatest(url_titles.last_seen, excluded.last_seen);
+`
+
+func (s *PostgresStore) InsertTitles(ctx context.Context, url string, titles ...types.TitleRecord) error {
+	md5 := util.HashMd5String(url)
+
+	for _, t := range titles {
+		if t.Title == "" {
+			continue
+		}
+
+		_, err := s.db.ExecContext(ctx, postgresUpsertTitle, md5, t.Title, unixOrNull(t.FirstSeen), unixOrNull(t.LastSeen))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// See SqliteStore.Records
+func (s *PostgresStore) Records(ctx context.Context, opts RecordOptions, fn func(*types.UrlRecord) error) error {
+	since, until := opts.bounds()
+	var lastId string
+
+	for {
+		records, ids, err := s.recordUrls(ctx, lastId, since, until)
+		if err != nil {
+			return errors.Wrap(err, "could not read urls")
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		lastId = ids[len(ids)-1]
+
+		err = s.recordTitles(ctx, records, ids)
+		if err != nil {
+			return errors.Wrap(err, "could not read titles")
+		}
+
+		err = s.recordVisits(ctx, records, ids, since, until)
+		if err != nil {
+			return errors.Wrap(err, "could not read visits")
+		}
+
+		err = s.recordDocuments(ctx, records, ids)
+		if err != nil {
+			return errors.Wrap(err, "could not read documents")
+		}
+
+		for _, id := range ids {
+			err := fn(records[id])
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// @note there is no rowid in postgres, so batches are by url_md5 instead
+func (s *PostgresStore) recordUrls(ctx context.Context, after string, since, until int64) (map[string]*types.UrlRecord, []string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			u.url_md5,
+			u.url,
+			u.title,
+			u.description,
+			coalesce(u.last_visit, 0),
+			u.redacted
+		FROM
+			urls u
+		WHERE
+			u.url_md5 > $1
+			AND (
+				EXISTS (SELECT 1 FROM visits v WHERE v.url_md5 = u.url_md5 AND v.visit_time >= $2 AND v.visit_time < $3)
+				OR (u.visit_count = 0 AND coalesce(u.last_visit, 0) >= $2 AND coalesce(u.last_visit, 0) < $3)
+			)
+		ORDER BY
+			u.url_md5 ASC
+		LIMIT $4;
+	`, after, since, until, recordBatchSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	records := map[string]*types.UrlRecord{}
+	var ids []string
+
+	for rows.Next() {
+		rec := &types.UrlRecord{Titles: []types.TitleRecord{}, Visits: []types.VisitRecord{}}
+		var id string
+		var ts int64
+
+		err := rows.Scan(&id, &rec.Url, &rec.Title, &rec.Description, &ts, &rec.Redacted)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		rec.LastVisit = unixOrNil(ts)
+		records[id] = rec
+		ids = append(ids, id)
+	}
+
+	return records, ids, rows.Err()
+}
+
+func (s *PostgresStore) recordTitles(ctx context.Context, records map[string]*types.UrlRecord, ids []string) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			url_md5,
+			title,
+			first_seen,
+			last_seen
+		FROM
+			url_titles
+		WHERE
+			url_md5 = ANY($1)
+		ORDER BY
+			first_seen ASC NULLS FIRST;
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var t types.TitleRecord
+		var firstSeen, lastSeen sql.NullInt64
+
+		err := rows.Scan(&id, &t.Title, &firstSeen, &lastSeen)
+		if err != nil {
+			return err
+		}
+
+		t.FirstSeen = unixOrNil(firstSeen.Int64)
+		t.LastSeen = unixOrNil(lastSeen.Int64)
+		records[id].Titles = append(records[id].Titles, t)
+	}
+
+	return rows.Err()
+}
+
+func (s *PostgresStore) recordVisits(ctx context.Context, records map[string]*types.UrlRecord, ids []string, since, until int64) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			url_md5,
+			visit_time,
+			coalesce(extractor_name, '')
+		FROM
+			visits
+		WHERE
+			url_md5 = ANY($1)
+			AND visit_time >= $2
+			AND visit_time < $3
+		ORDER BY
+			visit_time ASC;
+	`, pq.Array(ids), since, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var ts int64
+		var v types.VisitRecord
+
+		err := rows.Scan(&id, &ts, &v.ExtractorName)
+		if err != nil {
+			return err
+		}
+
+		v.Time = time.Unix(ts, 0)
+		records[id].Visits = append(records[id].Visits, v)
+	}
+
+	return rows.Err()
+}
+
+func (s *PostgresStore) recordDocuments(ctx context.Context, records map[string]*types.UrlRecord, ids []string) error {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			edge.url_md5,
+			d.document_md5,
+			coalesce(d.status_code, 0),
+			coalesce(d.accessed_at, 0),
+			d.body
+		FROM
+			url_document_edges edge
+			JOIN documents d ON d.document_md5 = edge.document_md5
+		WHERE
+			edge.url_md5 = ANY($1);
+	`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var ts int64
+		var d types.DocumentRecord
+
+		err := rows.Scan(&id, &d.DocumentMd5, &d.StatusCode, &ts, &d.Body)
+		if err != nil {
+			return err
+		}
+
+		d.AccessedAt = unixOrNil(ts)
+		records[id].Documents = append(records[id].Documents, d)
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,396 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// Rough multiplier from full-text body size to on-disk size. Bodies are stored
+// once as markdown, once more as plaintext fragments and again in the trigram
+// index, which is larger than the text itself.
+const documentSizeFactor = 4
+
+type PruneOptions struct {
+	VisitsBefore    *time.Time // Nullable. Delete visits older than this
+	DocumentsBefore *time.Time // Nullable. Delete full-text bodies scraped before this
+	MaxDBSize       int64      // In bytes. Zero means no limit
+	DryRun          bool       // Only count what would be deleted
+}
+
+type PruneReport struct {
+	Visits    int
+	Documents int
+	Fragments int
+	// Urls whose term vectors were made from a pruned body. They are made
+	// again from what is left the next time the url is indexed.
+	TermVectors int
+	// Words of the vocabulary that were only in pruned bodies, which are no
+	// longer suggested
+	Words        int
+	DBSizeBefore int64
+	DBSizeAfter  int64 // Estimated during a dry run
+}
+
+// What pruneDocuments pruned, or would have
+type prunedDocuments struct {
+	docs, fragments, vectors int
+	// The size of the bodies
+	size int64
+	// The urls whose bodies they were
+	urls []string
+}
+
+func (r *PruneReport) add(p prunedDocuments) {
+	r.Documents += p.docs
+	r.Fragments += p.fragments
+	r.TermVectors += p.vectors
+}
+
+// The number of words of the vocabulary that are only in the full-text of the
+// given urls, i.e. that pruning their bodies would remove
+func prunedWords(ctx context.Context, store Store, urls []string) (int, error) {
+	pruned := lo.SliceToMap(urls, func(id string) (string, bool) { return id, true })
+	kept := map[string]bool{}
+	dropped := map[string]bool{}
+	err := store.Fragments(ctx, nil, func(f types.Fragment) error {
+		counts := map[string]map[string]int{}
+		countWords(counts, f)
+		for w := range counts[f.E] {
+			if f.T == "documents" && pruned[f.E] {
+				dropped[w] = true
+			} else {
+				kept[w] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for w := range dropped {
+		if !kept[w] {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Remove the words of pruned bodies from the vocabulary, see prunedWords for a
+// dry run. words is the size of the vocabulary before they were pruned.
+// Returns the number of words removed.
+func pruneVocabulary(ctx context.Context, store Store, words int) (int, error) {
+	n, err := RebuildVocabulary(ctx, store)
+	if err != nil {
+		return 0, err
+	}
+	return words - n, nil
+}
+
+func (s *SqliteStore) Size(ctx context.Context) (int64, error) {
+	var pageCount, pageSize int64
+	err := s.db.QueryRowContext(ctx, "PRAGMA page_count;").Scan(&pageCount)
+	if err != nil {
+		return 0, err
+	}
+	err = s.db.QueryRowContext(ctx, "PRAGMA page_size;").Scan(&pageSize)
+	if err != nil {
+		return 0, err
+	}
+	return pageCount * pageSize, nil
+}
+
+// Prune deletes visits and full-text bodies according to the passed options.
+// Urls are never deleted. Document rows are kept with an empty body so that the
+// url is not scraped again.
+func (s *SqliteStore) Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error) {
+	db := s.db
+	var err error
+	report := &PruneReport{}
+
+	report.DBSizeBefore, err = s.Size(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get db size")
+	}
+
+	words, err := countVocabulary(ctx, db)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not count vocabulary")
+	}
+
+	var freed int64
+	var urls []string
+
+	if opts.VisitsBefore != nil {
+		report.Visits, err = pruneVisits(ctx, db, *opts.VisitsBefore, opts.DryRun)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not prune visits")
+		}
+	}
+
+	if opts.DocumentsBefore != nil {
+		pruned, err := pruneDocuments(ctx, db, dialectSqlite, `d.accessed_at < ?1`, []any{opts.DocumentsBefore.Unix()}, opts.DryRun)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not prune documents")
+		}
+		report.add(pruned)
+		urls = append(urls, pruned.urls...)
+		freed += pruned.size * documentSizeFactor
+	}
+
+	if opts.MaxDBSize > 0 && report.DBSizeBefore-freed > opts.MaxDBSize {
+		var since int64
+		if opts.DocumentsBefore != nil {
+			since = opts.DocumentsBefore.Unix()
+		}
+
+		excess := (report.DBSizeBefore - freed - opts.MaxDBSize) / documentSizeFactor
+		cutoff, err := documentCutoffForSize(ctx, db, excess, since)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not find documents to prune")
+		}
+
+		if cutoff != nil {
+			pruned, err := pruneDocuments(ctx, db, dialectSqlite, `d.accessed_at >= ?1 AND d.accessed_at <= ?2`, []any{since, *cutoff}, opts.DryRun)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not prune documents")
+			}
+			report.add(pruned)
+			urls = append(urls, pruned.urls...)
+			freed += pruned.size * documentSizeFactor
+		}
+	}
+
+	if opts.DryRun {
+		report.Words, err = prunedWords(ctx, s, urls)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not count pruned words")
+		}
+		report.DBSizeAfter = report.DBSizeBefore - freed
+		if report.DBSizeAfter < 0 {
+			report.DBSizeAfter = 0
+		}
+		return report, nil
+	}
+
+	if report.Documents > 0 {
+		report.Words, err = pruneVocabulary(ctx, s, words)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not prune vocabulary")
+		}
+	}
+
+	// Deleted rows only free pages within the file. Vacuum to give the space back.
+	if report.Visits > 0 || report.Documents > 0 {
+		_, err = db.ExecContext(ctx, "VACUUM;")
+		if err != nil {
+			return nil, errors.Wrap(err, "could not vacuum")
+		}
+	}
+
+	report.DBSizeAfter, err = s.Size(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get db size")
+	}
+
+	return report, nil
+}
+
+// @note what is reported is what was deleted, counted in the same statement
+// or transaction rather than beforehand, when other writes may still come in
+func pruneVisits(ctx context.Context, db *sql.DB, before time.Time, dryRun bool) (int, error) {
+	if dryRun {
+		var n int
+		err := db.QueryRowContext(ctx, `SELECT count(*) FROM visits WHERE visit_time < ?;`, before.Unix()).Scan(&n)
+		return n, err
+	}
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	res, err := db.ExecContext(ctx, `DELETE FROM visits WHERE visit_time < ?;`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Delete the body, index fragments and term vectors of documents matching
+// where, which refers to the documents as d.
+//
+// @note what is reported is what was deleted, see pruneVisits. In postgres the
+// bodies are locked until they are deleted so that the size is that of what is
+// deleted, sqlite only has one writer anyway.
+func pruneDocuments(ctx context.Context, db *sql.DB, dialect sqlDialect, where string, args []any, dryRun bool) (prunedDocuments, error) {
+	var p prunedDocuments
+	if !dryRun && dialect == dialectSqlite {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return p, err
+	}
+	defer tx.Rollback()
+
+	lock := ""
+	if !dryRun && dialect == dialectPostgres {
+		lock = " FOR UPDATE"
+	}
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			count(*),
+			coalesce(sum(n), 0)
+		FROM (
+			SELECT
+				length(d.body) AS n
+			FROM
+				documents d
+			WHERE
+				d.body IS NOT NULL
+				AND `+where+lock+`
+		) bodies;
+	`, args...).Scan(&p.docs, &p.size)
+	if err != nil {
+		return p, err
+	}
+
+	urls := `
+		SELECT
+			edge.url_md5
+		FROM
+			url_document_edges edge
+			JOIN documents d ON d.document_md5 = edge.document_md5
+		WHERE
+			d.body IS NOT NULL
+			AND ` + where
+
+	rows, err := tx.QueryContext(ctx, urls+`;`, args...)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return p, err
+		}
+		p.urls = append(p.urls, id)
+	}
+	if err := rows.Err(); err != nil {
+		return p, err
+	}
+	rows.Close()
+
+	fragmentsWhere := `t = 'documents' AND e IN (` + urls + `)`
+	vectorsWhere := `url_md5 IN (` + urls + `)`
+
+	if dryRun || p.docs == 0 {
+		err = tx.QueryRowContext(ctx, `SELECT count(*) FROM fragment WHERE `+fragmentsWhere+`;`, args...).Scan(&p.fragments)
+		if err != nil {
+			return p, err
+		}
+		err = tx.QueryRowContext(ctx, `SELECT count(DISTINCT url_md5) FROM term_vectors WHERE `+vectorsWhere+`;`, args...).Scan(&p.vectors)
+		return p, err
+	}
+
+	// @note the index first, it is found through the bodies we're about to delete
+	p.fragments, err = execCount(ctx, tx, `DELETE FROM fragment WHERE `+fragmentsWhere+`;`, args)
+	if err != nil {
+		return p, err
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT count(DISTINCT url_md5) FROM term_vectors WHERE `+vectorsWhere+`;`, args...).Scan(&p.vectors)
+	if err != nil {
+		return p, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM term_vectors WHERE `+vectorsWhere+`;`, args...)
+	if err != nil {
+		return p, err
+	}
+
+	// @note so that they get term vectors of what is left of them
+	_, err = tx.ExecContext(ctx, `UPDATE urls_meta SET indexed_at = NULL WHERE `+vectorsWhere+`;`, args...)
+	if err != nil {
+		return p, err
+	}
+
+	p.docs, err = execCount(ctx, tx, `UPDATE documents AS d SET body = NULL WHERE d.body IS NOT NULL AND `+where+`;`, args)
+	if err != nil {
+		return p, err
+	}
+
+	return p, tx.Commit()
+}
+
+// Exec qry and return the number of rows it affected
+func execCount(ctx context.Context, tx *sql.Tx, qry string, args []any) (int, error) {
+	res, err := tx.ExecContext(ctx, qry, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func countVocabulary(ctx context.Context, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT count(*) FROM vocabulary;`).Scan(&n)
+	return n, err
+}
+
+// Find the accessed_at time such that removing every body accessed at or before
+// it frees at least size bytes. Bodies accessed before since are skipped since
+// they are removed by the age limit anyway.
+func documentCutoffForSize(ctx context.Context, db *sql.DB, size int64, since int64) (*int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT
+			accessed_at,
+			length(body)
+		FROM
+			documents
+		WHERE
+			body NOT NULL
+			AND accessed_at >= ?
+		ORDER BY
+			accessed_at ASC;
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var total int64
+	for rows.Next() {
+		var accessedAt, n int64
+		err := rows.Scan(&accessedAt, &n)
+		if err != nil {
+			return nil, err
+		}
+
+		total += n
+		if total >= size {
+			return &accessedAt, nil
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Not enough to get under the limit, so remove everything
+	if total > 0 {
+		var max int64 = 1<<63 - 1
+		return &max, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,431 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"modernc.org/sqlite"
+)
+
+func init() {
+	// url_host(url) is the lowercased host name of a url, see query.Host
+	sqlite.MustRegisterDeterministicScalarFunction("url_host", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, nil
+		}
+		return query.Host(s), nil
+	})
+}
+
+// The sqlite search has two indexes over the same fragments. fragment_fts is
+// made of trigrams, so it matches any substring of three or more characters.
+// fragment_words is made of whole words, which is the only way to find shorter
+// terms, and matches other forms of a word through stemming.
+const (
+	trigramIndex = "fragment_fts"
+	wordIndex    = "fragment_words"
+)
+
+// The indexes a term is looked up in. Terms too short for trigrams only use the
+// word index. Words use both, so that "running" finds both "frontrunning" and
+// "runs", while anything else, e.g. "go.dev", is left to substring matching.
+func termIndexes(t query.Term) []string {
+	if utf8.RuneCountInString(t.Value) < 3 {
+		return []string{wordIndex}
+	}
+	if isWords(t.Value) {
+		return []string{trigramIndex, wordIndex}
+	}
+	return []string{trigramIndex}
+}
+
+func isWords(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Quote a term for an fts5 query of the index, so that nothing the user typed
+// is read as query syntax. Only the fragment text is searched, not the
+// attribute name. Short words are prefixes in the word index, so that e.g. k8
+// finds k8s like a substring would.
+func ftsTerm(index string, t query.Term) string {
+	term := `v : "` + strings.ReplaceAll(t.Value, `"`, `""`) + `"`
+	if index == wordIndex && !t.Phrase && utf8.RuneCountInString(t.Value) < 3 {
+		term += "*"
+	}
+	return term
+}
+
+// An fts5 query of the index for those of the terms that it is used for,
+// matching every term, or any of them with op " OR ". Empty if the index isn't
+// used for any of them.
+func ftsQuery(index string, terms []query.Term, op string) string {
+	xs := []string{}
+	for _, t := range terms {
+		if lo.Contains(termIndexes(t), index) {
+			xs = append(xs, ftsTerm(index, t))
+		}
+	}
+	return strings.Join(xs, op)
+}
+
+// The distinct trigrams of a word, the way the trigram tokenizer splits it
+func trigrams(word string) []string {
+	rs := []rune(strings.ToLower(word))
+	xs := []string{}
+	for i := 0; i+3 <= len(rs); i++ {
+		xs = append(xs, string(rs[i:i+3]))
+	}
+	return lo.Uniq(xs)
+}
+
+// Quote a word for a tsquery, so that operators typed by the user can't cause
+// a syntax error
+func tsWord(word string) string {
+	word = strings.ReplaceAll(word, `\`, `\\`)
+	word = strings.ReplaceAll(word, `'`, `''`)
+	return "'" + word + "'"
+}
+
+// A tsquery for one term. Words may be the prefix of a longer word, like short
+// words in the sqlite word index. The words of a phrase must be adjacent
+// instead.
+func tsTerm(t query.Term) string {
+	words := strings.Fields(t.Value)
+	if !t.Phrase {
+		xs := make([]string, len(words))
+		for i, w := range words {
+			xs[i] = tsWord(w) + ":*"
+		}
+		return strings.Join(xs, " & ")
+	}
+
+	xs := make([]string, len(words))
+	for i, w := range words {
+		xs[i] = tsWord(w)
+	}
+	return "(" + strings.Join(xs, " <-> ") + ")"
+}
+
+// A tsquery matching every term, or any of them with op " | "
+func tsQuery(terms []query.Term, op string) string {
+	xs := []string{}
+	for _, t := range terms {
+		if s := tsTerm(t); s != "" {
+			xs = append(xs, s)
+		}
+	}
+	return strings.Join(xs, op)
+}
+
+// SQL for the postgres fragment aliased as fr containing the term. As with the
+// sqlite trigram index, terms of three or more characters match anywhere,
+// which the pg_trgm index on v speeds up. Shorter ones are too short for
+// trigrams and match the start of a word instead, as in the sqlite word index.
+func (f *queryFilter) postgresTerm(fr string, t query.Term) string {
+	if utf8.RuneCountInString(t.Value) < 3 {
+		return fr + ".tsv @@ to_tsquery('simple', " + f.arg(tsTerm(t)) + ")"
+	}
+	return fr + ".v ILIKE " + f.arg("%"+escapeLike(t.Value)+"%") + ` ESCAPE '\'`
+}
+
+// SQL for the postgres fragment aliased as fr matching every term, or any of
+// them with op " OR "
+func (f *queryFilter) postgresMatches(fr string, terms []query.Term, op string) string {
+	xs := make([]string, len(terms))
+	for i, t := range terms {
+		xs[i] = f.postgresTerm(fr, t)
+	}
+	return "(" + strings.Join(xs, op) + ")"
+}
+
+type sqlDialect int
+
+const (
+	dialectSqlite sqlDialect = iota
+	dialectPostgres
+)
+
+// Matches the host name of u.url, like url_host does in sqlite
+const postgresUrlHost = `lower(substring(u.url from '^[A-Za-z][A-Za-z0-9+.-]*://(?:[^@/?#]*@)?([^:/?#]*)'))`
+
+// queryFilter is everything in a query but its positive full-text terms,
+// compiled to a condition on the urls table aliased as u. Positive full-text
+// terms are left to the search index.
+//
+// Placeholders are numbered, so the rest of a statement can add its own
+// arguments with arg in any order.
+type queryFilter struct {
+	dialect sqlDialect
+	conds   []string
+	args    []any
+}
+
+func newQueryFilter(q *query.Query, dialect sqlDialect) *queryFilter {
+	f := &queryFilter{dialect: dialect}
+
+	if negated := query.Negated(q.Text); len(negated) > 0 {
+		if dialect == dialectPostgres {
+			f.add("NOT EXISTS (SELECT 1 FROM fragment nf WHERE nf.e = u.url_md5 AND " + f.postgresMatches("nf", negated, " OR ") + ")")
+		} else {
+			xs := []string{}
+			for _, index := range []string{trigramIndex, wordIndex} {
+				if match := ftsQuery(index, negated, " OR "); match != "" {
+					xs = append(xs, "SELECT e FROM "+index+" WHERE "+index+" MATCH "+f.arg(match))
+				}
+			}
+			f.add("u.url_md5 NOT IN (" + strings.Join(xs, " UNION ") + ")")
+		}
+	}
+
+	f.addLike("coalesce(u.title, '')", q.Title)
+	f.addLike("u.url", q.Url)
+
+	host := "url_host(u.url)"
+	if dialect == dialectPostgres {
+		host = postgresUrlHost
+	}
+	if positive := query.Positive(q.Sites); len(positive) > 0 {
+		f.add(f.sites(host, positive))
+	}
+	for _, t := range query.Negated(q.Sites) {
+		f.add("NOT " + f.sites(host, []query.Term{t}))
+	}
+
+	// @note browser and dates have to match the same visit
+	if visit := f.visitConds(q); len(visit) > 0 {
+		f.add("EXISTS (SELECT 1 FROM visits v WHERE v.url_md5 = u.url_md5 AND " + strings.Join(visit, " AND ") + ")")
+	}
+	if negated := query.Negated(q.Browsers); len(negated) > 0 {
+		f.add("NOT EXISTS (SELECT 1 FROM visits v WHERE v.url_md5 = u.url_md5 AND lower(v.extractor_name) IN (" + f.values(termValues(negated)) + "))")
+	}
+
+	if q.HasFulltext != nil {
+		exists := `EXISTS (
+  SELECT 1 FROM url_document_edges ed INNER JOIN documents d ON d.document_md5 = ed.document_md5
+  WHERE ed.url_md5 = u.url_md5 AND d.body IS NOT NULL
+)`
+		if !*q.HasFulltext {
+			exists = "NOT " + exists
+		}
+		f.add(exists)
+	}
+
+	if q.Bookmarked != nil {
+		exists := "EXISTS (SELECT 1 FROM bookmarks b WHERE b.url_md5 = u.url_md5)"
+		if !*q.Bookmarked {
+			exists = "NOT " + exists
+		}
+		f.add(exists)
+	}
+
+	return f
+}
+
+// Conditions on a visit aliased as v for the positive browser: filters and
+// the dates of q, see query.Query.MatchesVisit
+func (f *queryFilter) visitConds(q *query.Query) []string {
+	conds := []string{}
+	if positive := query.Positive(q.Browsers); len(positive) > 0 {
+		conds = append(conds, "lower(v.extractor_name) IN ("+f.values(termValues(positive))+")")
+	}
+	if q.After != nil {
+		conds = append(conds, "v.visit_time >= "+f.arg(q.After.Unix()))
+	}
+	if q.Before != nil {
+		conds = append(conds, "v.visit_time < "+f.arg(q.Before.Unix()))
+	}
+	return conds
+}
+
+func (f *queryFilter) add(cond string) {
+	f.conds = append(f.conds, cond)
+}
+
+// Add an argument and return its placeholder
+func (f *queryFilter) arg(v any) string {
+	f.args = append(f.args, v)
+	if f.dialect == dialectPostgres {
+		return fmt.Sprintf("$%d", len(f.args))
+	}
+	return fmt.Sprintf("?%d", len(f.args))
+}
+
+// Like arg, for arguments whose type postgres can't infer from where they are used
+func (f *queryFilter) typed(v any, postgresType string) string {
+	if f.dialect == dialectPostgres {
+		return f.arg(v) + "::" + postgresType
+	}
+	return f.arg(v)
+}
+
+// Comma separated placeholders for vs
+func (f *queryFilter) values(vs []string) string {
+	xs := make([]string, len(vs))
+	for i, v := range vs {
+		xs[i] = f.arg(v)
+	}
+	return strings.Join(xs, ", ")
+}
+
+// SQL for being in vs, with a single argument however many there are
+func (f *queryFilter) in(vs []string) string {
+	if f.dialect == dialectPostgres {
+		return "= ANY(" + f.arg(pq.Array(vs)) + ")"
+	}
+	bs, _ := json.Marshal(vs)
+	return "IN (SELECT value FROM json_each(" + f.arg(string(bs)) + "))"
+}
+
+func termValues(ts []query.Term) []string {
+	vs := make([]string, len(ts))
+	for i, t := range ts {
+		vs[i] = t.Value
+	}
+	return vs
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Case-insensitive substring matches of col against every term
+func (f *queryFilter) addLike(col string, ts []query.Term) {
+	like := "LIKE"
+	if f.dialect == dialectPostgres {
+		like = "ILIKE"
+	}
+
+	for _, t := range ts {
+		cond := col + " " + like + " " + f.arg("%"+escapeLike(t.Value)+"%") + ` ESCAPE '\'`
+		if t.Negated {
+			cond = "NOT " + cond
+		}
+		f.add(cond)
+	}
+}
+
+// The host is any of the sites, or one of their subdomains
+func (f *queryFilter) sites(host string, ts []query.Term) string {
+	xs := []string{}
+	for _, t := range ts {
+		xs = append(xs, host+" = "+f.arg(t.Value))
+		xs = append(xs, host+" LIKE "+f.arg("%."+escapeLike(t.Value))+` ESCAPE '\'`)
+	}
+	return "(" + strings.Join(xs, " OR ") + ")"
+}
+
+// SQL for the fragment whose id is col matching every term, each in any of the
+// indexes it is used for
+func (f *queryFilter) fragmentMatches(col string, terms []query.Term) string {
+	conds := []string{}
+	for _, t := range terms {
+		xs := []string{}
+		for _, index := range termIndexes(t) {
+			xs = append(xs, col+" IN (SELECT rowid FROM "+index+" WHERE "+index+" MATCH "+f.arg(ftsTerm(index, t))+")")
+		}
+		conds = append(conds, "("+strings.Join(xs, " OR ")+")")
+	}
+	return strings.Join(conds, " AND ")
+}
+
+func (f *queryFilter) where() string {
+	if len(f.conds) == 0 {
+		return "1 = 1"
+	}
+	return strings.Join(f.conds, "\n  AND ")
+}
+
+// SQL selecting the url_md5 of every url SearchUrls would find for q, and the
+// filter that holds its arguments
+func matchedUrls(q *query.Query, dialect sqlDialect, opts SearchOptions) (*queryFilter, string) {
+	f := newQueryFilter(q, dialect)
+	f.restrict(opts)
+
+	positive := query.Positive(q.Text)
+	if len(positive) > 0 {
+		var matches string
+		if dialect == dialectPostgres {
+			matches = f.postgresMatches("fr", positive, " AND ")
+		} else {
+			matches = f.fragmentMatches("fr.id", positive)
+		}
+		return f, `SELECT DISTINCT fr.e AS url_md5
+    FROM fragment fr INNER JOIN urls u ON u.url_md5 = fr.e
+    WHERE ` + matches + ` AND ` + f.where()
+	}
+
+	return f, "SELECT u.url_md5 FROM urls u WHERE " + f.where()
+}
+
+// Search for urls when there are no full-text terms, only filters. Since
+// nothing was matched there are no snippets, and only visits count towards
+// relevance.
+func searchFiltered(ctx context.Context, db *sql.DB, q *query.Query, dialect sqlDialect, opts SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+	f := newQueryFilter(q, dialect)
+	f.restrict(opts)
+
+	var count uint
+	err := db.QueryRowContext(ctx, `SELECT count(*) FROM urls u WHERE `+f.where(), f.args...).Scan(&count)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "row count error")
+	}
+
+	xs, err := scoredUrls(ctx, db, f, opts, f.limit(opts))
+	return xs, count, err
+}
+
+// Urls matching f, in the order of opts, scored as if nothing matched their text
+func scoredUrls(ctx context.Context, db *sql.DB, f *queryFilter, opts SearchOptions, limit string) ([]types.UrlDbSearchEntity, error) {
+	rows, err := db.QueryContext(ctx, `
+SELECT
+  u.url_md5,
+  u.url,
+  u.title,
+  u.description,
+  coalesce(u.last_visit, 0),
+  u.visit_count,
+  `+f.visitScore("u.url_md5", time.Now(), opts.ranking())+` + `+f.bookmarkScore("u.url_md5", opts.ranking())+` AS score
+FROM
+  urls u
+WHERE
+  `+f.where()+`
+ORDER BY
+  `+opts.orderBy("u")+`
+`+limit, f.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.UrlDbSearchEntity{}
+	for rows.Next() {
+		var x types.UrlDbSearchEntity
+		var ts int64
+		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts, &x.VisitCount, &x.Score)
+		if err != nil {
+			return nil, errors.Wrap(err, "row error")
+		}
+		x.LastVisit = unixOrNil(ts)
+		xs = append(xs, x)
+	}
+
+	return xs, errors.Wrap(rows.Err(), "query error")
+}
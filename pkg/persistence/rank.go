@@ -0,0 +1,222 @@
+package persistence
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/samber/lo"
+)
+
+type SortOrder string
+
+const (
+	// Best match first, see config.RankingConfig
+	SortRelevance SortOrder = "relevance"
+	// Most recently visited first
+	SortRecent SortOrder = "recent"
+	// Most visited first
+	SortFrequent SortOrder = "frequent"
+)
+
+var SortOrders = []SortOrder{SortRelevance, SortRecent, SortFrequent}
+
+func ParseSortOrder(s string) (SortOrder, error) {
+	for _, o := range SortOrders {
+		if string(o) == s {
+			return o, nil
+		}
+	}
+
+	names := make([]string, len(SortOrders))
+	for i, o := range SortOrders {
+		names[i] = string(o)
+	}
+	return "", fmt.Errorf("unknown sort order %q, expected one of %s", s, strings.Join(names, ", "))
+}
+
+// The number of results returned when SearchOptions.Limit is 0
+const DefaultSearchLimit = 100
+
+// SearchOptions controls the order of search results and which page of them is
+// returned. The zero value returns the first DefaultSearchLimit results by
+// relevance with the default ranking.
+type SearchOptions struct {
+	Sort    SortOrder
+	Ranking config.RankingConfig
+	Limit   uint
+	Offset  uint
+
+	// Restrict the search to these url_md5s, if not nil, see EncryptedStore
+	only []string
+	// Leave out these url_md5s
+	exclude []string
+}
+
+func (o SearchOptions) limit() uint {
+	if o.Limit == 0 {
+		return DefaultSearchLimit
+	}
+	return o.Limit
+}
+
+// The page of xs selected by the options, for results sorted in Go
+func paginate[T any](xs []T, o SearchOptions) []T {
+	if o.Offset >= uint(len(xs)) {
+		return []T{}
+	}
+	xs = xs[o.Offset:]
+	if o.limit() < uint(len(xs)) {
+		xs = xs[:o.limit()]
+	}
+	return xs
+}
+
+// Whether the options restrict the search to include the url
+func (o SearchOptions) includes(urlMd5 string) bool {
+	if o.only != nil && !lo.Contains(o.only, urlMd5) {
+		return false
+	}
+	return !lo.Contains(o.exclude, urlMd5)
+}
+
+func (o SearchOptions) sort() SortOrder {
+	if o.Sort == "" {
+		return SortRelevance
+	}
+	return o.Sort
+}
+
+func (o SearchOptions) ranking() config.RankingConfig {
+	r := o.Ranking
+	if r == (config.RankingConfig{}) {
+		return config.DefaultRanking
+	}
+	if r.VisitHalfLifeDays <= 0 {
+		r.VisitHalfLifeDays = config.DefaultRanking.VisitHalfLifeDays
+	}
+	return r
+}
+
+// SQL to order urls aliased as t, with their relevance selected as score.
+// Ties are broken by url_md5, so that pages don't overlap.
+func (o SearchOptions) orderBy(t string) string {
+	switch o.sort() {
+	case SortRecent:
+		return fmt.Sprintf("coalesce(%s.last_visit, 0) DESC, %s.url_md5", t, t)
+	case SortFrequent:
+		return fmt.Sprintf("%s.visit_count DESC, coalesce(%s.last_visit, 0) DESC, %s.url_md5", t, t, t)
+	default:
+		return fmt.Sprintf("score DESC, coalesce(%s.last_visit, 0) DESC, %s.url_md5", t, t)
+	}
+}
+
+// SQL for the page selected by the options
+func (f *queryFilter) limit(o SearchOptions) string {
+	return "LIMIT " + f.typed(o.limit(), "bigint") + " OFFSET " + f.typed(o.Offset, "bigint")
+}
+
+// Add the restrictions of only and exclude to the filter
+func (f *queryFilter) restrict(o SearchOptions) {
+	if o.only != nil {
+		f.add("u.url_md5 " + f.in(o.only))
+	}
+	if len(o.exclude) > 0 {
+		f.add("NOT (u.url_md5 " + f.in(o.exclude) + ")")
+	}
+}
+
+// Visits decay exponentially with age, so that tau is the time in seconds
+// after which a visit is worth 1/e of a visit now
+func visitTau(r config.RankingConfig) float64 {
+	return r.VisitHalfLifeDays * 24 * 60 * 60 / math.Ln2
+}
+
+// How much the visits of a url add to its relevance. The sum of the decayed
+// visits is dampened so that a page visited a thousand times doesn't drown out
+// the text match.
+func visitScore(visits []time.Time, now time.Time, r config.RankingConfig) float64 {
+	tau := visitTau(r)
+	sum := 0.0
+	for _, t := range visits {
+		sum += math.Exp(-float64(now.Unix()-t.Unix()) / tau)
+	}
+	return r.VisitWeight * math.Log1p(sum)
+}
+
+// SQL for visitScore of the url whose url_md5 is col
+func (f *queryFilter) visitScore(col string, now time.Time, r config.RankingConfig) string {
+	return fmt.Sprintf(
+		"%s * ln(1 + coalesce((SELECT sum(exp((v.visit_time - %s) / %s)) FROM visits v WHERE v.url_md5 = %s), 0))",
+		f.typed(r.VisitWeight, "float8"), f.typed(now.Unix(), "bigint"), f.typed(visitTau(r), "float8"), col,
+	)
+}
+
+// How much being bookmarked adds to the relevance of a url
+func bookmarkScore(bookmarked bool, r config.RankingConfig) float64 {
+	if !bookmarked {
+		return 0
+	}
+	return r.BookmarkWeight
+}
+
+// SQL for bookmarkScore of the url whose url_md5 is col
+func (f *queryFilter) bookmarkScore(col string, r config.RankingConfig) string {
+	return fmt.Sprintf(
+		"CASE WHEN EXISTS (SELECT 1 FROM bookmarks b WHERE b.url_md5 = %s) THEN %s ELSE 0 END",
+		col, f.typed(r.BookmarkWeight, "float8"),
+	)
+}
+
+// Weight for a fragment attribute, see config.RankingConfig
+func attributeWeight(a string, r config.RankingConfig) float64 {
+	switch a {
+	case "title":
+		return r.TitleWeight
+	case "url":
+		return r.UrlWeight
+	default:
+		return r.ContentWeight
+	}
+}
+
+// SQL for the weight of the fragment attribute in col
+func (f *queryFilter) attributeWeight(col string, r config.RankingConfig) string {
+	return fmt.Sprintf(
+		"CASE %s WHEN 'title' THEN %s WHEN 'url' THEN %s ELSE %s END",
+		col, f.typed(r.TitleWeight, "float8"), f.typed(r.UrlWeight, "float8"), f.typed(r.ContentWeight, "float8"),
+	)
+}
+
+// Sort search results in Go, the same way orderBy does in SQL
+func sortResults(xs []types.UrlDbSearchEntity, order SortOrder) {
+	score := func(x types.UrlDbSearchEntity) float64 {
+		if x.Score == nil {
+			return 0
+		}
+		return *x.Score
+	}
+
+	sort.SliceStable(xs, func(i, j int) bool {
+		a, b := xs[i], xs[j]
+		switch order {
+		case SortRecent:
+		case SortFrequent:
+			if a.VisitCount != b.VisitCount {
+				return a.VisitCount > b.VisitCount
+			}
+		default:
+			if score(a) != score(b) {
+				return score(a) > score(b)
+			}
+		}
+		if unixOrZero(a.LastVisit) != unixOrZero(b.LastVisit) {
+			return unixOrZero(a.LastVisit) > unixOrZero(b.LastVisit)
+		}
+		return a.UrlMd5 < b.UrlMd5
+	})
+}
@@ -0,0 +1,80 @@
+package persistence_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRanking(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			now := time.Now()
+			day := 24 * time.Hour
+			insert := func(url, title string, visits ...time.Time) {
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title, LastVisit: &visits[len(visits)-1]}))
+				for _, v := range visits {
+					require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: v, ExtractorName: "chrome"}))
+				}
+				require.NoError(t, store.InsertFragments(ctx, types.Fragment{E: util.HashMd5String(url), T: "urls", A: "title", V: title}))
+			}
+
+			// Visited often and recently
+			often := []time.Time{}
+			for i := 10; i > 0; i-- {
+				often = append(often, now.Add(-time.Duration(i)*day))
+			}
+			insert("https://often.example", "Gopher tips", often...)
+			// Visited once, a long time ago
+			insert("https://once.example", "Gopher tips", now.Add(-400*day))
+			// Only mentions gophers in its content, visited an hour ago
+			insert("https://content.example", "Unrelated", now.Add(-time.Hour))
+			require.NoError(t, store.InsertFragments(ctx, types.Fragment{E: util.HashMd5String("https://content.example"), T: "documents", A: "content", V: "Some gopher tips"}))
+
+			// @note without other pages every trigram is too common for bm25 to tell matches apart
+			for i := 0; i < 20; i++ {
+				insert(fmt.Sprintf("https://filler%d.example", i), fmt.Sprintf("Filler page %d", i), now.Add(-400*day))
+			}
+
+			search := func(opts persistence.SearchOptions) []string {
+				results, count, err := store.SearchUrls(ctx, query.MustParse("gopher tips"), opts)
+				require.NoError(t, err)
+				require.Equal(t, uint(3), count)
+				urls := []string{}
+				for _, r := range results {
+					require.NotNil(t, r.Score)
+					urls = append(urls, r.Url)
+				}
+				return urls
+			}
+
+			require.Equal(t, []string{"https://often.example", "https://once.example", "https://content.example"}, search(persistence.SearchOptions{}),
+				"visits break the tie between equal titles, and title matches beat content matches")
+			require.Equal(t, []string{"https://content.example", "https://often.example", "https://once.example"}, search(persistence.SearchOptions{Sort: persistence.SortRecent}))
+			require.Equal(t, []string{"https://often.example", "https://content.example", "https://once.example"}, search(persistence.SearchOptions{Sort: persistence.SortFrequent}))
+
+			paged := []string{}
+			for offset := uint(0); offset < 4; offset += 2 {
+				paged = append(paged, search(persistence.SearchOptions{Limit: 2, Offset: offset})...)
+			}
+			require.Equal(t, []string{"https://often.example", "https://once.example", "https://content.example"}, paged)
+
+			require.Equal(t, []string{"https://content.example", "https://often.example", "https://once.example"}, search(persistence.SearchOptions{
+				Ranking: config.RankingConfig{TitleWeight: 1, ContentWeight: 100, VisitWeight: 1},
+			}), "weights are configurable")
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Number of urls read at once by Records
+const recordBatchSize = 500
+
+// RecordOptions limits Records to urls visited in a time range. Only the
+// visits in the range are included. Urls without any visits are included if
+// their last_visit is in the range.
+type RecordOptions struct {
+	Since *time.Time // Nullable. Inclusive
+	Until *time.Time // Nullable. Exclusive
+}
+
+// The range as unix times, with open ends replaced by the smallest and largest possible time
+func (o RecordOptions) bounds() (int64, int64) {
+	var since int64 = math.MinInt64
+	var until int64 = math.MaxInt64
+	if o.Since != nil {
+		since = o.Since.Unix()
+	}
+	if o.Until != nil {
+		until = o.Until.Unix()
+	}
+	return since, until
+}
+
+// @note min and max with a single argument are aggregates in sqlite, hence the coalesce on both sides
+const sqliteUpsertTitle = `
+	INSERT INTO
+		url_titles(url_md5, title, first_seen, last_seen)
+			VALUES(?, ?, ?, ?)
+	ON CONFLICT(url_md5, title) DO UPDATE SET
+		first_seen = min(coalesce(url_titles.first_seen, excluded.first_seen), coalesce(excluded.first_seen, url_titles.first_seen)),
+		last_seen = max(coalesce(url_titles.last_seen, excluded.last_seen), coalesce(excluded.last_seen, url_titles.last_seen));
+`
+
+func unixOrNull(t *time.Time) sql.NullInt64 {
+	if t == nil || t.Unix() <= 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+func (s *SqliteStore) InsertTitles(ctx context.Context, url string, titles ...types.TitleRecord) error {
+	md5 := util.HashMd5String(url)
+
+	for _, t := range titles {
+		if t.Title == "" {
+			continue
+		}
+
+		_, err := s.db.ExecContext(ctx, sqliteUpsertTitle, md5, t.Title, unixOrNull(t.FirstSeen), unixOrNull(t.LastSeen))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SqliteStore) Records(ctx context.Context, opts RecordOptions, fn func(*types.UrlRecord) error) error {
+	since, until := opts.bounds()
+	var lastRowid int64
+
+	for {
+		records, ids, rowid, err := s.recordUrls(ctx, lastRowid, since, until)
+		if err != nil {
+			return errors.Wrap(err, "could not read urls")
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		lastRowid = rowid
+
+		in, args := placeholders(ids)
+
+		err = s.recordTitles(ctx, records, in, args)
+		if err != nil {
+			return errors.Wrap(err, "could not read titles")
+		}
+
+		err = s.recordVisits(ctx, records, in, append(args, since, until))
+		if err != nil {
+			return errors.Wrap(err, "could not read visits")
+		}
+
+		err = s.recordDocuments(ctx, records, in, args)
+		if err != nil {
+			return errors.Wrap(err, "could not read documents")
+		}
+
+		for _, id := range ids {
+			err := fn(records[id])
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Read a batch of urls visited in the given range, keyed by url_md5. The ids
+// are returned separately to keep the order stable.
+func (s *SqliteStore) recordUrls(ctx context.Context, after, since, until int64) (map[string]*types.UrlRecord, []string, int64, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			u.rowid,
+			u.url_md5,
+			u.url,
+			u.title,
+			u.description,
+			u.last_visit,
+			u.redacted
+		FROM
+			urls u
+		WHERE
+			u.rowid > ?
+			AND (
+				EXISTS (SELECT 1 FROM visits v WHERE v.url_md5 = u.url_md5 AND v.visit_time >= ? AND v.visit_time < ?)
+				OR (u.visit_count = 0 AND coalesce(u.last_visit, 0) >= ? AND coalesce(u.last_visit, 0) < ?)
+			)
+		ORDER BY
+			u.rowid ASC
+		LIMIT ?;
+	`, after, since, until, since, until, recordBatchSize)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer rows.Close()
+
+	records := map[string]*types.UrlRecord{}
+	var ids []string
+	last := after
+
+	for rows.Next() {
+		rec := &types.UrlRecord{Titles: []types.TitleRecord{}, Visits: []types.VisitRecord{}}
+		var id string
+		var ts sql.NullInt64
+
+		err := rows.Scan(&last, &id, &rec.Url, &rec.Title, &rec.Description, &ts, &rec.Redacted)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		rec.LastVisit = unixOrNil(ts.Int64)
+		records[id] = rec
+		ids = append(ids, id)
+	}
+
+	return records, ids, last, rows.Err()
+}
+
+func (s *SqliteStore) recordTitles(ctx context.Context, records map[string]*types.UrlRecord, in string, args []any) error {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT
+			url_md5,
+			title,
+			first_seen,
+			last_seen
+		FROM
+			url_titles
+		WHERE
+			url_md5 IN (%s)
+		ORDER BY
+			first_seen ASC;
+	`, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var t types.TitleRecord
+		var firstSeen, lastSeen sql.NullInt64
+
+		err := rows.Scan(&id, &t.Title, &firstSeen, &lastSeen)
+		if err != nil {
+			return err
+		}
+
+		t.FirstSeen = unixOrNil(firstSeen.Int64)
+		t.LastSeen = unixOrNil(lastSeen.Int64)
+		records[id].Titles = append(records[id].Titles, t)
+	}
+
+	return rows.Err()
+}
+
+// args are the ids followed by the start and end of the time range
+func (s *SqliteStore) recordVisits(ctx context.Context, records map[string]*types.UrlRecord, in string, args []any) error {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT
+			url_md5,
+			visit_time,
+			coalesce(extractor_name, '')
+		FROM
+			visits
+		WHERE
+			url_md5 IN (%s)
+			AND visit_time >= ?
+			AND visit_time < ?
+		ORDER BY
+			visit_time ASC;
+	`, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var ts int64
+		var v types.VisitRecord
+
+		err := rows.Scan(&id, &ts, &v.ExtractorName)
+		if err != nil {
+			return err
+		}
+
+		v.Time = time.Unix(ts, 0)
+		records[id].Visits = append(records[id].Visits, v)
+	}
+
+	return rows.Err()
+}
+
+func (s *SqliteStore) recordDocuments(ctx context.Context, records map[string]*types.UrlRecord, in string, args []any) error {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT
+			edge.url_md5,
+			d.document_md5,
+			coalesce(d.status_code, 0),
+			coalesce(d.accessed_at, 0),
+			d.body
+		FROM
+			url_document_edges edge
+			JOIN documents d ON d.document_md5 = edge.document_md5
+		WHERE
+			edge.url_md5 IN (%s);
+	`, in), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var ts int64
+		var d types.DocumentRecord
+
+		err := rows.Scan(&id, &d.DocumentMd5, &d.StatusCode, &ts, &d.Body)
+		if err != nil {
+			return err
+		}
+
+		d.AccessedAt = unixOrNil(ts)
+		records[id].Documents = append(records[id].Documents, d)
+	}
+
+	return rows.Err()
+}
+
+// InsertRecord writes everything in rec to store, merging it with whatever is
+// already stored for the url the same way populate would. The url is redacted
+// the way store redacts urls, see RedactUrl.
+func InsertRecord(ctx context.Context, store Store, rec *types.UrlRecord) error {
+	url, redacted := RedactUrl(store, rec.Url)
+	err := store.InsertUrl(ctx, &types.UrlRow{
+		Url:         url,
+		Title:       rec.Title,
+		Description: rec.Description,
+		LastVisit:   rec.LastVisit,
+		Redacted:    rec.Redacted || redacted,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not insert url")
+	}
+
+	err = store.InsertTitles(ctx, url, rec.Titles...)
+	if err != nil {
+		return errors.Wrap(err, "could not insert titles")
+	}
+
+	for _, v := range rec.Visits {
+		err := store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: v.Time, ExtractorName: v.ExtractorName})
+		if err != nil {
+			return errors.Wrap(err, "could not insert visit")
+		}
+	}
+
+	urlMd5 := util.HashMd5String(url)
+
+	for _, d := range rec.Documents {
+		docMd5 := d.DocumentMd5
+		if docMd5 == "" && d.Body != nil {
+			docMd5 = util.HashMd5String(*d.Body)
+		}
+		if docMd5 == "" {
+			continue
+		}
+
+		err := store.InsertDocument(ctx, &types.DocumentRow{
+			DocumentMd5: docMd5,
+			UrlMd5:      urlMd5,
+			StatusCode:  d.StatusCode,
+			AccessedAt:  d.AccessedAt,
+			Body:        d.Body,
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not insert document")
+		}
+	}
+
+	return nil
+}
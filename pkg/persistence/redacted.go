@@ -0,0 +1,63 @@
+package persistence
+
+import (
+	"context"
+
+	"github.com/iansinnott/browser-gopher/pkg/redact"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+)
+
+// RedactedStore wraps a Store so that every url written to it is redacted
+// first, see redact.Redactor, whether it comes from populate, merge, sync or
+// an import. Urls that are keyed by their md5 elsewhere, e.g. documents, have
+// to be redacted with RedactUrl before hashing them.
+type RedactedStore struct {
+	Store
+	redactor *redact.Redactor
+}
+
+// Compile time check that RedactedStore satisfies the Store interface
+var _ Store = (*RedactedStore)(nil)
+
+func NewRedactedStore(store Store, redactor *redact.Redactor) *RedactedStore {
+	return &RedactedStore{Store: store, redactor: redactor}
+}
+
+// RedactUrl returns url as store would write it, and whether that is redacted
+func RedactUrl(store Store, url string) (string, bool) {
+	switch s := store.(type) {
+	case *RedactedStore:
+		return s.redactor.RedactUrl(url)
+	case *EncryptedStore:
+		return RedactUrl(s.Store, url)
+	}
+	return url, false
+}
+
+// @note the url of row is redacted in place, so that callers can tell which
+// url was written
+func (s *RedactedStore) InsertUrl(ctx context.Context, row *types.UrlRow) error {
+	var redacted bool
+	row.Url, redacted = s.redactor.RedactUrl(row.Url)
+	row.Redacted = row.Redacted || redacted
+	return s.Store.InsertUrl(ctx, row)
+}
+
+func (s *RedactedStore) InsertVisit(ctx context.Context, row *types.VisitRow) error {
+	row.Url, _ = s.redactor.RedactUrl(row.Url)
+	return s.Store.InsertVisit(ctx, row)
+}
+
+func (s *RedactedStore) InsertTitles(ctx context.Context, url string, titles ...types.TitleRecord) error {
+	url, _ = s.redactor.RedactUrl(url)
+	return s.Store.InsertTitles(ctx, url, titles...)
+}
+
+func (s *RedactedStore) ReplaceBookmarks(ctx context.Context, extractorName string, rows ...types.BookmarkRow) error {
+	redacted := make([]types.BookmarkRow, len(rows))
+	for i, row := range rows {
+		row.Url, _ = s.redactor.RedactUrl(row.Url)
+		redacted[i] = row
+	}
+	return s.Store.ReplaceBookmarks(ctx, extractorName, redacted...)
+}
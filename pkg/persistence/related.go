@@ -0,0 +1,145 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sort"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// The urls most related to the url with the given url_md5, see
+// Store.RelatedUrls.
+//
+// @note a term's weights are multiplied by its idf, ln(urls / urls with the
+// term), in both vectors. A term every url has counts for nothing.
+func relatedUrls(ctx context.Context, db *sql.DB, dialect sqlDialect, urlMd5 string, limit int) ([]types.UrlDbSearchEntity, error) {
+	f := &queryFilter{dialect: dialect}
+	id := f.arg(urlMd5)
+	rows, err := db.QueryContext(ctx, `
+WITH
+  source AS (
+    SELECT term, weight FROM term_vectors WHERE url_md5 = `+id+`
+  ),
+  total AS (
+    SELECT count(DISTINCT url_md5) AS n FROM term_vectors
+  ),
+  idf AS (
+    SELECT
+      tv.term,
+      ln(CAST(total.n AS DOUBLE PRECISION) / count(*)) AS idf
+    FROM
+      term_vectors tv,
+      total
+    WHERE
+      tv.term IN (SELECT term FROM source)
+    GROUP BY
+      tv.term, total.n
+  ),
+  scored AS (
+    SELECT
+      tv.url_md5,
+      sum(s.weight * tv.weight * i.idf * i.idf) AS score
+    FROM
+      source s
+      INNER JOIN term_vectors tv ON tv.term = s.term
+      INNER JOIN idf i ON i.term = s.term
+    WHERE
+      tv.url_md5 <> `+id+`
+    GROUP BY
+      tv.url_md5
+  )
+SELECT
+  t.url_md5,
+  t.url,
+  t.title,
+  t.description,
+  coalesce(t.last_visit, 0),
+  t.visit_count,
+  m.score
+FROM
+  scored m
+  INNER JOIN urls t ON t.url_md5 = m.url_md5
+WHERE
+  m.score > 0
+ORDER BY
+  m.score DESC, t.url_md5
+LIMIT `+f.arg(limit)+`;
+	`, f.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.UrlDbSearchEntity{}
+	for rows.Next() {
+		var x types.UrlDbSearchEntity
+		var ts int64
+		var score float64
+		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts, &x.VisitCount, &score)
+		if err != nil {
+			return nil, errors.Wrap(err, "row error")
+		}
+		x.LastVisit = unixOrNil(ts)
+		x.Score = &score
+		xs = append(xs, x)
+	}
+
+	return xs, errors.Wrap(rows.Err(), "query error")
+}
+
+// The similarity of every other url to the url with the given url_md5, as
+// scored by relatedUrls, for stores that keep term vectors in memory
+func relatedScores(vectors map[string]map[string]float64, urlMd5 string) map[string]float64 {
+	source := vectors[urlMd5]
+	scores := map[string]float64{}
+	if len(source) == 0 {
+		return scores
+	}
+
+	df := map[string]int{}
+	for _, terms := range vectors {
+		for term := range terms {
+			if _, ok := source[term]; ok {
+				df[term]++
+			}
+		}
+	}
+
+	for md5, terms := range vectors {
+		if md5 == urlMd5 {
+			continue
+		}
+		var score float64
+		for term, weight := range terms {
+			if w, ok := source[term]; ok {
+				idf := math.Log(float64(len(vectors)) / float64(df[term]))
+				score += w * weight * idf * idf
+			}
+		}
+		if score > 0 {
+			scores[md5] = score
+		}
+	}
+	return scores
+}
+
+// The ids of scores, highest first, at most limit of them
+func topScores(scores map[string]float64, limit int) []string {
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids
+}
@@ -0,0 +1,64 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelatedUrls(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			vectors := map[string]map[string]float64{
+				"https://go.dev":              {"gopher": 0.8, "language": 0.6},
+				"https://go.dev/blog":         {"gopher": 0.6, "blog": 0.8},
+				"https://go.dev/doc":          {"language": 0.6, "doc": 0.8},
+				"https://rust-lang.org":       {"language": 0.6, "crab": 0.8},
+				"https://example.com/recipes": {"bread": 1},
+			}
+			for url, terms := range vectors {
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url}))
+				require.NoError(t, store.InsertTermVectors(ctx, types.TermVector{UrlMd5: util.HashMd5String(url), Terms: terms}))
+			}
+
+			related, err := store.RelatedUrls(ctx, util.HashMd5String("https://go.dev"), 10)
+			require.NoError(t, err)
+			urls := []string{}
+			for _, x := range related {
+				urls = append(urls, x.Url)
+				require.NotNil(t, x.Score)
+			}
+			require.Equal(t, "https://go.dev/blog", urls[0], "rarer terms count for more")
+			require.ElementsMatch(t, []string{"https://go.dev/blog", "https://go.dev/doc", "https://rust-lang.org"}, urls)
+
+			related, err = store.RelatedUrls(ctx, util.HashMd5String("https://go.dev"), 1)
+			require.NoError(t, err)
+			require.Len(t, related, 1)
+
+			// Inserting a vector replaces the old one
+			require.NoError(t, store.InsertTermVectors(ctx, types.TermVector{
+				UrlMd5: util.HashMd5String("https://go.dev"),
+				Terms:  map[string]float64{"bread": 1},
+			}))
+			related, err = store.RelatedUrls(ctx, util.HashMd5String("https://go.dev"), 10)
+			require.NoError(t, err)
+			require.Len(t, related, 1)
+			require.Equal(t, "https://example.com/recipes", related[0].Url)
+
+			n, err := store.DeleteTermVectors(ctx, util.HashMd5String("https://go.dev"), util.HashMd5String("https://unknown.example"))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			related, err = store.RelatedUrls(ctx, util.HashMd5String("https://go.dev"), 10)
+			require.NoError(t, err)
+			require.Empty(t, related, "a url without a vector has nothing related")
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package persistence
+
+import (
+	"context"
+
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// UrlsWithParams returns every stored url that has a query string or fragment.
+// These are the only urls that may need redaction.
+func (s *SqliteStore) UrlsWithParams(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			url
+		FROM
+			urls
+		WHERE
+			url LIKE '%?%' OR url LIKE '%#%';
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var u string
+		err := rows.Scan(&u)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+
+	return urls, rows.Err()
+}
+
+// RewriteUrl moves everything stored under oldUrl to newUrl. Visits are
+// merged, and any scraped document and search index fragments for the old url
+// are dropped since they may contain data that was only visible with the
+// original url. The new url is flagged as redacted.
+func (s *SqliteStore) RewriteUrl(ctx context.Context, oldUrl string, newUrl string) error {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	oldMd5 := util.HashMd5String(oldUrl)
+	newMd5 := util.HashMd5String(newUrl)
+
+	if oldMd5 == newMd5 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	cleanupWithError := func(err error) error {
+		tx.Rollback()
+		return err
+	}
+
+	stmts := []struct {
+		name string
+		qry  string
+		args []any
+	}{
+		{
+			// @note the `WHERE true` is needed for sqlite to parse an upsert on INSERT ... SELECT
+			name: "copy url",
+			qry: `
+				INSERT INTO
+					urls(url_md5, url, title, description, last_visit, redacted)
+				SELECT ?, ?, title, description, last_visit, 1 FROM urls WHERE url_md5 = ? AND true
+				ON CONFLICT(url_md5) DO UPDATE SET
+					last_visit = max(urls.last_visit, excluded.last_visit),
+					redacted = 1;
+			`,
+			args: []any{newMd5, newUrl, oldMd5},
+		},
+		{
+			name: "move visits",
+			qry:  `UPDATE OR IGNORE visits SET url_md5 = ? WHERE url_md5 = ?;`,
+			args: []any{newMd5, oldMd5},
+		},
+		{
+			name: "drop duplicate visits",
+			qry:  `DELETE FROM visits WHERE url_md5 = ?;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "move titles",
+			qry:  `UPDATE OR IGNORE url_titles SET url_md5 = ? WHERE url_md5 = ?;`,
+			args: []any{newMd5, oldMd5},
+		},
+		{
+			name: "drop duplicate titles",
+			qry:  `DELETE FROM url_titles WHERE url_md5 = ?;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "move bookmarks",
+			qry:  `UPDATE OR IGNORE bookmarks SET url_md5 = ? WHERE url_md5 = ?;`,
+			args: []any{newMd5, oldMd5},
+		},
+		{
+			name: "drop duplicate bookmarks",
+			qry:  `DELETE FROM bookmarks WHERE url_md5 = ?;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop fragments",
+			qry:  `DELETE FROM fragment WHERE e = ?;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop term vectors",
+			qry:  `DELETE FROM term_vectors WHERE url_md5 = ?;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop words",
+			qry:  `DELETE FROM url_vocabulary WHERE url_md5 = ?;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop documents",
+			qry: `
+				DELETE FROM documents
+				WHERE
+					document_md5 IN (SELECT document_md5 FROM url_document_edges WHERE url_md5 = ?)
+					AND document_md5 NOT IN (SELECT document_md5 FROM url_document_edges WHERE url_md5 != ?);
+			`,
+			args: []any{oldMd5, oldMd5},
+		},
+		{
+			name: "drop document edges",
+			qry:  `DELETE FROM url_document_edges WHERE url_md5 = ?;`,
+			args: []any{oldMd5},
+		},
+		{
+			name: "drop url meta",
+			qry:  `DELETE FROM urls_meta WHERE url_md5 IN (?, ?);`,
+			args: []any{oldMd5, newMd5},
+		},
+		{
+			name: "drop url",
+			qry:  `DELETE FROM urls WHERE url_md5 = ?;`,
+			args: []any{oldMd5},
+		},
+	}
+
+	for _, stmt := range stmts {
+		_, err := tx.ExecContext(ctx, stmt.qry, stmt.args...)
+		if err != nil {
+			return cleanupWithError(errors.Wrap(err, stmt.name))
+		}
+	}
+
+	return tx.Commit()
+}
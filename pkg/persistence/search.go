@@ -0,0 +1,407 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+func (s *SqliteStore) SearchUrls(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+	if q.IsEmpty() {
+		return []types.UrlDbSearchEntity{}, 0, nil
+	}
+
+	positive := query.Positive(q.Text)
+	if len(positive) == 0 {
+		return searchFiltered(ctx, s.db, q, dialectSqlite, opts)
+	}
+
+	f := newQueryFilter(q, dialectSqlite)
+	f.restrict(opts)
+	var count uint
+	row := s.db.QueryRowContext(ctx, `
+SELECT
+  count(DISTINCT fr.e)
+FROM
+  fragment fr
+  INNER JOIN urls u ON u.url_md5 = fr.e
+WHERE
+  `+f.fragmentMatches("fr.id", positive)+`
+  AND `+f.where()+`;
+	`, f.args...)
+	if row.Err() != nil {
+		return nil, 0, errors.Wrap(row.Err(), "row count error")
+	}
+	err := row.Scan(&count)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "row count error")
+	}
+
+	// @note every match is scored, rather than only the most recent ones, so
+	// that an often visited page isn't cut off by newer one-off visits. The
+	// rank, bm25 by default, is lower for better matches. A fragment is ranked
+	// in each index that any of the terms were looked up in.
+	ranking := opts.ranking()
+	f = newQueryFilter(q, dialectSqlite)
+	f.restrict(opts)
+	rows, err := s.db.QueryContext(ctx, `
+WITH
+  trigram_ranks AS MATERIALIZED (`+f.ranks(trigramIndex, positive)+`),
+  word_ranks AS MATERIALIZED (`+f.ranks(wordIndex, positive)+`),
+  matches AS (
+    SELECT
+      fr.e,
+      coalesce(tr.rank, 0) + coalesce(wr.rank, 0) AS rank,
+      (coalesce(tr.rank, 0) + coalesce(wr.rank, 0)) * `+f.attributeWeight("fr.a", ranking)+` AS weighted_rank
+    FROM
+      fragment fr
+      INNER JOIN urls u ON u.url_md5 = fr.e
+      LEFT JOIN trigram_ranks tr ON tr.id = fr.id
+      LEFT JOIN word_ranks wr ON wr.id = fr.id
+    WHERE
+      `+f.fragmentMatches("fr.id", positive)+`
+      AND `+f.where()+`
+  ),
+  scored AS (
+    SELECT
+      e,
+      count(*) AS match_count,
+      sum(rank) AS sum_rank,
+      - min(weighted_rank) AS text_score
+    FROM
+      matches
+    GROUP BY
+      e
+  )
+SELECT
+  t.url_md5,
+  t.url,
+  t.title,
+  t.description,
+  coalesce(t.last_visit, 0),
+  t.visit_count,
+  m.match_count,
+  m.sum_rank,
+  m.text_score + `+f.visitScore("t.url_md5", time.Now(), ranking)+` + `+f.bookmarkScore("t.url_md5", ranking)+` AS score
+FROM
+  scored m
+  INNER JOIN urls t ON t.url_md5 = m.e
+ORDER BY
+  `+opts.orderBy("t")+`
+`+f.limit(opts)+`;
+	`, f.args...)
+
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.UrlDbSearchEntity{}
+
+	for rows.Next() {
+		var x types.UrlDbSearchEntity
+		var ts int64
+		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts, &x.VisitCount, &x.MatchCount, &x.SumRank, &x.Score)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "row error")
+		}
+		x.LastVisit = unixOrNil(ts)
+		xs = append(xs, x)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, errors.Wrap(rows.Err(), "query error")
+	}
+
+	err = s.addSnippets(ctx, positive, xs)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return xs, count, nil
+}
+
+// SQL selecting the id and rank of every fragment that matches any of the terms
+// in the index, or nothing if the index isn't used for any of them
+func (f *queryFilter) ranks(index string, terms []query.Term) string {
+	match := ftsQuery(index, terms, " OR ")
+	if match == "" {
+		return "SELECT NULL AS id, NULL AS rank WHERE 0"
+	}
+	return "SELECT rowid AS id, rank FROM " + index + " WHERE " + index + " MATCH " + f.arg(match)
+}
+
+// Set the snippets of each result to those of its fragments that match, best
+// first. Fragments that matched in the trigram index are highlighted by it,
+// the rest by the word index.
+func (s *SqliteStore) addSnippets(ctx context.Context, terms []query.Term, xs []types.UrlDbSearchEntity) error {
+	if len(xs) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(xs))
+	for i, x := range xs {
+		ids[i] = x.UrlMd5
+	}
+
+	snippets := map[string][]types.Snippet{}
+	for _, index := range []string{trigramIndex, wordIndex} {
+		match := ftsQuery(index, terms, " OR ")
+		if match == "" {
+			continue
+		}
+
+		f := &queryFilter{dialect: dialectSqlite}
+		fragments := "SELECT fr.id FROM fragment fr WHERE fr.e " + f.in(ids) + " AND " + f.fragmentMatches("fr.id", terms)
+		if index == wordIndex {
+			if trigrams := ftsQuery(trigramIndex, terms, " OR "); trigrams != "" {
+				fragments += " AND fr.id NOT IN (SELECT rowid FROM " + trigramIndex + " WHERE " + trigramIndex + " MATCH " + f.arg(trigrams) + ")"
+			}
+		}
+
+		rows, err := s.db.QueryContext(ctx, `
+SELECT
+  e,
+  a,
+  coalesce((SELECT section FROM fragment WHERE id = `+index+`.rowid), '') AS section,
+  snippet (`+index+`,
+    3,
+    `+f.arg(markStart)+`,
+    `+f.arg(markEnd)+`,
+    '…',
+    64) AS snippet
+FROM
+  `+index+`
+WHERE
+  `+index+` MATCH `+f.arg(match)+`
+  AND rowid IN (`+fragments+`)
+ORDER BY
+  rank;
+	`, f.args...)
+		if err != nil {
+			return errors.Wrap(err, "snippet query error")
+		}
+
+		for rows.Next() {
+			var e, a, section, snippet string
+			err := rows.Scan(&e, &a, &section, &snippet)
+			if err != nil {
+				rows.Close()
+				return errors.Wrap(err, "row error")
+			}
+			sn := parseSnippet(a, snippet)
+			sn.Section = section
+			snippets[e] = append(snippets[e], sn)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return errors.Wrap(err, "snippet query error")
+		}
+	}
+
+	for i := range xs {
+		xs[i].Snippets = append([]types.Snippet{}, snippets[xs[i].UrlMd5]...)
+	}
+
+	return nil
+}
+
+func (s *SqliteStore) FilterUrls(ctx context.Context, q *query.Query, opts SearchOptions, ids ...string) ([]types.UrlDbSearchEntity, error) {
+	xs := []types.UrlDbSearchEntity{}
+	for _, batch := range lo.Chunk(ids, recordBatchSize) {
+		f := newQueryFilter(q, dialectSqlite)
+		f.add("u.url_md5 IN (" + f.values(batch) + ")")
+
+		urls, err := scoredUrls(ctx, s.db, f, opts, "")
+		if err != nil {
+			return nil, err
+		}
+		xs = append(xs, urls...)
+	}
+	return xs, nil
+}
+
+func (s *SqliteStore) SearchFacets(ctx context.Context, q *query.Query, opts SearchOptions) (*types.Facets, error) {
+	f, matched := matchedUrls(q, dialectSqlite, opts)
+	return searchFacets(ctx, s.db, f, q, matched)
+}
+
+func (s *SqliteStore) SearchVisits(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.VisitDbSearchEntity, uint, error) {
+	f, matched := matchedUrls(q, dialectSqlite, opts)
+	return searchVisits(ctx, s.db, f, q, matched, opts)
+}
+
+func (s *SqliteStore) RelatedUrls(ctx context.Context, urlMd5 string, limit int) ([]types.UrlDbSearchEntity, error) {
+	return relatedUrls(ctx, s.db, dialectSqlite, urlMd5, limit)
+}
+
+func (s *SqliteStore) Fragments(ctx context.Context, contains []string, fn func(f types.Fragment) error) error {
+	f := &queryFilter{dialect: dialectSqlite}
+	where := "1 = 1"
+	if match := ftsQuery(trigramIndex, containsTerms(contains), " AND "); match != "" {
+		where = "fr.id IN (SELECT rowid FROM " + trigramIndex + " WHERE " + trigramIndex + " MATCH " + f.arg(match) + ")"
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT fr.e, fr.t, fr.a, fr.v, coalesce(fr.section, '') FROM fragment fr WHERE `+where+`;`, f.args...)
+	if err != nil {
+		return errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var x types.Fragment
+		err := rows.Scan(&x.E, &x.T, &x.A, &x.V, &x.Section)
+		if err != nil {
+			return errors.Wrap(err, "row error")
+		}
+		if err := fn(x); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "query error")
+}
+
+func (s *SqliteStore) SimilarWords(ctx context.Context, word string, limit int) ([]types.VocabularyRow, error) {
+	tris := trigrams(word)
+	if len(tris) == 0 {
+		return s.knownWords(ctx, word)
+	}
+
+	quoted := make([]string, len(tris))
+	for i, t := range tris {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+
+	// @note the more trigrams a word shares the better its rank
+	rows, err := s.db.QueryContext(ctx, `
+WITH
+  candidates AS MATERIALIZED (
+    SELECT
+      rowid AS id,
+      rank
+    FROM
+      vocabulary_fts
+    WHERE
+      vocabulary_fts MATCH ?
+    ORDER BY
+      rank
+    LIMIT ?
+  )
+SELECT
+  v.word,
+  v.count
+FROM
+  candidates c
+  INNER JOIN vocabulary v ON v.id = c.id
+ORDER BY
+  c.rank;
+	`, strings.Join(quoted, " OR "), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	xs, err := scanVocabulary(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// @note the word itself is almost always the best ranked, but make sure
+	known, err := s.knownWords(ctx, word)
+	if err != nil {
+		return nil, err
+	}
+	for _, x := range known {
+		if !lo.ContainsBy(xs, func(y types.VocabularyRow) bool { return y.Word == x.Word }) {
+			xs = append([]types.VocabularyRow{x}, xs...)
+		}
+	}
+	return xs, nil
+}
+
+// The word itself, if it is known
+func (s *SqliteStore) knownWords(ctx context.Context, word string) ([]types.VocabularyRow, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT word, count FROM vocabulary WHERE word = ?;`, strings.ToLower(word))
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	return scanVocabulary(rows)
+}
+
+func scanVocabulary(rows *sql.Rows) ([]types.VocabularyRow, error) {
+	defer rows.Close()
+
+	xs := []types.VocabularyRow{}
+	for rows.Next() {
+		var x types.VocabularyRow
+		err := rows.Scan(&x.Word, &x.Count)
+		if err != nil {
+			return nil, errors.Wrap(err, "row error")
+		}
+		xs = append(xs, x)
+	}
+	return xs, errors.Wrap(rows.Err(), "query error")
+}
+
+func (s *SqliteStore) RecentUrls(ctx context.Context, limit, offset uint) ([]types.UrlDbEntity, uint, error) {
+	var count uint
+	row := s.db.QueryRowContext(ctx, `
+SELECT
+	COUNT(*)
+FROM
+  urls;
+	`)
+	if row.Err() != nil {
+		return nil, 0, errors.Wrap(row.Err(), "row count error")
+	}
+	err := row.Scan(&count)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "row count error")
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT
+	url_md5,
+  url,
+  title,
+  description,
+  last_visit,
+  visit_count
+FROM
+  urls
+ORDER BY
+  last_visit DESC,
+  url_md5
+LIMIT ? OFFSET ?;
+	`, limit, offset)
+
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.UrlDbEntity{}
+
+	for rows.Next() {
+		var x types.UrlDbEntity
+		var ts int64
+		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts, &x.VisitCount)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "row error")
+		}
+		x.LastVisit = unixOrNil(ts)
+		xs = append(xs, x)
+	}
+
+	if rows.Err() != nil {
+		return nil, 0, errors.Wrap(rows.Err(), "query error")
+	}
+
+	return xs, count, nil
+}
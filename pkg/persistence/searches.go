@@ -0,0 +1,179 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// @note the search history and saved searches only use standard SQL and are
+// shared by every sql backend
+
+func insertSearchHistory(ctx context.Context, db *sql.DB, dialect sqlDialect, row types.SearchHistoryRow) error {
+	f := &queryFilter{dialect: dialect}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO
+			search_history(query, mode, searched_at, result_count)
+				VALUES(`+f.values([]string{row.Query, row.Mode})+`, `+f.arg(row.SearchedAt.Unix())+`, `+f.arg(int64(row.ResultCount))+`);
+	`, f.args...)
+	return errors.Wrap(err, "error inserting search")
+}
+
+func searchHistory(ctx context.Context, db *sql.DB, dialect sqlDialect, limit int) ([]types.SearchHistoryRow, error) {
+	f := &queryFilter{dialect: dialect}
+	rows, err := db.QueryContext(ctx, `
+SELECT
+  query,
+  mode,
+  searched_at,
+  result_count
+FROM
+  search_history
+ORDER BY
+  searched_at DESC, id DESC
+LIMIT `+f.arg(limit)+`;
+	`, f.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.SearchHistoryRow{}
+	for rows.Next() {
+		var x types.SearchHistoryRow
+		var ts int64
+		err := rows.Scan(&x.Query, &x.Mode, &ts, &x.ResultCount)
+		if err != nil {
+			return nil, errors.Wrap(err, "row error")
+		}
+		x.SearchedAt = time.Unix(ts, 0)
+		xs = append(xs, x)
+	}
+
+	return xs, errors.Wrap(rows.Err(), "query error")
+}
+
+func saveSearch(ctx context.Context, db *sql.DB, dialect sqlDialect, row types.SavedSearchRow) error {
+	f := &queryFilter{dialect: dialect}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO
+			saved_searches(name, query, mode, created_at)
+				VALUES(`+f.values([]string{row.Name, row.Query, row.Mode})+`, `+f.arg(row.CreatedAt.Unix())+`)
+		ON CONFLICT(name) DO UPDATE SET
+			query = excluded.query,
+			mode = excluded.mode,
+			created_at = excluded.created_at;
+	`, f.args...)
+	return errors.Wrap(err, "error saving search")
+}
+
+// Saved searches, all of them or only the one named name if it isn't empty
+func savedSearches(ctx context.Context, db *sql.DB, dialect sqlDialect, name string) ([]types.SavedSearchRow, error) {
+	f := &queryFilter{dialect: dialect}
+	where := "1 = 1"
+	if name != "" {
+		where = "name = " + f.arg(name)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+SELECT
+  name,
+  query,
+  mode,
+  created_at
+FROM
+  saved_searches
+WHERE
+  `+where+`
+ORDER BY
+  name;
+	`, f.args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.SavedSearchRow{}
+	for rows.Next() {
+		var x types.SavedSearchRow
+		var ts int64
+		err := rows.Scan(&x.Name, &x.Query, &x.Mode, &ts)
+		if err != nil {
+			return nil, errors.Wrap(err, "row error")
+		}
+		x.CreatedAt = time.Unix(ts, 0)
+		xs = append(xs, x)
+	}
+
+	return xs, errors.Wrap(rows.Err(), "query error")
+}
+
+func savedSearch(ctx context.Context, db *sql.DB, dialect sqlDialect, name string) (*types.SavedSearchRow, error) {
+	xs, err := savedSearches(ctx, db, dialect, name)
+	if err != nil || len(xs) == 0 {
+		return nil, err
+	}
+	return &xs[0], nil
+}
+
+func deleteSavedSearch(ctx context.Context, db *sql.DB, dialect sqlDialect, name string) (bool, error) {
+	f := &queryFilter{dialect: dialect}
+	res, err := db.ExecContext(ctx, `DELETE FROM saved_searches WHERE name = `+f.arg(name)+`;`, f.args...)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *SqliteStore) InsertSearchHistory(ctx context.Context, row types.SearchHistoryRow) error {
+	return insertSearchHistory(ctx, s.db, dialectSqlite, row)
+}
+
+func (s *SqliteStore) SearchHistory(ctx context.Context, limit int) ([]types.SearchHistoryRow, error) {
+	return searchHistory(ctx, s.db, dialectSqlite, limit)
+}
+
+func (s *SqliteStore) SaveSearch(ctx context.Context, row types.SavedSearchRow) error {
+	return saveSearch(ctx, s.db, dialectSqlite, row)
+}
+
+func (s *SqliteStore) SavedSearch(ctx context.Context, name string) (*types.SavedSearchRow, error) {
+	return savedSearch(ctx, s.db, dialectSqlite, name)
+}
+
+func (s *SqliteStore) SavedSearches(ctx context.Context) ([]types.SavedSearchRow, error) {
+	return savedSearches(ctx, s.db, dialectSqlite, "")
+}
+
+func (s *SqliteStore) DeleteSavedSearch(ctx context.Context, name string) (bool, error) {
+	return deleteSavedSearch(ctx, s.db, dialectSqlite, name)
+}
+
+func (s *PostgresStore) InsertSearchHistory(ctx context.Context, row types.SearchHistoryRow) error {
+	return insertSearchHistory(ctx, s.db, dialectPostgres, row)
+}
+
+func (s *PostgresStore) SearchHistory(ctx context.Context, limit int) ([]types.SearchHistoryRow, error) {
+	return searchHistory(ctx, s.db, dialectPostgres, limit)
+}
+
+func (s *PostgresStore) SaveSearch(ctx context.Context, row types.SavedSearchRow) error {
+	return saveSearch(ctx, s.db, dialectPostgres, row)
+}
+
+func (s *PostgresStore) SavedSearch(ctx context.Context, name string) (*types.SavedSearchRow, error) {
+	return savedSearch(ctx, s.db, dialectPostgres, name)
+}
+
+func (s *PostgresStore) SavedSearches(ctx context.Context) ([]types.SavedSearchRow, error) {
+	return savedSearches(ctx, s.db, dialectPostgres, "")
+}
+
+func (s *PostgresStore) DeleteSavedSearch(ctx context.Context, name string) (bool, error) {
+	return deleteSavedSearch(ctx, s.db, dialectPostgres, name)
+}
@@ -0,0 +1,64 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchHistory(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			now := time.Unix(time.Now().Unix(), 0)
+			for i, q := range []string{"golang", "site:go.dev generics", `issues/\d+`} {
+				mode := ""
+				if i == 2 {
+					mode = "regex"
+				}
+				require.NoError(t, store.InsertSearchHistory(ctx, types.SearchHistoryRow{Query: q, Mode: mode, SearchedAt: now, ResultCount: uint(i)}))
+			}
+			require.NoError(t, store.InsertSearchHistory(ctx, types.SearchHistoryRow{Query: "rust", SearchedAt: now.Add(-time.Hour)}))
+
+			searches, err := store.SearchHistory(ctx, 3)
+			require.NoError(t, err)
+			require.Equal(t, []types.SearchHistoryRow{
+				{Query: `issues/\d+`, Mode: "regex", SearchedAt: now, ResultCount: 2},
+				{Query: "site:go.dev generics", SearchedAt: now, ResultCount: 1},
+				{Query: "golang", SearchedAt: now, ResultCount: 0},
+			}, searches, "most recent first, then last searched")
+
+			saved, err := store.SavedSearch(ctx, "generics")
+			require.NoError(t, err)
+			require.Nil(t, saved)
+
+			require.NoError(t, store.SaveSearch(ctx, types.SavedSearchRow{Name: "generics", Query: "generics", CreatedAt: now}))
+			require.NoError(t, store.SaveSearch(ctx, types.SavedSearchRow{Name: "generics", Query: "site:go.dev generics", CreatedAt: now}))
+			require.NoError(t, store.SaveSearch(ctx, types.SavedSearchRow{Name: "issues", Query: `issues/\d+`, Mode: "regex", CreatedAt: now}))
+
+			saved, err = store.SavedSearch(ctx, "generics")
+			require.NoError(t, err)
+			require.Equal(t, &types.SavedSearchRow{Name: "generics", Query: "site:go.dev generics", CreatedAt: now}, saved, "saving under the same name replaces")
+
+			all, err := store.SavedSearches(ctx)
+			require.NoError(t, err)
+			require.Len(t, all, 2)
+			require.Equal(t, "issues", all[1].Name)
+			require.Equal(t, "regex", all[1].Mode)
+
+			deleted, err := store.DeleteSavedSearch(ctx, "generics")
+			require.NoError(t, err)
+			require.True(t, deleted)
+			deleted, err = store.DeleteSavedSearch(ctx, "generics")
+			require.NoError(t, err)
+			require.False(t, deleted)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package persistence
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+)
+
+// Markers put around matches by the databases' snippet functions, which
+// parseSnippet turns into spans. Control characters, so that they can't be
+// confused with the text of a page.
+const (
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+// A snippet of the attribute a from text with matches between markStart and
+// markEnd
+func parseSnippet(a string, marked string) types.Snippet {
+	var sb strings.Builder
+	spans := []types.Span{}
+	for {
+		i := strings.Index(marked, markStart)
+		if i < 0 {
+			break
+		}
+		j := strings.Index(marked[i:], markEnd)
+		if j < 0 {
+			break
+		}
+
+		sb.WriteString(marked[:i])
+		start := sb.Len()
+		sb.WriteString(marked[i+len(markStart) : i+j])
+		if sb.Len() > start {
+			spans = append(spans, types.Span{Start: start, End: sb.Len()})
+		}
+		marked = marked[i+j+len(markEnd):]
+	}
+	sb.WriteString(marked)
+
+	return types.Snippet{Attribute: a, Text: strings.ReplaceAll(sb.String(), markStart, ""), Spans: spans}
+}
+
+// A snippet of the attribute a from text, with every match of re in it
+func highlight(a string, text string, re *regexp.Regexp) types.Snippet {
+	spans := []types.Span{}
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		if m[0] < m[1] {
+			spans = append(spans, types.Span{Start: m[0], End: m[1]})
+		}
+	}
+	return types.Snippet{Attribute: a, Text: text, Spans: spans}
+}
+
+// An expression matching any of the terms, ignoring case, for highlighting
+// them where the database can't
+func termsRegexp(terms []query.Term) *regexp.Regexp {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = regexp.QuoteMeta(t.Value)
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+}
@@ -0,0 +1,68 @@
+package persistence_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+// The text of snippets with their spans marked up, one per line
+func marked(snippets []types.Snippet) string {
+	lines := make([]string, len(snippets))
+	for i, s := range snippets {
+		var sb strings.Builder
+		pos := 0
+		for _, span := range s.Spans {
+			sb.WriteString(s.Text[pos:span.Start] + "<mark>" + s.Text[span.Start:span.End] + "</mark>")
+			pos = span.End
+		}
+		sb.WriteString(s.Text[pos:])
+		lines[i] = sb.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestSnippets(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			url := "https://gophers.example/care"
+			title := "Caring for gophers"
+			require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title}))
+			md5 := util.HashMd5String(url)
+			require.NoError(t, store.InsertFragments(ctx,
+				types.Fragment{E: md5, T: "urls", A: "title", V: title},
+				types.Fragment{E: md5, T: "documents", A: "content", V: "Gophers dig burrows. A happy gopher is a fed gopher.", Section: "Care > Feeding"},
+			))
+
+			results, _, err := store.SearchUrls(ctx, query.MustParse("gopher"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Len(t, results, 1)
+			require.Len(t, results[0].Snippets, 2)
+
+			byAttribute := map[string]types.Snippet{}
+			for _, s := range results[0].Snippets {
+				byAttribute[s.Attribute] = s
+			}
+			require.Equal(t, types.Snippet{Attribute: "title", Text: "Caring for gophers", Spans: []types.Span{{Start: 11, End: 17}}}, byAttribute["title"])
+
+			content := byAttribute["content"]
+			require.Equal(t, "Care > Feeding", content.Section)
+			require.NotContains(t, content.Text, "<mark>")
+			require.Len(t, content.Spans, 3)
+			for _, span := range content.Spans {
+				require.Equal(t, "gopher", strings.ToLower(content.Text[span.Start:span.End]))
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package persistence
+
+import (
+	"context"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+)
+
+// Store is everything the rest of the app needs from the database. Callers
+// should depend on this rather than on SQL or the schema so that the storage
+// backend can be swapped out, e.g. for the in-memory store in tests or when
+// embedding browser-gopher in another app.
+type Store interface {
+	UrlStore
+	VisitStore
+	BookmarkStore
+	DocumentStore
+	IndexStore
+	SearchStore
+	SearchHistoryStore
+	RecordStore
+	MaintenanceStore
+
+	Close() error
+}
+
+type UrlStore interface {
+	InsertUrl(ctx context.Context, row *types.UrlRow) error
+	UrlsById(ctx context.Context, ids ...string) ([]types.UrlDbEntity, error)
+
+	// Every url that has a query string or fragment
+	UrlsWithParams(ctx context.Context) ([]string, error)
+
+	// Move everything stored under oldUrl to newUrl, dropping any full-text for
+	// the old url. Used for redaction.
+	RewriteUrl(ctx context.Context, oldUrl string, newUrl string) error
+
+	// Add to the title history of a url. InsertUrl records the title it is
+	// passed, so this is only needed when importing history.
+	InsertTitles(ctx context.Context, url string, titles ...types.TitleRecord) error
+}
+
+type VisitStore interface {
+	InsertVisit(ctx context.Context, row *types.VisitRow) error
+
+	// The time of the most recent visit recorded by the named extractor
+	LatestVisitTime(ctx context.Context, extractorName string) (*time.Time, error)
+}
+
+type BookmarkStore interface {
+	// Replace the bookmarks imported from the named extractor with rows, so
+	// that those removed in the browser are forgotten. Bookmarks are searched
+	// with is:bookmarked and rank higher, see config.RankingConfig.
+	ReplaceBookmarks(ctx context.Context, extractorName string, rows ...types.BookmarkRow) error
+}
+
+type DocumentStore interface {
+	InsertDocument(ctx context.Context, row *types.DocumentRow) error
+
+	// Urls that have not been scraped yet. Redacted urls are never included.
+	CountUrlsWithoutDocuments(ctx context.Context) (int, error)
+	UrlsWithoutDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error)
+
+	// The subset of the given urls, by url_md5, that have a document
+	UrlsWithDocuments(ctx context.Context, ids ...string) ([]string, error)
+
+	// The document_md5 of each of the given urls, by url_md5, that was fetched
+	// successfully and isn't empty. Urls with the same one have the same
+	// full-text, e.g. because they are mirrors of each other.
+	DocumentMd5s(ctx context.Context, ids ...string) (map[string]string, error)
+
+	// Replace the body of every document with fn(body), e.g. to encrypt them.
+	// Pruned bodies are skipped. Returns the number of bodies that changed.
+	UpdateBodies(ctx context.Context, fn func(body string) (string, error)) (int, error)
+
+	// Call fn with the url_md5 and body of every document whose body starts
+	// with prefix. Pruned bodies are skipped.
+	Bodies(ctx context.Context, prefix string, fn func(urlMd5 string, body string) error) error
+}
+
+type IndexStore interface {
+	InsertUrlMeta(ctx context.Context, rows ...types.UrlMetaRow) error
+
+	// Urls that have never been indexed, with their full-text body if any
+	CountUnindexed(ctx context.Context) (int, error)
+	Unindexed(ctx context.Context, limit int) ([]types.UrlDbEntity, error)
+
+	// Urls whose full-text was scraped after they were last indexed
+	CountUnindexedDocuments(ctx context.Context) (int, error)
+	UnindexedDocuments(ctx context.Context, limit int) ([]types.UrlDbEntity, error)
+
+	// Write search index fragments. The whole batch is written or none of it is.
+	InsertFragments(ctx context.Context, fragments ...types.Fragment) error
+
+	// Replace every fragment of the given urls, by url_md5, with fragments, so
+	// that what they no longer contain can't be found. The whole batch is
+	// written or none of it is. Returns the number of stale fragments removed.
+	ReplaceFragments(ctx context.Context, ids []string, fragments ...types.Fragment) (int, error)
+
+	// Remove every fragment of the given urls, by url_md5, from the index
+	DeleteEntityFragments(ctx context.Context, ids ...string) (int, error)
+
+	// Mark every url as unindexed so that the next index build covers everything
+	ResetIndexed(ctx context.Context) error
+
+	// Mark the given urls, by url_md5, as unindexed
+	MarkUnindexed(ctx context.Context, ids ...string) error
+
+	// Remove every fragment of the given type, e.g. "documents", from the index
+	DeleteFragments(ctx context.Context, t string) (int, error)
+
+	// Replace the words of the given urls, by url_md5, with rows. The count of
+	// a word in the vocabulary is its total over every url, and words no url
+	// has any more are forgotten. The vocabulary is what misspelled searches
+	// are corrected to.
+	ReplaceVocabulary(ctx context.Context, ids []string, rows ...types.VocabularyRow) error
+
+	// Forget every word of the vocabulary, see RebuildVocabulary
+	DeleteVocabulary(ctx context.Context) error
+
+	// Replace the term vectors of urls, see RelatedUrls
+	InsertTermVectors(ctx context.Context, vectors ...types.TermVector) error
+
+	// Delete the term vectors of the given urls, by url_md5, e.g. because they
+	// were made from bodies that have since been encrypted. Returns the number
+	// of urls that had one.
+	DeleteTermVectors(ctx context.Context, ids ...string) (int, error)
+
+	// Regenerate the search index from the fragments already written, e.g.
+	// after a new kind of index was added. Much faster than reindexing.
+	RebuildSearchIndex(ctx context.Context) error
+}
+
+type SearchStore interface {
+	// Search for urls matching q, see the query package for the syntax.
+	// Returns one page of matching urls, in the order of opts, and the total
+	// number of matches.
+	SearchUrls(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.UrlDbSearchEntity, uint, error)
+
+	// Those of the urls with the given ids, by url_md5, that satisfy
+	// everything in q but its positive full-text terms. They are scored as
+	// if their text didn't match, and all of them are returned regardless of
+	// the limit and offset of opts.
+	FilterUrls(ctx context.Context, q *query.Query, opts SearchOptions, ids ...string) ([]types.UrlDbSearchEntity, error)
+
+	// Facets of every url SearchUrls would find for q, regardless of the
+	// limit and offset of opts. Browsers and months only count the visits
+	// that satisfy the browser: and date filters of q. An empty q matches
+	// every url.
+	SearchFacets(ctx context.Context, q *query.Query, opts SearchOptions) (*types.Facets, error)
+
+	// Visits to the urls SearchUrls would find for q, that satisfy its
+	// browser: and date filters. Returns one page of them in chronological
+	// order, whatever the sort of opts, and the total number of them. An
+	// empty q matches every visit.
+	SearchVisits(ctx context.Context, q *query.Query, opts SearchOptions) ([]types.VisitDbSearchEntity, uint, error)
+
+	// Call fn with every fragment of the search index whose value contains
+	// all of the given strings, ignoring case. They may be looked up in the
+	// index, so any shorter than 3 characters can be ignored. Used to match
+	// fragments against a Pattern.
+	Fragments(ctx context.Context, contains []string, fn func(f types.Fragment) error) error
+
+	// Known words that look like word, i.e. that share some of its trigrams,
+	// best candidates first. Includes word itself if it is known.
+	SimilarWords(ctx context.Context, word string, limit int) ([]types.VocabularyRow, error)
+
+	// The urls whose term vectors are most similar to that of the url with
+	// the given url_md5, most similar first. Terms that are common to many
+	// urls count less. The score of each is its similarity.
+	RelatedUrls(ctx context.Context, urlMd5 string, limit int) ([]types.UrlDbSearchEntity, error)
+
+	// A page of the most recently visited urls and the total number of urls
+	RecentUrls(ctx context.Context, limit, offset uint) ([]types.UrlDbEntity, uint, error)
+}
+
+type SearchHistoryStore interface {
+	InsertSearchHistory(ctx context.Context, row types.SearchHistoryRow) error
+
+	// The most recent searches, most recent first
+	SearchHistory(ctx context.Context, limit int) ([]types.SearchHistoryRow, error)
+
+	// Save a search under its name, replacing any saved under the same name
+	SaveSearch(ctx context.Context, row types.SavedSearchRow) error
+
+	// The search saved under name, or nil if there isn't one
+	SavedSearch(ctx context.Context, name string) (*types.SavedSearchRow, error)
+
+	// Every saved search, by name
+	SavedSearches(ctx context.Context) ([]types.SavedSearchRow, error)
+
+	// Reports whether there was a search saved under name to delete
+	DeleteSavedSearch(ctx context.Context, name string) (bool, error)
+}
+
+type RecordStore interface {
+	// Call fn with every url, along with its title history, visits and
+	// documents. See RecordOptions for filtering.
+	Records(ctx context.Context, opts RecordOptions, fn func(*types.UrlRecord) error) error
+}
+
+type MaintenanceStore interface {
+	// On-disk size in bytes
+	Size(ctx context.Context) (int64, error)
+	Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error)
+	Diagnose(ctx context.Context) ([]Finding, error)
+	Repair(ctx context.Context, findings []Finding) error
+}
@@ -0,0 +1,224 @@
+package persistence_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+// Every Store implementation should pass these. This is mostly to keep the
+// in-memory store honest.
+func TestStoreImplementations(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			recent := time.Unix(2000, 0)
+			old := time.Unix(1000, 0)
+			goTitle := "The Go Programming Language"
+			rustTitle := "Rust Programming Language"
+			body := "Go is an open source programming language"
+
+			require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: "https://go.dev", Title: &goTitle, LastVisit: &recent}))
+			require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: "https://rust-lang.org", Title: &rustTitle, LastVisit: &old}))
+			require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: "https://go.dev", Datetime: recent, ExtractorName: "chrome"}))
+			require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: "https://rust-lang.org", Datetime: old, ExtractorName: "firefox"}))
+
+			latest, err := store.LatestVisitTime(ctx, "chrome")
+			require.NoError(t, err)
+			require.Equal(t, recent.Unix(), latest.Unix())
+
+			n, err := store.CountUrlsWithoutDocuments(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 2, n)
+
+			require.NoError(t, store.InsertDocument(ctx, &types.DocumentRow{
+				DocumentMd5: util.HashMd5String(body),
+				UrlMd5:      util.HashMd5String("https://go.dev"),
+				AccessedAt:  &recent,
+				Body:        &body,
+			}))
+
+			unscraped, err := store.UrlsWithoutDocuments(ctx, 10)
+			require.NoError(t, err)
+			require.Len(t, unscraped, 1)
+			require.Equal(t, "https://rust-lang.org", unscraped[0].Url)
+
+			n, err = store.CountUnindexed(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 2, n)
+
+			unindexed, err := store.Unindexed(ctx, 10)
+			require.NoError(t, err)
+			require.Len(t, unindexed, 2)
+			require.Equal(t, "https://go.dev", unindexed[0].Url, "most recent first")
+			require.Equal(t, body, *unindexed[0].Body)
+
+			fragments := []types.Fragment{}
+			for _, u := range unindexed {
+				fragments = append(fragments, types.Fragment{E: u.UrlMd5, T: "urls", A: "title", V: *u.Title})
+			}
+			fragments = append(fragments, types.Fragment{E: unindexed[0].UrlMd5, T: "documents", A: "content", V: body})
+			require.NoError(t, store.InsertFragments(ctx, fragments...))
+
+			indexedAt := time.Now()
+			require.NoError(t, store.InsertUrlMeta(ctx,
+				types.UrlMetaRow{Url: "https://go.dev", IndexedAt: &indexedAt},
+				types.UrlMetaRow{Url: "https://rust-lang.org", IndexedAt: &indexedAt},
+			))
+
+			n, err = store.CountUnindexed(ctx)
+			require.NoError(t, err)
+			require.Equal(t, 0, n)
+
+			results, count, err := store.SearchUrls(ctx, query.MustParse("programming"), persistence.SearchOptions{Sort: persistence.SortRecent})
+			require.NoError(t, err)
+			require.Equal(t, uint(2), count)
+			require.Len(t, results, 2)
+			require.Equal(t, "https://go.dev", results[0].Url)
+			require.Equal(t, 1, results[0].VisitCount)
+
+			results, count, err = store.SearchUrls(ctx, query.MustParse("open source"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, uint(1), count)
+			require.Equal(t, "https://go.dev", results[0].Url)
+
+			search := func(s string) []string {
+				results, count, err := store.SearchUrls(ctx, query.MustParse(s), persistence.SearchOptions{})
+				require.NoError(t, err, s)
+				require.Equal(t, uint(len(results)), count, s)
+				urls := []string{}
+				for _, r := range results {
+					urls = append(urls, r.Url)
+				}
+				return urls
+			}
+
+			require.Equal(t, []string{"https://go.dev"}, search(`"open source"`))
+			require.Equal(t, []string{"https://go.dev"}, search("go"), "terms shorter than three characters")
+			require.Equal(t, []string{"https://go.dev"}, search("programming -rust"))
+			require.Equal(t, []string{"https://go.dev"}, search("site:go.dev"))
+			require.Equal(t, []string{"https://rust-lang.org"}, search("-site:go.dev"))
+			require.Equal(t, []string{"https://rust-lang.org"}, search("programming browser:firefox"))
+			require.Equal(t, []string{"https://go.dev"}, search("programming -browser:firefox"))
+			require.Equal(t, []string{"https://go.dev"}, search("programming after:1970-01-01T00:25:00Z"))
+			require.Equal(t, []string{"https://rust-lang.org"}, search("before:1970-01-01T00:25:00Z"))
+			require.Equal(t, []string{"https://rust-lang.org"}, search("title:RUST"))
+			require.Equal(t, []string{"https://go.dev"}, search("programming -title:rust"))
+			require.Equal(t, []string{"https://go.dev"}, search("url:go.dev has:fulltext"))
+			require.Equal(t, []string{"https://rust-lang.org"}, search("programming -has:fulltext"))
+			require.Empty(t, search("open source site:rust-lang.org"))
+			require.Empty(t, search("title:100%"), "like wildcards are escaped")
+			require.ElementsMatch(t, []string{"https://go.dev", "https://rust-lang.org"}, search("ogramm"), "terms match in the middle of a word")
+			require.Equal(t, []string{"https://rust-lang.org"}, search("programming -ource"))
+
+			results, _, err = store.SearchUrls(ctx, query.MustParse("ogramm"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			for _, r := range results {
+				require.NotEmpty(t, r.Snippets, r.Url)
+				sn := r.Snippets[0]
+				require.NotEmpty(t, sn.Spans, r.Url)
+				require.True(t, strings.EqualFold("ogramm", sn.Text[sn.Spans[0].Start:sn.Spans[0].End]), sn.Text)
+			}
+
+			matched := 0
+			require.NoError(t, store.Fragments(ctx, []string{"ogramm", "LANG"}, func(f types.Fragment) error {
+				matched++
+				return nil
+			}))
+			require.Equal(t, 3, matched)
+
+			require.NoError(t, store.ReplaceVocabulary(ctx, nil,
+				types.VocabularyRow{UrlMd5: "a", Word: "programming", Count: 2},
+				types.VocabularyRow{UrlMd5: "a", Word: "gopher", Count: 1},
+				types.VocabularyRow{UrlMd5: "b", Word: "gopher", Count: 2},
+			))
+			similar, err := store.SimilarWords(ctx, "gopehr", 10)
+			require.NoError(t, err)
+			require.Contains(t, similar, types.VocabularyRow{Word: "gopher", Count: 3}, "misspellings find the word, counted over every url")
+
+			require.NoError(t, store.ReplaceVocabulary(ctx, []string{"b"}, types.VocabularyRow{UrlMd5: "b", Word: "gopher", Count: 2}))
+			similar, err = store.SimilarWords(ctx, "gopher", 10)
+			require.NoError(t, err)
+			require.Contains(t, similar, types.VocabularyRow{Word: "gopher", Count: 3}, "replacing a url's words doesn't add to them")
+
+			require.NoError(t, store.ReplaceVocabulary(ctx, []string{"a", "b"}, types.VocabularyRow{UrlMd5: "a", Word: "programming", Count: 2}))
+			similar, err = store.SimilarWords(ctx, "gopehr", 10)
+			require.NoError(t, err)
+			require.NotContains(t, lo.Map(similar, func(x types.VocabularyRow, _ int) string { return x.Word }), "gopher", "words no url has are forgotten")
+
+			require.NoError(t, store.ReplaceBookmarks(ctx, "firefox", types.BookmarkRow{Url: "https://rust-lang.org"}))
+			require.Equal(t, []string{"https://rust-lang.org"}, search("programming is:bookmarked"))
+
+			filtered, err := store.FilterUrls(ctx, query.MustParse("nothing site:go.dev"), persistence.SearchOptions{}, util.HashMd5String("https://go.dev"), util.HashMd5String("https://rust-lang.org"))
+			require.NoError(t, err)
+			require.Len(t, filtered, 1)
+			require.Equal(t, "https://go.dev", filtered[0].Url)
+
+			recentUrls, count, err := store.RecentUrls(ctx, 1, 0)
+			require.NoError(t, err)
+			require.Equal(t, uint(2), count)
+			require.Len(t, recentUrls, 1)
+			require.Equal(t, "https://go.dev", recentUrls[0].Url)
+
+			cutoff := time.Unix(1500, 0)
+			firstSeen := time.Unix(500, 0)
+			require.NoError(t, store.InsertTitles(ctx, "https://rust-lang.org", types.TitleRecord{Title: "Rust", FirstSeen: &firstSeen, LastSeen: &firstSeen}))
+
+			var records []*types.UrlRecord
+			collect := func(rec *types.UrlRecord) error {
+				records = append(records, rec)
+				return nil
+			}
+
+			require.NoError(t, store.Records(ctx, persistence.RecordOptions{}, collect))
+			require.Len(t, records, 2)
+			for _, rec := range records {
+				if rec.Url == "https://rust-lang.org" {
+					require.Len(t, rec.Titles, 2)
+					require.Equal(t, "Rust", rec.Titles[0].Title, "oldest title first")
+					require.Equal(t, rustTitle, rec.Titles[1].Title)
+					require.Empty(t, rec.Documents)
+				}
+			}
+
+			records = nil
+			require.NoError(t, store.Records(ctx, persistence.RecordOptions{Since: &cutoff}, collect))
+			require.Len(t, records, 1)
+			require.Equal(t, "https://go.dev", records[0].Url)
+			require.Len(t, records[0].Visits, 1)
+			require.Len(t, records[0].Documents, 1)
+			require.Equal(t, body, *records[0].Documents[0].Body)
+
+			report, err := store.Prune(ctx, persistence.PruneOptions{VisitsBefore: &cutoff, DocumentsBefore: &indexedAt})
+			require.NoError(t, err)
+			require.Equal(t, 1, report.Visits)
+			require.Equal(t, 1, report.Documents)
+			require.Equal(t, 1, report.Fragments)
+
+			results, _, err = store.SearchUrls(ctx, query.MustParse("open source"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Len(t, results, 0)
+
+			redacted := "https://example.com/?token=REDACTED"
+			require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: redacted, LastVisit: &old, Redacted: true}))
+			require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: redacted, LastVisit: &recent}))
+			unscraped, err = store.UrlsWithoutDocuments(ctx, 10)
+			require.NoError(t, err)
+			for _, u := range unscraped {
+				require.NotEqual(t, redacted, u.Url, "urls stay redacted")
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package testutils
 
 import (
+	"context"
 	"database/sql"
 	_ "embed"
+	"fmt"
+	"os"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/iansinnott/browser-gopher/pkg/persistence"
 	"github.com/pkg/errors"
@@ -49,3 +53,98 @@ func GetTestDBConn(t *testing.T) (*sql.DB, error) {
 
 	return conn, err
 }
+
+// get a store backed by an in-memory sqlite db. Don't forget to close it when done.
+func GetTestStore(t *testing.T) (*persistence.SqliteStore, error) {
+	conn, err := GetTestDBConn(t)
+	if err != nil {
+		return nil, err
+	}
+
+	return persistence.NewSqliteStore(conn), nil
+}
+
+// Set to a postgres connection string to run the postgres tests, e.g.
+// postgres://postgres@localhost/postgres?sslmode=disable
+const PostgresDSNEnv = "BROWSER_GOPHER_TEST_POSTGRES_DSN"
+
+// get a store backed by a fresh schema in the postgres database at
+// $BROWSER_GOPHER_TEST_POSTGRES_DSN. The test is skipped if that is not set.
+// The schema is dropped when the test is done.
+func GetTestPostgresStore(t *testing.T) (*persistence.PostgresStore, error) {
+	dsn := os.Getenv(PostgresDSNEnv)
+	if dsn == "" {
+		t.Skip(PostgresDSNEnv + " not set")
+	}
+
+	ctx := context.Background()
+	schema := fmt.Sprintf("browser_gopher_test_%d", time.Now().UnixNano())
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open test db")
+	}
+
+	_, err = admin.ExecContext(ctx, "CREATE SCHEMA "+schema)
+	if err != nil {
+		admin.Close()
+		return nil, errors.Wrap(err, "could not create test schema")
+	}
+
+	t.Cleanup(func() {
+		admin.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE")
+		admin.Close()
+	})
+
+	// @note lib/pq passes unknown connection parameters on as run-time
+	// settings. public stays on the path, since that is where extensions like
+	// pg_trgm usually are already.
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "search_path=" + schema + "%2Cpublic"
+	} else {
+		dsn += " search_path=" + schema + ",public"
+	}
+
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open test db")
+	}
+
+	err = persistence.MigratePostgres(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return persistence.NewPostgresStore(conn), nil
+}
+
+// Stores makes a store of each kind, by name, for tests that every kind of
+// store should pass. Tests of the postgres one are skipped unless
+// $BROWSER_GOPHER_TEST_POSTGRES_DSN is set, see GetTestPostgresStore. Don't
+// forget to close them when done.
+func Stores() map[string]func(t *testing.T) persistence.Store {
+	return map[string]func(t *testing.T) persistence.Store{
+		"sqlite": func(t *testing.T) persistence.Store {
+			store, err := GetTestStore(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+		"memory": func(t *testing.T) persistence.Store {
+			return persistence.NewMemoryStore()
+		},
+		"postgres": func(t *testing.T) persistence.Store {
+			store, err := GetTestPostgresStore(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+}
@@ -0,0 +1,86 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// Visits to the urls selected by matched, SQL with a url_md5 column that can
+// use the arguments of f, that satisfy q. See Store.SearchVisits.
+func searchVisits(ctx context.Context, db *sql.DB, f *queryFilter, q *query.Query, matched string, opts SearchOptions) ([]types.VisitDbSearchEntity, uint, error) {
+	visit := "1 = 1"
+	if conds := f.visitConds(q); len(conds) > 0 {
+		visit = strings.Join(conds, " AND ")
+	}
+
+	var count uint
+	err := db.QueryRowContext(ctx, `
+WITH
+  matched AS (
+    `+matched+`
+  )
+SELECT count(*)
+FROM matched m INNER JOIN visits v ON v.url_md5 = m.url_md5
+WHERE `+visit+`;
+`, f.args...).Scan(&count)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "row count error")
+	}
+
+	rows, err := db.QueryContext(ctx, `
+WITH
+  matched AS (
+    `+matched+`
+  )
+SELECT
+  coalesce(v.visit_time, 0),
+  v.extractor_name,
+  t.url_md5,
+  t.url,
+  t.title,
+  t.description
+FROM
+  matched m
+  INNER JOIN visits v ON v.url_md5 = m.url_md5
+  INNER JOIN urls t ON t.url_md5 = m.url_md5
+WHERE
+  `+visit+`
+ORDER BY
+  v.visit_time, t.url_md5
+`+f.limit(opts), f.args...)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "query error")
+	}
+	defer rows.Close()
+
+	xs := []types.VisitDbSearchEntity{}
+	for rows.Next() {
+		var x types.VisitDbSearchEntity
+		var ts int64
+		err := rows.Scan(&ts, &x.ExtractorName, &x.UrlMd5, &x.Url, &x.Title, &x.Description)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "row error")
+		}
+		x.VisitTime = time.Unix(ts, 0)
+		xs = append(xs, x)
+	}
+
+	return xs, count, errors.Wrap(rows.Err(), "query error")
+}
+
+// Sort visits into the order of Store.SearchVisits
+func sortVisits(xs []types.VisitDbSearchEntity) {
+	sort.SliceStable(xs, func(i, j int) bool {
+		if !xs[i].VisitTime.Equal(xs[j].VisitTime) {
+			return xs[i].VisitTime.Before(xs[j].VisitTime)
+		}
+		return xs[i].UrlMd5 < xs[j].UrlMd5
+	})
+}
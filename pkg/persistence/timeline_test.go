@@ -0,0 +1,64 @@
+package persistence_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchVisits(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			afternoon := time.Date(2024, 3, 12, 14, 0, 0, 0, time.Local)
+			insert := func(url, title string, visits ...time.Time) {
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title, LastVisit: &visits[len(visits)-1]}))
+				for _, v := range visits {
+					require.NoError(t, store.InsertVisit(ctx, &types.VisitRow{Url: url, Datetime: v, ExtractorName: "chrome"}))
+				}
+				require.NoError(t, store.InsertFragments(ctx, types.Fragment{E: util.HashMd5String(url), T: "urls", A: "title", V: title}))
+			}
+
+			// Revisited since, so its last visit is long after that afternoon
+			insert("https://go.dev/blog", "The Go blog", afternoon.Add(10*time.Minute), afternoon.AddDate(0, 1, 0))
+			insert("https://rust-lang.org", "Rust", afternoon)
+			insert("https://go.dev/doc", "Go documentation", afternoon.Add(-24*time.Hour))
+
+			on := query.MustParse("after:2024-03-12 before:2024-03-13")
+			visits, count, err := store.SearchVisits(ctx, on, persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, uint(2), count)
+			require.Equal(t, "https://rust-lang.org", visits[0].Url, "in chronological order")
+			require.Equal(t, "https://go.dev/blog", visits[1].Url, "pages are found by any visit, not only the last")
+			require.True(t, afternoon.Add(10*time.Minute).Equal(visits[1].VisitTime))
+			require.Equal(t, "chrome", visits[1].ExtractorName)
+			require.Equal(t, "The Go blog", *visits[1].Title)
+
+			visits, count, err = store.SearchVisits(ctx, query.MustParse("go"), persistence.SearchOptions{Limit: 2, Offset: 1})
+			require.NoError(t, err)
+			require.Equal(t, uint(3), count, "every visit to a matching url")
+			require.Len(t, visits, 2)
+			require.Equal(t, "https://go.dev/blog", visits[0].Url)
+			require.Equal(t, "https://go.dev/blog", visits[1].Url)
+
+			visits, count, err = store.SearchVisits(ctx, query.MustParse("go -blog before:2024-03-12"), persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, uint(1), count)
+			require.Equal(t, "https://go.dev/doc", visits[0].Url)
+
+			_, count, err = store.SearchVisits(ctx, &query.Query{}, persistence.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, uint(4), count, "an empty query matches every visit")
+		})
+	}
+}
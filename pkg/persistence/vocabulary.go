@@ -0,0 +1,80 @@
+package persistence
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// Words longer than this are mostly ids and hashes, which there is no point
+// in suggesting
+const MaxVocabularyWordLength = 24
+
+// Vocabulary returns the words in each url's fragments and how often they
+// appear, for suggesting corrections to misspelled searches. Words too short to
+// have a trigram are never corrected, so they are left out.
+func Vocabulary(fragments []types.Fragment) []types.VocabularyRow {
+	counts := map[string]map[string]int{}
+	for _, f := range fragments {
+		countWords(counts, f)
+	}
+	return vocabularyRows(counts)
+}
+
+func countWords(counts map[string]map[string]int, f types.Fragment) {
+	for _, w := range query.Words(f.V) {
+		if n := utf8.RuneCountInString(w); n >= 3 && n <= MaxVocabularyWordLength {
+			if counts[f.E] == nil {
+				counts[f.E] = map[string]int{}
+			}
+			counts[f.E][w]++
+		}
+	}
+}
+
+func vocabularyRows(counts map[string]map[string]int) []types.VocabularyRow {
+	rows := []types.VocabularyRow{}
+	for e, words := range counts {
+		for w, n := range words {
+			rows = append(rows, types.VocabularyRow{UrlMd5: e, Word: w, Count: n})
+		}
+	}
+	return rows
+}
+
+// RebuildVocabulary replaces the vocabulary of store with the words of the
+// fragments in its index, e.g. once text has been removed from the index that
+// shouldn't be suggested any more. Returns the number of words.
+func RebuildVocabulary(ctx context.Context, store Store) (int, error) {
+	// @note the fragments of an EncryptedStore include the text of encrypted
+	// bodies, which is never suggested
+	if encrypted, ok := store.(*EncryptedStore); ok {
+		store = encrypted.Store
+	}
+
+	counts := map[string]map[string]int{}
+	err := store.Fragments(ctx, nil, func(f types.Fragment) error {
+		countWords(counts, f)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read the index")
+	}
+
+	err = store.DeleteVocabulary(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not delete the vocabulary")
+	}
+
+	rows := vocabularyRows(counts)
+	err = store.ReplaceVocabulary(ctx, lo.Keys(counts), rows...)
+	if err != nil {
+		return 0, errors.Wrap(err, "error adding to vocabulary")
+	}
+
+	return len(lo.Uniq(lo.Map(rows, func(r types.VocabularyRow, _ int) string { return r.Word }))), nil
+}
@@ -10,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/iansinnott/browser-gopher/pkg/config"
 	"github.com/iansinnott/browser-gopher/pkg/logging"
 	"github.com/iansinnott/browser-gopher/pkg/persistence"
 	"github.com/iansinnott/browser-gopher/pkg/types"
@@ -21,17 +20,16 @@ import (
 var inceptionTime time.Time = time.Unix(0, 0) // 1970-01-01
 
 // PopulateAll populates all records from browsers, ignoring the last updated time
-func PopulateAll(extractor types.Extractor) error {
-	return PopulateSinceTime(extractor, inceptionTime, nil)
+func PopulateAll(ctx context.Context, store persistence.Store, extractor types.Extractor) error {
+	return PopulateSinceTime(ctx, store, extractor, inceptionTime, nil)
 }
 
 type PopulateOptions struct {
 	KeepTmpFiles bool
 }
 
-func PopulateSinceTime(extractor types.Extractor, since time.Time, opts *PopulateOptions) error {
+func PopulateSinceTime(ctx context.Context, store persistence.Store, extractor types.Extractor, since time.Time, opts *PopulateOptions) error {
 	conn, err := sql.Open("sqlite", extractor.GetDBPath())
-	ctx := context.TODO()
 
 	if err != nil {
 		log.Println("could not connect to db at", extractor.GetDBPath(), err)
@@ -82,7 +80,7 @@ func PopulateSinceTime(extractor types.Extractor, since time.Time, opts *Populat
 		extractor.SetDBPath(tmpPath)
 
 		// Retry with udpated db path
-		return PopulateSinceTime(extractor, since, opts)
+		return PopulateSinceTime(ctx, store, extractor, since, opts)
 	}
 
 	urls, err := extractor.GetAllUrlsSince(ctx, conn, since)
@@ -103,14 +101,10 @@ func PopulateSinceTime(extractor types.Extractor, since time.Time, opts *Populat
 
 	log.Printf("["+extractor.GetName()+"] %s urls:%d visits:%d source:%s", sinceString, len(urls), len(visits), extractor.GetDBPath())
 
-	db, err := persistence.InitDb(ctx, config.Config)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
+	// @note tokens and other secrets are scrubbed from urls and visits by the
+	// store as they are written, see persistence.RedactedStore
 	for _, x := range urls {
-		err := persistence.InsertUrl(ctx, db, &x)
+		err := store.InsertUrl(ctx, &x)
 		if err != nil {
 			log.Println("could not insert row", err)
 		}
@@ -121,11 +115,40 @@ func PopulateSinceTime(extractor types.Extractor, since time.Time, opts *Populat
 			x.ExtractorName = extractor.GetName()
 		}
 
-		err := persistence.InsertVisit(ctx, db, &x)
+		err := store.InsertVisit(ctx, &x)
 		if err != nil {
 			log.Println("could not insert row", err)
 		}
 	}
 
+	if b, ok := extractor.(types.BookmarkExtractor); ok {
+		err := populateBookmarks(ctx, store, extractor.GetName(), b, conn)
+		if err != nil {
+			log.Println("["+extractor.GetName()+"] could not import bookmarks", err)
+		}
+	}
+
 	return nil
 }
+
+// Import every bookmark of the browser, whatever since was, replacing those
+// imported before so that removed bookmarks are forgotten. Bookmarked pages
+// that were never visited are added too, so that they can be searched for.
+func populateBookmarks(ctx context.Context, store persistence.Store, name string, extractor types.BookmarkExtractor, conn *sql.DB) error {
+	bookmarks, err := extractor.GetBookmarks(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("["+name+"] bookmarks:%d", len(bookmarks))
+
+	for _, x := range bookmarks {
+		// @note the title of a page that was visited wins over the name of its bookmark
+		err := store.InsertUrl(ctx, &types.UrlRow{Url: x.Url, Title: x.Title})
+		if err != nil {
+			log.Println("could not insert row", err)
+		}
+	}
+
+	return store.ReplaceBookmarks(ctx, name, bookmarks...)
+}
@@ -2,27 +2,33 @@ package populate
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/iansinnott/browser-gopher/pkg/chunk"
 	"github.com/iansinnott/browser-gopher/pkg/persistence"
 	"github.com/iansinnott/browser-gopher/pkg/types"
-	"github.com/iansinnott/browser-gopher/pkg/util"
 	"github.com/pkg/errors"
-	stripmd "github.com/writeas/go-strip-markdown"
+	"github.com/samber/lo"
 )
 
 // how many urls to index at a time
 const batchSize = 1000
 
-func BuildIndex(ctx context.Context, db *sql.DB, limit int) (int, error) {
+func BuildIndex(ctx context.Context, store persistence.Store, limit int) (int, error) {
+	n, _, err := buildIndex(ctx, store, limit, nil)
+	return n, err
+}
+
+// Index unindexed urls, calling indexed with each batch if it isn't nil.
+// Returns the number of urls indexed and of stale fragments removed.
+func buildIndex(ctx context.Context, store persistence.Store, limit int, indexed func(ents []types.UrlDbEntity)) (int, int, error) {
 	indexedCount := 0
-	toIndexCount, err := persistence.CountUrlsWhere(ctx, db, "indexed_at IS NULL")
+	staleCount := 0
+	toIndexCount, err := store.CountUnindexed(ctx)
 	if err != nil {
-		return 0, errors.Wrap(err, "error getting count of urls to index")
+		return 0, 0, errors.Wrap(err, "error getting count of urls to index")
 	}
 
 	if limit > 0 && limit < toIndexCount {
@@ -31,15 +37,15 @@ func BuildIndex(ctx context.Context, db *sql.DB, limit int) (int, error) {
 
 	for indexedCount < toIndexCount {
 		// get documents to index
-		ents, err := getUnindexed(ctx, db)
+		ents, err := getUnindexed(ctx, store)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 
 		// index them
-		n, err := batchIndex(ctx, db, ents...)
+		n, stale, err := batchIndex(ctx, store, ents...)
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 
 		// Break out if indexedCount is not increasing
@@ -47,18 +53,23 @@ func BuildIndex(ctx context.Context, db *sql.DB, limit int) (int, error) {
 			break
 		}
 
+		if indexed != nil {
+			indexed(ents)
+		}
+
 		fmt.Printf("indexing: (%d/%d) %.2f\n", indexedCount, toIndexCount, float32(indexedCount)/float32(toIndexCount))
 
 		indexedCount += n
+		staleCount += stale
 	}
 
-	return indexedCount, err
+	return indexedCount, staleCount, err
 }
 
 // Index (or reindex) an individual document. If doc.Id is already present in
 // the search index it will be overwritten.
-func IndexDocument(ctx context.Context, db *sql.DB, doc types.UrlDbEntity) error {
-	_, err := batchIndex(ctx, db, doc)
+func IndexDocument(ctx context.Context, store persistence.Store, doc types.UrlDbEntity) error {
+	_, _, err := batchIndex(ctx, store, doc)
 	if err != nil {
 		return errors.Wrap(err, "error indexing document")
 	}
@@ -69,7 +80,7 @@ func IndexDocument(ctx context.Context, db *sql.DB, doc types.UrlDbEntity) error
 		IndexedAt: &t,
 	}
 
-	err = persistence.InsertUrlMeta(ctx, db, meta)
+	err = store.InsertUrlMeta(ctx, meta)
 	if err != nil {
 		return err
 	}
@@ -77,55 +88,11 @@ func IndexDocument(ctx context.Context, db *sql.DB, doc types.UrlDbEntity) error
 	return nil
 }
 
-// The reason we need an int ID is due to the int requirement on rowid in the fts table.
-func generateEavId(e string, t string, a string, v string) (int64, error) {
-	shasum := util.HashSha1String(fmt.Sprintf("%s%s%s%s", e, t, a, v))
-
-	// take the first 15 characters of the sha1 hash, as this is the max that will
-	// fit into sqlite int column (it's signed, i think. otherwise we could take
-	// 16 chars)
-	hexId := shasum[0:15]
-
-	// convert to a base 10 number
-	return strconv.ParseInt(hexId, 16, 64)
-}
-
-/**
- * Index an entity
- */
-func indexEav(ctx context.Context, db *sql.Tx, e string, t string, a string, v string) error {
-	// insert into the fragments table
-	const qry = `
-		INSERT OR REPLACE INTO
-			fragment(id, e, t, a, v)
-				VALUES(?, ?, ?, ?, ?);
-	`
-
-	id, err := generateEavId(e, t, a, v)
-	if err != nil {
-		return errors.Wrap(err, "error generating eav id")
-	}
-
-	_, err = db.ExecContext(ctx, qry, id, e, t, a, v)
-	if err != nil {
-		return errors.Wrap(err, "error inserting fragment")
-	}
-
-	return nil
-}
-
-func batchIndex(ctx context.Context, db *sql.DB, ents ...types.UrlDbEntity) (int, error) {
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return 0, err
-	}
-
-	cleanupWithError := func(err error) error {
-		tx.Rollback()
-		return err
-	}
+// Index ents, replacing whatever was indexed for them before. Returns the
+// number indexed and of stale fragments removed.
+func batchIndex(ctx context.Context, store persistence.Store, ents ...types.UrlDbEntity) (int, int, error) {
+	fragments := []types.Fragment{}
 
-	// @todo Could be much more efficient by not committing transaction for each row
 	for _, ent := range ents {
 
 		// vs is an array of structs containing `a` and `v` fields
@@ -138,49 +105,42 @@ func batchIndex(ctx context.Context, db *sql.DB, ents ...types.UrlDbEntity) (int
 		for _, x := range vs {
 			table := "urls"
 			if x.v != nil {
-				err := indexEav(ctx, tx, ent.UrlMd5, table, x.a, *x.v)
-				if err != nil {
-					return 0, cleanupWithError(err)
-				}
+				fragments = append(fragments, types.Fragment{E: ent.UrlMd5, T: table, A: x.a, V: *x.v})
 			}
 		}
 
-		// Insert fulltext data
+		// Insert fulltext data, chunked along the headings of the markdown so
+		// that matches can be shown with the section they are in
 		if ent.Body != nil {
 			table := "documents"
-			chunk := ""
-			// Chunk documents by paragraphs, for now
-			for _, paragraph := range strings.Split(*ent.Body, "\n\n") {
-				chunk += strings.TrimSpace(paragraph)
-				if len(chunk) < 180 {
-					chunk += " "
-					continue
-				}
-
-				err := indexEav(ctx, tx, ent.UrlMd5, table, "content", chunk)
-				if err != nil {
-					return 0, cleanupWithError(err)
-				}
-
-				chunk = ""
-			}
-
-			// Grab straggling chunk. i.e. if the whole document is less than the threshold.
-			if len(chunk) > 0 {
-				err := indexEav(ctx, tx, ent.UrlMd5, table, "content", chunk)
-				if err != nil {
-					return 0, cleanupWithError(err)
-				}
+			for _, c := range chunk.Markdown(*ent.Body) {
+				fragments = append(fragments, types.Fragment{E: ent.UrlMd5, T: table, A: "content", V: c.Text, Section: c.SectionPath()})
 			}
 		}
 	}
 
-	err = tx.Commit()
+	ids := make([]string, len(ents))
+	for i, ent := range ents {
+		ids[i] = ent.UrlMd5
+	}
+	stale, err := store.ReplaceFragments(ctx, ids, fragments...)
 	if err != nil {
-		return 0, err
+		return 0, 0, errors.Wrap(err, "error replacing fragments")
 	}
 
-	// var err error
+	err = store.ReplaceVocabulary(ctx, ids, persistence.Vocabulary(fragments)...)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error adding to vocabulary")
+	}
+
+	vectors := make([]types.TermVector, len(ents))
+	for i, ent := range ents {
+		vectors[i] = termVector(ent)
+	}
+	err = store.InsertTermVectors(ctx, vectors...)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error adding term vectors")
+	}
 
 	metas := []types.UrlMetaRow{}
 
@@ -193,101 +153,100 @@ func batchIndex(ctx context.Context, db *sql.DB, ents ...types.UrlDbEntity) (int
 		})
 	}
 
-	err = persistence.InsertUrlMeta(ctx, db, metas...)
-
+	// @note only marking them is retried, everything above replaces what was
+	// indexed for ents so it's already done
+	err = store.InsertUrlMeta(ctx, metas...)
+	for err != nil && strings.Contains(err.Error(), "database is locked") {
+		fmt.Println("database is locked, retrying...")
+		time.Sleep(1000 * time.Millisecond)
+		err = store.InsertUrlMeta(ctx, metas...)
+	}
 	if err != nil {
-		// check if SQLITE_BUSY error
-		if strings.Contains(err.Error(), "database is locked") {
-			fmt.Println("database is locked, retrying...")
-			time.Sleep(1000 * time.Millisecond)
-			return batchIndex(ctx, db, ents...)
-		}
-
-		return 0, errors.Wrap(err, "error marking doc as indexed")
+		return 0, 0, errors.Wrap(err, "error marking doc as indexed")
 	}
 
-	return len(ents), nil
+	return len(ents), stale, nil
 }
 
-func getUnindexed(ctx context.Context, db *sql.DB) ([]types.UrlDbEntity, error) {
-	const qry = `
-		SELECT
-			u.url_md5,
-			u.url,
-			u.title,
-			u.description,
-			u.last_visit,
-			doc.document_md5,
-			doc.body
-		FROM
-			urls u
-			LEFT OUTER JOIN urls_meta um ON u.url_md5 = um.url_md5
-			LEFT OUTER JOIN url_document_edges ON u.url_md5 = url_document_edges.url_md5
-			LEFT OUTER JOIN documents doc ON url_document_edges.document_md5 = doc.document_md5
-		WHERE
-			um.indexed_at IS NULL
-		ORDER BY 
-			last_visit DESC
-		LIMIT ?;
-	`
-
-	rows, err := db.QueryContext(ctx, qry, batchSize)
+func getUnindexed(ctx context.Context, store persistence.Store) ([]types.UrlDbEntity, error) {
+	// Put docs into a slice so that we can iterate over them to mark them as
+	// indexed. Otherwies we could add them to the batch directly.
+	// @note bodies are left as markdown, batchIndex chunks them along their
+	// headings
+	return store.Unindexed(ctx, batchSize)
+}
+
+func ReindexWithLimit(ctx context.Context, store persistence.Store, limit int) (int, error) {
+	err := store.ResetIndexed(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "error querying unindexed urls")
+		return 0, errors.Wrap(err, "error removing indexed status")
 	}
-	defer rows.Close()
 
-	// Put docs into a slice so that we can iterate over them to mark them as
-	// indexed. Otherwies we could add them to the batch directly.
-	var docs []types.UrlDbEntity
+	return BuildIndex(ctx, store, limit)
+}
 
-	for rows.Next() {
-		var ent types.UrlDbEntity
-		var ts int64
-		err := rows.Scan(&ent.UrlMd5, &ent.Url, &ent.Title, &ent.Description, &ts, &ent.BodyMd5, &ent.Body)
-		if err != nil {
-			return nil, errors.Wrap(err, "error scanning row")
-		}
+// Reindex every url and document, as if nothing had been indexed, and remove
+// whatever is stale: fragments of text a page no longer has, and the
+// fragments, term vectors and words of urls that no longer exist. The index is
+// rewritten in place a batch of urls at a time, each batch at once, so
+// searches keep working meanwhile. Returns the number of urls indexed and of
+// stale fragments removed.
+func RebuildIndex(ctx context.Context, store persistence.Store) (int, int, error) {
+	err := store.ResetIndexed(ctx)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error removing indexed status")
+	}
 
-		// @note last visit time can be zero, indicating unknown visit time. This
-		// will happen if importing from browserparrot/persistory because the visits
-		// table had a bug
-		if ts > 0 {
-			t := time.Unix(ts, 0)
-			ent.LastVisit = &t
+	seen := map[string]bool{}
+	n, stale, err := buildIndex(ctx, store, 0, func(ents []types.UrlDbEntity) {
+		for _, ent := range ents {
+			seen[ent.UrlMd5] = true
 		}
+	})
+	if err != nil {
+		return n, stale, err
+	}
 
-		if ent.Body != nil {
-			plaintext := stripmd.Strip(*ent.Body)
-			ent.Body = &plaintext
+	// @note collected first, the store can't be written while it is being read
+	orphans := map[string]bool{}
+	err = store.Fragments(ctx, nil, func(f types.Fragment) error {
+		if !seen[f.E] {
+			orphans[f.E] = true
 		}
-
-		docs = append(docs, ent)
+		return nil
+	})
+	if err != nil {
+		return n, stale, errors.Wrap(err, "error finding orphaned fragments")
 	}
+	orphaned, err := store.DeleteEntityFragments(ctx, lo.Keys(orphans)...)
+	if err != nil {
+		return n, stale, errors.Wrap(err, "error deleting orphaned fragments")
+	}
+	stale += orphaned
 
-	return docs, nil
-}
+	_, err = store.DeleteTermVectors(ctx, lo.Keys(orphans)...)
+	if err != nil {
+		return n, stale, errors.Wrap(err, "error deleting orphaned term vectors")
+	}
 
-func ReindexWithLimit(ctx context.Context, db *sql.DB, limit int) (int, error) {
-	var err error
-	qry := `
-		UPDATE
-			urls_meta
-		SET
-			indexed_at = NULL
-		WHERE
-			indexed_at NOT NULL;
-	`
-	_, err = db.ExecContext(ctx, qry)
+	// @note also drops words counted by older versions, which added to the
+	// vocabulary every time a url was indexed
+	_, err = persistence.RebuildVocabulary(ctx, store)
 	if err != nil {
-		return 0, errors.Wrap(err, "error removing indexed status")
+		return n, stale, errors.Wrap(err, "error rebuilding vocabulary")
 	}
 
-	return BuildIndex(ctx, db, limit)
+	// Compact the full-text indexes after all that was deleted
+	err = store.RebuildSearchIndex(ctx)
+	if err != nil {
+		return n, stale, errors.Wrap(err, "error rebuilding search index")
+	}
+	return n, stale, nil
 }
 
-// Reindex documents that have already been indexed. This does not remove
-// anything from the index, but will overwrite documents that have been updated.
-func ReindexAll(ctx context.Context, db *sql.DB) (int, error) {
-	return ReindexWithLimit(ctx, db, 0)
+// Reindex documents that have already been indexed. What a document no longer
+// contains is removed from the index along the way, but fragments of urls that
+// no longer exist are left, see RebuildIndex.
+func ReindexAll(ctx context.Context, store persistence.Store) (int, error) {
+	return ReindexWithLimit(ctx, store, 0)
 }
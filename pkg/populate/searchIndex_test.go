@@ -0,0 +1,181 @@
+package populate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildIndex(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+
+	title := "Effective Go"
+	err := store.InsertUrl(ctx, &types.UrlRow{Url: "https://go.dev/doc/effective_go", Title: &title})
+	require.NoError(t, err)
+
+	n, err := populate.BuildIndex(ctx, store, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	results, count, err := store.SearchUrls(ctx, query.MustParse("effective"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), count)
+	require.Equal(t, "https://go.dev/doc/effective_go", results[0].Url)
+
+	words, err := store.SimilarWords(ctx, "efective", 10)
+	require.NoError(t, err)
+	require.Equal(t, "effective", words[0].Word, "indexed words are added to the vocabulary")
+
+	// Nothing left to do
+	n, err = populate.BuildIndex(ctx, store, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestBuildIndexTermVectors(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+
+	titles := map[string]string{
+		"https://go.dev/doc/effective_go":     "Effective Go, writing clear idiomatic Go code",
+		"https://go.dev/blog/go-code-reviews": "Go code review comments",
+		"https://example.com/sourdough":       "How to bake sourdough bread",
+	}
+	for url, title := range titles {
+		title := title
+		err := store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title})
+		require.NoError(t, err)
+	}
+
+	_, err := populate.BuildIndex(ctx, store, 0)
+	require.NoError(t, err)
+
+	related, err := store.RelatedUrls(ctx, util.HashMd5String("https://go.dev/doc/effective_go"), 10)
+	require.NoError(t, err)
+	require.Len(t, related, 1, "pages with nothing in common are not related")
+	require.Equal(t, "https://go.dev/blog/go-code-reviews", related[0].Url)
+}
+
+func TestRebuildIndexDropsStaleFragments(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+
+	url := "https://go.dev/doc/style"
+	title := "Effective Go"
+	err := store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title})
+	require.NoError(t, err)
+	_, err = populate.BuildIndex(ctx, store, 0)
+	require.NoError(t, err)
+
+	// The page was renamed since it was indexed, and a url it linked to is gone
+	renamed := "Writing idiomatic Go"
+	later := time.Now()
+	err = store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &renamed, LastVisit: &later})
+	require.NoError(t, err)
+	gone := types.Fragment{E: util.HashMd5String("https://go.dev/gone"), T: "urls", A: "title", V: "Effective vanished"}
+	err = store.InsertFragments(ctx, gone)
+	require.NoError(t, err)
+	err = store.ReplaceVocabulary(ctx, []string{gone.E}, persistence.Vocabulary([]types.Fragment{gone})...)
+	require.NoError(t, err)
+	err = store.InsertTermVectors(ctx, types.TermVector{UrlMd5: gone.E, Terms: map[string]float64{"vanished": 1}})
+	require.NoError(t, err)
+
+	n, err := populate.ReindexAll(ctx, store)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	search := func(q string) []types.UrlDbSearchEntity {
+		results, _, err := store.SearchUrls(ctx, query.MustParse(q), persistence.SearchOptions{})
+		require.NoError(t, err)
+		return results
+	}
+	require.Len(t, search("idiomatic"), 1)
+	require.Empty(t, search("effective"), "the old title is no longer indexed")
+
+	n, stale, err := populate.RebuildIndex(ctx, store)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, 1, stale, "fragments of urls that no longer exist are dropped")
+	require.Len(t, search("idiomatic"), 1)
+
+	words, err := store.SimilarWords(ctx, "vanished", 10)
+	require.NoError(t, err)
+	require.Empty(t, words, "so are their words")
+	vectors, err := store.DeleteTermVectors(ctx, gone.E)
+	require.NoError(t, err)
+	require.Equal(t, 0, vectors, "and term vectors")
+}
+
+func TestReindexVocabulary(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+
+	url := "https://go.dev/doc/tutorial"
+	title := "Generics tutorial, generics"
+	err := store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title})
+	require.NoError(t, err)
+	_, err = populate.BuildIndex(ctx, store, 0)
+	require.NoError(t, err)
+
+	count := func(word string) int {
+		words, err := store.SimilarWords(ctx, word, 10)
+		require.NoError(t, err)
+		for _, w := range words {
+			if w.Word == word {
+				return w.Count
+			}
+		}
+		return 0
+	}
+	require.Equal(t, 2, count("generics"))
+
+	_, err = populate.ReindexAll(ctx, store)
+	require.NoError(t, err)
+	_, _, err = populate.RebuildIndex(ctx, store)
+	require.NoError(t, err)
+	require.Equal(t, 2, count("generics"), "reindexing doesn't count words again")
+
+	renamed := "Type parameters"
+	later := time.Now()
+	err = store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &renamed, LastVisit: &later})
+	require.NoError(t, err)
+	_, err = populate.ReindexAll(ctx, store)
+	require.NoError(t, err)
+	require.Equal(t, 0, count("generics"), "words of the old title are forgotten")
+	require.Equal(t, 1, count("parameters"))
+}
+
+func TestBuildIndexSections(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+
+	url := "https://gophers.example/docs"
+	body := "# Installation\n\n## Linux\n\nInstall it with `apt install gopher`.\n\n## macOS\n\nUse brew."
+	err := store.InsertUrl(ctx, &types.UrlRow{Url: url})
+	require.NoError(t, err)
+	err = store.InsertDocument(ctx, &types.DocumentRow{
+		DocumentMd5: util.HashMd5String(body),
+		UrlMd5:      util.HashMd5String(url),
+		StatusCode:  200,
+		Body:        &body,
+	})
+	require.NoError(t, err)
+
+	_, err = populate.BuildIndex(ctx, store, 0)
+	require.NoError(t, err)
+
+	results, _, err := store.SearchUrls(ctx, query.MustParse("apt"), persistence.SearchOptions{})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Len(t, results[0].Snippets, 1)
+	require.Equal(t, "Installation > Linux", results[0].Snippets[0].Section)
+	require.Equal(t, "Linux\nInstall it with apt install gopher.", results[0].Snippets[0].Text, "markdown is removed")
+}
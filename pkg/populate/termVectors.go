@@ -0,0 +1,104 @@
+package populate
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	stripmd "github.com/writeas/go-strip-markdown"
+)
+
+// How many terms are kept for each url. The rest of a long page adds little
+// to what it is about, and a lot to the size of the database.
+const maxTerms = 64
+
+// A word in the title says more about a page than one in its body
+const titleWeight = 3
+
+// Common english words, which say nothing about what a page is about
+var stopwords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`
+		about above after again against all also and any are because been before
+		being below between both but can could did does doing down during each
+		few for from further had has have having her here hers herself him
+		himself his how into its itself just more most not now off once only
+		other our ours ourselves out over own same she should some such than
+		that the their theirs them themselves then there these they this those
+		through too under until very was were what when where which while who
+		whom why will with would you your yours yourself yourselves
+		http https www com org net html
+	`) {
+		stopwords[w] = true
+	}
+}
+
+// The form of a word that its plural shares, so that e.g. "gopher" and
+// "gophers" are the same term. Deliberately naive.
+func stem(w string) string {
+	switch {
+	case len(w) > 4 && strings.HasSuffix(w, "ies"):
+		return w[:len(w)-3] + "y"
+	case len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") && !strings.HasSuffix(w, "us") && !strings.HasSuffix(w, "is"):
+		return w[:len(w)-1]
+	}
+	return w
+}
+
+// What a url is about, from its title, description and markdown full-text, for
+// finding related urls. Each term's weight is 1 + ln of how often it appears,
+// and the weights have a length of 1 so that long pages don't outweigh short
+// ones.
+func termVector(ent types.UrlDbEntity) types.TermVector {
+	counts := map[string]float64{}
+	add := func(s *string, weight float64) {
+		if s == nil {
+			return
+		}
+		for _, w := range query.Words(*s) {
+			if n := utf8.RuneCountInString(w); n < 3 || n > persistence.MaxVocabularyWordLength || stopwords[w] {
+				continue
+			}
+			counts[stem(w)] += weight
+		}
+	}
+	add(ent.Title, titleWeight)
+	add(ent.Description, 1)
+	if ent.Body != nil {
+		plaintext := stripmd.Strip(*ent.Body)
+		add(&plaintext, 1)
+	}
+
+	terms := make([]string, 0, len(counts))
+	for t := range counts {
+		terms = append(terms, t)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if counts[terms[i]] != counts[terms[j]] {
+			return counts[terms[i]] > counts[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > maxTerms {
+		terms = terms[:maxTerms]
+	}
+
+	weights := make(map[string]float64, len(terms))
+	var norm float64
+	for _, t := range terms {
+		w := 1 + math.Log(counts[t])
+		weights[t] = w
+		norm += w * w
+	}
+	norm = math.Sqrt(norm)
+	for t := range weights {
+		weights[t] /= norm
+	}
+
+	return types.TermVector{UrlMd5: ent.UrlMd5, Terms: weights}
+}
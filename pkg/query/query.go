@@ -0,0 +1,530 @@
+// Package query parses the search syntax shared by the CLI, the TUI and
+// anything else that searches history, e.g.
+//
+//	golang site:github.com -gitlab "error handling" after:2022-01-01
+//
+// Words and "quoted phrases" are searched for in urls, titles and full-text.
+// Every one of them must match, and a leading - excludes pages that contain
+// it. Filters take the form field:value:
+//
+//	site:github.com    the page is on github.com or one of its subdomains
+//	title:gopher       the title contains gopher
+//	url:issues         the url contains issues
+//	browser:firefox    the page was visited in firefox
+//	after:2022-01-01   visited on or after the first of January
+//	before:2022-02-01  visited before the first of February
+//	has:fulltext       the full-text of the page has been scraped
+//	is:bookmarked      the page is bookmarked in a browser
+//
+// Filters can also be negated with -, except after: and before:. Repeating
+// site: or browser: matches any of the given sites or browsers.
+//
+// Parse only checks the syntax, each persistence.Store compiles the result to
+// whatever it searches with.
+package query
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A word or phrase to search for
+type Term struct {
+	Value string
+	// Quoted in the query
+	Phrase  bool
+	Negated bool
+}
+
+func (t Term) String() string {
+	if t.Negated {
+		return "-" + t.quoted()
+	}
+	return t.quoted()
+}
+
+func (t Term) quoted() string {
+	if t.Phrase || t.Value == "" || strings.IndexFunc(t.Value, unicode.IsSpace) != -1 {
+		return `"` + t.Value + `"`
+	}
+	return t.Value
+}
+
+type Query struct {
+	// Searched for in urls, titles, descriptions and full-text
+	Text []Term
+
+	Title    []Term
+	Url      []Term
+	Sites    []Term
+	Browsers []Term
+
+	// Visited on or after After and before Before
+	After  *time.Time
+	Before *time.Time
+
+	// Nil when has:fulltext was not given
+	HasFulltext *bool
+	// Nil when is:bookmarked was not given
+	Bookmarked *bool
+}
+
+// ParseError is returned by Parse for queries that are not valid
+type ParseError struct {
+	// Position in the query, in bytes
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("query parse error at character %d: %s", e.Pos+1, e.Msg)
+}
+
+// Parse a query as typed by the user. See the package docs for the syntax.
+func Parse(s string) (*Query, error) {
+	p := &parser{s: s}
+	q := &Query{}
+
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			break
+		}
+
+		err := p.parseTerm(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
+}
+
+// MustParse is like Parse but panics if the query is not valid. For queries
+// that are known to be valid, such as in tests.
+func MustParse(s string) *Query {
+	q, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) && isSpace(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+func isSpace(b byte) bool {
+	return unicode.IsSpace(rune(b))
+}
+
+func (p *parser) errorf(pos int, format string, args ...interface{}) error {
+	return &ParseError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Read a word, up to the next space, or a quoted phrase
+func (p *parser) readValue() (value string, phrase bool, err error) {
+	start := p.pos
+
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		end := strings.IndexByte(p.s[p.pos+1:], '"')
+		if end == -1 {
+			return "", false, p.errorf(start, "missing closing quote")
+		}
+
+		value = p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		if p.pos < len(p.s) && !isSpace(p.s[p.pos]) {
+			return "", false, p.errorf(p.pos, "expected a space after the closing quote")
+		}
+
+		return value, true, nil
+	}
+
+	for p.pos < len(p.s) && !isSpace(p.s[p.pos]) {
+		p.pos++
+	}
+
+	return p.s[start:p.pos], false, nil
+}
+
+func (p *parser) parseTerm(q *Query) error {
+	start := p.pos
+
+	negated := false
+	if p.s[p.pos] == '-' {
+		negated = true
+		p.pos++
+		if p.pos >= len(p.s) || isSpace(p.s[p.pos]) {
+			return p.errorf(start, "expected a word or phrase after -")
+		}
+	}
+
+	field, ok := p.readField()
+	if !ok {
+		value, phrase, err := p.readValue()
+		if err != nil {
+			return err
+		}
+		if phrase && strings.TrimSpace(value) == "" {
+			return p.errorf(start, "empty phrase")
+		}
+
+		q.Text = append(q.Text, Term{Value: value, Phrase: phrase, Negated: negated})
+		return nil
+	}
+
+	valueStart := p.pos
+	value, phrase, err := p.readValue()
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(value) == "" {
+		return p.errorf(valueStart, "%s: needs a value", field)
+	}
+
+	term := Term{Value: value, Phrase: phrase, Negated: negated}
+
+	switch field {
+	case "title":
+		q.Title = append(q.Title, term)
+	case "url":
+		q.Url = append(q.Url, term)
+	case "site":
+		// @note also accepts a url, e.g. pasted from the browser
+		if strings.Contains(value, "://") {
+			value = Host(value)
+		}
+		value = strings.SplitN(strings.ToLower(value), "/", 2)[0]
+		term.Value = strings.TrimPrefix(value, "www.")
+		if term.Value == "" {
+			return p.errorf(valueStart, "site: needs a domain, like github.com")
+		}
+		q.Sites = append(q.Sites, term)
+	case "browser":
+		term.Value = strings.ToLower(term.Value)
+		q.Browsers = append(q.Browsers, term)
+	case "after", "before":
+		if negated {
+			other := map[string]string{"after": "before", "before": "after"}[field]
+			return p.errorf(start, "-%s: is not supported, use %s: instead", field, other)
+		}
+
+		t, err := ParseDate(value)
+		if err != nil {
+			return p.errorf(valueStart, "%s: %s", field, err)
+		}
+
+		if field == "after" {
+			q.After = &t
+		} else {
+			q.Before = &t
+		}
+	case "has":
+		if strings.ToLower(value) != "fulltext" {
+			return p.errorf(valueStart, "unknown has: value %q, expected has:fulltext", value)
+		}
+
+		has := !negated
+		q.HasFulltext = &has
+	case "is":
+		if strings.ToLower(value) != "bookmarked" {
+			return p.errorf(valueStart, "unknown is: value %q, expected is:bookmarked", value)
+		}
+
+		bookmarked := !negated
+		q.Bookmarked = &bookmarked
+	}
+
+	return nil
+}
+
+var fields = []string{"title", "url", "site", "browser", "after", "before", "has", "is"}
+
+// Read a known field name and its colon, if there is one at the current
+// position. Anything else with a colon, like https://, is left to be read as a
+// word.
+func (p *parser) readField() (string, bool) {
+	rest := p.s[p.pos:]
+	for _, f := range fields {
+		if len(rest) > len(f) && strings.EqualFold(rest[:len(f)], f) && rest[len(f)] == ':' {
+			p.pos += len(f) + 1
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// ParseDate reads a date as written in after: and before:, either YYYY-MM-DD,
+// which is midnight in local time, or RFC 3339
+func ParseDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a date like 2022-01-31, got %q", s)
+	}
+	return t, nil
+}
+
+// IsEmpty reports whether there is nothing to search for
+func (q *Query) IsEmpty() bool {
+	return len(q.Text) == 0 && len(q.Title) == 0 && len(q.Url) == 0 &&
+		len(q.Sites) == 0 && len(q.Browsers) == 0 &&
+		q.After == nil && q.Before == nil && q.HasFulltext == nil && q.Bookmarked == nil
+}
+
+// Positive returns the terms in ts that are not negated
+func Positive(ts []Term) []Term {
+	return split(ts, false)
+}
+
+// Negated returns the terms in ts that are negated
+func Negated(ts []Term) []Term {
+	return split(ts, true)
+}
+
+func split(ts []Term, negated bool) []Term {
+	var xs []Term
+	for _, t := range ts {
+		if t.Negated == negated {
+			xs = append(xs, t)
+		}
+	}
+	return xs
+}
+
+// String formats the query in the syntax Parse reads. Parsing the result gives
+// back an equal query.
+func (q *Query) String() string {
+	var parts []string
+
+	for _, t := range q.Text {
+		parts = append(parts, t.String())
+	}
+
+	fieldTerms := []struct {
+		name  string
+		terms []Term
+	}{{"title", q.Title}, {"url", q.Url}, {"site", q.Sites}, {"browser", q.Browsers}}
+
+	for _, f := range fieldTerms {
+		for _, t := range f.terms {
+			s := f.name + ":" + t.quoted()
+			if t.Negated {
+				s = "-" + s
+			}
+			parts = append(parts, s)
+		}
+	}
+
+	if q.After != nil {
+		parts = append(parts, "after:"+formatDate(*q.After))
+	}
+	if q.Before != nil {
+		parts = append(parts, "before:"+formatDate(*q.Before))
+	}
+	if q.HasFulltext != nil {
+		if *q.HasFulltext {
+			parts = append(parts, "has:fulltext")
+		} else {
+			parts = append(parts, "-has:fulltext")
+		}
+	}
+	if q.Bookmarked != nil {
+		if *q.Bookmarked {
+			parts = append(parts, "is:bookmarked")
+		} else {
+			parts = append(parts, "-is:bookmarked")
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func formatDate(t time.Time) string {
+	local := t.In(time.Local)
+	if local.Hour() == 0 && local.Minute() == 0 && local.Second() == 0 && local.Nanosecond() == 0 {
+		return local.Format("2006-01-02")
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Host returns the lowercased host name of rawUrl, without any port. Empty if
+// rawUrl can't be parsed.
+func Host(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// MatchesSite reports whether host is site or one of its subdomains
+func MatchesSite(host string, site string) bool {
+	return host == site || strings.HasSuffix(host, "."+site)
+}
+
+// Page is what a query is matched against by stores that search in Go rather
+// than SQL
+type Page struct {
+	Url         string
+	Title       string
+	HasFulltext bool
+	Bookmarked  bool
+	Visits      []Visit
+	// Url, title, description and full-text, each of which is matched separately
+	Text []string
+}
+
+type Visit struct {
+	Time    time.Time
+	Browser string
+}
+
+// Matches reports whether p satisfies every part of q. As with the search
+// index, the positive text terms must all appear in the same piece of text.
+func (q *Query) Matches(p Page) bool {
+	if !q.MatchesFilters(p) {
+		return false
+	}
+
+	positive := Positive(q.Text)
+	if len(positive) == 0 {
+		return true
+	}
+
+	for _, text := range p.Text {
+		if ContainsAll(text, positive) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchesFilters is like Matches but ignores the positive text terms of q
+func (q *Query) MatchesFilters(p Page) bool {
+	for _, text := range p.Text {
+		if ContainsAny(text, Negated(q.Text)) {
+			return false
+		}
+	}
+
+	if !matchesTerms(p.Title, q.Title) || !matchesTerms(p.Url, q.Url) {
+		return false
+	}
+
+	host := Host(p.Url)
+	if !matchesAny(q.Sites, func(site string) bool { return MatchesSite(host, site) }) {
+		return false
+	}
+	for _, t := range Negated(q.Sites) {
+		if MatchesSite(host, t.Value) {
+			return false
+		}
+	}
+
+	if q.HasFulltext != nil && *q.HasFulltext != p.HasFulltext {
+		return false
+	}
+	if q.Bookmarked != nil && *q.Bookmarked != p.Bookmarked {
+		return false
+	}
+
+	for _, b := range Negated(q.Browsers) {
+		for _, v := range p.Visits {
+			if strings.EqualFold(v.Browser, b.Value) {
+				return false
+			}
+		}
+	}
+
+	if len(Positive(q.Browsers)) == 0 && q.After == nil && q.Before == nil {
+		return true
+	}
+
+	// @note browser and dates have to match the same visit
+	for _, v := range p.Visits {
+		if q.MatchesVisit(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchesVisit reports whether v satisfies the positive browser: filters and
+// the dates of q
+func (q *Query) MatchesVisit(v Visit) bool {
+	if q.After != nil && v.Time.Before(*q.After) {
+		return false
+	}
+	if q.Before != nil && !v.Time.Before(*q.Before) {
+		return false
+	}
+	return matchesAny(q.Browsers, func(b string) bool { return strings.EqualFold(v.Browser, b) })
+}
+
+// Whether s satisfies every term, positive or negated, as a case-insensitive substring
+func matchesTerms(s string, ts []Term) bool {
+	return ContainsAll(s, Positive(ts)) && !ContainsAny(s, Negated(ts))
+}
+
+// Whether any of the positive terms satisfies fn. True if there are none.
+func matchesAny(ts []Term, fn func(string) bool) bool {
+	positive := Positive(ts)
+	if len(positive) == 0 {
+		return true
+	}
+
+	for _, t := range positive {
+		if fn(t.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContainsAll reports whether s contains every term, ignoring case
+func ContainsAll(s string, ts []Term) bool {
+	s = strings.ToLower(s)
+	for _, t := range ts {
+		if !strings.Contains(s, strings.ToLower(t.Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// ContainsAny reports whether s contains any of the terms, ignoring case
+func ContainsAny(s string, ts []Term) bool {
+	s = strings.ToLower(s)
+	for _, t := range ts {
+		if strings.Contains(s, strings.ToLower(t.Value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Words splits s into lowercased runs of letters, e.g. for building a
+// vocabulary of indexed words
+func Words(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+}
@@ -0,0 +1,88 @@
+package query_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	q, err := query.Parse(`golang "error handling" -gitlab site:www.GitHub.com/golang -site:gist.github.com title:"go blog" url:issues browser:Firefox after:2022-01-01 before:2022-02-01 -has:fulltext is:bookmarked https://go.dev`)
+	require.NoError(t, err)
+
+	require.Equal(t, []query.Term{
+		{Value: "golang"},
+		{Value: "error handling", Phrase: true},
+		{Value: "gitlab", Negated: true},
+		{Value: "https://go.dev"},
+	}, q.Text)
+	require.Equal(t, []query.Term{{Value: "github.com"}, {Value: "gist.github.com", Negated: true}}, q.Sites)
+	require.Equal(t, []query.Term{{Value: "go blog", Phrase: true}}, q.Title)
+	require.Equal(t, []query.Term{{Value: "issues"}}, q.Url)
+	require.Equal(t, []query.Term{{Value: "firefox"}}, q.Browsers)
+	require.Equal(t, time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local), *q.After)
+	require.Equal(t, time.Date(2022, 2, 1, 0, 0, 0, 0, time.Local), *q.Before)
+	require.False(t, *q.HasFulltext)
+	require.True(t, *q.Bookmarked)
+
+	again, err := query.Parse(q.String())
+	require.NoError(t, err)
+	require.Equal(t, q, again)
+
+	empty, err := query.Parse("   ")
+	require.NoError(t, err)
+	require.True(t, empty.IsEmpty())
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]int{
+		`golang "error handling`: 7,
+		`site:`:                  5,
+		`-`:                      0,
+		`after:yesterday`:        6,
+		`-before:2022-01-01`:     0,
+		`has:images`:             4,
+		`is:pinned`:              3,
+		`"a"b`:                   3,
+	}
+
+	for s, pos := range cases {
+		_, err := query.Parse(s)
+		var parseErr *query.ParseError
+		require.True(t, errors.As(err, &parseErr), s)
+		require.Equal(t, pos, parseErr.Pos, s)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	page := query.Page{
+		Url:    "https://blog.golang.org/error-handling",
+		Title:  "Error handling and Go",
+		Visits: []query.Visit{{Time: time.Date(2022, 1, 15, 12, 0, 0, 0, time.Local), Browser: "firefox"}},
+		Text:   []string{"Error handling and Go", "Go code uses error values to indicate an abnormal state."},
+	}
+
+	matches := map[string]bool{
+		"error values":                          true,
+		"error values -abnormal":                false,
+		"handling values":                       false,
+		"site:golang.org":                       true,
+		"site:org":                              true,
+		"site:lang.org":                         false,
+		"title:go -url:blog":                    false,
+		"browser:chrome browser:firefox":        true,
+		"browser:firefox after:2022-02-01":      false,
+		"after:2022-01-15 before:2022-01-16":    true,
+		"has:fulltext":                          false,
+		"is:bookmarked":                         false,
+		"-is:bookmarked error":                  true,
+		`"error handling" site:blog.golang.org`: true,
+	}
+
+	for s, want := range matches {
+		require.Equal(t, want, query.MustParse(s).Matches(page), s)
+	}
+}
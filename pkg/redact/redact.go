@@ -0,0 +1,161 @@
+package redact
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+)
+
+// Values that look like tokens: no spaces or other punctuation you'd expect in
+// a human-written search query.
+var tokenCharset = regexp.MustCompile(`^[A-Za-z0-9_\-.~+/=]+$`)
+
+type Redactor struct {
+	enabled          bool
+	params           map[string]bool
+	placeholder      string
+	entropyMinLength int
+	entropyThreshold float64
+}
+
+func NewRedactor(c config.RedactionConfig) *Redactor {
+	params := map[string]bool{}
+	for _, p := range c.Params {
+		params[strings.ToLower(p)] = true
+	}
+
+	return &Redactor{
+		enabled:          c.Enabled,
+		params:           params,
+		placeholder:      c.Placeholder,
+		entropyMinLength: c.EntropyMinLength,
+		entropyThreshold: c.EntropyThreshold,
+	}
+}
+
+// RedactUrl replaces sensitive query (and fragment) parameter values in the
+// passed URL with the placeholder. The second return value reports whether
+// anything was redacted. URLs that do not need redaction are returned
+// unchanged, byte for byte, so that their md5 stays stable.
+func (r *Redactor) RedactUrl(rawUrl string) (string, bool) {
+	if !r.enabled {
+		return rawUrl, false
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl, false
+	}
+
+	// Work on the raw strings rather than u.String() so that the rest of the URL
+	// is left exactly as it was.
+	base, fragment, hasFragment := strings.Cut(rawUrl, "#")
+	base, _, hasQuery := strings.Cut(base, "?")
+
+	query, queryRedacted := r.redactParams(u.RawQuery)
+
+	// @note OAuth implicit flows put tokens in the fragment, e.g. #access_token=...
+	fragmentRedacted := false
+	if strings.Contains(fragment, "=") {
+		fragment, fragmentRedacted = r.redactParams(fragment)
+	}
+
+	if !queryRedacted && !fragmentRedacted {
+		return rawUrl, false
+	}
+
+	result := base
+	if hasQuery {
+		result += "?" + query
+	}
+	if hasFragment {
+		result += "#" + fragment
+	}
+
+	return result, true
+}
+
+// Redact values in an `a=1&b=2` style string, preserving parameter order.
+func (r *Redactor) redactParams(raw string) (string, bool) {
+	if raw == "" {
+		return raw, false
+	}
+
+	redacted := false
+	pairs := strings.Split(raw, "&")
+
+	for i, pair := range pairs {
+		k, v, found := strings.Cut(pair, "=")
+		if !found || v == "" {
+			continue
+		}
+
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			value = v
+		}
+
+		// @note the placeholder is written escaped, so it is compared unescaped
+		if value == r.placeholder {
+			continue
+		}
+
+		if r.params[strings.ToLower(name)] || r.looksLikeToken(value) {
+			pairs[i] = k + "=" + url.QueryEscape(r.placeholder)
+			redacted = true
+		}
+	}
+
+	return strings.Join(pairs, "&"), redacted
+}
+
+func (r *Redactor) looksLikeToken(s string) bool {
+	if r.entropyMinLength <= 0 || len(s) < r.entropyMinLength {
+		return false
+	}
+
+	if !tokenCharset.MatchString(s) {
+		return false
+	}
+
+	// Tokens mix letters and digits. Long words or slugs do not.
+	if !strings.ContainsAny(s, "0123456789") || strings.IndexFunc(s, isLetter) == -1 {
+		return false
+	}
+
+	return ShannonEntropy(s) >= r.entropyThreshold
+}
+
+func isLetter(c rune) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// ShannonEntropy returns the entropy of s in bits per character.
+func ShannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+
+	counts := map[rune]int{}
+	n := 0
+	for _, c := range s {
+		counts[c]++
+		n++
+	}
+
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
@@ -0,0 +1,62 @@
+package redact_test
+
+import (
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/redact"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactUrl(t *testing.T) {
+	r := redact.NewRedactor(config.RedactionConfig{
+		Enabled:          true,
+		Params:           []string{"token", "code", "access_token"},
+		Placeholder:      "REDACTED",
+		EntropyMinLength: 24,
+		EntropyThreshold: 4.0,
+	})
+
+	table := []struct {
+		name     string
+		url      string
+		expected string
+		redacted bool
+	}{
+		{"no query", "https://example.com/a/b", "https://example.com/a/b", false},
+		{"harmless query", "https://www.google.com/search?q=golang+generics&hl=en", "https://www.google.com/search?q=golang+generics&hl=en", false},
+		{"named param", "https://example.com/login?token=abc&next=/home", "https://example.com/login?token=REDACTED&next=/home", true},
+		{"case insensitive", "https://example.com/cb?Code=123", "https://example.com/cb?Code=REDACTED", true},
+		{"fragment", "https://example.com/cb#access_token=abc&state=1", "https://example.com/cb#access_token=REDACTED&state=1", true},
+		{"high entropy value", "https://example.com/dl?x=Zx81kLq0aP3vT7mN2bR9sW4yQ6uE1cJ5", "https://example.com/dl?x=REDACTED", true},
+		{"hex hash is kept", "https://github.com/a/b/commit?sha=4f1c2a9e8b7d6c5f4e3a2b1c0d9e8f7a6b5c4d3e", "https://github.com/a/b/commit?sha=4f1c2a9e8b7d6c5f4e3a2b1c0d9e8f7a6b5c4d3e", false},
+		{"already redacted", "https://example.com/login?token=REDACTED", "https://example.com/login?token=REDACTED", false},
+		{"param order is kept", "https://example.com/?z=1&token=a&a=2", "https://example.com/?z=1&token=REDACTED&a=2", true},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, redacted := r.RedactUrl(tt.url)
+			require.Equal(t, tt.expected, actual)
+			require.Equal(t, tt.redacted, redacted)
+		})
+	}
+
+	t.Run("escaped placeholder", func(t *testing.T) {
+		r := redact.NewRedactor(config.RedactionConfig{Enabled: true, Params: []string{"token"}, Placeholder: "[redacted]"})
+		actual, redacted := r.RedactUrl("https://example.com/?token=abc")
+		require.Equal(t, "https://example.com/?token=%5Bredacted%5D", actual)
+		require.True(t, redacted)
+
+		actual, redacted = r.RedactUrl(actual)
+		require.Equal(t, "https://example.com/?token=%5Bredacted%5D", actual)
+		require.False(t, redacted, "urls that were redacted already are left alone")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r := redact.NewRedactor(config.RedactionConfig{Params: []string{"token"}})
+		actual, redacted := r.RedactUrl("https://example.com/?token=abc")
+		require.Equal(t, "https://example.com/?token=abc", actual)
+		require.False(t, redacted)
+	})
+}
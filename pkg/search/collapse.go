@@ -0,0 +1,175 @@
+package search
+
+import (
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/samber/lo"
+)
+
+// A page of results from the store, and the total number of them
+type fetchFunc func(opts persistence.SearchOptions) ([]types.UrlDbSearchEntity, uint, error)
+
+// Cursor remembers how far the pages of a search got, so that the next page
+// carries on from there rather than fetching and grouping every result before
+// it again. Pass the same one with each page, see Each. The zero value is
+// ready to use. It isn't safe for concurrent use.
+type Cursor struct {
+	// By the query, sort and mode that were searched, see collapseKey
+	states map[string]*collapseState
+}
+
+// How far collapse got through the results of a search
+type collapseState struct {
+	// The offset of the next result to fetch from the store
+	next uint
+	// Every result has been fetched
+	done bool
+	// The number of results, and of them grouped under another as a variant
+	total, grouped uint
+	// The group of each canonical url and document
+	byKey map[string]*types.SearchableEntity
+	// The groups from the base'th on, those before it have been returned
+	groups []*types.SearchableEntity
+	base   uint
+	// The groups that have been returned, which no more variants are added to
+	returned map[*types.SearchableEntity]bool
+}
+
+func newCollapseState() *collapseState {
+	return &collapseState{byKey: map[string]*types.SearchableEntity{}, returned: map[*types.SearchableEntity]bool{}}
+}
+
+// The state of the search with the given key, or a new one if it is being
+// paged through from before where the cursor got to
+func (c *Cursor) state(key string, offset uint) *collapseState {
+	if c.states == nil {
+		c.states = map[string]*collapseState{}
+	}
+	st := c.states[key]
+	if st == nil || offset < st.base {
+		st = newCollapseState()
+		c.states[key] = st
+	}
+	return st
+}
+
+func collapseKey(s string, opts SearchOptions) string {
+	return string(opts.Mode) + "\x00" + string(opts.Sort) + "\x00" + s
+}
+
+// Fetch a page of results, with the variants of a page grouped under the best
+// of them unless opts.AllVariants is set. Variants share a canonical url, see
+// util.CanonicalUrl, or a full-text document. key identifies the search, see
+// collapseKey, so that opts.Cursor can carry on from an earlier page of it.
+//
+// @note groups are made in the order of the results from the first one, so
+// that pages don't overlap. Only variants among the results fetched to fill
+// the page are grouped, and until every result has been fetched the count is
+// an estimate, that of the results less the variants grouped so far, see
+// SearchResult.CountIsEstimate. With a cursor, a
+// variant of a group on a page that has already been returned is a result of
+// its own, later variants are grouped under it.
+func (p SqlSearchProvider) collapse(key string, opts SearchOptions, fetch fetchFunc) (*SearchResult, error) {
+	storeOpts := persistence.SearchOptions{
+		Sort:    opts.Sort,
+		Ranking: p.ranking,
+		Limit:   opts.Limit,
+		Offset:  opts.Offset,
+	}
+	if opts.AllVariants {
+		xs, count, err := fetch(storeOpts)
+		if err != nil {
+			return nil, err
+		}
+		return &SearchResult{
+			Urls: lo.Map(xs, func(x types.UrlDbSearchEntity, _ int) types.SearchableEntity {
+				return types.UrlDbSearchEntityToSearchableEntity(x)
+			}),
+			Count: count,
+		}, nil
+	}
+
+	limit := opts.Limit
+	if limit == 0 {
+		limit = persistence.DefaultSearchLimit
+	}
+	end := opts.Offset + limit
+
+	st := newCollapseState()
+	if opts.Cursor != nil {
+		st = opts.Cursor.state(key, opts.Offset)
+	}
+
+	for !st.done && st.base+uint(len(st.groups)) < end {
+		// @note at least a page is fetched at a time, more if it takes more
+		// groups than that to get to the end of this one
+		storeOpts.Limit = end - st.base - uint(len(st.groups))
+		if storeOpts.Limit < limit {
+			storeOpts.Limit = limit
+		}
+		storeOpts.Offset = st.next
+
+		xs, total, err := fetch(storeOpts)
+		if err != nil {
+			return nil, err
+		}
+		st.total = total
+
+		docs, err := p.store.DocumentMd5s(p.ctx, lo.Map(xs, func(x types.UrlDbSearchEntity, _ int) string { return x.UrlMd5 })...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, x := range xs {
+			keys := []string{"url:" + util.CanonicalUrl(x.Url)}
+			if doc, ok := docs[x.UrlMd5]; ok {
+				keys = append(keys, "document:"+doc)
+			}
+
+			e := types.UrlDbSearchEntityToSearchableEntity(x)
+			group := st.byKey[keys[0]]
+			if group == nil && len(keys) > 1 {
+				group = st.byKey[keys[1]]
+			}
+			if group == nil || st.returned[group] {
+				group = &e
+				st.groups = append(st.groups, group)
+			} else {
+				group.Variants = append(group.Variants, e)
+				st.grouped++
+			}
+			for _, k := range keys {
+				if g, ok := st.byKey[k]; !ok || st.returned[g] {
+					st.byKey[k] = group
+				}
+			}
+		}
+
+		st.next += uint(len(xs))
+		st.done = st.next >= total || len(xs) == 0
+	}
+
+	count := st.total - st.grouped
+	if st.done {
+		count = st.base + uint(len(st.groups))
+	}
+
+	page := []types.SearchableEntity{}
+	for i := opts.Offset; i < st.base+uint(len(st.groups)) && i < end; i++ {
+		page = append(page, *st.groups[i-st.base])
+	}
+
+	// @note groups that have been returned are only needed to tell their
+	// variants apart, which byKey is enough for
+	if opts.Cursor != nil {
+		n := opts.Offset + uint(len(page)) - st.base
+		for _, g := range st.groups[:n] {
+			st.returned[g] = true
+		}
+		st.groups = st.groups[n:]
+		st.base += n
+	}
+
+	return &SearchResult{Urls: page, Count: count, CountIsEstimate: !st.done}, nil
+}
@@ -0,0 +1,134 @@
+package search_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollapseVariants(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			now := time.Now().Truncate(time.Second)
+			insert := func(url string, age time.Duration, body string, statusCode int) {
+				title := "Gophers and how to care for them"
+				visited := now.Add(-age)
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title, LastVisit: &visited}))
+				if statusCode == 0 {
+					return
+				}
+				require.NoError(t, store.InsertDocument(ctx, &types.DocumentRow{
+					DocumentMd5: util.HashMd5String(body),
+					UrlMd5:      util.HashMd5String(url),
+					StatusCode:  statusCode,
+					AccessedAt:  &now,
+					Body:        &body,
+				}))
+			}
+
+			insert("https://example.com/gophers", 0, "All about gophers", 200)
+			insert("https://example.com/gophers/amp", time.Hour, "", 0)
+			insert("https://m.example.com/gophers?utm_source=hn", 2*time.Hour, "", 0)
+			insert("https://mirror.org/copy-of-gophers", 3*time.Hour, "All about gophers", 200)
+			insert("https://example.com/gophers/care", 4*time.Hour, "", 0)
+			insert("https://blog.example.com/a", 5*time.Hour, "", 200)
+			insert("https://blog.example.com/b", 6*time.Hour, "", 200)
+			insert("https://blog.example.com/c", 7*time.Hour, "Not found", 404)
+			insert("https://blog.example.com/d", 8*time.Hour, "Not found", 404)
+			_, err := populate.BuildIndex(ctx, store, 0)
+			require.NoError(t, err)
+
+			provider := search.NewSqlSearchProvider(ctx, store, config.DefaultRanking)
+			urls := func(xs []types.SearchableEntity) []string {
+				us := []string{}
+				for _, x := range xs {
+					us = append(us, x.Url)
+				}
+				return us
+			}
+
+			result, err := provider.SearchUrls("gophers", search.SearchOptions{Sort: persistence.SortRecent})
+			require.NoError(t, err)
+			require.Equal(t, []string{
+				"https://example.com/gophers",
+				"https://example.com/gophers/care",
+				"https://blog.example.com/a",
+				"https://blog.example.com/b",
+				"https://blog.example.com/c",
+				"https://blog.example.com/d",
+			}, urls(result.Urls), "empty and failed documents aren't the same page")
+			require.Equal(t, uint(6), result.Count)
+			require.False(t, result.CountIsEstimate)
+			require.Equal(t, []string{
+				"https://example.com/gophers/amp",
+				"https://m.example.com/gophers?utm_source=hn",
+				"https://mirror.org/copy-of-gophers",
+			}, urls(result.Urls[0].Variants))
+
+			result, err = provider.SearchUrls("gophers", search.SearchOptions{Sort: persistence.SortRecent, Limit: 2, Offset: 1})
+			require.NoError(t, err)
+			require.Equal(t, []string{"https://example.com/gophers/care", "https://blog.example.com/a"}, urls(result.Urls), "pages are of the groups")
+			require.Empty(t, result.Urls[0].Variants)
+			require.True(t, result.CountIsEstimate, "later results haven't been fetched to be grouped")
+
+			result, err = provider.SearchUrls("gophers", search.SearchOptions{Sort: persistence.SortRecent, AllVariants: true})
+			require.NoError(t, err)
+			require.Len(t, result.Urls, 9)
+			require.Equal(t, uint(9), result.Count)
+
+			all, err := provider.SearchUrls("gophers", search.SearchOptions{Sort: persistence.SortRecent})
+			require.NoError(t, err)
+			counting := &countingStore{Store: store}
+			provider = search.NewSqlSearchProvider(ctx, counting, config.DefaultRanking)
+			each := []types.SearchableEntity{}
+			result, err = search.Each(provider, "gophers", search.SearchOptions{Sort: persistence.SortRecent, Limit: 2}, func(x types.SearchableEntity) error {
+				each = append(each, x)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, uint(6), result.Count)
+			require.False(t, result.CountIsEstimate, "every result has been fetched")
+			require.Equal(t, all.Urls, each, "paging through groups the same variants")
+			require.Equal(t, 9, counting.fetched, "every result is fetched once")
+
+			// A variant of the first result that is only fetched for the last page
+			insert("https://www.example.com/gophers/", 9*time.Hour, "", 0)
+			_, err = populate.BuildIndex(ctx, store, 0)
+			require.NoError(t, err)
+			each = []types.SearchableEntity{}
+			result, err = search.Each(provider, "gophers", search.SearchOptions{Sort: persistence.SortRecent, Limit: 2}, func(x types.SearchableEntity) error {
+				each = append(each, x)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, uint(7), result.Count)
+			require.Equal(t, "https://www.example.com/gophers/", each[len(each)-1].Url, "variants of a result already returned are returned on their own")
+		})
+	}
+}
+
+// Counts the results fetched from a store
+type countingStore struct {
+	persistence.Store
+	fetched int
+}
+
+func (s *countingStore) SearchUrls(ctx context.Context, q *query.Query, opts persistence.SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+	xs, count, err := s.Store.SearchUrls(ctx, q, opts)
+	s.fetched += len(xs)
+	return xs, count, err
+}
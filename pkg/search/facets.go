@@ -0,0 +1,95 @@
+package search
+
+import (
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+)
+
+// The most domains listed in Facets, the least common are left out
+const facetDomains = 10
+
+// Facet is a value some of the results have in common, and how to narrow the
+// search down to them
+type Facet struct {
+	Value string `json:"value"`
+	// The number of results with the value
+	Count int `json:"count"`
+	// The query refined to the results with the value
+	Query string `json:"query"`
+}
+
+// Facets count every result of a search, not only the page that was returned
+type Facets struct {
+	// Refined with site:
+	Domains []Facet `json:"domains"`
+	// Refined with browser:
+	Browsers []Facet `json:"browsers"`
+	// Months like 2022-01, most recent first, refined with after: and before:
+	Months []Facet `json:"months"`
+	// A single facet with the value "fulltext", unless no result has been
+	// scraped, refined with has:fulltext
+	HasFulltext []Facet `json:"has_fulltext"`
+}
+
+func facetsOf(q *query.Query, f *types.Facets) *Facets {
+	facets := &Facets{Domains: []Facet{}, Browsers: []Facet{}, Months: []Facet{}, HasFulltext: []Facet{}}
+
+	for _, x := range f.Domains {
+		if len(facets.Domains) == facetDomains {
+			break
+		}
+		facets.Domains = append(facets.Domains, Facet{Value: x.Value, Count: x.Count, Query: RefineSite(q, x.Value).String()})
+	}
+	for _, x := range f.Browsers {
+		facets.Browsers = append(facets.Browsers, Facet{Value: x.Value, Count: x.Count, Query: RefineBrowser(q, x.Value).String()})
+	}
+	for _, x := range f.Months {
+		refined, err := RefineMonth(q, x.Value)
+		if err != nil {
+			continue
+		}
+		facets.Months = append(facets.Months, Facet{Value: x.Value, Count: x.Count, Query: refined.String()})
+	}
+	if f.HasFulltext > 0 {
+		facets.HasFulltext = append(facets.HasFulltext, Facet{Value: "fulltext", Count: f.HasFulltext, Query: RefineFulltext(q).String()})
+	}
+
+	return facets
+}
+
+// RefineSite narrows q down to a site, in place of any other sites it was
+// looking for
+func RefineSite(q *query.Query, site string) *query.Query {
+	refined := *q
+	refined.Sites = append(query.Negated(q.Sites), query.Term{Value: site})
+	return &refined
+}
+
+// RefineBrowser narrows q down to a browser, in place of any other browsers
+// it was looking for
+func RefineBrowser(q *query.Query, browser string) *query.Query {
+	refined := *q
+	refined.Browsers = append(query.Negated(q.Browsers), query.Term{Value: strings.ToLower(browser)})
+	return &refined
+}
+
+// RefineMonth narrows q down to visits in a month like 2022-01, in local time
+func RefineMonth(q *query.Query, month string) (*query.Query, error) {
+	start, err := time.ParseInLocation("2006-01", month, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	end := start.AddDate(0, 1, 0)
+	return RefineDates(q, &start, &end), nil
+}
+
+// RefineFulltext narrows q down to pages whose full-text has been scraped
+func RefineFulltext(q *query.Query) *query.Query {
+	refined := *q
+	hasFulltext := true
+	refined.HasFulltext = &hasFulltext
+	return &refined
+}
@@ -0,0 +1,62 @@
+package search_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFacets(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+
+	for url, title := range map[string]string{
+		"https://github.com/golang/go": "Go issues",
+		"https://go.dev":               "The Go Programming Language",
+	} {
+		title := title
+		require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title}))
+	}
+	_, err := populate.BuildIndex(ctx, store, 0)
+	require.NoError(t, err)
+
+	provider := search.NewSqlSearchProvider(ctx, store, config.DefaultRanking)
+
+	result, err := provider.SearchUrls("go", search.SearchOptions{Limit: 1})
+	require.NoError(t, err)
+	require.Nil(t, result.Facets, "facets are only counted when asked for")
+
+	result, err = provider.SearchUrls("go -site:example.com", search.SearchOptions{Limit: 1, Facets: true})
+	require.NoError(t, err)
+	require.Len(t, result.Urls, 1)
+	require.Len(t, result.Facets.Domains, 2, "facets count every result, not only the page")
+	require.Equal(t, "go -site:example.com site:github.com", result.Facets.Domains[0].Query)
+
+	refined, err := provider.SearchUrls(result.Facets.Domains[0].Query, search.SearchOptions{})
+	require.NoError(t, err)
+	require.Equal(t, uint(1), refined.Count)
+}
+
+func TestRefine(t *testing.T) {
+	q := query.MustParse("go site:go.dev browser:chrome after:2022-01-20")
+
+	require.Equal(t, "go site:github.com browser:chrome after:2022-01-20", search.RefineSite(q, "github.com").String())
+	require.Equal(t, "go site:go.dev browser:firefox after:2022-01-20", search.RefineBrowser(q, "Firefox").String())
+	require.Equal(t, "go site:go.dev browser:chrome after:2022-01-20 has:fulltext", search.RefineFulltext(q).String())
+
+	refined, err := search.RefineMonth(q, "2022-01")
+	require.NoError(t, err)
+	require.Equal(t, "go site:go.dev browser:chrome after:2022-01-20 before:2022-02-01", refined.String(), "the month is narrowed to what was already searched")
+
+	_, err = search.RefineMonth(q, "January")
+	require.Error(t, err)
+
+	require.Equal(t, "go site:go.dev browser:chrome after:2022-01-20", q.String(), "q is left as it is")
+}
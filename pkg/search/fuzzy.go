@@ -0,0 +1,129 @@
+package search
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+)
+
+// Searches with fewer results than this look for a correction
+const sparseResults = 3
+
+// How many similar words are compared to each misspelled one
+const candidateWords = 50
+
+// The most edits a word can be from its correction, more for longer words
+func maxEdits(word string) int {
+	switch n := utf8.RuneCountInString(word); {
+	case n <= 4:
+		return 1
+	case n <= 8:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// Suggest a correction of q, where each word that isn't known is replaced by
+// the closest known word. Returns nil if there is nothing to correct. Only the
+// text and title: terms are corrected, phrases and excluded words are left as
+// they are.
+func Suggest(ctx context.Context, store persistence.SearchStore, q *query.Query) (*query.Query, error) {
+	corrected := *q
+	changed := false
+
+	for _, terms := range []*[]query.Term{&corrected.Text, &corrected.Title} {
+		ts := append([]query.Term{}, *terms...)
+		for i, t := range ts {
+			word, err := correct(ctx, store, t)
+			if err != nil {
+				return nil, err
+			}
+			if word != "" {
+				ts[i].Value = word
+				changed = true
+			}
+		}
+		*terms = ts
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return &corrected, nil
+}
+
+// The closest known word to the term, preferring more common words, or "" if
+// the term is known, isn't a single word, or nothing is close enough
+func correct(ctx context.Context, store persistence.SearchStore, t query.Term) (string, error) {
+	word := strings.ToLower(t.Value)
+	if t.Phrase || t.Negated || utf8.RuneCountInString(word) < 3 || strings.IndexFunc(word, func(r rune) bool { return !unicode.IsLetter(r) }) != -1 {
+		return "", nil
+	}
+
+	candidates, err := store.SimilarWords(ctx, word, candidateWords)
+	if err != nil {
+		return "", err
+	}
+
+	best, bestEdits, bestCount := "", maxEdits(word)+1, 0
+	for _, c := range candidates {
+		if c.Word == word {
+			return "", nil
+		}
+
+		n := editDistance(word, c.Word)
+		if n < bestEdits || (n == bestEdits && c.Count > bestCount) {
+			best, bestEdits, bestCount = c.Word, n, c.Count
+		}
+	}
+
+	return best, nil
+}
+
+// The number of insertions, deletions, substitutions and swaps of adjacent
+// letters that turn a into b, so that "kuberentes" is one edit from
+// "kubernetes" rather than two
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	// @note three rows of the usual matrix are enough, the one before last is
+	// needed for swaps
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = minInt(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(x int, xs ...int) int {
+	for _, y := range xs {
+		if y < x {
+			x = y
+		}
+	}
+	return x
+}
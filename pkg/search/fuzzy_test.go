@@ -0,0 +1,99 @@
+package search_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/persistence/testutils"
+	"github.com/iansinnott/browser-gopher/pkg/populate"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuzzySearch(t *testing.T) {
+	for name, newStore := range testutils.Stores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			defer store.Close()
+
+			for url, title := range map[string]string{
+				"https://kubernetes.io/docs":     "Kubernetes documentation",
+				"https://kubernetes.io/tutorial": "Kubernetes deployment tutorial",
+				"https://example.com/kubelet":    "Running the kubelet",
+				"https://go.dev":                 "The Go Programming Language",
+			} {
+				title := title
+				require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: url, Title: &title}))
+			}
+			_, err := populate.BuildIndex(ctx, store, 0)
+			require.NoError(t, err)
+
+			provider := search.NewSqlSearchProvider(ctx, store, config.DefaultRanking)
+
+			result, err := provider.SearchUrls("kuberntes", search.SearchOptions{})
+			require.NoError(t, err)
+			require.True(t, result.Fuzzy, "results of the correction instead of none")
+			require.Equal(t, "kubernetes", result.Suggestion)
+			require.Equal(t, uint(2), result.Count)
+			require.Len(t, result.Urls, 2)
+
+			result, err = provider.SearchUrls("kuberentes deploymnt", search.SearchOptions{})
+			require.NoError(t, err)
+			require.Equal(t, "kubernetes deployment", result.Suggestion, "swapped letters are a single edit")
+			require.Len(t, result.Urls, 1)
+
+			result, err = provider.SearchUrls("kubernetes", search.SearchOptions{})
+			require.NoError(t, err)
+			require.False(t, result.Fuzzy)
+			require.Empty(t, result.Suggestion, "known words are not corrected")
+
+			result, err = provider.SearchUrls(`"kuberntes"`, search.SearchOptions{})
+			require.NoError(t, err)
+			require.Empty(t, result.Suggestion, "phrases are not corrected")
+			require.Empty(t, result.Urls)
+
+			result, err = provider.SearchUrls("zzzzzz", search.SearchOptions{})
+			require.NoError(t, err)
+			require.Empty(t, result.Suggestion, "nothing close enough")
+		})
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+	require.NoError(t, store.ReplaceVocabulary(ctx, nil,
+		types.VocabularyRow{UrlMd5: "a", Word: "gopher", Count: 1},
+		types.VocabularyRow{UrlMd5: "a", Word: "golang", Count: 10},
+		types.VocabularyRow{UrlMd5: "a", Word: "goland", Count: 1},
+	))
+
+	table := []struct {
+		query    string
+		expected string
+	}{
+		{"gophr", "gopher"},
+		{"golan", "golang"},
+		{"title:gopehr site:go.dev", "title:gopher site:go.dev"},
+		{"gopher -golnag", ""},
+		{"gopher", ""},
+		{"go", ""},
+	}
+
+	for _, tt := range table {
+		t.Run(tt.query, func(t *testing.T) {
+			suggestion, err := search.Suggest(ctx, store, query.MustParse(tt.query))
+			require.NoError(t, err)
+			if tt.expected == "" {
+				require.Nil(t, suggestion)
+			} else {
+				require.Equal(t, tt.expected, suggestion.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package search
+
+import (
+	"strings"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/pkg/errors"
+)
+
+type HistoryProvider interface {
+	// Add a search, and the number of results it had, to the search history.
+	// Empty queries are left out.
+	RecordSearch(query string, mode MatchMode, count uint) error
+	// The most recent searches, most recent first
+	History(limit uint) ([]types.SearchHistoryRow, error)
+}
+
+func (p SqlSearchProvider) RecordSearch(query string, mode MatchMode, count uint) error {
+	if strings.TrimSpace(query) == "" {
+		return nil
+	}
+
+	err := p.store.InsertSearchHistory(p.ctx, types.SearchHistoryRow{
+		Query:       query,
+		Mode:        string(mode),
+		SearchedAt:  time.Now(),
+		ResultCount: count,
+	})
+	return errors.Wrap(err, "could not record search")
+}
+
+func (p SqlSearchProvider) History(limit uint) ([]types.SearchHistoryRow, error) {
+	return p.store.SearchHistory(p.ctx, int(limit))
+}
+
+// RecentQueries are the distinct queries of the searches matched in the mode,
+// in the order of searches, e.g. most recent first
+func RecentQueries(searches []types.SearchHistoryRow, mode MatchMode) []string {
+	seen := map[string]bool{}
+	xs := []string{}
+	for _, s := range searches {
+		if MatchMode(s.Mode) != mode || seen[s.Query] {
+			continue
+		}
+		seen[s.Query] = true
+		xs = append(xs, s.Query)
+	}
+	return xs
+}
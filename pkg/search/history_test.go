@@ -0,0 +1,51 @@
+package search_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/iansinnott/browser-gopher/pkg/config"
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearchHistory(t *testing.T) {
+	ctx := context.Background()
+	store := persistence.NewMemoryStore()
+
+	title := "The Go Programming Language"
+	require.NoError(t, store.InsertUrl(ctx, &types.UrlRow{Url: "https://go.dev", Title: &title}))
+	require.NoError(t, store.InsertFragments(ctx, types.Fragment{E: util.HashMd5String("https://go.dev"), T: "urls", A: "title", V: title}))
+
+	p := search.NewSqlSearchProvider(ctx, store, config.DefaultRanking)
+	_, err := p.SearchUrls("go", search.SearchOptions{})
+	require.NoError(t, err)
+	searches, err := p.History(10)
+	require.NoError(t, err)
+	require.Empty(t, searches, "searches are only recorded by the interactive search")
+
+	for _, x := range []struct {
+		query string
+		mode  search.MatchMode
+		count uint
+	}{
+		{"go", search.MatchQuery, 1},
+		{"", search.MatchQuery, 0},
+		{"Go Pro", search.MatchLiteral, 1},
+		{"go", search.MatchQuery, 1},
+	} {
+		require.NoError(t, p.RecordSearch(x.query, x.mode, x.count))
+	}
+
+	searches, err = p.History(10)
+	require.NoError(t, err)
+	require.Len(t, searches, 3, "empty queries are left out")
+	require.Equal(t, uint(1), searches[0].ResultCount)
+	require.Equal(t, "literal", searches[1].Mode)
+
+	require.Equal(t, []string{"go"}, search.RecentQueries(searches, search.MatchQuery), "queries are only recalled once")
+	require.Equal(t, []string{"Go Pro"}, search.RecentQueries(searches, search.MatchLiteral))
+}
@@ -0,0 +1,39 @@
+package search
+
+import (
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/iansinnott/browser-gopher/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// ErrUnknownUrl is returned for related pages of a url that isn't in the history
+var ErrUnknownUrl = errors.New("url is not in the history")
+
+type RelatedProvider interface {
+	// The pages most like the one at url, by the words they share, most
+	// related first. Returns ErrUnknownUrl if url was never visited.
+	Related(url string, limit uint) (*SearchResult, error)
+}
+
+func (p SqlSearchProvider) Related(url string, limit uint) (*SearchResult, error) {
+	md5 := util.HashMd5String(url)
+	urls, err := p.store.UrlsById(p.ctx, md5)
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, ErrUnknownUrl
+	}
+
+	xs, err := p.store.RelatedUrls(p.ctx, md5, int(limit))
+	if err != nil {
+		return nil, err
+	}
+
+	related := lo.Map(xs, func(x types.UrlDbSearchEntity, i int) types.SearchableEntity {
+		return types.UrlDbSearchEntityToSearchableEntity(x)
+	})
+
+	return &SearchResult{Urls: related, Count: uint(len(related))}, nil
+}
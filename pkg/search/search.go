@@ -1,6 +1,7 @@
 package search
 
 import (
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
 	"github.com/iansinnott/browser-gopher/pkg/types"
 )
 
@@ -10,15 +11,102 @@ type URLQueryResult struct {
 }
 
 type SearchResult struct {
-	Urls  []types.SearchableEntity
+	Urls []types.SearchableEntity
+	// The total number of results, which can all be paged through with
+	// SearchOptions.Offset. See CountIsEstimate.
 	Count uint
+	// Count is an upper bound rather than exact. Variants are only grouped as
+	// they are fetched, so until every result has been, those that haven't are
+	// counted as results of their own although some may turn out to be
+	// variants of another.
+	CountIsEstimate bool
+
+	// A correction of a query with few results, if there is one that has more.
+	// See Suggest.
+	Suggestion string
+	// The query had no results at all, so these are the results of the
+	// suggestion instead
+	Fuzzy bool
+
+	// Counts of every result by domain, browser and so on, if
+	// SearchOptions.Facets was set
+	Facets *Facets
+}
+
+// SearchOptions selects a page of results and their order. The zero value is
+// the first persistence.DefaultSearchLimit results by relevance.
+type SearchOptions struct {
+	Limit  uint
+	Offset uint
+	Sort   persistence.SortOrder
+	// Count the facets of the results, which takes another query
+	Facets bool
+	// How the query is matched, see MatchMode
+	Mode MatchMode
+	// List every variant of a page as a result of its own, rather than grouped
+	// under the best of them, see types.SearchableEntity.Variants
+	AllVariants bool
+	// Carry on from the previous page of the search rather than starting from
+	// the first result again, see Cursor
+	Cursor *Cursor
 }
 
+// MatchMode is how SearchUrls reads a query
+type MatchMode string
+
+const (
+	// A query in the syntax of the query package, looked up in the search index
+	MatchQuery MatchMode = ""
+	// A regular expression, matched against every fragment of the index that
+	// could match it. Filters are not supported, and there are no facets or
+	// suggestions.
+	MatchRegex MatchMode = "regex"
+	// An exact, case-sensitive string, matched like MatchRegex
+	MatchLiteral MatchMode = "literal"
+)
+
 type SearchProvider interface {
-	SearchUrls(query string) (*SearchResult, error)
+	SearchUrls(query string, opts SearchOptions) (*SearchResult, error)
 }
 
 type DataProvider interface {
 	SearchProvider
-	RecentUrls(limit uint) (*SearchResult, error)
+	// Sort is ignored, recent urls are always most recent first
+	RecentUrls(opts SearchOptions) (*SearchResult, error)
+}
+
+// Each calls fn with every result of the query in turn, fetching them a page
+// of opts.Limit at a time starting from opts.Offset. Useful for exporting
+// results without holding them all in memory. Returns the total number of
+// results, any suggestion and the facets of the first page, without the urls.
+func Each(p SearchProvider, query string, opts SearchOptions, fn func(x types.SearchableEntity) error) (*SearchResult, error) {
+	if opts.Cursor == nil {
+		opts.Cursor = &Cursor{}
+	}
+	var facets *Facets
+	for {
+		result, err := p.SearchUrls(query, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// @note facets are of every result, so they only need counting once
+		if opts.Facets {
+			facets = result.Facets
+			opts.Facets = false
+		}
+		result.Facets = facets
+
+		for _, x := range result.Urls {
+			if err := fn(x); err != nil {
+				return nil, err
+			}
+		}
+
+		opts.Offset += uint(len(result.Urls))
+		if len(result.Urls) == 0 || opts.Offset >= result.Count {
+			result.Urls = nil
+			return result, nil
+		}
+	}
 }
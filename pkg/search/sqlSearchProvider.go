@@ -2,177 +2,118 @@ package search
 
 import (
 	"context"
-	"time"
 
 	"github.com/iansinnott/browser-gopher/pkg/config"
 	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/query"
 	"github.com/iansinnott/browser-gopher/pkg/types"
-	"github.com/pkg/errors"
 	"github.com/samber/lo"
 )
 
+// SqlSearchProvider searches a persistence.Store. Despite the name it works
+// with any store, not only the sqlite one.
 type SqlSearchProvider struct {
-	ctx  context.Context
-	conf *config.AppConfig
+	ctx     context.Context
+	store   persistence.Store
+	ranking config.RankingConfig
 }
 
-func NewSqlSearchProvider(ctx context.Context, conf *config.AppConfig) SqlSearchProvider {
-	return SqlSearchProvider{ctx: ctx, conf: conf}
+func NewSqlSearchProvider(ctx context.Context, store persistence.Store, ranking config.RankingConfig) SqlSearchProvider {
+	return SqlSearchProvider{ctx: ctx, store: store, ranking: ranking}
 }
 
-func (p SqlSearchProvider) SearchUrls(query string) (*SearchResult, error) {
-	conn, err := persistence.OpenConnection(p.ctx, p.conf)
-	if err != nil {
-		return nil, err
+// SearchUrls parses the query, see the query package for the syntax, and
+// searches for it. Invalid queries return a *query.ParseError.
+//
+// When there are only a few results a correction of any misspelled words is
+// suggested, and if there are none at all the results of the correction are
+// returned instead.
+//
+// @note searches aren't added to the search history here, the interactive
+// search does that with the query the user ends up with, see HistoryProvider.
+// Scripts and exports are left out of it.
+func (p SqlSearchProvider) SearchUrls(s string, opts SearchOptions) (*SearchResult, error) {
+	if opts.Mode != MatchQuery {
+		return p.searchPattern(s, opts)
 	}
-	defer conn.Close()
-
-	var count uint
-	row := conn.QueryRowContext(p.ctx, `
-SELECT
-  count(*)
-FROM (
-  SELECT
-    e
-  FROM
-    fragment_fts
-  WHERE
-    fragment_fts MATCH ?
-  GROUP BY
-    e);
-	`, query)
-	if row.Err() != nil {
-		return nil, errors.Wrap(row.Err(), "row count error")
-	}
-	err = row.Scan(&count)
+
+	q, err := query.Parse(s)
 	if err != nil {
-		return nil, errors.Wrap(err, "row count error")
+		return nil, err
 	}
 
-	rows, err := conn.QueryContext(p.ctx, `
-WITH
-  search_fragments AS (
-    SELECT
-      fts.rank,
-      fts.e,
-      fts.a,
-      snippet (fragment_fts,
-        - 1,
-        '<mark>',
-        '</mark>',
-        '…',
-        64) AS snippet
-    FROM
-      fragment_fts fts
-      LEFT OUTER JOIN urls d ON d.url_md5 = fts.e
-    WHERE
-      fragment_fts MATCH ?
-    ORDER BY
-      d.last_visit DESC
-    LIMIT
-      500
-  )
-SELECT
-  t.url_md5,
-  t.url,
-	t.title,
-	t.description,
-  t.last_visit,
-  group_concat (m.snippet, '\n') AS 'match',
-  count(m.snippet) as 'match_count',
-  sum(m.rank) as 'sum_rank'
-FROM
-  search_fragments m
-  inner join urls t on t.url_md5 = m.e
-GROUP BY
-  m.e
-ORDER BY t.last_visit DESC
-LIMIT 100;
-	`, query)
+	result, err := p.search(q, opts)
+	if err != nil || result.Count >= sparseResults {
+		return p.withFacets(result, q, opts, err)
+	}
 
-	if err != nil {
-		return nil, errors.Wrap(err, "query error")
+	suggestion, err := Suggest(p.ctx, p.store, q)
+	if err != nil || suggestion == nil {
+		return p.withFacets(result, q, opts, err)
 	}
-	if rows.Err() != nil {
-		return nil, errors.Wrap(rows.Err(), "query error")
+
+	corrected, err := p.search(suggestion, opts)
+	if err != nil || corrected.Count <= result.Count {
+		return p.withFacets(result, q, opts, err)
 	}
 
-	xs := []types.UrlDbSearchEntity{}
-
-	for rows.Next() {
-		var x types.UrlDbSearchEntity
-		var ts int64
-		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts, &x.Match, &x.MatchCount, &x.SumRank)
-		if err != nil {
-			return nil, errors.Wrap(err, "row error")
-		}
-		t := time.Unix(ts, 0)
-		x.LastVisit = &t
-		xs = append(xs, x)
+	if result.Count > 0 {
+		result.Suggestion = suggestion.String()
+		return p.withFacets(result, q, opts, nil)
 	}
 
-	searchResult := lo.Map(xs, func(x types.UrlDbSearchEntity, i int) types.SearchableEntity {
-		return types.UrlDbSearchEntityToSearchableEntity(x)
-	})
+	corrected.Suggestion = suggestion.String()
+	corrected.Fuzzy = true
+	return p.withFacets(corrected, suggestion, opts, nil)
+}
 
-	return &SearchResult{Urls: searchResult, Count: count}, nil
+func (p SqlSearchProvider) search(q *query.Query, opts SearchOptions) (*SearchResult, error) {
+	return p.collapse(collapseKey(q.String(), opts), opts, func(storeOpts persistence.SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+		return p.store.SearchUrls(p.ctx, q, storeOpts)
+	})
 }
 
-func (p SqlSearchProvider) RecentUrls(limit uint) (*SearchResult, error) {
-	conn, err := persistence.OpenConnection(p.ctx, p.conf)
+// Search for s as a regular expression or exact string, see MatchMode. Invalid
+// expressions return a *syntax.Error.
+func (p SqlSearchProvider) searchPattern(s string, opts SearchOptions) (*SearchResult, error) {
+	if s == "" {
+		return &SearchResult{Urls: []types.SearchableEntity{}}, nil
+	}
+
+	pattern, err := persistence.NewPattern(s, opts.Mode == MatchLiteral)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-
-	var count uint
-	row := conn.QueryRowContext(p.ctx, `
-SELECT
-	COUNT(*)
-FROM
-  urls;
-	`)
-	if row.Err() != nil {
-		return nil, errors.Wrap(row.Err(), "row count error")
+
+	return p.collapse(collapseKey(s, opts), opts, func(storeOpts persistence.SearchOptions) ([]types.UrlDbSearchEntity, uint, error) {
+		return persistence.SearchPattern(p.ctx, p.store, pattern, storeOpts)
+	})
+}
+
+// Add the facets of q, whose results these are, if they were asked for
+func (p SqlSearchProvider) withFacets(result *SearchResult, q *query.Query, opts SearchOptions, err error) (*SearchResult, error) {
+	if err != nil || !opts.Facets || q.IsEmpty() {
+		return result, err
 	}
-	err = row.Scan(&count)
+
+	facets, err := p.store.SearchFacets(p.ctx, q, persistence.SearchOptions{})
 	if err != nil {
-		return nil, errors.Wrap(err, "row count error")
+		return nil, err
 	}
 
-	rows, err := conn.QueryContext(p.ctx, `
-SELECT
-	url_md5,
-  url,
-  title,
-  description,
-  last_visit
-FROM
-  urls
-ORDER BY
-  last_visit DESC
-LIMIT ?;
-	`, limit)
+	result.Facets = facetsOf(q, facets)
+	return result, nil
+}
 
-	if err != nil {
-		return nil, errors.Wrap(err, "query error")
-	}
-	if rows.Err() != nil {
-		return nil, errors.Wrap(rows.Err(), "query error")
+func (p SqlSearchProvider) RecentUrls(opts SearchOptions) (*SearchResult, error) {
+	limit := opts.Limit
+	if limit == 0 {
+		limit = persistence.DefaultSearchLimit
 	}
 
-	xs := []types.UrlDbEntity{}
-
-	for rows.Next() {
-		var x types.UrlDbEntity
-		var ts int64
-		err := rows.Scan(&x.UrlMd5, &x.Url, &x.Title, &x.Description, &ts)
-		if err != nil {
-			return nil, errors.Wrap(err, "row error")
-		}
-		t := time.Unix(ts, 0)
-		x.LastVisit = &t
-		xs = append(xs, x)
+	xs, count, err := p.store.RecentUrls(p.ctx, limit, opts.Offset)
+	if err != nil {
+		return nil, err
 	}
 
 	searchResult := lo.Map(xs, func(x types.UrlDbEntity, i int) types.SearchableEntity {
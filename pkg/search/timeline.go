@@ -0,0 +1,131 @@
+package search
+
+import (
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/persistence"
+	"github.com/iansinnott/browser-gopher/pkg/query"
+	"github.com/iansinnott/browser-gopher/pkg/types"
+	"github.com/samber/lo"
+)
+
+// Visits further apart than this are in separate sessions
+const SessionGap = 30 * time.Minute
+
+// TimelineVisit is a single visit to a url that matched a search
+type TimelineVisit struct {
+	Time        time.Time `json:"time"`
+	Browser     string    `json:"browser"`
+	Id          string    `json:"id"`
+	Url         string    `json:"url"`
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+}
+
+type TimelineResult struct {
+	// In chronological order
+	Visits []TimelineVisit
+	// The total number of visits, which can all be paged through with
+	// SearchOptions.Offset
+	Count uint
+}
+
+type TimelineProvider interface {
+	// Visits to the urls matching the query, see the query package for the
+	// syntax. The sort of opts is ignored, visits are always in chronological
+	// order.
+	Timeline(query string, opts SearchOptions) (*TimelineResult, error)
+}
+
+// Session is a run of visits with no more than SessionGap between them
+type Session struct {
+	Start  time.Time       `json:"start"`
+	End    time.Time       `json:"end"`
+	Visits []TimelineVisit `json:"visits"`
+}
+
+// NewSession reports whether a visit at t starts a new session after a visit
+// at prev
+func NewSession(prev time.Time, t time.Time) bool {
+	return t.Sub(prev) > SessionGap
+}
+
+// Sessions groups visits, in chronological order, into sessions
+func Sessions(visits []TimelineVisit) []Session {
+	sessions := []Session{}
+	for _, v := range visits {
+		if n := len(sessions); n > 0 && !NewSession(sessions[n-1].End, v.Time) {
+			sessions[n-1].End = v.Time
+			sessions[n-1].Visits = append(sessions[n-1].Visits, v)
+			continue
+		}
+		sessions = append(sessions, Session{Start: v.Time, End: v.Time, Visits: []TimelineVisit{v}})
+	}
+	return sessions
+}
+
+// RefineDates narrows q down to visits on or after after and before before,
+// either of which can be nil
+func RefineDates(q *query.Query, after *time.Time, before *time.Time) *query.Query {
+	refined := *q
+	if after != nil && (q.After == nil || q.After.Before(*after)) {
+		refined.After = after
+	}
+	if before != nil && (q.Before == nil || q.Before.After(*before)) {
+		refined.Before = before
+	}
+	return &refined
+}
+
+// EachVisit calls fn with every visit of the timeline of the query in turn,
+// fetching them a page of opts.Limit at a time starting from opts.Offset.
+// Returns the total number of visits.
+func EachVisit(p TimelineProvider, query string, opts SearchOptions, fn func(v TimelineVisit) error) (uint, error) {
+	for {
+		result, err := p.Timeline(query, opts)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, v := range result.Visits {
+			if err := fn(v); err != nil {
+				return 0, err
+			}
+		}
+
+		opts.Offset += uint(len(result.Visits))
+		if len(result.Visits) == 0 || opts.Offset >= result.Count {
+			return result.Count, nil
+		}
+	}
+}
+
+// Timeline parses the query and returns the visits to the urls it matches.
+// Invalid queries return a *query.ParseError.
+func (p SqlSearchProvider) Timeline(s string, opts SearchOptions) (*TimelineResult, error) {
+	q, err := query.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	xs, count, err := p.store.SearchVisits(p.ctx, q, persistence.SearchOptions{
+		Limit:  opts.Limit,
+		Offset: opts.Offset,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	visits := lo.Map(xs, func(x types.VisitDbSearchEntity, i int) TimelineVisit {
+		return TimelineVisit{
+			Time:        x.VisitTime,
+			Browser:     x.ExtractorName,
+			Id:          x.UrlMd5,
+			Url:         x.Url,
+			Title:       x.Title,
+			Description: x.Description,
+		}
+	})
+
+	return &TimelineResult{Visits: visits, Count: count}, nil
+}
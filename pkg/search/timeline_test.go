@@ -0,0 +1,26 @@
+package search_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	start := time.Date(2024, 3, 12, 14, 0, 0, 0, time.Local)
+	at := func(minutes int) search.TimelineVisit {
+		return search.TimelineVisit{Time: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	sessions := search.Sessions([]search.TimelineVisit{at(0), at(20), at(50), at(81), at(200)})
+	require.Len(t, sessions, 3)
+	require.Len(t, sessions[0].Visits, 3, "a session goes on as long as visits are close together")
+	require.Equal(t, start, sessions[0].Start)
+	require.Equal(t, start.Add(50*time.Minute), sessions[0].End)
+	require.Len(t, sessions[1].Visits, 1)
+	require.Len(t, sessions[2].Visits, 1)
+
+	require.Empty(t, search.Sessions(nil))
+}
@@ -6,14 +6,19 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"regexp/syntax"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/iansinnott/browser-gopher/pkg/logging"
+	"github.com/iansinnott/browser-gopher/pkg/query"
 	"github.com/iansinnott/browser-gopher/pkg/search"
+	"github.com/iansinnott/browser-gopher/pkg/types"
 	"github.com/iansinnott/browser-gopher/pkg/util"
 	"github.com/pkg/errors"
 )
@@ -22,6 +27,10 @@ var docStyle = lipgloss.NewStyle().Margin(1, 2)
 var titleStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("#fafafa"))
 var urlStyle = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("#87BCF7"))
 
+var errorStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#F78787"))
+var hintStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#D8D7A0"))
+var facetStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#A0A0A0"))
+
 var HighlightStyle = lipgloss.NewStyle().Background(lipgloss.Color("#D8D7A0")).Foreground(lipgloss.Color("#000000"))
 
 const UNTITLED = "<UNTITLED>"
@@ -31,6 +40,11 @@ type ListItem struct {
 	ItemTitle, Desc, query string
 	Body                   *string
 	Date                   *time.Time
+
+	snippets []types.Snippet // the parts of the page that matched, highlighted when shown
+	variants []ListItem      // other versions of the same page, see types.SearchableEntity.Variants
+	expanded bool            // the variants are listed below the item
+	variant  bool            // the item is listed below the one it is a variant of
 }
 
 func (i ListItem) Title() string {
@@ -41,30 +55,334 @@ func (i ListItem) Title() string {
 		sb.WriteString(" ")
 	}
 
-	sb.WriteString(titleStyle.Render(i.ItemTitle))
+	if i.variant {
+		sb.WriteString(facetStyle.Render("↳ "))
+	}
+
+	sb.WriteString(highlight(i.ItemTitle, i.spans("title", i.ItemTitle), titleStyle))
+
+	if len(i.variants) > 0 && !i.expanded {
+		sb.WriteString(facetStyle.Render(fmt.Sprintf(" +%d variants, ctrl+o", len(i.variants))))
+	}
 
 	return sb.String()
 }
-func (i ListItem) Description() string { return urlStyle.Render(i.Desc) }
+
+// The url, highlighted where it matched, and below it the best snippet of the
+// rest of the page
+func (i ListItem) Description() string {
+	desc := highlight(i.Desc, i.spans("url", i.Desc), urlStyle)
+	for _, s := range i.snippets {
+		if s.Attribute != "title" && s.Attribute != "url" {
+			return desc + "\n" + snippetLine(s)
+		}
+	}
+	return desc
+}
+
 func (i ListItem) FilterValue() string { return i.ItemTitle + i.Desc }
 
 // @todo Support other systems that don't have `open`
 // @todo should prob store a list of the `item` structs that have the URL rather than doing this string manipulation
 func OpenItem(item list.Item) error {
+	url := itemUrl(item)
+	if url == "" {
+		return nil
+	}
+	fmt.Println("open", url)
+	return exec.Command("open", url).Run()
+}
+
+// The spans of the snippet of the attribute a, if it is all of text
+func (i ListItem) spans(a string, text string) []types.Span {
+	for _, s := range i.snippets {
+		if s.Attribute == a && s.Text == text {
+			return s.Spans
+		}
+	}
+	return nil
+}
+
+// Render text in style, with the spans in it highlighted
+func highlight(text string, spans []types.Span, style lipgloss.Style) string {
+	var sb strings.Builder
+	pos := 0
+	for _, span := range spans {
+		if span.Start < pos || span.End > len(text) {
+			continue
+		}
+		if span.Start > pos {
+			sb.WriteString(style.Render(text[pos:span.Start]))
+		}
+		sb.WriteString(HighlightStyle.Render(text[span.Start:span.End]))
+		pos = span.End
+	}
+	if pos < len(text) {
+		sb.WriteString(style.Render(text[pos:]))
+	}
+	return sb.String()
+}
+
+// Characters of a snippet shown before its first match
+const snippetLead = 24
+
+// A snippet on one line, starting shortly before its first match so that the
+// match isn't cut off, after the section of the page it is from if any
+func snippetLine(s types.Snippet) string {
+	text, spans := s.Text, s.Spans
+	if len(spans) > 0 && spans[0].Start > snippetLead {
+		cut := spans[0].Start - snippetLead
+		for !utf8.RuneStart(text[cut]) {
+			cut++
+		}
+		text = "…" + text[cut:]
+		shift := len("…") - cut
+		spans = make([]types.Span, len(s.Spans))
+		for j, span := range s.Spans {
+			spans[j] = types.Span{Start: span.Start + shift, End: span.End + shift}
+		}
+	}
+	line := highlight(strings.ReplaceAll(text, "\n", " "), spans, facetStyle)
+	if s.Section != "" {
+		line = hintStyle.Render(s.Section+":") + " " + line
+	}
+	return line
+}
+
+// The url of an item, or "" if it doesn't have one
+func itemUrl(item list.Item) string {
+	if item == nil {
+		return ""
+	}
 	filterVal := item.FilterValue()
 	re := regexp.MustCompile(`https?://`)
 	loc := re.FindStringIndex(filterVal)
-	url := filterVal[loc[0]:]
-	fmt.Println("open", url)
-	return exec.Command("open", url).Run()
+	if loc == nil {
+		return ""
+	}
+	return filterVal[loc[0]:]
 }
 
+// The heading of a session in a timeline, see search.Sessions
+type sessionItem struct {
+	start time.Time
+}
+
+func (i sessionItem) Title() string {
+	return titleStyle.Render("Session at " + i.start.Format("15:04 on Mon, 2 Jan 2006"))
+}
+func (i sessionItem) Description() string { return "" }
+func (i sessionItem) FilterValue() string { return "" }
+
 type model struct {
 	input          textinput.Model
 	list           list.Model
 	searchProvider search.SearchProvider
 	dataProvider   search.DataProvider
+	timeline       search.TimelineProvider // if set, visits are listed chronologically instead of urls
+	related        string                  // if set, pages related to this url are listed instead of results
+	history        []string                // earlier queries, most recent first, see search.HistoryProvider
+	recalled       int                     // the index in history of the query recalled into the input, or -1
 	mapItem        ItemMapping
+	opts           search.SearchOptions // sort and page size
+	loaded         uint                 // the number of results in the list, i.e. the offset of the next page
+	count          uint                 // the total number of results that can be paged through
+	lastVisit      *time.Time           // the time of the last visit in the timeline
+	hint           string               // a correction of the query, see search.SearchResult.Suggestion
+	facets         []facetItem          // ways to refine the query, see search.SearchResult.Facets
+	facet          int                  // the index of the selected facet, or -1 if none is
+	err            error                // why the current query could not be searched, if it couldn't
+}
+
+// A page of results as list items, and what else came with them
+type page struct {
+	items     []list.Item
+	loaded    uint // the number of results, which doesn't count session headings
+	count     uint
+	lastVisit *time.Time
+	hint      string
+	facets    []facetItem
+}
+
+// The most values of a facet shown in the filter row
+const facetRowValues = 3
+
+// The most related pages listed, see search.RelatedProvider
+const relatedLimit = 50
+
+// How many searches back the history can be recalled
+const historyLimit = 500
+
+// A facet value that can be picked to refine the query
+type facetItem struct {
+	label string
+	query string
+}
+
+func facetItems(facets *search.Facets) []facetItem {
+	if facets == nil {
+		return nil
+	}
+
+	items := []facetItem{}
+	add := func(xs []search.Facet, limit int, label func(x search.Facet) string) {
+		for i, x := range xs {
+			if i == limit {
+				break
+			}
+			items = append(items, facetItem{label: fmt.Sprintf("%s (%d)", label(x), x.Count), query: x.Query})
+		}
+	}
+
+	add(facets.Domains, facetRowValues, func(x search.Facet) string { return "site:" + x.Value })
+	add(facets.Browsers, facetRowValues, func(x search.Facet) string { return "browser:" + x.Value })
+	add(facets.Months, facetRowValues, func(x search.Facet) string { return x.Value })
+	add(facets.HasFulltext, 1, func(x search.Facet) string { return "has:fulltext" })
+	return items
+}
+
+// Fetch a page of results for the current query
+func (m model) fetch(offset uint) (*page, error) {
+	opts := m.opts
+	opts.Offset = offset
+	// @note facets are of every result, so they don't change from page to page
+	opts.Facets = opts.Facets && offset == 0
+
+	if m.timeline != nil {
+		result, err := m.timeline.Timeline(m.input.Value(), opts)
+		if err != nil {
+			return nil, err
+		}
+
+		prev := m.lastVisit
+		if offset == 0 {
+			prev = nil
+		}
+		p := &page{items: TimelineToItems(result.Visits, prev, m.mapItem), loaded: uint(len(result.Visits)), count: result.Count, lastVisit: prev}
+		if n := len(result.Visits); n > 0 {
+			p.lastVisit = &result.Visits[n-1].Time
+		}
+		return p, nil
+	}
+
+	if m.related != "" {
+		result, err := m.searchProvider.(search.RelatedProvider).Related(m.related, relatedLimit)
+		if err != nil {
+			return nil, err
+		}
+		return &page{
+			items:  ResultToItems(result, "", m.mapItem),
+			loaded: uint(len(result.Urls)),
+			count:  result.Count,
+			hint:   fmt.Sprintf("Pages related to %s, esc to go back", m.related),
+		}, nil
+	}
+
+	var result *search.SearchResult
+	var err error
+	if m.input.Value() == "" {
+		result, err = m.dataProvider.RecentUrls(opts)
+	} else {
+		result, err = m.searchProvider.SearchUrls(m.input.Value(), opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &page{
+		items:  ResultToItems(result, m.input.Value(), m.mapItem),
+		loaded: uint(len(result.Urls)),
+		count:  result.Count,
+		hint:   hint(result),
+		facets: facetItems(result.Facets),
+	}, nil
+}
+
+// Append the next page of results once the end of the list is in view
+func (m model) loadMore() (model, tea.Cmd) {
+	if m.err != nil || !m.list.Paginator.OnLastPage() || m.loaded >= m.count {
+		return m, nil
+	}
+
+	p, err := m.fetch(m.loaded)
+	if err != nil && !AcceptibleSearchError(err) {
+		fmt.Println("search error", err)
+		os.Exit(1)
+	}
+	if err != nil || p.loaded == 0 {
+		return m, nil
+	}
+
+	m.loaded += p.loaded
+	m.count = p.count
+	m.lastVisit = p.lastVisit
+	return m, m.list.SetItems(append(m.list.Items(), p.items...))
+}
+
+// Replace the list with the first page of results for the current query.
+// Invalid queries are expected while typing, so only other errors are returned.
+func (m model) reload() (model, tea.Cmd, error) {
+	p, err := m.fetch(0)
+	if err != nil && !AcceptibleSearchError(err) {
+		return m, nil, err
+	}
+	// @note the previous results are kept until the query is valid again
+	m.err = err
+	if err != nil {
+		return m, nil, nil
+	}
+
+	m.loaded = p.loaded
+	m.count = p.count
+	m.lastVisit = p.lastVisit
+	m.hint = p.hint
+	m.facets = p.facets
+	m.facet = -1
+	return m, m.list.SetItems(p.items), nil
+}
+
+// Search for the current query, replacing the list
+func (m model) search() (model, tea.Cmd) {
+	m, cmd, err := m.reload()
+	if err != nil {
+		fmt.Println("search error", err)
+		os.Exit(1)
+	}
+	return m, cmd
+}
+
+// Add the current query to the search history. Queries are drafts while they
+// are typed, so only the one the user ends up with is recorded.
+func (m model) record() {
+	history, ok := m.searchProvider.(search.HistoryProvider)
+	if !ok || m.related != "" || m.err != nil {
+		return
+	}
+	// @note a search that can't be recorded, e.g. because the database is
+	// locked, is still a search
+	if err := history.RecordSearch(m.input.Value(), m.opts.Mode, m.count); err != nil {
+		logging.Warn().Println(err)
+	}
+}
+
+// List the variants of the selected item below it, or hide them again
+func (m *model) toggleVariants() tea.Cmd {
+	i := m.list.Index()
+	item, ok := m.list.SelectedItem().(ListItem)
+	if !ok || len(item.variants) == 0 {
+		return nil
+	}
+
+	item.expanded = !item.expanded
+	cmds := []tea.Cmd{m.list.SetItem(i, item)}
+	for j, v := range item.variants {
+		if item.expanded {
+			cmds = append(cmds, m.list.InsertItem(i+1+j, m.mapItem(v)))
+		} else {
+			m.list.RemoveItem(i + 1)
+		}
+	}
+	return tea.Batch(cmds...)
 }
 
 func (m model) Init() tea.Cmd {
@@ -77,36 +395,83 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case tea.KeyMsg:
 		switch msg.String() {
-		case "ctrl-c", "esc":
+		case "esc":
+			if m.facet >= 0 {
+				m.facet = -1
+				return m, nil
+			}
+			if m.related != "" {
+				m.related = ""
+				return m.search()
+			}
+			m.record()
+			return m, tea.Quit
+		case "ctrl-c":
 			return m, tea.Quit
-		case "ctrl+n", "ctrl+j", "down":
+		case "tab":
+			if len(m.facets) > 0 {
+				m.facet = (m.facet + 1) % len(m.facets)
+			}
+			return m, nil
+		case "shift+tab":
+			if len(m.facets) > 0 {
+				m.facet = (m.facet + len(m.facets) - 1) % len(m.facets)
+			}
+			return m, nil
+		case "ctrl+r":
+			url := itemUrl(m.list.SelectedItem())
+			if _, ok := m.searchProvider.(search.RelatedProvider); !ok || url == "" {
+				return m, nil
+			}
+			related := m
+			related.related = url
+			related, cmd, err := related.reload()
+			if err != nil {
+				// @note e.g. an item that isn't in the history, the list is left as it was
+				m.err = err
+				return m, nil
+			}
+			return related, cmd
+		case "ctrl+o":
+			return m, m.toggleVariants()
+		case "ctrl+n", "ctrl+j", "down", "pgdown":
+			m.list, cmd = m.list.Update(msg)
+			var moreCmd tea.Cmd
+			m, moreCmd = m.loadMore()
+			return m, tea.Batch(cmd, moreCmd)
+		case "up":
+			// @note up at the top of the list recalls earlier queries, like a shell
+			if m.list.Index() == 0 && m.recalled+1 < len(m.history) {
+				m.recalled++
+				m.input.SetValue(m.history[m.recalled])
+				m.input.CursorEnd()
+				m.related = ""
+				return m.search()
+			}
 			m.list, cmd = m.list.Update(msg)
 			return m, cmd
-		case "ctrl+p", "ctrl+k", "up":
+		case "ctrl+p", "ctrl+k":
 			m.list, cmd = m.list.Update(msg)
 			return m, cmd
 		case "enter":
+			if m.facet >= 0 {
+				m.input.SetValue(m.facets[m.facet].query)
+				m.input.CursorEnd()
+				return m.search()
+			}
 			item := m.list.SelectedItem()
+			if _, ok := item.(sessionItem); ok {
+				return m, nil
+			}
+			m.record()
 			OpenItem(item) // @todo wrap this in a tea.Cmd to preserve purity
 			return m, tea.Quit
 		default:
-			var inputCmd tea.Cmd
-			var result *search.SearchResult
-			var err error
+			var inputCmd, listCmd tea.Cmd
 			m.input, inputCmd = m.input.Update(msg)
-			query := m.input.Value()
-			if query == "" {
-				result, err = m.dataProvider.RecentUrls(100)
-			} else {
-				result, err = m.searchProvider.SearchUrls(query)
-			}
-			// @note we ignored parse errors since they are quite expected when a user is typing
-			if err != nil && !AcceptibleSearchError(err) {
-				fmt.Println("search error", err)
-				os.Exit(1)
-			}
-			items := ResultToItems(result, query, m.mapItem)
-			listCmd := m.list.SetItems(items)
+			m.related = ""
+			m.recalled = -1
+			m, listCmd = m.search()
 			return m, tea.Batch(inputCmd, listCmd)
 		}
 
@@ -120,7 +485,35 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 func (m model) View() string {
 	listView := m.list.View()
-	return docStyle.Render(m.input.View()) + "\n" + listView
+	inputView := m.input.View()
+	if m.err != nil {
+		inputView += "\n" + errorStyle.Render(m.err.Error())
+	} else if m.hint != "" {
+		inputView += "\n" + hintStyle.Render(m.hint)
+	}
+	if len(m.facets) > 0 {
+		labels := make([]string, len(m.facets))
+		for i, f := range m.facets {
+			if i == m.facet {
+				labels[i] = HighlightStyle.Render(f.label)
+			} else {
+				labels[i] = facetStyle.Render(f.label)
+			}
+		}
+		inputView += "\n" + facetStyle.Render("tab to refine: ") + strings.Join(labels, "  ")
+	}
+	return docStyle.Render(inputView) + "\n" + listView
+}
+
+func hint(result *search.SearchResult) string {
+	switch {
+	case result.Fuzzy:
+		return fmt.Sprintf("No results, showing results for %q instead", result.Suggestion)
+	case result.Suggestion != "":
+		return fmt.Sprintf("Did you mean %q?", result.Suggestion)
+	default:
+		return ""
+	}
 }
 
 type ItemMapping func(x ListItem) list.Item
@@ -138,51 +531,77 @@ func GetSearchProgram(
 	initialQuery string,
 	dataProvider search.DataProvider,
 	searchProvider search.SearchProvider,
+	opts search.SearchOptions,
 	mapItem *func(x ListItem) list.Item,
 ) (*tea.Program, error) {
-	var err error
-	var result *search.SearchResult
+	// The filter row shows the facets of the results
+	opts.Facets = true
 
-	var mapping ItemMapping
-	if mapItem != nil {
-		mapping = ItemMapping(*mapItem)
-	} else {
-		mapping = identityMapping
+	m := model{
+		searchProvider: searchProvider,
+		dataProvider:   dataProvider,
+		opts:           opts,
 	}
-
-	if initialQuery == "" {
-		result, err = dataProvider.RecentUrls(100)
-	} else {
-		result, err = searchProvider.SearchUrls(initialQuery)
+	if history, ok := searchProvider.(search.HistoryProvider); ok {
+		searches, err := history.History(historyLimit)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get search history")
+		}
+		m.history = search.RecentQueries(searches, opts.Mode)
 	}
 
-	if err != nil && !AcceptibleSearchError(err) {
-		return nil, errors.Wrap(err, "failed to get initial search results")
-	}
+	return newProgram(m, initialQuery, mapItem)
+}
+
+// GetTimelineProgram lists the visits to urls matching the query
+// chronologically, grouped into sessions. See search.TimelineProvider.
+func GetTimelineProgram(
+	ctx context.Context,
+	initialQuery string,
+	timeline search.TimelineProvider,
+	mapItem *func(x ListItem) list.Item,
+) (*tea.Program, error) {
+	return newProgram(model{timeline: timeline}, initialQuery, mapItem)
+}
 
-	items := ResultToItems(result, "", mapping)
+// Set up the input and list of m and load the first page of results
+func newProgram(m model, initialQuery string, mapItem *func(x ListItem) list.Item) (*tea.Program, error) {
+	if mapItem != nil {
+		m.mapItem = ItemMapping(*mapItem)
+	} else {
+		m.mapItem = identityMapping
+	}
 
 	// Input el
-	input := textinput.New()
-	input.Placeholder = "Search..."
-	input.SetValue(initialQuery)
-	input.Focus()
+	m.input = textinput.New()
+	m.input.Placeholder = "Search..."
+	switch m.opts.Mode {
+	case search.MatchRegex:
+		m.input.Placeholder = "Regular expression..."
+	case search.MatchLiteral:
+		m.input.Placeholder = "Exact text..."
+	}
+	m.input.SetValue(initialQuery)
+	m.input.Focus()
 
 	// Search results list el
 	listDelegate := list.NewDefaultDelegate()
 	listDelegate.SetHeight(2)
+	if m.timeline == nil {
+		// @note a line for the snippet of each result
+		listDelegate.SetHeight(3)
+	}
 	listDelegate.SetSpacing(1)
-	list := list.New(items, listDelegate, 0, 0)
-	list.SetFilteringEnabled(false)
-	list.SetShowTitle(false)
-	list.SetShowStatusBar(false)
-
-	m := model{
-		list:           list,
-		input:          input,
-		searchProvider: searchProvider,
-		dataProvider:   dataProvider,
-		mapItem:        mapping,
+	m.list = list.New(ResultToItems(nil, "", m.mapItem), listDelegate, 0, 0)
+	m.list.SetFilteringEnabled(false)
+	m.list.SetShowTitle(false)
+	m.list.SetShowStatusBar(false)
+
+	m.facet = -1
+	m.recalled = -1
+	m, _, err := m.reload()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get initial search results")
 	}
 
 	return tea.NewProgram(m, tea.WithAltScreen()), nil
@@ -197,44 +616,73 @@ func ResultToItems(result *search.SearchResult, query string, mapItem ItemMappin
 	items := []list.Item{}
 
 	for _, u := range urls {
-		displayUrl := u.Url
-		displayTitle := UNTITLED
-		if u.Title != nil {
-			displayTitle = *u.Title
-		}
-
-		// @todo commented out while moving to sqlite
-		// Highlighting
-		// if result.Meta != nil {
-		// 	hit, ok := lo.Find(result.Meta.Hits, func(x *bs.DocumentMatch) bool {
-		// 		return x.ID == u.Id
-		// 	})
-
-		// 	if ok {
-		// 		for k, locations := range hit.Locations {
-		// 			switch k {
-		// 			case "title":
-		// 				displayTitle = search.HighlightAll(locations, displayTitle, HighlightStyle.Render)
-		// 			case "url":
-		// 				displayUrl = search.HighlightAll(locations, displayUrl, HighlightStyle.Render)
-		// 			default:
-		// 			}
-		// 		}
-		// 	}
-		// }
+		item := urlToItem(u, query)
+		for _, v := range u.Variants {
+			variant := urlToItem(v, query)
+			variant.variant = true
+			item.variants = append(item.variants, variant)
+		}
+
+		items = append(items, mapItem(item))
+	}
+
+	return items
+}
+
+func urlToItem(u types.SearchableEntity, query string) ListItem {
+	title := UNTITLED
+	if u.Title != nil {
+		title = *u.Title
+	}
+	return ListItem{
+		ItemTitle: title,
+		Desc:      u.Url,
+		Date:      u.LastVisit,
+		query:     query,
+		Body:      u.Match,
+		snippets:  u.Snippets,
+	}
+}
+
+// TimelineToItems lists visits with a heading before each session. prev is the
+// time of the visit before them, if they continue a list.
+func TimelineToItems(visits []search.TimelineVisit, prev *time.Time, mapItem ItemMapping) []list.Item {
+	if len(visits) == 0 && prev == nil {
+		return []list.Item{ListItem{ItemTitle: "No visits found"}}
+	}
+
+	items := []list.Item{}
+	for _, v := range visits {
+		if prev == nil || search.NewSession(*prev, v.Time) {
+			items = append(items, sessionItem{start: v.Time})
+		}
+		t := v.Time
+		prev = &t
+
+		title := UNTITLED
+		if v.Title != nil {
+			title = *v.Title
+		}
 
 		items = append(items, mapItem(ListItem{
-			ItemTitle: displayTitle,
-			Desc:      displayUrl,
-			Date:      u.LastVisit,
-			query:     query,
-			Body:      u.Match,
+			ItemTitle: v.Time.Format("15:04") + " " + title,
+			Desc:      v.Url,
 		}))
 	}
 
 	return items
 }
 
+// Errors caused by an invalid or incomplete query, which are expected while
+// the user is typing
 func AcceptibleSearchError(err error) bool {
+	var parseErr *query.ParseError
+	if errors.As(err, &parseErr) {
+		return true
+	}
+	var regexErr *syntax.Error
+	if errors.As(err, &regexErr) {
+		return true
+	}
 	return strings.Contains(err.Error(), "parse error") || strings.Contains(err.Error(), "syntax error")
 }
@@ -3,6 +3,7 @@ package types
 import (
 	"context"
 	"database/sql"
+	"strings"
 	"time"
 )
 
@@ -11,6 +12,15 @@ type UrlRow struct {
 	Title       *string    // Nullable
 	Description *string    // Nullable
 	LastVisit   *time.Time // Nullable
+	Redacted    bool       // Whether sensitive query params were removed from Url
+}
+
+// BookmarkRow is a page bookmarked in a browser, see BookmarkExtractor
+type BookmarkRow struct {
+	Url           string
+	Title         *string    // Nullable. The name of the bookmark, not of the page.
+	AddedAt       *time.Time // Nullable
+	ExtractorName string
 }
 
 // Meta information about the URL
@@ -38,6 +48,7 @@ type UrlDbEntity struct {
 	Title       *string
 	Description *string
 	LastVisit   *time.Time
+	VisitCount  int
 	Body        *string
 	BodyMd5     *string
 }
@@ -48,9 +59,138 @@ type UrlDbSearchEntity struct {
 	Title       *string
 	Description *string
 	LastVisit   *time.Time
-	Match       *string
-	MatchCount  *int
-	SumRank     *float64
+	VisitCount  int
+	// The fragments that matched, best first
+	Snippets   []Snippet
+	MatchCount *int
+	SumRank    *float64
+	// Relevance, higher is better. Only comparable between results of the same search.
+	Score *float64
+}
+
+// Snippet is the part of a fragment of a page that matched a search, e.g. a
+// few words of its full-text around the match
+type Snippet struct {
+	// The attribute of the fragment, e.g. title, url or content
+	Attribute string `json:"attribute"`
+	// The headings above the fragment in its document, see Fragment.Section
+	Section string `json:"section,omitempty"`
+	Text    string `json:"text"`
+	// The parts of the text that matched, in order
+	Spans []Span `json:"spans"`
+}
+
+// Span is a part of a snippet's text, from byte Start up to byte End
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// A single visit along with the url that was visited, see Store.SearchVisits
+type VisitDbSearchEntity struct {
+	VisitTime     time.Time
+	ExtractorName string
+	UrlMd5        string
+	Url           string
+	Title         *string
+	Description   *string
+}
+
+// Fragment is a single entry in the search index. Entity, table, attribute,
+// value. E.g. the title of a url is {E: url_md5, T: "urls", A: "title", V: title}.
+type Fragment struct {
+	E string
+	T string
+	A string
+	V string
+	// The headings above the fragment in its document, e.g. "Installation >
+	// Linux", if it is a chunk of full-text
+	Section string
+}
+
+// VocabularyRow is a word that has been indexed, and how often. See
+// Store.ReplaceVocabulary.
+type VocabularyRow struct {
+	// The url the word was counted in. Empty in the vocabulary itself, whose
+	// counts are the total over every url.
+	UrlMd5 string
+	Word   string
+	Count  int
+}
+
+// TermVector is what a url is about, as weights of the words in its title,
+// description and full-text. See Store.RelatedUrls.
+type TermVector struct {
+	UrlMd5 string
+	Terms  map[string]float64
+}
+
+// SearchHistoryRow is a search that was run, see Store.InsertSearchHistory
+type SearchHistoryRow struct {
+	Query string
+	// How the query was matched, empty for the query syntax
+	Mode        string
+	SearchedAt  time.Time
+	ResultCount uint
+}
+
+// SavedSearchRow is a search that was given a name, see Store.SaveSearch
+type SavedSearchRow struct {
+	Name      string
+	Query     string
+	Mode      string
+	CreatedAt time.Time
+}
+
+// Facets count the urls matching a search by some of their attributes, so that
+// the search can be narrowed down. See Store.SearchFacets.
+type Facets struct {
+	// Host names, without www., most common first
+	Domains []FacetCount
+	// Extractor names, lowercased, most common first
+	Browsers []FacetCount
+	// Months in which urls were visited, formatted as 2022-01 in local time,
+	// most recent first
+	Months []FacetCount
+	// The number of urls whose full-text has been scraped
+	HasFulltext int
+}
+
+type FacetCount struct {
+	Value string
+	Count int
+}
+
+// UrlRecord is everything stored about a single url, in a form that does not
+// depend on the database schema. It is the format of `export --format jsonl`.
+type UrlRecord struct {
+	Url         string           `json:"url"`
+	Title       *string          `json:"title"`
+	Description *string          `json:"description"`
+	LastVisit   *time.Time       `json:"last_visit"`
+	Redacted    bool             `json:"redacted,omitempty"`
+	Titles      []TitleRecord    `json:"titles"`
+	Visits      []VisitRecord    `json:"visits"`
+	Documents   []DocumentRecord `json:"documents,omitempty"`
+}
+
+// A title a url has had, and when it was seen with it
+type TitleRecord struct {
+	Title     string     `json:"title"`
+	FirstSeen *time.Time `json:"first_seen"`
+	LastSeen  *time.Time `json:"last_seen"`
+}
+
+type VisitRecord struct {
+	Time          time.Time `json:"time"`
+	ExtractorName string    `json:"extractor_name"`
+}
+
+type DocumentRecord struct {
+	DocumentMd5 string     `json:"document_md5"`
+	StatusCode  int        `json:"status_code"`
+	AccessedAt  *time.Time `json:"accessed_at"`
+	Body        *string    `json:"body"` // Null if pruned
 }
 
 type VisitRow struct {
@@ -74,15 +214,29 @@ type Extractor interface {
 	VerifyConnection(ctx context.Context, conn *sql.DB) (bool, error)
 }
 
+// BookmarkExtractor is implemented by the extractors that can also import the
+// bookmarks of their browser
+type BookmarkExtractor interface {
+	// Every bookmark the browser has now, so that those that were removed can
+	// be forgotten
+	GetBookmarks(ctx context.Context, conn *sql.DB) ([]BookmarkRow, error)
+}
+
 type SearchableEntity struct {
 	Id          string     `json:"id"`
 	Url         string     `json:"url"`
 	Title       *string    `json:"title"`
 	Description *string    `json:"description"`
 	LastVisit   *time.Time `json:"last_visit"`
-	Match       *string    `json:"match"`
+	VisitCount  int        `json:"visit_count"`
+	Match       *string    `json:"match"` // the text of the snippets, one per line
+	Snippets    []Snippet  `json:"snippets"`
 	MatchCount  *int       `json:"match_count"`
 	SumRank     *float64   `json:"sum_rank"`
+	Score       *float64   `json:"score"`
+	// Other results that are the same page, e.g. its AMP version or a mirror,
+	// if they were grouped under this one
+	Variants []SearchableEntity `json:"variants,omitempty"`
 }
 
 func UrlDbEntityToSearchableEntity(x UrlDbEntity) SearchableEntity {
@@ -92,7 +246,21 @@ func UrlDbEntityToSearchableEntity(x UrlDbEntity) SearchableEntity {
 		Title:       x.Title,
 		Description: x.Description,
 		LastVisit:   x.LastVisit,
+		VisitCount:  x.VisitCount,
+	}
+}
+
+// The text of snippets, one per line, or nil if there are none
+func snippetsText(snippets []Snippet) *string {
+	if snippets == nil {
+		return nil
+	}
+	texts := make([]string, len(snippets))
+	for i, s := range snippets {
+		texts[i] = s.Text
 	}
+	text := strings.Join(texts, "\n")
+	return &text
 }
 
 func UrlDbSearchEntityToSearchableEntity(x UrlDbSearchEntity) SearchableEntity {
@@ -102,8 +270,11 @@ func UrlDbSearchEntityToSearchableEntity(x UrlDbSearchEntity) SearchableEntity {
 		Title:       x.Title,
 		Description: x.Description,
 		LastVisit:   x.LastVisit,
-		Match:       x.Match,
+		VisitCount:  x.VisitCount,
+		Match:       snippetsText(x.Snippets),
+		Snippets:    x.Snippets,
 		MatchCount:  x.MatchCount,
 		SumRank:     x.SumRank,
+		Score:       x.Score,
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -91,3 +92,52 @@ func ReverseSlice[S ~[]E, E any](s S) []E {
 	}
 	return result
 }
+
+// Subdomains that serve another version of the same site
+var variantSubdomains = []string{"www.", "m.", "mobile.", "amp."}
+
+// Query parameters that only track where a visit came from, or ask for the AMP
+// version of a page
+var trackingParams = map[string]bool{
+	"fbclid": true, "gclid": true, "msclkid": true, "mc_cid": true, "mc_eid": true,
+	"igshid": true, "ref_src": true, "amp": true,
+}
+
+// CanonicalUrl is a key that the variants of a page share, e.g. its AMP version,
+// its mobile subdomain and its url with tracking parameters. The scheme,
+// fragment and trailing slash are left out. Urls that can't be parsed are their
+// own key.
+func CanonicalUrl(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return s
+	}
+
+	// @note only one, m.amp.example.com is not a version of example.com
+	host := strings.ToLower(u.Host)
+	for _, sub := range variantSubdomains {
+		if strings.HasPrefix(host, sub) {
+			host = host[len(sub):]
+			break
+		}
+	}
+
+	path := strings.TrimSuffix(u.EscapedPath(), "/")
+	path = strings.TrimSuffix(path, "/amp")
+	if strings.HasPrefix(path, "/amp/") {
+		path = path[len("/amp"):]
+	}
+
+	q := u.Query()
+	for k := range q {
+		if trackingParams[k] || strings.HasPrefix(k, "utm_") {
+			q.Del(k)
+		}
+	}
+
+	key := host + path
+	if len(q) > 0 {
+		key += "?" + q.Encode()
+	}
+	return key
+}
@@ -49,3 +49,35 @@ func TestReverseSlice(t *testing.T) {
 		})
 	}
 }
+
+func TestCanonicalUrl(t *testing.T) {
+	same := [][]string{
+		{"https://www.example.com/article", "http://example.com/article/", "https://m.example.com/article#comments"},
+		{"https://example.com/article", "https://example.com/article/amp", "https://amp.example.com/amp/article"},
+		{"https://example.com/article?id=1", "https://example.com/article?utm_source=hn&id=1&fbclid=abc", "https://example.com/article?ref_src=twsrc&id=1"},
+	}
+	for _, urls := range same {
+		for _, u := range urls[1:] {
+			require.Equal(t, util.CanonicalUrl(urls[0]), util.CanonicalUrl(u), u)
+		}
+	}
+
+	different := []string{
+		"https://example.com/article?id=1",
+		"https://example.com/article?id=2",
+		"https://example.com/article/2",
+		"https://blog.example.com/article",
+		"https://example.org/article",
+		"not a url",
+	}
+	keys := map[string]bool{}
+	for _, u := range different {
+		keys[util.CanonicalUrl(u)] = true
+	}
+	require.Len(t, keys, len(different))
+
+	require.NotEqual(t, util.CanonicalUrl("https://example.com/article"), util.CanonicalUrl("https://example.com/article?ref=v2"),
+		"ref is often part of what the page is")
+	require.NotEqual(t, util.CanonicalUrl("https://example.com/article"), util.CanonicalUrl("https://m.amp.example.com/article"),
+		"only one variant subdomain is removed")
+}